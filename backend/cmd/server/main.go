@@ -43,7 +43,9 @@ func main() {
 	// Initialize services
 	authService := services.NewAuthService(db, redisClient, cfg)
 	tunnelService := services.NewTunnelService(db, redisClient, cfg)
-	monitoringService := services.NewMonitoringService(db, redisClient, cfg)
+	monitoringService := services.NewMonitoringService(db, redisClient, cfg, tunnelService)
+	certificateService := services.NewCertificateService(db, cfg, tunnelService)
+	tunnelService.SetCertificateService(certificateService)
 
 	// Start monitoring service
 	ctx, cancel := context.WithCancel(context.Background())
@@ -53,9 +55,16 @@ func main() {
 		log.Fatalf("Failed to start monitoring service: %v", err)
 	}
 
+	// Start certificate service
+	if err := certificateService.Start(ctx); err != nil {
+		log.Fatalf("Failed to start certificate service: %v", err)
+	}
+
 	// Initialize handlers
 	tunnelHandler := handlers.NewTunnelHandler(tunnelService, nil)
 	authHandler := handlers.NewAuthHandler(authService)
+	certificateHandler := handlers.NewCertificateHandler(certificateService, tunnelService)
+	domainHandler := handlers.NewDomainHandler(tunnelService)
 
 	// Setup Gin router
 	if cfg.Server.Mode == "release" {
@@ -84,7 +93,7 @@ func main() {
 	})
 
 	// API routes
-	setupAPIRoutes(router, authService, tunnelHandler, authHandler)
+	setupAPIRoutes(router, authService, tunnelHandler, authHandler, certificateHandler, domainHandler)
 
 	// Prometheus metrics endpoint
 	if cfg.Monitoring.PrometheusEnabled {
@@ -180,6 +189,8 @@ func initDatabase(cfg *config.Config) (*gorm.DB, error) {
 		&models.TunnelMetric{},
 		&models.UserSession{},
 		&models.AuditLog{},
+		&models.Certificate{},
+		&models.Domain{},
 	); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -212,7 +223,7 @@ func initRedis(cfg *config.Config) *redis.Client {
 	return client
 }
 
-func setupAPIRoutes(router *gin.Engine, authService *services.AuthService, tunnelHandler *handlers.TunnelHandler, authHandler *handlers.AuthHandler) {
+func setupAPIRoutes(router *gin.Engine, authService *services.AuthService, tunnelHandler *handlers.TunnelHandler, authHandler *handlers.AuthHandler, certificateHandler *handlers.CertificateHandler, domainHandler *handlers.DomainHandler) {
 	api := router.Group("/api/v1")
 
 	// Public routes
@@ -250,7 +261,22 @@ func setupAPIRoutes(router *gin.Engine, authService *services.AuthService, tunne
 			tunnels.POST("/:id/stop", tunnelHandler.StopTunnel)
 			tunnels.GET("/:id/status", tunnelHandler.GetTunnelStatus)
 			tunnels.GET("/:id/metrics", tunnelHandler.GetTunnelMetrics)
+			tunnels.GET("/:id/targets", tunnelHandler.GetTunnelTargets)
 			tunnels.GET("/:id/logs", tunnelHandler.GetTunnelLogs)
+			tunnels.GET("/:id/certificate", certificateHandler.GetTunnelCertificate)
+			tunnels.POST("/:id/certificate/renew", certificateHandler.RenewTunnelCertificate)
+		}
+
+		// Certificate routes
+		protected.GET("/certificates/ca", certificateHandler.GetCACertificate)
+
+		// Custom domain routes
+		domains := protected.Group("/domains")
+		{
+			domains.GET("/", domainHandler.GetDomains)
+			domains.POST("/", domainHandler.ClaimDomain)
+			domains.POST("/:id/verify", domainHandler.VerifyDomain)
+			domains.DELETE("/:id", domainHandler.DeleteDomain)
 		}
 
 		// Dashboard routes
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+
+	"utunnel-pro/internal/models"
+	"utunnel-pro/internal/services"
+	"utunnel-pro/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CertificateHandler handles requests for the certificates the backend
+// manages for tunnels
+type CertificateHandler struct {
+	certificateService *services.CertificateService
+	tunnelService      *services.TunnelService
+}
+
+// NewCertificateHandler creates a new certificate handler
+func NewCertificateHandler(certificateService *services.CertificateService, tunnelService *services.TunnelService) *CertificateHandler {
+	return &CertificateHandler{
+		certificateService: certificateService,
+		tunnelService:      tunnelService,
+	}
+}
+
+// GetCACertificate serves the internal CA certificate in PEM, which clients
+// verify internally issued tunnel certificates with
+func (h *CertificateHandler) GetCACertificate(c *gin.Context) {
+	caPEM, err := h.certificateService.CACertificate()
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusServiceUnavailable, "Internal CA is not available", err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", caPEM)
+}
+
+// GetTunnelCertificate returns the managed certificate of a tunnel
+func (h *CertificateHandler) GetTunnelCertificate(c *gin.Context) {
+	tunnel, ok := h.authorizedTunnel(c, "view_all_tunnels")
+	if !ok {
+		return
+	}
+
+	cert, err := h.certificateService.GetTunnelCertificate(tunnel.ID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusNotFound, "Certificate not found", err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Certificate retrieved successfully", cert)
+}
+
+// RenewTunnelCertificate issues a new certificate for a tunnel now and
+// pushes it to the tunnel if it is running
+func (h *CertificateHandler) RenewTunnelCertificate(c *gin.Context) {
+	tunnel, ok := h.authorizedTunnel(c, "manage_tunnels")
+	if !ok {
+		return
+	}
+
+	if !tunnel.UsesTLS() || !tunnel.TLSConfig.CertSource.IsManaged() {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Tunnel certificate is not managed by the backend", nil)
+		return
+	}
+
+	cert, err := h.certificateService.RenewTunnelCertificate(c.Request.Context(), tunnel)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusInternalServerError, "Failed to renew certificate", err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Certificate renewed successfully", cert)
+}
+
+// authorizedTunnel loads the tunnel named in the path if the current user
+// owns it or may perform action on any tunnel, otherwise it responds with
+// the error
+func (h *CertificateHandler) authorizedTunnel(c *gin.Context, action string) (*models.Tunnel, bool) {
+	tunnelID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid tunnel ID", err)
+		return nil, false
+	}
+
+	// Get user from context
+	user, exists := c.Get("user")
+	if !exists {
+		utils.ErrorResponse(c, http.StatusUnauthorized, "User not found in context", nil)
+		return nil, false
+	}
+	currentUser := user.(*models.User)
+
+	// Get tunnel
+	tunnel, err := h.tunnelService.GetTunnelByID(tunnelID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusNotFound, "Tunnel not found", err)
+		return nil, false
+	}
+
+	// Check ownership or admin privileges
+	if tunnel.UserID != currentUser.ID && !currentUser.CanPerformAction(action) {
+		utils.ErrorResponse(c, http.StatusForbidden, "Access denied", nil)
+		return nil, false
+	}
+	return tunnel, true
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+
+	"utunnel-pro/internal/models"
+	"utunnel-pro/internal/services"
+	"utunnel-pro/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// DomainHandler handles requests for the custom domains users verify for
+// the host names of their HTTP tunnels
+type DomainHandler struct {
+	tunnelService *services.TunnelService
+}
+
+// NewDomainHandler creates a new domain handler
+func NewDomainHandler(tunnelService *services.TunnelService) *DomainHandler {
+	return &DomainHandler{tunnelService: tunnelService}
+}
+
+// ClaimDomainRequest represents a request to claim a custom domain
+type ClaimDomainRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// DomainResponse is a claimed domain with the TXT record that verifies it
+type DomainResponse struct {
+	models.Domain
+	ChallengeName string `json:"challenge_name"`
+}
+
+func newDomainResponse(domain *models.Domain) DomainResponse {
+	return DomainResponse{Domain: *domain, ChallengeName: domain.ChallengeName()}
+}
+
+// GetDomains lists the current user's custom domains
+func (h *DomainHandler) GetDomains(c *gin.Context) {
+	currentUser, ok := contextUser(c)
+	if !ok {
+		return
+	}
+
+	domains, err := h.tunnelService.GetDomains(currentUser.ID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusInternalServerError, "Failed to get domains", err)
+		return
+	}
+
+	responses := make([]DomainResponse, 0, len(domains))
+	for i := range domains {
+		responses = append(responses, newDomainResponse(&domains[i]))
+	}
+	utils.SuccessResponse(c, http.StatusOK, "Domains retrieved successfully", responses)
+}
+
+// ClaimDomain starts the verification of a custom domain, returning the TXT
+// record the user has to publish
+func (h *DomainHandler) ClaimDomain(c *gin.Context) {
+	currentUser, ok := contextUser(c)
+	if !ok {
+		return
+	}
+
+	var req ClaimDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid request format", err)
+		return
+	}
+
+	domain, err := h.tunnelService.ClaimDomain(currentUser.ID, req.Name)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Failed to claim domain", err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusCreated, "Domain claimed, publish its token in the TXT record to verify it", newDomainResponse(domain))
+}
+
+// VerifyDomain checks the TXT record of a claimed domain
+func (h *DomainHandler) VerifyDomain(c *gin.Context) {
+	currentUser, ok := contextUser(c)
+	if !ok {
+		return
+	}
+	domainID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid domain ID", err)
+		return
+	}
+
+	domain, err := h.tunnelService.VerifyDomain(currentUser.ID, domainID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Failed to verify domain", err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Domain verified successfully", newDomainResponse(domain))
+}
+
+// DeleteDomain drops the current user's claim of a domain
+func (h *DomainHandler) DeleteDomain(c *gin.Context) {
+	currentUser, ok := contextUser(c)
+	if !ok {
+		return
+	}
+	domainID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid domain ID", err)
+		return
+	}
+
+	if err := h.tunnelService.DeleteDomain(currentUser.ID, domainID); err != nil {
+		utils.ErrorResponse(c, http.StatusNotFound, "Domain not found", err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Domain deleted successfully", nil)
+}
+
+// contextUser returns the authenticated user, otherwise it responds with
+// the error
+func contextUser(c *gin.Context) (*models.User, bool) {
+	user, exists := c.Get("user")
+	if !exists {
+		utils.ErrorResponse(c, http.StatusUnauthorized, "User not found in context", nil)
+		return nil, false
+	}
+	return user.(*models.User), true
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"utunnel-pro/internal/models"
@@ -29,32 +31,62 @@ func NewTunnelHandler(tunnelService *services.TunnelService, userService *servic
 
 // CreateTunnelRequest represents the request body for creating a tunnel
 type CreateTunnelRequest struct {
-	Name        string                `json:"name" binding:"required,min=3,max=50"`
-	Description string                `json:"description"`
-	Protocol    models.TunnelProtocol `json:"protocol" binding:"required"`
-	ServerIP    string                `json:"server_ip" binding:"required,ip"`
-	ServerPort  int                   `json:"server_port" binding:"required,min=1,max=65535"`
-	ClientIP    string                `json:"client_ip" binding:"omitempty,ip"`
-	ClientPort  int                   `json:"client_port" binding:"omitempty,min=1,max=65535"`
-	TargetIP    string                `json:"target_ip" binding:"required,ip"`
-	TargetPort  int                   `json:"target_port" binding:"required,min=1,max=65535"`
-	MuxConfig   *models.MuxConfig     `json:"mux_config,omitempty"`
-	TLSConfig   *models.TLSConfig     `json:"tls_config,omitempty"`
+	Name         string                `json:"name" binding:"required,min=3,max=50"`
+	Description  string                `json:"description"`
+	Protocol     models.TunnelProtocol `json:"protocol" binding:"required"`
+	ServerIP     string                `json:"server_ip" binding:"required,ip"`
+	ServerPort   int                   `json:"server_port" binding:"required,min=1,max=65535"`
+	ClientIP     string                `json:"client_ip" binding:"omitempty,ip"`
+	ClientPort   int                   `json:"client_port" binding:"omitempty,min=1,max=65535"`
+	TargetIP     string                `json:"target_ip" binding:"required,ip"`
+	TargetPort   int                   `json:"target_port" binding:"required,min=1,max=65535"`
+	PortMappings []models.PortMapping  `json:"port_mappings,omitempty" binding:"omitempty,dive"`
+	MuxConfig    *models.MuxConfig     `json:"mux_config,omitempty"`
+	TLSConfig    *models.TLSConfig     `json:"tls_config,omitempty"`
+
+	ProxyProtocol       models.ProxyProtocolVersion `json:"proxy_protocol,omitempty" binding:"omitempty,oneof=v1 v2"`
+	AcceptProxyProtocol bool                        `json:"accept_proxy_protocol,omitempty"`
+
+	Compression models.LinkCompression `json:"compression,omitempty" binding:"omitempty,oneof=zstd snappy"`
+	Path        string                 `json:"path,omitempty" binding:"omitempty,startswith=/"`
+	Decoy       string                 `json:"decoy,omitempty"`
+
+	LoadBalancing *models.LoadBalancing `json:"load_balancing,omitempty"`
+
+	HTTPRouting bool     `json:"http_routing,omitempty"`
+	Hostnames   []string `json:"hostnames,omitempty"`
+
+	DynamicForwarding *models.DynamicForwarding `json:"dynamic_forwarding,omitempty"`
 }
 
 // UpdateTunnelRequest represents the request body for updating a tunnel
 type UpdateTunnelRequest struct {
-	Name        *string               `json:"name,omitempty" binding:"omitempty,min=3,max=50"`
-	Description *string               `json:"description,omitempty"`
-	Protocol    *models.TunnelProtocol `json:"protocol,omitempty"`
-	ServerIP    *string               `json:"server_ip,omitempty" binding:"omitempty,ip"`
-	ServerPort  *int                  `json:"server_port,omitempty" binding:"omitempty,min=1,max=65535"`
-	ClientIP    *string               `json:"client_ip,omitempty" binding:"omitempty,ip"`
-	ClientPort  *int                  `json:"client_port,omitempty" binding:"omitempty,min=1,max=65535"`
-	TargetIP    *string               `json:"target_ip,omitempty" binding:"omitempty,ip"`
-	TargetPort  *int                  `json:"target_port,omitempty" binding:"omitempty,min=1,max=65535"`
-	MuxConfig   *models.MuxConfig     `json:"mux_config,omitempty"`
-	TLSConfig   *models.TLSConfig     `json:"tls_config,omitempty"`
+	Name         *string                `json:"name,omitempty" binding:"omitempty,min=3,max=50"`
+	Description  *string                `json:"description,omitempty"`
+	Protocol     *models.TunnelProtocol `json:"protocol,omitempty"`
+	ServerIP     *string                `json:"server_ip,omitempty" binding:"omitempty,ip"`
+	ServerPort   *int                   `json:"server_port,omitempty" binding:"omitempty,min=1,max=65535"`
+	ClientIP     *string                `json:"client_ip,omitempty" binding:"omitempty,ip"`
+	ClientPort   *int                   `json:"client_port,omitempty" binding:"omitempty,min=1,max=65535"`
+	TargetIP     *string                `json:"target_ip,omitempty" binding:"omitempty,ip"`
+	TargetPort   *int                   `json:"target_port,omitempty" binding:"omitempty,min=1,max=65535"`
+	PortMappings *[]models.PortMapping  `json:"port_mappings,omitempty" binding:"omitempty,dive"`
+	MuxConfig    *models.MuxConfig      `json:"mux_config,omitempty"`
+	TLSConfig    *models.TLSConfig      `json:"tls_config,omitempty"`
+
+	ProxyProtocol       *models.ProxyProtocolVersion `json:"proxy_protocol,omitempty"`
+	AcceptProxyProtocol *bool                        `json:"accept_proxy_protocol,omitempty"`
+
+	Compression *models.LinkCompression `json:"compression,omitempty"`
+	Path        *string                 `json:"path,omitempty"`
+	Decoy       *string                 `json:"decoy,omitempty"`
+
+	LoadBalancing *models.LoadBalancing `json:"load_balancing,omitempty"`
+
+	HTTPRouting *bool     `json:"http_routing,omitempty"`
+	Hostnames   *[]string `json:"hostnames,omitempty"`
+
+	DynamicForwarding *models.DynamicForwarding `json:"dynamic_forwarding,omitempty"`
 }
 
 // TunnelResponse represents the response for tunnel operations
@@ -112,17 +144,28 @@ func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
 
 	// Create tunnel model
 	tunnel := &models.Tunnel{
-		Name:        req.Name,
-		Description: req.Description,
-		Protocol:    req.Protocol,
-		ServerIP:    req.ServerIP,
-		ServerPort:  req.ServerPort,
-		ClientIP:    req.ClientIP,
-		ClientPort:  req.ClientPort,
-		TargetIP:    req.TargetIP,
-		TargetPort:  req.TargetPort,
-		UserID:      currentUser.ID,
-		Status:      models.TunnelStatusInactive,
+		Name:         req.Name,
+		Description:  req.Description,
+		Protocol:     req.Protocol,
+		ServerIP:     req.ServerIP,
+		ServerPort:   req.ServerPort,
+		ClientIP:     req.ClientIP,
+		ClientPort:   req.ClientPort,
+		TargetIP:     req.TargetIP,
+		TargetPort:   req.TargetPort,
+		PortMappings: req.PortMappings,
+		UserID:       currentUser.ID,
+		Status:       models.TunnelStatusInactive,
+
+		ProxyProtocol:       req.ProxyProtocol,
+		AcceptProxyProtocol: req.AcceptProxyProtocol,
+
+		Compression: req.Compression,
+		Path:        req.Path,
+		Decoy:       req.Decoy,
+
+		HTTPRouting: req.HTTPRouting,
+		Hostnames:   req.Hostnames,
 	}
 
 	// Set MUX configuration
@@ -138,6 +181,14 @@ func (h *TunnelHandler) CreateTunnel(c *gin.Context) {
 		tunnel.TLSConfig = *req.TLSConfig
 	}
 
+	if req.LoadBalancing != nil {
+		tunnel.LoadBalancing = *req.LoadBalancing
+	}
+
+	if req.DynamicForwarding != nil {
+		tunnel.DynamicForwarding = *req.DynamicForwarding
+	}
+
 	// Create tunnel
 	createdTunnel, err := h.tunnelService.CreateTunnel(tunnel)
 	if err != nil {
@@ -385,6 +436,133 @@ func (h *TunnelHandler) UpdateTunnel(c *gin.Context) {
 	if req.TargetPort != nil {
 		updates["target_port"] = *req.TargetPort
 	}
+	if req.PortMappings != nil {
+		for i, mapping := range *req.PortMappings {
+			if err := mapping.Validate(); err != nil {
+				utils.ErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("Invalid port mapping %d", i+1), err)
+				return
+			}
+		}
+		updates["port_mappings"] = *req.PortMappings
+	}
+	if req.ProxyProtocol != nil {
+		if !req.ProxyProtocol.IsValid() {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid PROXY protocol version", nil)
+			return
+		}
+		updates["proxy_protocol"] = *req.ProxyProtocol
+	}
+	if req.AcceptProxyProtocol != nil {
+		updates["accept_proxy_protocol"] = *req.AcceptProxyProtocol
+	}
+	if req.Compression != nil {
+		protocol := tunnel.Protocol
+		if req.Protocol != nil {
+			protocol = *req.Protocol
+		}
+		if !req.Compression.IsValid() {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid compression", nil)
+			return
+		}
+		if *req.Compression != models.CompressionNone && protocol == models.ProtocolUDP {
+			utils.ErrorResponse(c, http.StatusBadRequest, "The udp protocol has no links to compress", nil)
+			return
+		}
+		updates["compression"] = *req.Compression
+	}
+	if req.Path != nil {
+		if *req.Path != "" && !strings.HasPrefix(*req.Path, "/") {
+			utils.ErrorResponse(c, http.StatusBadRequest, "The path must start with /", nil)
+			return
+		}
+		updates["path"] = *req.Path
+	}
+	if req.Decoy != nil || req.Protocol != nil {
+		protocol, decoy := tunnel.Protocol, tunnel.Decoy
+		if req.Protocol != nil {
+			protocol = *req.Protocol
+		}
+		if req.Decoy != nil {
+			decoy = *req.Decoy
+		}
+		if err := h.tunnelService.ValidateDecoy(protocol, decoy); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid decoy", err)
+			return
+		}
+		updates["decoy"] = decoy
+	}
+	if req.LoadBalancing != nil {
+		protocol := tunnel.Protocol
+		if req.Protocol != nil {
+			protocol = *req.Protocol
+		}
+		lb := *req.LoadBalancing
+		if err := lb.Validate(protocol); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid load balancing config", err)
+			return
+		}
+		updates["lb_targets"] = lb.Targets
+		updates["lb_target_weight"] = lb.TargetWeight
+		updates["lb_strategy"] = lb.Strategy
+		updates["lb_health_check"] = lb.HealthCheck
+		updates["lb_health_path"] = lb.HealthPath
+		updates["lb_health_interval"] = lb.HealthInterval
+		updates["lb_health_timeout"] = lb.HealthTimeout
+		updates["lb_health_fails"] = lb.HealthFails
+		updates["lb_health_passes"] = lb.HealthPasses
+	}
+	if req.DynamicForwarding != nil {
+		protocol := tunnel.Protocol
+		if req.Protocol != nil {
+			protocol = *req.Protocol
+		}
+		dyn := *req.DynamicForwarding
+		if err := dyn.Validate(protocol); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid dynamic forwarding config", err)
+			return
+		}
+		httpRouting := tunnel.HTTPRouting
+		if req.HTTPRouting != nil {
+			httpRouting = *req.HTTPRouting
+		}
+		if dyn.Enabled && httpRouting {
+			utils.ErrorResponse(c, http.StatusBadRequest, "HTTP tunnels cannot take dynamic clients", nil)
+			return
+		}
+		updates["dyn_enabled"] = dyn.Enabled
+		updates["dyn_allow_nets"] = dyn.AllowNets
+		updates["dyn_deny_nets"] = dyn.DenyNets
+		updates["dyn_allow_ports"] = dyn.AllowPorts
+		updates["dyn_deny_ports"] = dyn.DenyPorts
+	}
+	if req.HTTPRouting != nil || req.Hostnames != nil || tunnel.HTTPRouting {
+		// Host names are checked against the tunnel as it will be
+		next := *tunnel
+		if req.Name != nil {
+			next.Name = *req.Name
+		}
+		if req.Protocol != nil {
+			next.Protocol = *req.Protocol
+		}
+		if req.PortMappings != nil {
+			next.PortMappings = *req.PortMappings
+		}
+		if req.ProxyProtocol != nil {
+			next.ProxyProtocol = *req.ProxyProtocol
+		}
+		if req.HTTPRouting != nil {
+			next.HTTPRouting = *req.HTTPRouting
+		}
+		if req.Hostnames != nil {
+			next.Hostnames = *req.Hostnames
+		}
+		if err := h.tunnelService.AssignHostnames(&next); err != nil {
+			utils.ErrorResponse(c, http.StatusBadRequest, "Invalid host names", err)
+			return
+		}
+		updates["http_routing"] = next.HTTPRouting
+		updates["hostnames"] = next.Hostnames
+	}
 
 	// Update tunnel
 	updatedTunnel, err := h.tunnelService.UpdateTunnel(tunnelID, updates)
@@ -664,6 +842,39 @@ func (h *TunnelHandler) GetTunnelMetrics(c *gin.Context) {
 	utils.SuccessResponse(c, http.StatusOK, "Tunnel metrics retrieved successfully", metrics)
 }
 
+// GetTunnelTargets returns the target pools of a tunnel and the health of
+// their members
+func (h *TunnelHandler) GetTunnelTargets(c *gin.Context) {
+	tunnelID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusBadRequest, "Invalid tunnel ID", err)
+		return
+	}
+
+	// Get user from context
+	user, exists := c.Get("user")
+	if !exists {
+		utils.ErrorResponse(c, http.StatusUnauthorized, "User not found in context", nil)
+		return
+	}
+	currentUser := user.(*models.User)
+
+	// Get tunnel
+	tunnel, err := h.tunnelService.GetTunnelByID(tunnelID)
+	if err != nil {
+		utils.ErrorResponse(c, http.StatusNotFound, "Tunnel not found", err)
+		return
+	}
+
+	// Check ownership or admin privileges
+	if tunnel.UserID != currentUser.ID && !currentUser.CanPerformAction("view_all_tunnels") {
+		utils.ErrorResponse(c, http.StatusForbidden, "Access denied", nil)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, "Tunnel targets retrieved successfully", h.tunnelService.GetTunnelTargets(tunnel))
+}
+
 // GetTunnelLogs returns tunnel logs
 func (h *TunnelHandler) GetTunnelLogs(c *gin.Context) {
 	tunnelID, err := uuid.Parse(c.Param("id"))
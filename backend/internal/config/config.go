@@ -1,6 +1,7 @@
 package config
 
 import (
+	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
@@ -34,6 +35,12 @@ type Config struct {
 	// Application Configuration
 	App AppConfig `mapstructure:"app"`
 	
+	// Managed Tunnels Configuration
+	Tunnels TunnelsConfig `mapstructure:"tunnels"`
+	
+	// Certificate Management Configuration
+	Certificates CertificatesConfig `mapstructure:"certificates"`
+	
 	// JWT Configuration
 	JWTSecret string `mapstructure:"jwt_secret"`
 }
@@ -129,6 +136,61 @@ type AppConfig struct {
 	Language    string `mapstructure:"language"`
 }
 
+// TunnelsConfig holds configuration for the stunnel-core processes the
+// backend manages
+type TunnelsConfig struct {
+	ConfigDir    string            `mapstructure:"config_dir"`    // Per-tunnel config files, written 0600
+	DrainTimeout time.Duration     `mapstructure:"drain_timeout"` // How long a stopping tunnel's connections get to finish
+	DecoyDir     string            `mapstructure:"decoy_dir"`     // Directory decoys are sites below it, empty for none
+	DecoyURLs    []string          `mapstructure:"decoy_urls"`    // Websites URL decoys may proxy, empty for none
+	HTTP         HTTPRoutingConfig `mapstructure:"http"`
+}
+
+// HTTPRoutingConfig holds configuration for the shared router that sends
+// public HTTP and HTTPS traffic to HTTP tunnels by host name
+type HTTPRoutingConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	BaseDomain  string `mapstructure:"base_domain"` // Each user gets <username>.<base domain> and the names below it
+	HTTPListen  string `mapstructure:"http_listen"`
+	HTTPSListen string `mapstructure:"https_listen"` // Empty for no HTTPS
+	CertFile    string `mapstructure:"cert_file"`    // Terminates HTTPS, without it TLS passes through to the tunnels
+	KeyFile     string `mapstructure:"key_file"`
+}
+
+// CertificatesConfig holds configuration for the certificates the backend
+// issues and renews for tunnels
+type CertificatesConfig struct {
+	EncryptionKey    string        `mapstructure:"encryption_key"`    // Base64 of 32 random bytes encrypting stored private keys, required to manage certificates
+	RenewBefore      time.Duration `mapstructure:"renew_before"`      // Renew this long before a certificate expires
+	CheckInterval    time.Duration `mapstructure:"check_interval"`    // How often expiring certificates are looked for
+	InternalValidity time.Duration `mapstructure:"internal_validity"` // Lifetime of certificates from the internal CA
+	ACME             ACMEConfig    `mapstructure:"acme"`
+}
+
+// EncryptionKeySize is the length of the decoded certificate encryption key
+const EncryptionKeySize = 32
+
+// Key decodes the encryption key, which must be EncryptionKeySize random
+// bytes in base64, as generated by openssl rand -base64 32
+func (c CertificatesConfig) Key() ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(c.EncryptionKey)
+	if err != nil || len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("certificate encryption key must be %d random bytes in base64, generate one with openssl rand -base64 %d", EncryptionKeySize, EncryptionKeySize)
+	}
+	return key, nil
+}
+
+// ACMEConfig holds configuration for obtaining certificates over ACME
+type ACMEConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	DirectoryURL string `mapstructure:"directory_url"`
+	Email        string `mapstructure:"email"`
+	Challenge    string `mapstructure:"challenge"`    // http-01 or tls-alpn-01
+	HTTPAddr     string `mapstructure:"http_addr"`    // Where http-01 challenges are answered
+	TLSAddr      string `mapstructure:"tls_addr"`     // Where tls-alpn-01 challenges are answered
+	RootCAFile   string `mapstructure:"root_ca_file"` // Trusts a private directory such as Pebble
+}
+
 // LoadConfig loads configuration from environment variables and config files
 func LoadConfig() (*Config, error) {
 	// Load .env file if it exists
@@ -187,6 +249,22 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("app.debug", false)
 	viper.SetDefault("app.timezone", "UTC")
 	viper.SetDefault("app.language", "en")
+	
+	viper.SetDefault("tunnels.config_dir", "/var/lib/stunnel-pro/tunnels")
+	viper.SetDefault("tunnels.drain_timeout", "30s")
+	viper.SetDefault("tunnels.decoy_dir", "/var/lib/stunnel-pro/decoys")
+	viper.SetDefault("tunnels.http.enabled", false)
+	viper.SetDefault("tunnels.http.http_listen", ":80")
+	viper.SetDefault("tunnels.http.https_listen", ":443")
+	
+	viper.SetDefault("certificates.renew_before", "720h")
+	viper.SetDefault("certificates.check_interval", "12h")
+	viper.SetDefault("certificates.internal_validity", "2160h")
+	viper.SetDefault("certificates.acme.enabled", false)
+	viper.SetDefault("certificates.acme.directory_url", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("certificates.acme.challenge", "http-01")
+	viper.SetDefault("certificates.acme.http_addr", ":80")
+	viper.SetDefault("certificates.acme.tls_addr", ":443")
 
 	// Bind environment variables
 	viper.BindEnv("server.host", "SERVER_HOST")
@@ -214,6 +292,16 @@ func LoadConfig() (*Config, error) {
 	viper.BindEnv("monitoring.log_level", "LOG_LEVEL")
 	viper.BindEnv("app.environment", "ENVIRONMENT")
 	viper.BindEnv("app.debug", "DEBUG")
+	viper.BindEnv("tunnels.config_dir", "TUNNEL_CONFIG_DIR")
+	viper.BindEnv("tunnels.decoy_dir", "TUNNEL_DECOY_DIR")
+	viper.BindEnv("tunnels.http.enabled", "TUNNEL_HTTP_ENABLED")
+	viper.BindEnv("tunnels.http.base_domain", "TUNNEL_HTTP_BASE_DOMAIN")
+	viper.BindEnv("tunnels.http.cert_file", "TUNNEL_HTTP_CERT_FILE")
+	viper.BindEnv("tunnels.http.key_file", "TUNNEL_HTTP_KEY_FILE")
+	viper.BindEnv("certificates.encryption_key", "CERT_ENCRYPTION_KEY")
+	viper.BindEnv("certificates.acme.enabled", "ACME_ENABLED")
+	viper.BindEnv("certificates.acme.directory_url", "ACME_DIRECTORY_URL")
+	viper.BindEnv("certificates.acme.email", "ACME_EMAIL")
 
 	// Set config file paths
 	viper.SetConfigName("config")
@@ -265,6 +353,20 @@ func validateConfig(config *Config) error {
 	if config.JWTSecret == "" || config.JWTSecret == "your-super-secret-jwt-key-change-this-in-production" {
 		log.Println("WARNING: Using default JWT secret. Please set JWT_SECRET environment variable in production!")
 	}
+	if config.Certificates.EncryptionKey == "" {
+		log.Println("WARNING: CERT_ENCRYPTION_KEY is not set, managed tunnel certificates are disabled")
+	} else if _, err := config.Certificates.Key(); err != nil {
+		return err
+	}
+	if acme := config.Certificates.ACME; acme.Enabled && acme.Challenge != "http-01" && acme.Challenge != "tls-alpn-01" {
+		return fmt.Errorf("unsupported ACME challenge: %s", acme.Challenge)
+	}
+	if http := config.Tunnels.HTTP; http.Enabled && (http.CertFile == "") != (http.KeyFile == "") {
+		return fmt.Errorf("tunnel HTTP routing needs both a certificate and a key file")
+	}
+	if config.Tunnels.DrainTimeout < 0 {
+		return fmt.Errorf("tunnel drain timeout cannot be negative")
+	}
 	return nil
 }
 
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CertificateSource says where a tunnel's TLS certificate comes from
+type CertificateSource string
+
+const (
+	CertificateSourceFile     CertificateSource = "file"     // CertFile and KeyFile placed by hand
+	CertificateSourceInternal CertificateSource = "internal" // Issued by the backend's internal CA
+	CertificateSourceACME     CertificateSource = "acme"     // Obtained from the ACME directory
+)
+
+// IsValid reports whether the source is one the backend knows
+func (s CertificateSource) IsValid() bool {
+	switch s {
+	case "", CertificateSourceFile, CertificateSourceInternal, CertificateSourceACME:
+		return true
+	}
+	return false
+}
+
+// IsManaged reports whether the backend issues and renews the certificate
+func (s CertificateSource) IsManaged() bool {
+	return s == CertificateSourceInternal || s == CertificateSourceACME
+}
+
+// CertificateKind says what a stored certificate is used for
+type CertificateKind string
+
+const (
+	CertificateKindCA          CertificateKind = "ca"           // The internal CA
+	CertificateKindACMEAccount CertificateKind = "acme_account" // Key of the ACME account, no certificate
+	CertificateKindTunnel      CertificateKind = "tunnel"       // A tunnel's server certificate
+)
+
+// Certificate is a certificate and private key managed by the backend. The
+// key is stored encrypted.
+type Certificate struct {
+	ID        uuid.UUID         `json:"id" gorm:"type:uuid;primary_key"` // Set by BeforeCreate
+	Kind      CertificateKind   `json:"kind" gorm:"not null;index"`
+	Source    CertificateSource `json:"source"`
+	TunnelID  *uuid.UUID        `json:"tunnel_id,omitempty" gorm:"type:uuid;index"`
+	Domains   []string          `json:"domains" gorm:"serializer:json"`
+	CertPEM   string            `json:"cert_pem" gorm:"type:text"` // Chain, leaf first
+	KeyData   []byte            `json:"-"`
+	Serial    string            `json:"serial"`
+	NotBefore time.Time         `json:"not_before"`
+	NotAfter  time.Time         `json:"not_after" gorm:"index"`
+	LastError string            `json:"last_error,omitempty" gorm:"type:text"` // Why the last renewal failed
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// BeforeCreate hook to generate UUID
+func (c *Certificate) BeforeCreate(tx *gorm.DB) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	return nil
+}
+
+// NeedsRenewal reports whether the certificate expires within before
+func (c *Certificate) NeedsRenewal(before time.Duration) bool {
+	return time.Now().Add(before).After(c.NotAfter)
+}
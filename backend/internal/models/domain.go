@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DomainChallengeLabel is prepended to a custom domain to name the DNS TXT
+// record that proves it belongs to a user
+const DomainChallengeLabel = "_stunnel-challenge"
+
+// Domain is a custom domain a user claims for the host names of HTTP tunnels.
+// Names in it can only be assigned once it is verified, which takes Token in
+// the TXT record at ChallengeName.
+type Domain struct {
+	ID         uuid.UUID  `json:"id" gorm:"type:uuid;primary_key"` // Set by BeforeCreate
+	UserID     uuid.UUID  `json:"user_id" gorm:"type:uuid;not null;uniqueIndex:idx_domains_user_name"`
+	Name       string     `json:"name" gorm:"not null;uniqueIndex:idx_domains_user_name"`
+	Token      string     `json:"token" gorm:"not null"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// BeforeCreate hook to generate UUID
+func (d *Domain) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+// ChallengeName returns the name of the TXT record that verifies the domain
+func (d *Domain) ChallengeName() string {
+	return DomainChallengeLabel + "." + d.Name
+}
+
+// IsVerified reports whether the user proved the domain is theirs
+func (d *Domain) IsVerified() bool {
+	return d.VerifiedAt != nil
+}
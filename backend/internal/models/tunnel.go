@@ -1,6 +1,10 @@
 package models
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -24,13 +28,99 @@ const (
 	ProtocolUDP      TunnelProtocol = "udp"
 	ProtocolWS       TunnelProtocol = "ws"
 	ProtocolWSS      TunnelProtocol = "wss"
+	ProtocolH2       TunnelProtocol = "h2"
+	ProtocolGRPC     TunnelProtocol = "grpc"
 	ProtocolTCPMux   TunnelProtocol = "tcpmux"
 	ProtocolWSMux    TunnelProtocol = "wsmux"
 	ProtocolWSSMux   TunnelProtocol = "wssmux"
 	ProtocolUTCPMux  TunnelProtocol = "utcpmux"
 	ProtocolUWSMux   TunnelProtocol = "uwsmux"
+	ProtocolQUIC     TunnelProtocol = "quic"
+	ProtocolUQUIC    TunnelProtocol = "uquic"
 )
 
+// IsValid reports whether the protocol is one stunnel-core implements
+func (p TunnelProtocol) IsValid() bool {
+	switch p {
+	case ProtocolTCP, ProtocolUDP, ProtocolWS, ProtocolWSS, ProtocolH2, ProtocolGRPC,
+		ProtocolTCPMux, ProtocolWSMux, ProtocolWSSMux, ProtocolUTCPMux, ProtocolUWSMux,
+		ProtocolQUIC, ProtocolUQUIC:
+		return true
+	}
+	return false
+}
+
+// IsMux reports whether the protocol multiplexes streams over pooled links
+func (p TunnelProtocol) IsMux() bool {
+	switch p {
+	case ProtocolTCPMux, ProtocolWSMux, ProtocolWSSMux, ProtocolUTCPMux, ProtocolUWSMux:
+		return true
+	}
+	return false
+}
+
+// UsesTLS reports whether the protocol's links run over TLS
+func (p TunnelProtocol) UsesTLS() bool {
+	return p == ProtocolWSS || p == ProtocolWSSMux || p.IsQUIC()
+}
+
+// IsHTTP reports whether the protocol carries links in HTTP requests, as
+// WebSocket upgrades or HTTP/2 streams, which go to a configurable path and
+// can sit behind a decoy site
+func (p TunnelProtocol) IsHTTP() bool {
+	switch p {
+	case ProtocolWS, ProtocolWSS, ProtocolWSMux, ProtocolWSSMux, ProtocolUWSMux, ProtocolH2, ProtocolGRPC:
+		return true
+	}
+	return false
+}
+
+// IsQUIC reports whether the protocol's links run over QUIC, which needs
+// TLS 1.3
+func (p TunnelProtocol) IsQUIC() bool {
+	return p == ProtocolQUIC || p == ProtocolUQUIC
+}
+
+// ForwardsUDP reports whether the protocol forwards UDP rather than TCP
+func (p TunnelProtocol) ForwardsUDP() bool {
+	return p == ProtocolUDP || p == ProtocolUTCPMux || p == ProtocolUWSMux || p == ProtocolUQUIC
+}
+
+// ProxyProtocolVersion is the HAProxy PROXY protocol header version a tunnel
+// sends to its targets
+type ProxyProtocolVersion string
+
+const (
+	ProxyProtocolNone ProxyProtocolVersion = ""
+	ProxyProtocolV1   ProxyProtocolVersion = "v1"
+	ProxyProtocolV2   ProxyProtocolVersion = "v2"
+)
+
+// IsValid reports whether stunnel-core can send the version
+func (v ProxyProtocolVersion) IsValid() bool {
+	return v == ProxyProtocolNone || v == ProxyProtocolV1 || v == ProxyProtocolV2
+}
+
+// LinkCompression is the algorithm a tunnel compresses its links with
+type LinkCompression string
+
+const (
+	CompressionNone   LinkCompression = ""
+	CompressionZstd   LinkCompression = "zstd"
+	CompressionSnappy LinkCompression = "snappy"
+)
+
+// IsValid reports whether stunnel-core can compress with the algorithm
+func (c LinkCompression) IsValid() bool {
+	return c == CompressionNone || c == CompressionZstd || c == CompressionSnappy
+}
+
+// UsesTLS reports whether the tunnel's links run over TLS, either because
+// its protocol always does or because TLS is enabled for it
+func (t *Tunnel) UsesTLS() bool {
+	return t.Protocol.UsesTLS() || t.TLSConfig.Enabled
+}
+
 // Tunnel represents a tunnel configuration
 type Tunnel struct {
 	ID          uuid.UUID      `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
@@ -50,7 +140,35 @@ type Tunnel struct {
 	// Target Configuration
 	TargetIP     string `json:"target_ip" gorm:"not null" validate:"required,ip"`
 	TargetPort   int    `json:"target_port" gorm:"not null" validate:"required,min=1,max=65535"`
-	
+
+	// Extra ports forwarded by the same process
+	PortMappings []PortMapping `json:"port_mappings" gorm:"serializer:json" validate:"dive"`
+
+	// Further targets sharing the main target's connections
+	LoadBalancing LoadBalancing `json:"load_balancing" gorm:"embedded;embeddedPrefix:lb_"`
+
+	// PROXY protocol header sent to targets so they see the real client,
+	// and whether listeners expect one from a load balancer in front
+	ProxyProtocol       ProxyProtocolVersion `json:"proxy_protocol" validate:"omitempty,oneof=v1 v2"`
+	AcceptProxyProtocol bool                 `json:"accept_proxy_protocol" gorm:"default:false"`
+
+	// Compression of the tunnel's links, used when both ends ask for it
+	Compression LinkCompression `json:"compression" validate:"omitempty,oneof=zstd snappy"`
+
+	// Request path of WebSocket, h2 and grpc links, empty for the protocol's
+	// default, and the site served to every other request: a directory on
+	// the tunnel host or an http(s) URL to proxy
+	Path  string `json:"path" validate:"omitempty,startswith=/"`
+	Decoy string `json:"decoy"`
+
+	// Public HTTP and HTTPS traffic for these host names reaches the tunnel
+	// through the shared router. A name may be a *. wildcard.
+	HTTPRouting bool     `json:"http_routing" gorm:"default:false"`
+	Hostnames   []string `json:"hostnames" gorm:"serializer:json"`
+
+	// SOCKS5 and HTTP CONNECT clients and the destinations they may reach
+	DynamicForwarding DynamicForwarding `json:"dynamic_forwarding" gorm:"embedded;embeddedPrefix:dyn_"`
+
 	// Authentication
 	Token        string `json:"token" gorm:"not null" validate:"required,min=16"`
 	
@@ -76,6 +194,91 @@ type Tunnel struct {
 	Metrics      []TunnelMetric  `json:"metrics,omitempty" gorm:"foreignKey:TunnelID"`
 }
 
+// PortMapping forwards a listen port, or a range of ports, to its own target
+type PortMapping struct {
+	ListenPort    int    `json:"listen_port" validate:"required,min=1,max=65535"`
+	ListenPortEnd int    `json:"listen_port_end,omitempty" validate:"omitempty,min=1,max=65535"` // 0 for a single port
+	TargetIP      string `json:"target_ip" validate:"required,ip"`
+	TargetPort    int    `json:"target_port,omitempty" validate:"omitempty,min=1,max=65535"` // 0 keeps the listen port
+	TargetPortEnd int    `json:"target_port_end,omitempty" validate:"omitempty,min=1,max=65535"`
+}
+
+// Validate checks that the mapping's ranges are well formed
+func (m PortMapping) Validate() error {
+	if m.ListenPort < 1 || m.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", m.ListenPort)
+	}
+	if m.ListenPortEnd != 0 && (m.ListenPortEnd < m.ListenPort || m.ListenPortEnd > 65535) {
+		return fmt.Errorf("invalid listen port range %d-%d", m.ListenPort, m.ListenPortEnd)
+	}
+	if net.ParseIP(m.TargetIP) == nil {
+		return fmt.Errorf("invalid target IP %q", m.TargetIP)
+	}
+	if m.TargetPort < 0 || m.TargetPort > 65535 {
+		return fmt.Errorf("invalid target port %d", m.TargetPort)
+	}
+	if m.TargetPortEnd != 0 {
+		if m.TargetPort == 0 || m.TargetPortEnd < m.TargetPort || m.TargetPortEnd > 65535 {
+			return fmt.Errorf("invalid target port range %d-%d", m.TargetPort, m.TargetPortEnd)
+		}
+		if m.TargetPortEnd-m.TargetPort != m.listenEnd()-m.ListenPort {
+			return fmt.Errorf("target port range %d-%d does not match listen range", m.TargetPort, m.TargetPortEnd)
+		}
+	}
+	return nil
+}
+
+// ForwardSpec renders the mapping as a stunnel-core -forward value
+func (m PortMapping) ForwardSpec(listenIP string) string {
+	listen := portRange(m.ListenPort, m.ListenPortEnd)
+	if listenIP != "" {
+		listen = net.JoinHostPort(listenIP, listen)
+	}
+
+	target := m.TargetIP
+	if m.TargetPort != 0 {
+		target = net.JoinHostPort(m.TargetIP, portRange(m.TargetPort, m.TargetPortEnd))
+	} else if strings.Contains(target, ":") {
+		target = "[" + target + "]"
+	}
+	return listen + "=" + target
+}
+
+func (m PortMapping) listenEnd() int {
+	if m.ListenPortEnd == 0 {
+		return m.ListenPort
+	}
+	return m.ListenPortEnd
+}
+
+// PortSpan is an inclusive range of ports
+type PortSpan struct {
+	First int
+	Last  int
+}
+
+// Overlaps reports whether two spans share a port
+func (s PortSpan) Overlaps(other PortSpan) bool {
+	return s.First <= other.Last && other.First <= s.Last
+}
+
+// ListenPorts returns the ports a tunnel listens on at its server IP, its
+// server port and those of its port mappings
+func (t *Tunnel) ListenPorts() []PortSpan {
+	spans := []PortSpan{{First: t.ServerPort, Last: t.ServerPort}}
+	for _, mapping := range t.PortMappings {
+		spans = append(spans, PortSpan{First: mapping.ListenPort, Last: mapping.listenEnd()})
+	}
+	return spans
+}
+
+func portRange(first, last int) string {
+	if last == 0 || last == first {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("%d-%d", first, last)
+}
+
 // MuxConfig represents multiplexing configuration
 type MuxConfig struct {
 	Enabled         bool `json:"enabled" gorm:"default:true"`
@@ -98,6 +301,214 @@ type TLSConfig struct {
 	InsecureSkipVerify bool `json:"insecure_skip_verify" gorm:"default:false"`
 	MinVersion      string `json:"min_version" gorm:"default:'1.2'"`
 	MaxVersion      string `json:"max_version" gorm:"default:'1.3'"`
+	CipherSuites    string `json:"cipher_suites"` // Comma separated Go names, empty for the defaults
+
+	// Certificates the backend manages replace CertFile and KeyFile
+	CertSource      CertificateSource `json:"cert_source"`
+	Domain          string            `json:"domain"` // Name the certificate is issued for, required for ACME, one the owner holds for the internal CA
+}
+
+// tlsVersions orders the TLS versions tunnel-core accepts
+var tlsVersions = map[string]int{"1.0": 0, "1.1": 1, "1.2": 2, "1.3": 3}
+
+// Validate checks the settings tunnel-core would refuse to start with
+func (c TLSConfig) Validate(protocol TunnelProtocol) error {
+	if !c.Enabled && !protocol.UsesTLS() {
+		return nil
+	}
+	if protocol == ProtocolUDP {
+		return fmt.Errorf("TLS is not available for the udp protocol")
+	}
+	switch {
+	case !c.CertSource.IsValid():
+		return fmt.Errorf("unsupported certificate source %q", c.CertSource)
+	case c.CertSource == CertificateSourceACME && c.Domain == "":
+		return fmt.Errorf("a domain is required for ACME certificates")
+	case !c.CertSource.IsManaged() && (c.CertFile == "" || c.KeyFile == ""):
+		return fmt.Errorf("TLS certificate and key files are required")
+	}
+	min, ok := tlsVersions[c.MinVersion]
+	if c.MinVersion != "" && !ok {
+		return fmt.Errorf("unsupported TLS min version %q", c.MinVersion)
+	}
+	max, ok := tlsVersions[c.MaxVersion]
+	if c.MaxVersion != "" && !ok {
+		return fmt.Errorf("unsupported TLS max version %q", c.MaxVersion)
+	}
+	if c.MinVersion != "" && c.MaxVersion != "" && max < min {
+		return fmt.Errorf("TLS max version %s is below min version %s", c.MaxVersion, c.MinVersion)
+	}
+	if protocol.IsQUIC() && c.MaxVersion != "" && max < tlsVersions["1.3"] {
+		return fmt.Errorf("QUIC needs TLS 1.3, got max version %s", c.MaxVersion)
+	}
+	return nil
+}
+
+// LoadBalanceStrategy says how a tunnel spreads connections over its targets
+type LoadBalanceStrategy string
+
+const (
+	BalanceRoundRobin LoadBalanceStrategy = "round-robin"
+	BalanceLeastConn  LoadBalanceStrategy = "least-conn"
+	BalanceWeighted   LoadBalanceStrategy = "weighted"
+	BalanceSourceHash LoadBalanceStrategy = "source-hash" // Same target for the same client IP
+)
+
+// IsValid reports whether stunnel-core implements the strategy
+func (s LoadBalanceStrategy) IsValid() bool {
+	switch s {
+	case "", BalanceRoundRobin, BalanceLeastConn, BalanceWeighted, BalanceSourceHash:
+		return true
+	}
+	return false
+}
+
+// HealthCheckType says how stunnel-core probes a tunnel's targets
+type HealthCheckType string
+
+const (
+	HealthCheckNone HealthCheckType = ""     // Only failed dials eject a target
+	HealthCheckTCP  HealthCheckType = "tcp"  // Connect to the target
+	HealthCheckHTTP HealthCheckType = "http" // GET HealthPath, expecting a 2xx or 3xx answer
+)
+
+// IsValid reports whether stunnel-core implements the check
+func (c HealthCheckType) IsValid() bool {
+	return c == HealthCheckNone || c == HealthCheckTCP || c == HealthCheckHTTP
+}
+
+// maxTargetWeight and maxTunnelTargets mirror stunnel-core's limits
+const (
+	maxTargetWeight  = 100
+	maxTunnelTargets = 32
+)
+
+// TunnelTarget is a target besides TargetIP:TargetPort
+type TunnelTarget struct {
+	IP     string `json:"ip" validate:"required,ip"`
+	Port   int    `json:"port" validate:"required,min=1,max=65535"`
+	Weight int    `json:"weight,omitempty" validate:"omitempty,min=1,max=100"` // 1 when unset
+}
+
+// Spec renders the target as a member of a stunnel-core target list
+func (t TunnelTarget) Spec() string {
+	return targetSpec(t.IP, t.Port, t.Weight)
+}
+
+func targetSpec(ip string, port, weight int) string {
+	spec := net.JoinHostPort(ip, strconv.Itoa(port))
+	if weight > 1 {
+		spec += "@" + strconv.Itoa(weight)
+	}
+	return spec
+}
+
+// LoadBalancing spreads a tunnel's connections over its main target and
+// Targets, ejecting targets that fail their health checks
+type LoadBalancing struct {
+	Targets      []TunnelTarget      `json:"targets" gorm:"serializer:json" validate:"dive"`
+	TargetWeight int                 `json:"target_weight,omitempty"` // Weight of the main target, 1 when unset
+	Strategy     LoadBalanceStrategy `json:"strategy"`                // Round robin when unset
+
+	HealthCheck    HealthCheckType `json:"health_check"`
+	HealthPath     string          `json:"health_path"`               // Requested by http checks, / when unset
+	HealthInterval int             `json:"health_interval,omitempty"` // Seconds between checks, 10 when unset
+	HealthTimeout  int             `json:"health_timeout,omitempty"`  // Seconds, 2 when unset
+	HealthFails    int             `json:"health_fails,omitempty"`    // Failures in a row that eject a target, 3 when unset
+	HealthPasses   int             `json:"health_passes,omitempty"`   // Passed checks in a row that take it back, 2 when unset
+}
+
+// Validate checks the settings tunnel-core would refuse to start with
+func (lb LoadBalancing) Validate(protocol TunnelProtocol) error {
+	if len(lb.Targets) > maxTunnelTargets {
+		return fmt.Errorf("at most %d additional targets are allowed", maxTunnelTargets)
+	}
+	for i, target := range lb.Targets {
+		if net.ParseIP(target.IP) == nil {
+			return fmt.Errorf("target %d: invalid IP %q", i+1, target.IP)
+		}
+		if target.Port < 1 || target.Port > 65535 {
+			return fmt.Errorf("target %d: invalid port %d", i+1, target.Port)
+		}
+		if target.Weight < 0 || target.Weight > maxTargetWeight {
+			return fmt.Errorf("target %d: weight must be 1-%d", i+1, maxTargetWeight)
+		}
+	}
+	if lb.TargetWeight < 0 || lb.TargetWeight > maxTargetWeight {
+		return fmt.Errorf("target weight must be 1-%d", maxTargetWeight)
+	}
+	if !lb.Strategy.IsValid() {
+		return fmt.Errorf("unsupported balancing strategy %q", lb.Strategy)
+	}
+	if !lb.HealthCheck.IsValid() {
+		return fmt.Errorf("unsupported health check %q", lb.HealthCheck)
+	}
+	if lb.HealthCheck != HealthCheckNone && protocol.ForwardsUDP() {
+		return fmt.Errorf("health checks only probe TCP targets")
+	}
+	if lb.HealthPath != "" && !strings.HasPrefix(lb.HealthPath, "/") {
+		return fmt.Errorf("health check path must start with /")
+	}
+	if lb.HealthInterval < 0 || lb.HealthTimeout < 0 || lb.HealthFails < 0 || lb.HealthPasses < 0 {
+		return fmt.Errorf("health check settings must not be negative")
+	}
+	return nil
+}
+
+// TargetSpec renders the main target, followed by the load balanced ones, as
+// a stunnel-core -target value
+func (t *Tunnel) TargetSpec() string {
+	specs := []string{targetSpec(t.TargetIP, t.TargetPort, t.LoadBalancing.TargetWeight)}
+	for _, target := range t.LoadBalancing.Targets {
+		specs = append(specs, target.Spec())
+	}
+	return strings.Join(specs, ",")
+}
+
+// DynamicForwarding lets the tunnel's clients run a SOCKS5 or HTTP CONNECT
+// proxy whose destinations the tunnel resolves and dials. Deny rules win
+// over allow rules, and empty allow lists allow everything. tunnel-core
+// refuses its internal networks, the server's own host and local networks,
+// unless AllowNets covers them.
+type DynamicForwarding struct {
+	Enabled    bool     `json:"enabled" gorm:"default:false"`
+	AllowNets  []string `json:"allow_nets" gorm:"serializer:json"`  // CIDRs or single IPs
+	DenyNets   []string `json:"deny_nets" gorm:"serializer:json"`   // CIDRs or single IPs
+	AllowPorts []string `json:"allow_ports" gorm:"serializer:json"` // Ports or ranges like 8000-8100
+	DenyPorts  []string `json:"deny_ports" gorm:"serializer:json"`  // Ports or ranges like 8000-8100
+}
+
+// Validate checks the settings tunnel-core would refuse to start with
+func (d DynamicForwarding) Validate(protocol TunnelProtocol) error {
+	if !d.Enabled {
+		return nil
+	}
+	if protocol != ProtocolTCP && !protocol.IsMux() || protocol.ForwardsUDP() {
+		return fmt.Errorf("dynamic forwarding needs tcp or a TCP mux protocol, got %s", protocol)
+	}
+	for _, network := range append(append([]string{}, d.AllowNets...), d.DenyNets...) {
+		if net.ParseIP(network) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("invalid network %q", network)
+		}
+	}
+	for _, ports := range append(append([]string{}, d.AllowPorts...), d.DenyPorts...) {
+		first, last, found := strings.Cut(ports, "-")
+		if !found {
+			last = first
+		}
+		low, err := strconv.Atoi(first)
+		if err != nil || low < 1 || low > 65535 {
+			return fmt.Errorf("invalid port range %q", ports)
+		}
+		high, err := strconv.Atoi(last)
+		if err != nil || high < low || high > 65535 {
+			return fmt.Errorf("invalid port range %q", ports)
+		}
+	}
+	return nil
 }
 
 // TunnelLog represents tunnel activity logs
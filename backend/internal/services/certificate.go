@@ -0,0 +1,383 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"utunnel-pro/internal/config"
+	"utunnel-pro/internal/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme"
+	"gorm.io/gorm"
+)
+
+// CertificateService issues, stores and renews the certificates of tunnels
+// whose TLSConfig.CertSource is internal or acme. Certificates live in the
+// database with their keys encrypted, and are written next to the tunnel's
+// config file for its process to read. Renewed certificates are pushed to
+// running processes with SIGHUP, which reloads them without dropping links.
+type CertificateService struct {
+	db      *gorm.DB
+	config  *config.Config
+	tunnels *TunnelService
+
+	// mu serialises issuance so a tunnel never gets two certificates at once
+	mu         sync.Mutex
+	acmeClient *acme.Client
+	challenges *acmeChallenges
+
+	caMu sync.Mutex
+	ca   *internalCA
+}
+
+// NewCertificateService creates a new certificate service
+func NewCertificateService(db *gorm.DB, config *config.Config, tunnels *TunnelService) *CertificateService {
+	return &CertificateService{
+		db:         db,
+		config:     config,
+		tunnels:    tunnels,
+		challenges: newACMEChallenges(),
+	}
+}
+
+// errCertificatesDisabled is returned while no encryption key is configured
+var errCertificatesDisabled = errors.New("certificate management is disabled, set CERT_ENCRYPTION_KEY")
+
+// Start loads the internal CA, serves ACME challenges and renews expiring
+// certificates until ctx ends
+func (s *CertificateService) Start(ctx context.Context) error {
+	if s.config.Certificates.EncryptionKey == "" {
+		return nil
+	}
+
+	if _, err := s.internalCA(); err != nil {
+		return err
+	}
+	if s.config.Certificates.ACME.Enabled {
+		if err := s.challenges.serve(ctx, s.config.Certificates.ACME); err != nil {
+			return err
+		}
+	}
+
+	go s.renewLoop(ctx)
+
+	log.Println("Certificate service started")
+	return nil
+}
+
+// CACertificate returns the internal CA certificate in PEM, for clients to
+// verify internally issued tunnel certificates with
+func (s *CertificateService) CACertificate() ([]byte, error) {
+	ca, err := s.internalCA()
+	if err != nil {
+		return nil, err
+	}
+	return ca.certPEM, nil
+}
+
+// GetTunnelCertificate returns the stored certificate of a tunnel
+func (s *CertificateService) GetTunnelCertificate(tunnelID uuid.UUID) (*models.Certificate, error) {
+	var cert models.Certificate
+	err := s.db.Where("kind = ? AND tunnel_id = ?", models.CertificateKindTunnel, tunnelID).First(&cert).Error
+	if err != nil {
+		return nil, fmt.Errorf("certificate not found: %w", err)
+	}
+	return &cert, nil
+}
+
+// TunnelCertificate returns the PEM certificate chain and key a tunnel's
+// process should present, issuing one if the stored certificate is missing,
+// expiring or no longer matches the tunnel
+func (s *CertificateService) TunnelCertificate(ctx context.Context, tunnel *models.Tunnel) (certPEM, keyPEM []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, _ := s.GetTunnelCertificate(tunnel.ID)
+	if stored != nil && stored.Source == tunnel.TLSConfig.CertSource &&
+		sameDomains(stored.Domains, tunnelCertificateDomains(tunnel)) &&
+		!stored.NeedsRenewal(s.config.Certificates.RenewBefore) {
+		keyPEM, err := s.openKey(stored.KeyData)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []byte(stored.CertPEM), keyPEM, nil
+	}
+
+	return s.issueTunnelCertificate(ctx, tunnel, stored)
+}
+
+// RenewTunnelCertificate issues a new certificate for a tunnel and pushes it
+// to the tunnel's process if it is running
+func (s *CertificateService) RenewTunnelCertificate(ctx context.Context, tunnel *models.Tunnel) (*models.Certificate, error) {
+	s.mu.Lock()
+	stored, _ := s.GetTunnelCertificate(tunnel.ID)
+	certPEM, keyPEM, err := s.issueTunnelCertificate(ctx, tunnel, stored)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.tunnels.rotateTunnelCertificate(tunnel, certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	return s.GetTunnelCertificate(tunnel.ID)
+}
+
+// issueTunnelCertificate issues a certificate from the tunnel's source and
+// stores it over stored, callers hold mu
+func (s *CertificateService) issueTunnelCertificate(ctx context.Context, tunnel *models.Tunnel, stored *models.Certificate) (certPEM, keyPEM []byte, err error) {
+	if s.config.Certificates.EncryptionKey == "" {
+		return nil, nil, errCertificatesDisabled
+	}
+
+	domains := tunnelCertificateDomains(tunnel)
+	switch tunnel.TLSConfig.CertSource {
+	case models.CertificateSourceInternal:
+		// Tunnels saved before names were checked are caught here
+		if err = s.tunnels.checkTLSDomain(tunnel); err != nil {
+			break
+		}
+		var ca *internalCA
+		if ca, err = s.internalCA(); err == nil {
+			certPEM, keyPEM, err = ca.issue(tunnel.Name, domains, s.config.Certificates.InternalValidity)
+		}
+	case models.CertificateSourceACME:
+		certPEM, keyPEM, err = s.obtainACMECertificate(ctx, domains)
+	default:
+		return nil, nil, fmt.Errorf("tunnel certificate is not managed by the backend")
+	}
+	if err != nil {
+		if stored != nil {
+			s.db.Model(stored).Update("last_error", err.Error())
+		}
+		return nil, nil, fmt.Errorf("failed to issue %s certificate: %w", tunnel.TLSConfig.CertSource, err)
+	}
+
+	tunnelID := tunnel.ID
+	cert := &models.Certificate{
+		Kind:     models.CertificateKindTunnel,
+		Source:   tunnel.TLSConfig.CertSource,
+		TunnelID: &tunnelID,
+		Domains:  domains,
+	}
+	if stored != nil {
+		cert.ID = stored.ID
+		cert.CreatedAt = stored.CreatedAt
+	}
+	if err := s.storeCertificate(cert, certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+
+	log.Printf("Issued %s certificate for tunnel %s, expires %s", cert.Source, tunnel.ID, cert.NotAfter.Format(time.RFC3339))
+	return certPEM, keyPEM, nil
+}
+
+// renewLoop renews expiring certificates every check interval
+func (s *CertificateService) renewLoop(ctx context.Context) {
+	interval := s.config.Certificates.CheckInterval
+	if interval <= 0 {
+		interval = 12 * time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.renewDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewDue renews the tunnel certificates expiring within renew_before
+func (s *CertificateService) renewDue(ctx context.Context) {
+	var due []models.Certificate
+	deadline := time.Now().Add(s.config.Certificates.RenewBefore)
+	if err := s.db.Where("kind = ? AND not_after < ?", models.CertificateKindTunnel, deadline).Find(&due).Error; err != nil {
+		log.Printf("Failed to look up expiring certificates: %v", err)
+		return
+	}
+
+	for _, cert := range due {
+		if ctx.Err() != nil {
+			return
+		}
+
+		tunnel, err := s.tunnels.GetTunnelByID(*cert.TunnelID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			// Tried again on the next pass
+			log.Printf("Failed to look up tunnel %s for renewal: %v", *cert.TunnelID, err)
+			continue
+		}
+		if err != nil || !tunnel.UsesTLS() || !tunnel.TLSConfig.CertSource.IsManaged() {
+			// The tunnel is gone or manages its certificate itself now
+			s.db.Delete(&cert)
+			continue
+		}
+
+		if _, err := s.RenewTunnelCertificate(ctx, tunnel); err != nil {
+			log.Printf("Failed to renew certificate of tunnel %s: %v", tunnel.ID, err)
+		}
+	}
+}
+
+// storeCertificate fills in cert from certPEM and saves it with keyPEM
+// encrypted
+func (s *CertificateService) storeCertificate(cert *models.Certificate, certPEM, keyPEM []byte) error {
+	if len(certPEM) > 0 {
+		leaf, err := parseCertificatePEM(certPEM)
+		if err != nil {
+			return err
+		}
+		cert.CertPEM = string(certPEM)
+		cert.Serial = leaf.SerialNumber.Text(16)
+		cert.NotBefore = leaf.NotBefore
+		cert.NotAfter = leaf.NotAfter
+	}
+
+	sealed, err := s.sealKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	cert.KeyData = sealed
+	cert.LastError = ""
+
+	if err := s.db.Save(cert).Error; err != nil {
+		return fmt.Errorf("failed to store certificate: %w", err)
+	}
+	return nil
+}
+
+// loadKeyPair reads the only stored certificate of a kind, nil if there is
+// none yet
+func (s *CertificateService) loadKeyPair(kind models.CertificateKind) (*models.Certificate, []byte, error) {
+	var cert models.Certificate
+	err := s.db.Where("kind = ?", kind).First(&cert).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load %s certificate: %w", kind, err)
+	}
+
+	keyPEM, err := s.openKey(cert.KeyData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cert, keyPEM, nil
+}
+
+// encryptionCipher returns the AEAD stored keys are encrypted with
+func (s *CertificateService) encryptionCipher() (cipher.AEAD, error) {
+	if s.config.Certificates.EncryptionKey == "" {
+		return nil, errCertificatesDisabled
+	}
+
+	key, err := s.config.Certificates.Key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKey encrypts a private key for storage, prefixed with its nonce
+func (s *CertificateService) sealKey(keyPEM []byte) ([]byte, error) {
+	aead, err := s.encryptionCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, keyPEM, nil), nil
+}
+
+// openKey decrypts a private key sealed by sealKey
+func (s *CertificateService) openKey(sealed []byte) ([]byte, error) {
+	aead, err := s.encryptionCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("stored key is truncated")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	keyPEM, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt stored key, was the encryption key changed?: %w", err)
+	}
+	return keyPEM, nil
+}
+
+// tunnelCertificateDomains returns the names a tunnel's certificate covers,
+// its domain and, when it listens on a specific one, its IP
+func tunnelCertificateDomains(tunnel *models.Tunnel) []string {
+	var domains []string
+	if tunnel.TLSConfig.Domain != "" {
+		domains = append(domains, tunnel.TLSConfig.Domain)
+	}
+	// ACME directories do not issue for IPs
+	if tunnel.TLSConfig.CertSource == models.CertificateSourceInternal {
+		if ip := net.ParseIP(tunnel.ServerIP); ip != nil && !ip.IsUnspecified() {
+			domains = append(domains, ip.String())
+		}
+	}
+	return domains
+}
+
+func sameDomains(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCertificatePEM parses the first certificate of a PEM chain
+func parseCertificatePEM(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// encodePEM encodes DER blocks of one type into a PEM chain
+func encodePEM(blockType string, blocks ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, der := range blocks {
+		pem.Encode(&buf, &pem.Block{Type: blockType, Bytes: der})
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"utunnel-pro/internal/config"
+	"utunnel-pro/internal/models"
+
+	"golang.org/x/crypto/acme"
+)
+
+// acmeTimeout bounds obtaining one certificate, challenges included
+const acmeTimeout = 5 * time.Minute
+
+// acmeAccount returns a client registered with the configured directory,
+// creating and storing the account key on first use. Callers hold mu.
+func (s *CertificateService) acmeAccount(ctx context.Context) (*acme.Client, error) {
+	if s.acmeClient != nil {
+		return s.acmeClient, nil
+	}
+
+	cfg := s.config.Certificates.ACME
+	if !cfg.Enabled {
+		return nil, fmt.Errorf("ACME is not enabled")
+	}
+
+	httpClient := http.DefaultClient
+	if cfg.RootCAFile != "" {
+		rootPEM, err := os.ReadFile(cfg.RootCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME root CA: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(rootPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.RootCAFile)
+		}
+		httpClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	stored, keyPEM, err := s.loadKeyPair(models.CertificateKindACMEAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	if stored != nil {
+		parsed, err := parsePrivateKey(keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	} else {
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+		}
+		if keyPEM, err = encodePrivateKey(generated); err != nil {
+			return nil, err
+		}
+		key = generated
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: cfg.DirectoryURL,
+		HTTPClient:   httpClient,
+		UserAgent:    s.config.App.Name,
+	}
+
+	account := &acme.Account{}
+	if cfg.Email != "" {
+		account.Contact = []string{"mailto:" + cfg.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %w", err)
+	}
+
+	// Only keep keys the directory accepted
+	if stored == nil {
+		if err := s.storeCertificate(&models.Certificate{Kind: models.CertificateKindACMEAccount}, nil, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+
+	s.acmeClient = client
+	return client, nil
+}
+
+// obtainACMECertificate orders a certificate for domains, answering the
+// configured challenge type, and returns its chain and key in PEM
+func (s *CertificateService) obtainACMECertificate(ctx context.Context, domains []string) (certPEM, keyPEM []byte, err error) {
+	if len(domains) == 0 {
+		return nil, nil, fmt.Errorf("no domain to request a certificate for")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+
+	client, err := s.acmeAccount(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create order: %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := s.authorize(ctx, client, authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, nil, fmt.Errorf("order was not authorized: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: domains}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	if keyPEM, err = encodePrivateKey(key); err != nil {
+		return nil, nil, err
+	}
+	return encodePEM("CERTIFICATE", chain...), keyPEM, nil
+}
+
+// authorize proves control of one authorization's domain with the
+// configured challenge type
+func (s *CertificateService) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	challengeType := s.config.Certificates.ACME.Challenge
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("directory offers no %s challenge for %s", challengeType, authz.Identifier.Value)
+	}
+
+	domain := authz.Identifier.Value
+	switch challengeType {
+	case "http-01":
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return fmt.Errorf("failed to build http-01 response: %w", err)
+		}
+		path := client.HTTP01ChallengePath(challenge.Token)
+		s.challenges.setHTTP(path, response)
+		defer s.challenges.setHTTP(path, "")
+	case "tls-alpn-01":
+		cert, err := client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			return fmt.Errorf("failed to build tls-alpn-01 certificate: %w", err)
+		}
+		s.challenges.setALPN(domain, &cert)
+		defer s.challenges.setALPN(domain, nil)
+	}
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return fmt.Errorf("failed to accept %s challenge: %w", challengeType, err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization of %s failed: %w", domain, err)
+	}
+	return nil
+}
+
+// acmeChallenges answers the pending challenges of ACME orders
+type acmeChallenges struct {
+	mu   sync.RWMutex
+	http map[string]string           // Path to key authorization
+	alpn map[string]*tls.Certificate // Domain to challenge certificate
+}
+
+func newACMEChallenges() *acmeChallenges {
+	return &acmeChallenges{
+		http: make(map[string]string),
+		alpn: make(map[string]*tls.Certificate),
+	}
+}
+
+// setHTTP answers path with response, an empty response stops answering it
+func (c *acmeChallenges) setHTTP(path, response string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if response == "" {
+		delete(c.http, path)
+		return
+	}
+	c.http[path] = response
+}
+
+// setALPN presents cert for domain, nil stops presenting one
+func (c *acmeChallenges) setALPN(domain string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	domain = strings.ToLower(domain)
+	if cert == nil {
+		delete(c.alpn, domain)
+		return
+	}
+	c.alpn[domain] = cert
+}
+
+func (c *acmeChallenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	response, ok := c.http[r.URL.Path]
+	c.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(response))
+}
+
+func (c *acmeChallenges) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if cert, ok := c.alpn[strings.ToLower(hello.ServerName)]; ok {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no pending challenge for %q", hello.ServerName)
+}
+
+// serve listens for the configured challenge type until ctx ends
+func (c *acmeChallenges) serve(ctx context.Context, cfg config.ACMEConfig) error {
+	switch cfg.Challenge {
+	case "http-01":
+		listener, err := net.Listen("tcp", cfg.HTTPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for http-01 challenges: %w", err)
+		}
+		server := &http.Server{Handler: c, ReadHeaderTimeout: 10 * time.Second}
+		go server.Serve(listener)
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		log.Printf("Answering ACME http-01 challenges on %s", cfg.HTTPAddr)
+
+	case "tls-alpn-01":
+		listener, err := tls.Listen("tcp", cfg.TLSAddr, &tls.Config{
+			GetCertificate: c.getCertificate,
+			NextProtos:     []string{acme.ALPNProto},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to listen for tls-alpn-01 challenges: %w", err)
+		}
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				// The handshake is the whole challenge
+				go func() {
+					defer conn.Close()
+					conn.SetDeadline(time.Now().Add(10 * time.Second))
+					conn.(*tls.Conn).Handshake()
+				}()
+			}
+		}()
+		log.Printf("Answering ACME tls-alpn-01 challenges on %s", cfg.TLSAddr)
+	}
+	return nil
+}
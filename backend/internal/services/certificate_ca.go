@@ -0,0 +1,193 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"utunnel-pro/internal/models"
+)
+
+// caValidity is how long the internal CA itself is valid
+const caValidity = 10 * 365 * 24 * time.Hour
+
+// internalCA signs tunnel certificates with a key kept in the database
+type internalCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	certPEM []byte
+}
+
+// internalCA returns the backend's CA, creating and storing it on first use
+func (s *CertificateService) internalCA() (*internalCA, error) {
+	s.caMu.Lock()
+	defer s.caMu.Unlock()
+
+	if s.ca != nil {
+		return s.ca, nil
+	}
+
+	stored, keyPEM, err := s.loadKeyPair(models.CertificateKindCA)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		ca, err := parseInternalCA([]byte(stored.CertPEM), keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		s.ca = ca
+		return ca, nil
+	}
+
+	ca, keyPEM, err := newInternalCA(s.config.App.Name + " Internal CA")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.storeCertificate(&models.Certificate{Kind: models.CertificateKindCA}, ca.certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	s.ca = ca
+	return ca, nil
+}
+
+// newInternalCA creates a self-signed CA, returning it with its key in PEM
+func newInternalCA(name string) (*internalCA, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := parseInternalCA(encodePEM("CERTIFICATE", der), keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, keyPEM, nil
+}
+
+// parseInternalCA loads a CA from its PEM certificate and key
+func parseInternalCA(certPEM, keyPEM []byte) (*internalCA, error) {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &internalCA{cert: cert, key: key, certPEM: certPEM}, nil
+}
+
+// issue signs a server certificate for names, which may be DNS names or IPs,
+// returning the chain up to the CA and the new key in PEM
+func (ca *internalCA) issue(commonName string, names []string, validity time.Duration) (certPEM, keyPEM []byte, err error) {
+	if validity <= 0 {
+		validity = 90 * 24 * time.Hour
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	keyPEM, err = encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodePEM("CERTIFICATE", der, ca.cert.Raw), keyPEM, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// encodePrivateKey encodes a key as PKCS #8 PEM
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+	return encodePEM("PRIVATE KEY", der), nil
+}
+
+// parsePrivateKey decodes a key encoded by encodePrivateKey
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in PEM data")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
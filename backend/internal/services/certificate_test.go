@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+	"time"
+
+	"utunnel-pro/internal/config"
+	"utunnel-pro/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type CertificateServiceTestSuite struct {
+	suite.Suite
+	db                 *gorm.DB
+	config             *config.Config
+	tunnelService      *TunnelService
+	certificateService *CertificateService
+}
+
+func (suite *CertificateServiceTestSuite) SetupTest() {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	suite.Require().NoError(err)
+	suite.Require().NoError(db.AutoMigrate(&models.Certificate{}))
+	suite.db = db
+
+	suite.config = &config.Config{
+		App: config.AppConfig{Name: "STunnel Pro"},
+		Tunnels: config.TunnelsConfig{
+			ConfigDir: suite.T().TempDir(),
+		},
+		Certificates: config.CertificatesConfig{
+			EncryptionKey:    "dGVzdC1lbmNyeXB0aW9uLWtleS0wMTIzNDU2Nzg5YWI=",
+			RenewBefore:      720 * time.Hour,
+			InternalValidity: 2160 * time.Hour,
+		},
+	}
+
+	suite.tunnelService = NewTunnelService(db, nil, suite.config)
+	suite.certificateService = NewCertificateService(db, suite.config, suite.tunnelService)
+	suite.tunnelService.SetCertificateService(suite.certificateService)
+}
+
+func (suite *CertificateServiceTestSuite) newTunnel(source models.CertificateSource) *models.Tunnel {
+	return &models.Tunnel{
+		ID:       uuid.New(),
+		Name:     "secure-tunnel",
+		Protocol: models.ProtocolWSS,
+		ServerIP: "203.0.113.10",
+		// The internal CA only signs the tunnel's own names
+		Hostnames: []string{"*.example.com"},
+		TLSConfig: models.TLSConfig{
+			CertSource: source,
+			Domain:     "tunnel.example.com",
+		},
+	}
+}
+
+func (suite *CertificateServiceTestSuite) TestSealKeyRoundTrip() {
+	sealed, err := suite.certificateService.sealKey([]byte("private key"))
+	suite.Require().NoError(err)
+	suite.NotContains(string(sealed), "private key")
+
+	opened, err := suite.certificateService.openKey(sealed)
+	suite.Require().NoError(err)
+	suite.Equal("private key", string(opened))
+
+	// A different key cannot open it
+	suite.config.Certificates.EncryptionKey = "YW5vdGhlci1lbmNyeXB0aW9uLWtleS0wMTIzNDU2Nzg="
+	_, err = suite.certificateService.openKey(sealed)
+	suite.Error(err)
+}
+
+func (suite *CertificateServiceTestSuite) TestInternalCertificate() {
+	tunnel := suite.newTunnel(models.CertificateSourceInternal)
+
+	certPEM, keyPEM, err := suite.certificateService.TunnelCertificate(context.Background(), tunnel)
+	suite.Require().NoError(err)
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	suite.Require().NoError(err)
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	suite.Require().NoError(err)
+	suite.Equal([]string{"tunnel.example.com"}, leaf.DNSNames)
+	suite.Equal("203.0.113.10", leaf.IPAddresses[0].String())
+
+	// The certificate verifies against the CA served to clients
+	caPEM, err := suite.certificateService.CACertificate()
+	suite.Require().NoError(err)
+	roots := x509.NewCertPool()
+	suite.Require().True(roots.AppendCertsFromPEM(caPEM))
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "tunnel.example.com", Roots: roots})
+	suite.NoError(err)
+
+	// The stored key is encrypted
+	stored, err := suite.certificateService.GetTunnelCertificate(tunnel.ID)
+	suite.Require().NoError(err)
+	suite.NotContains(string(stored.KeyData), "PRIVATE KEY")
+
+	// A valid stored certificate is reused, a new domain gets a new one
+	again, _, err := suite.certificateService.TunnelCertificate(context.Background(), tunnel)
+	suite.Require().NoError(err)
+	suite.Equal(certPEM, again)
+
+	tunnel.TLSConfig.Domain = "other.example.com"
+	changed, _, err := suite.certificateService.TunnelCertificate(context.Background(), tunnel)
+	suite.Require().NoError(err)
+	suite.NotEqual(certPEM, changed)
+}
+
+func (suite *CertificateServiceTestSuite) TestCAIsPersisted() {
+	caPEM, err := suite.certificateService.CACertificate()
+	suite.Require().NoError(err)
+
+	// A restarted backend loads the same CA
+	restarted := NewCertificateService(suite.db, suite.config, suite.tunnelService)
+	again, err := restarted.CACertificate()
+	suite.Require().NoError(err)
+	suite.Equal(caPEM, again)
+}
+
+func (suite *CertificateServiceTestSuite) TestRenewDueDropsOrphanedCertificates() {
+	// Only the columns the lookup reads, the tunnel is never stored, as if
+	// it had been deleted
+	suite.Require().NoError(suite.db.Exec("CREATE TABLE tunnels (id TEXT PRIMARY KEY, deleted_at DATETIME)").Error)
+	tunnel := suite.newTunnel(models.CertificateSourceInternal)
+	_, _, err := suite.certificateService.TunnelCertificate(context.Background(), tunnel)
+	suite.Require().NoError(err)
+
+	// Make the certificate due for renewal
+	suite.config.Certificates.RenewBefore = 24 * 365 * time.Hour
+	suite.certificateService.renewDue(context.Background())
+
+	_, err = suite.certificateService.GetTunnelCertificate(tunnel.ID)
+	suite.Error(err)
+}
+
+func (suite *CertificateServiceTestSuite) TestRenewDueKeepsCertificatesOnLookupErrors() {
+	// Without a tunnels table every lookup fails, as a database outage would
+	tunnel := suite.newTunnel(models.CertificateSourceInternal)
+	_, _, err := suite.certificateService.TunnelCertificate(context.Background(), tunnel)
+	suite.Require().NoError(err)
+
+	suite.config.Certificates.RenewBefore = 24 * 365 * time.Hour
+	suite.certificateService.renewDue(context.Background())
+
+	_, err = suite.certificateService.GetTunnelCertificate(tunnel.ID)
+	suite.NoError(err)
+}
+
+func (suite *CertificateServiceTestSuite) TestRejectsWeakEncryptionKey() {
+	suite.config.Certificates.EncryptionKey = "a passphrase"
+
+	_, err := suite.certificateService.sealKey([]byte("private key"))
+	suite.Error(err)
+}
+
+func (suite *CertificateServiceTestSuite) TestDisabledWithoutEncryptionKey() {
+	suite.config.Certificates.EncryptionKey = ""
+
+	_, _, err := suite.certificateService.TunnelCertificate(context.Background(), suite.newTunnel(models.CertificateSourceInternal))
+	suite.ErrorIs(err, errCertificatesDisabled)
+}
+
+// TestACMEWithPebble obtains a certificate from a local Pebble instance,
+// started with PEBBLE_VA_ALWAYS_VALID=1, for example:
+//
+//	ACME_TEST_DIRECTORY=https://localhost:14000/dir ACME_TEST_ROOT_CA=pebble.minica.pem go test ./internal/services
+func (suite *CertificateServiceTestSuite) TestACMEWithPebble() {
+	directory := os.Getenv("ACME_TEST_DIRECTORY")
+	if directory == "" {
+		suite.T().Skip("ACME_TEST_DIRECTORY is not set")
+	}
+
+	suite.config.Certificates.ACME = config.ACMEConfig{
+		Enabled:      true,
+		DirectoryURL: directory,
+		Email:        "admin@example.com",
+		Challenge:    "http-01",
+		HTTPAddr:     "127.0.0.1:5002",
+		RootCAFile:   os.Getenv("ACME_TEST_ROOT_CA"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	suite.Require().NoError(suite.certificateService.Start(ctx))
+
+	tunnel := suite.newTunnel(models.CertificateSourceACME)
+	certPEM, keyPEM, err := suite.certificateService.TunnelCertificate(ctx, tunnel)
+	suite.Require().NoError(err)
+
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	suite.NoError(err)
+}
+
+func TestCertificateServiceTestSuite(t *testing.T) {
+	suite.Run(t, new(CertificateServiceTestSuite))
+}
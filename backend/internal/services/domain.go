@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"utunnel-pro/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Custom domains
+//
+// A host name outside the user's own zone needs a custom domain the user has
+// verified. Claiming a domain hands out a random token, which the user puts
+// in a TXT record at _stunnel-challenge.<domain>; verifying looks the record
+// up and, when it holds the token, lets the user's HTTP tunnels take the
+// domain and every name below it.
+
+// domainLookupTimeout bounds the DNS lookup of a verification
+const domainLookupTimeout = 10 * time.Second
+
+// ClaimDomain starts the verification of a custom domain for a user, or
+// returns the user's claim of it if there is one
+func (s *TunnelService) ClaimDomain(userID uuid.UUID, name string) (*models.Domain, error) {
+	var user models.User
+	if err := s.db.First(&user, "id = ?", userID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	if !user.Limits.CanUseCustomDomains {
+		return nil, fmt.Errorf("your plan does not include custom domains")
+	}
+
+	host, err := normalizeHostname(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(host, "*.") {
+		return nil, fmt.Errorf("claim %s without the wildcard", strings.TrimPrefix(host, "*."))
+	}
+	if base := strings.ToLower(strings.TrimSuffix(s.config.Tunnels.HTTP.BaseDomain, ".")); base != "" && inDomain(host, base) {
+		return nil, fmt.Errorf("%s is not a custom domain", host)
+	}
+
+	var domain models.Domain
+	if err := s.db.Where("user_id = ? AND name = ?", userID, host).First(&domain).Error; err == nil {
+		return &domain, nil
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate domain token: %w", err)
+	}
+	domain = models.Domain{UserID: userID, Name: host, Token: hex.EncodeToString(token)}
+	if err := s.db.Create(&domain).Error; err != nil {
+		return nil, fmt.Errorf("failed to claim domain: %w", err)
+	}
+	return &domain, nil
+}
+
+// VerifyDomain checks the TXT record of a user's claimed domain and marks the
+// domain verified when the record holds its token
+func (s *TunnelService) VerifyDomain(userID, id uuid.UUID) (*models.Domain, error) {
+	var domain models.Domain
+	if err := s.db.First(&domain, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		return nil, fmt.Errorf("domain not found: %w", err)
+	}
+	if domain.IsVerified() {
+		return &domain, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), domainLookupTimeout)
+	defer cancel()
+	records, err := s.lookupTXT(ctx, domain.ChallengeName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", domain.ChallengeName(), err)
+	}
+	found := false
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.Token {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no TXT record at %s holds the domain's token", domain.ChallengeName())
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&domain).Update("verified_at", &now).Error; err != nil {
+		return nil, fmt.Errorf("failed to verify domain: %w", err)
+	}
+	domain.VerifiedAt = &now
+
+	log.Printf("Domain verified: %s (user %s)", domain.Name, userID)
+	return &domain, nil
+}
+
+// GetDomains returns the custom domains a user has claimed
+func (s *TunnelService) GetDomains(userID uuid.UUID) ([]models.Domain, error) {
+	var domains []models.Domain
+	if err := s.db.Where("user_id = ?", userID).Order("name").Find(&domains).Error; err != nil {
+		return nil, fmt.Errorf("failed to get domains: %w", err)
+	}
+	return domains, nil
+}
+
+// DeleteDomain drops a user's claim of a domain. Host names already assigned
+// from it stay until their tunnels are updated.
+func (s *TunnelService) DeleteDomain(userID, id uuid.UUID) error {
+	result := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Domain{})
+	if result.Error != nil {
+		return fmt.Errorf("failed to delete domain: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("domain not found")
+	}
+	return nil
+}
+
+// verifiedDomains returns the names of a user's verified custom domains
+func (s *TunnelService) verifiedDomains(userID uuid.UUID) ([]string, error) {
+	var names []string
+	if err := s.db.Model(&models.Domain{}).Where("user_id = ? AND verified_at IS NOT NULL", userID).
+		Pluck("name", &names).Error; err != nil {
+		return nil, fmt.Errorf("failed to load verified domains: %w", err)
+	}
+	return names, nil
+}
@@ -23,6 +23,7 @@ type MonitoringService struct {
 	db          *gorm.DB
 	redis       *redis.Client
 	config      *config.Config
+	tunnels     *TunnelService
 	clients     map[string]*websocket.Conn
 	clientsMux  sync.RWMutex
 	tunnelStats map[string]*TunnelStats
@@ -50,6 +51,9 @@ type TunnelStats struct {
 	MemoryUsage     int64     `json:"memory_usage"`
 	ErrorCount      int       `json:"error_count"`
 	Timestamp       time.Time `json:"timestamp"`
+
+	// Sessions are the tunnel's open mux sessions
+	Sessions []TunnelSessionStats `json:"sessions,omitempty"`
 }
 
 // AlertRule represents monitoring alert rules
@@ -80,7 +84,7 @@ type Alert struct {
 }
 
 // NewMonitoringService creates a new monitoring service
-func NewMonitoringService(db *gorm.DB, redis *redis.Client, config *config.Config) *MonitoringService {
+func NewMonitoringService(db *gorm.DB, redis *redis.Client, config *config.Config, tunnels *TunnelService) *MonitoringService {
 	// Initialize Prometheus metrics
 	tunnelConnections := promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "utunnel_active_connections_total",
@@ -112,6 +116,7 @@ func NewMonitoringService(db *gorm.DB, redis *redis.Client, config *config.Confi
 		db:                db,
 		redis:             redis,
 		config:            config,
+		tunnels:           tunnels,
 		clients:           make(map[string]*websocket.Conn),
 		tunnelStats:       make(map[string]*TunnelStats),
 		tunnelConnections: tunnelConnections,
@@ -165,13 +170,21 @@ func (m *MonitoringService) UpdateTunnelStats(stats *TunnelStats) {
 	defer m.statsMux.Unlock()
 	
 	stats.Timestamp = time.Now()
+	previous := m.tunnelStats[stats.TunnelID]
+	if previous == nil {
+		previous = &TunnelStats{}
+	}
 	m.tunnelStats[stats.TunnelID] = stats
 	
-	// Update Prometheus metrics
-	m.tunnelConnections.Set(float64(stats.ConnectionCount))
-	m.tunnelBandwidth.WithLabelValues(stats.TunnelID, "in").Add(float64(stats.BytesIn))
-	m.tunnelBandwidth.WithLabelValues(stats.TunnelID, "out").Add(float64(stats.BytesOut))
-	m.tunnelLatency.WithLabelValues(stats.TunnelID).Observe(stats.Latency / 1000) // Convert to seconds
+	// Update Prometheus metrics, counters only take what changed since the
+	// last update since the tunnel reports totals
+	m.tunnelConnections.Set(float64(m.activeConnections()))
+	m.tunnelBandwidth.WithLabelValues(stats.TunnelID, "in").Add(float64(counterDelta(previous.BytesIn, stats.BytesIn)))
+	m.tunnelBandwidth.WithLabelValues(stats.TunnelID, "out").Add(float64(counterDelta(previous.BytesOut, stats.BytesOut)))
+	m.tunnelErrors.WithLabelValues(stats.TunnelID, "connection").Add(float64(counterDelta(int64(previous.ErrorCount), int64(stats.ErrorCount))))
+	if stats.IsOnline && stats.Latency > 0 {
+		m.tunnelLatency.WithLabelValues(stats.TunnelID).Observe(stats.Latency / 1000) // Convert to seconds
+	}
 	
 	if stats.IsOnline {
 		m.tunnelUptime.WithLabelValues(stats.TunnelID).SetToCurrentTime()
@@ -276,24 +289,68 @@ func (m *MonitoringService) collectSystemMetrics() {
 	var tunnels []models.Tunnel
 	m.db.Where("status = ?", models.TunnelStatusActive).Find(&tunnels)
 	
+	active := make(map[string]bool, len(tunnels))
 	for _, tunnel := range tunnels {
-		// Simulate metric collection (in real implementation, this would collect actual metrics)
+		active[tunnel.ID.String()] = true
 		stats := &TunnelStats{
-			TunnelID:        tunnel.ID.String(),
-			Status:          string(tunnel.Status),
-			IsOnline:        tunnel.Status == models.TunnelStatusActive,
-			LastPing:        time.Now(),
-			ConnectionCount: tunnel.ConnectionCount,
-			BytesIn:         tunnel.BytesIn,
-			BytesOut:        tunnel.BytesOut,
-			Latency:         float64(time.Now().UnixNano()%100) + 10, // Simulated latency
-			CPUUsage:        float64(time.Now().UnixNano()%50) + 10,  // Simulated CPU usage
-			MemoryUsage:     int64(time.Now().UnixNano()%1000000) + 1000000, // Simulated memory usage
-			ErrorCount:      0,
+			TunnelID: tunnel.ID.String(),
+			Status:   string(tunnel.Status),
+			BytesIn:  tunnel.BytesIn,
+			BytesOut: tunnel.BytesOut,
+		}
+
+		// Tunnels without a running process are reported offline
+		if metrics, ok := m.tunnels.GetTunnelMetrics(tunnel.ID.String()); ok {
+			stats.IsOnline = true
+			stats.LastPing = metrics.LastUpdated
+			stats.ConnectionCount = metrics.ActiveConnections
+			stats.BytesIn = metrics.BytesIn
+			stats.BytesOut = metrics.BytesOut
+			stats.Latency = metrics.Latency
+			stats.CPUUsage = metrics.CPUUsage
+			stats.MemoryUsage = metrics.MemoryUsage
+			stats.ErrorCount = metrics.ErrorCount
+			stats.Sessions = metrics.Sessions
 		}
 		
 		m.UpdateTunnelStats(stats)
 	}
+
+	m.forgetInactiveTunnels(active)
+}
+
+// forgetInactiveTunnels drops the stats of tunnels that stopped so they no
+// longer count towards the gauges
+func (m *MonitoringService) forgetInactiveTunnels(active map[string]bool) {
+	m.statsMux.Lock()
+	defer m.statsMux.Unlock()
+
+	for tunnelID := range m.tunnelStats {
+		if !active[tunnelID] {
+			delete(m.tunnelStats, tunnelID)
+			m.tunnelUptime.DeleteLabelValues(tunnelID)
+		}
+	}
+	m.tunnelConnections.Set(float64(m.activeConnections()))
+}
+
+// activeConnections sums the open connections of all tunnels, callers hold
+// statsMux
+func (m *MonitoringService) activeConnections() int {
+	total := 0
+	for _, stats := range m.tunnelStats {
+		total += stats.ConnectionCount
+	}
+	return total
+}
+
+// counterDelta returns how much a reported total grew, treating a smaller
+// total as a restarted tunnel process that counts from zero
+func counterDelta(previous, current int64) int64 {
+	if current < previous {
+		return current
+	}
+	return current - previous
 }
 
 func (m *MonitoringService) processAlerts(ctx context.Context) {
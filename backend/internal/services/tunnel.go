@@ -5,8 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"utunnel-pro/internal/models"
@@ -17,6 +22,10 @@ import (
 	"gorm.io/gorm"
 )
 
+// drainKillMargin is how long a stopped tunnel's process gets past its
+// drain timeout to exit before it is killed
+const drainKillMargin = 5 * time.Second
+
 // TunnelService handles tunnel operations
 type TunnelService struct {
 	db          *gorm.DB
@@ -24,6 +33,15 @@ type TunnelService struct {
 	config      *config.Config
 	activeTunnels map[string]*TunnelProcess
 	tunnelsMux    sync.RWMutex
+
+	// Issues the certificates of tunnels whose CertSource is managed
+	certificates *CertificateService
+
+	// Shared router of HTTP tunnels, nil until one starts. Guarded by tunnelsMux.
+	httpRouter *exec.Cmd
+
+	// Looks up the TXT records that verify custom domains
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
 }
 
 // TunnelProcess represents an active tunnel process
@@ -36,18 +54,39 @@ type TunnelProcess struct {
 	LastPing    time.Time
 	Metrics     *TunnelMetrics
 	StopChannel chan bool
+
+	// Closed once the process has exited
+	exited chan struct{}
+
+	// Where the router sends an HTTP tunnel's requests, empty for others
+	HTTPAddr string
+
+	// Number of the last dynamic destination written to the tunnel's logs
+	lastDestination uint64
 }
 
-// TunnelMetrics represents tunnel performance metrics
+// TunnelMetrics represents tunnel performance metrics, as last read from the
+// tunnel process's control endpoint
 type TunnelMetrics struct {
-	BytesIn         int64   `json:"bytes_in"`
-	BytesOut        int64   `json:"bytes_out"`
-	ConnectionCount int     `json:"connection_count"`
-	Latency         float64 `json:"latency"`
-	CPUUsage        float64 `json:"cpu_usage"`
-	MemoryUsage     int64   `json:"memory_usage"`
-	ErrorCount      int     `json:"error_count"`
-	LastUpdated     time.Time `json:"last_updated"`
+	BytesIn           int64                `json:"bytes_in"`
+	BytesOut          int64                `json:"bytes_out"`
+	ConnectionCount   int                  `json:"connection_count"`
+	ActiveConnections int                  `json:"active_connections"`
+	Latency           float64              `json:"latency"`   // average session RTT in milliseconds
+	CPUUsage          float64              `json:"cpu_usage"` // percent of one core since the last poll
+	CPUSeconds        float64              `json:"cpu_seconds"`
+	MemoryUsage       int64                `json:"memory_usage"`
+	ErrorCount        int                  `json:"error_count"`
+	Reconnects        int64                `json:"reconnects"`
+	ResumedStreams    int64                `json:"resumed_streams"`
+	OrphanedStreams   int64                `json:"orphaned_streams"`
+	UncompressedBytes int64                `json:"uncompressed_bytes"`
+	CompressedBytes   int64                `json:"compressed_bytes"`
+	CompressionRatio  float64              `json:"compression_ratio"`
+	CompressionSaved  int64                `json:"compression_saved_bytes"`
+	Sessions          []TunnelSessionStats `json:"sessions"`
+	Targets           []TunnelTargetPool   `json:"targets,omitempty"`
+	LastUpdated       time.Time            `json:"last_updated"`
 }
 
 // NewTunnelService creates a new tunnel service
@@ -57,15 +96,30 @@ func NewTunnelService(db *gorm.DB, redis *redis.Client, config *config.Config) *
 		redis:         redis,
 		config:        config,
 		activeTunnels: make(map[string]*TunnelProcess),
+		lookupTXT:     net.DefaultResolver.LookupTXT,
 	}
 }
 
+// SetCertificateService lets tunnels use certificates the backend manages
+func (s *TunnelService) SetCertificateService(certificates *CertificateService) {
+	s.certificates = certificates
+}
+
 // CreateTunnel creates a new tunnel
 func (s *TunnelService) CreateTunnel(tunnel *models.Tunnel) (*models.Tunnel, error) {
 	// Validate tunnel configuration
 	if err := s.validateTunnelConfig(tunnel); err != nil {
 		return nil, fmt.Errorf("invalid tunnel configuration: %w", err)
 	}
+	if err := s.AssignHostnames(tunnel); err != nil {
+		return nil, fmt.Errorf("invalid host names: %w", err)
+	}
+	if err := s.checkTLSDomain(tunnel); err != nil {
+		return nil, err
+	}
+	if err := s.checkServerAddress(s.db, tunnel); err != nil {
+		return nil, err
+	}
 
 	// Check if tunnel name already exists for this user
 	var existingTunnel models.Tunnel
@@ -126,22 +180,43 @@ func (s *TunnelService) UpdateTunnel(id uuid.UUID, updates map[string]interface{
 		return nil, fmt.Errorf("tunnel not found: %w", err)
 	}
 
-	// Stop tunnel if it's running
-	if tunnel.Status == models.TunnelStatusActive {
-		if err := s.StopTunnel(id); err != nil {
-			log.Printf("Warning: failed to stop tunnel before update: %v", err)
-		}
-	}
+	running := tunnel.Status == models.TunnelStatusActive
 
-	// Update tunnel
-	if err := s.db.Model(&tunnel).Updates(updates).Error; err != nil {
-		return nil, fmt.Errorf("failed to update tunnel: %w", err)
+	// The updated tunnel is checked as a new one would be before it is kept
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&tunnel).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update tunnel: %w", err)
+		}
+		if err := tx.First(&tunnel, "id = ?", id).Error; err != nil {
+			return fmt.Errorf("failed to reload tunnel: %w", err)
+		}
+		if err := s.validateTunnelConfig(&tunnel); err != nil {
+			return fmt.Errorf("invalid tunnel configuration: %w", err)
+		}
+		if err := s.checkTLSDomain(&tunnel); err != nil {
+			return err
+		}
+		var existing models.Tunnel
+		if err := tx.Where("name = ? AND user_id = ? AND id <> ?", tunnel.Name, tunnel.UserID, tunnel.ID).First(&existing).Error; err == nil {
+			return fmt.Errorf("tunnel with name '%s' already exists", tunnel.Name)
+		}
+		return s.checkServerAddress(tx, &tunnel)
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	// Update cache
 	tunnelJSON, _ := json.Marshal(&tunnel)
 	s.redis.Set(context.Background(), fmt.Sprintf("tunnel:config:%s", tunnel.ID), tunnelJSON, 0)
 
+	// A running tunnel carries on with its new settings in a new process
+	if running {
+		if err := s.RestartTunnel(id); err != nil {
+			log.Printf("Warning: failed to restart tunnel after update: %v", err)
+		}
+	}
+
 	log.Printf("Tunnel updated: %s (%s)", tunnel.Name, tunnel.ID)
 	return &tunnel, nil
 }
@@ -168,6 +243,18 @@ func (s *TunnelService) DeleteTunnel(id uuid.UUID) error {
 	// Remove from cache
 	s.redis.Del(context.Background(), fmt.Sprintf("tunnel:config:%s", tunnel.ID))
 
+	// Remove the stunnel-core config file, it holds the token
+	if err := os.Remove(s.tunnelConfigPath(&tunnel)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove tunnel config file: %v", err)
+	}
+	os.Remove(s.tunnelControlPath(&tunnel))
+
+	// Managed certificates are never reused by another tunnel
+	certFile, keyFile := s.tunnelCertPaths(&tunnel)
+	os.Remove(certFile)
+	os.Remove(keyFile)
+	s.db.Where("kind = ? AND tunnel_id = ?", models.CertificateKindTunnel, tunnel.ID).Delete(&models.Certificate{})
+
 	log.Printf("Tunnel deleted: %s (%s)", tunnel.Name, tunnel.ID)
 	return nil
 }
@@ -179,12 +266,51 @@ func (s *TunnelService) StartTunnel(id uuid.UUID) error {
 		return err
 	}
 
+	// Issuing a certificate may take a while for ACME, so it happens unlocked
+	if err := s.prepareTunnelCertificate(context.Background(), tunnel); err != nil {
+		return fmt.Errorf("failed to prepare tunnel certificate: %w", err)
+	}
+
+	return s.startTunnel(tunnel, nil)
+}
+
+// RestartTunnel moves a running tunnel onto a new process with its current
+// settings. Every process opens its sockets with SO_REUSEPORT, and no other
+// tunnel may use its addresses, so the new process accepts alongside the old
+// one, which then drains.
+func (s *TunnelService) RestartTunnel(id uuid.UUID) error {
+	tunnel, err := s.GetTunnelByID(id)
+	if err != nil {
+		return err
+	}
+	if err := s.prepareTunnelCertificate(context.Background(), tunnel); err != nil {
+		return fmt.Errorf("failed to prepare tunnel certificate: %w", err)
+	}
+
+	s.tunnelsMux.RLock()
+	old, exists := s.activeTunnels[tunnel.ID.String()]
+	s.tunnelsMux.RUnlock()
+	if !exists {
+		return fmt.Errorf("tunnel is not running")
+	}
+	return s.startTunnel(tunnel, old)
+}
+
+// startTunnel starts a tunnel's process in place of replace, which then
+// drains, or of none when replace is nil
+func (s *TunnelService) startTunnel(tunnel *models.Tunnel, replace *TunnelProcess) error {
 	s.tunnelsMux.Lock()
 	defer s.tunnelsMux.Unlock()
 
 	// Check if tunnel is already running
-	if _, exists := s.activeTunnels[tunnel.ID.String()]; exists {
-		return fmt.Errorf("tunnel is already running")
+	if s.activeTunnels[tunnel.ID.String()] != replace {
+		if replace == nil {
+			return fmt.Errorf("tunnel is already running")
+		}
+		return fmt.Errorf("tunnel was stopped or restarted meanwhile")
+	}
+	if err := s.checkServerAddress(s.db, tunnel); err != nil {
+		return err
 	}
 
 	// Create tunnel process
@@ -197,17 +323,33 @@ func (s *TunnelService) StartTunnel(id uuid.UUID) error {
 	if err := process.Process.Start(); err != nil {
 		return fmt.Errorf("failed to start tunnel process: %w", err)
 	}
+	go func() {
+		process.Process.Wait()
+		close(process.exited)
+	}()
+	if replace != nil {
+		s.drainProcess(replace)
+	}
 
 	// Update tunnel status
 	s.db.Model(tunnel).Update("status", models.TunnelStatusActive)
 
 	// Store active tunnel
 	s.activeTunnels[tunnel.ID.String()] = process
+	if process.HTTPAddr != "" || (replace != nil && replace.HTTPAddr != "") {
+		if err := s.syncHTTPRouter(); err != nil {
+			log.Printf("Warning: failed to route tunnel %s: %v", tunnel.ID, err)
+		}
+	}
 
 	// Start monitoring
 	go s.monitorTunnel(process)
 
-	log.Printf("Tunnel started: %s (%s)", tunnel.Name, tunnel.ID)
+	if replace != nil {
+		log.Printf("Tunnel restarted: %s (%s)", tunnel.Name, tunnel.ID)
+	} else {
+		log.Printf("Tunnel started: %s (%s)", tunnel.Name, tunnel.ID)
+	}
 	return nil
 }
 
@@ -227,26 +369,54 @@ func (s *TunnelService) StopTunnel(id uuid.UUID) error {
 		return fmt.Errorf("tunnel is not running")
 	}
 
-	// Stop the process
-	if process.Process != nil && process.Process.Process != nil {
-		if err := process.Process.Process.Kill(); err != nil {
-			log.Printf("Warning: failed to kill tunnel process: %v", err)
-		}
-	}
-
-	// Signal stop
-	close(process.StopChannel)
+	// Stop the process, letting it drain its connections
+	s.drainProcess(process)
 
 	// Update tunnel status
 	s.db.Model(tunnel).Update("status", models.TunnelStatusInactive)
 
 	// Remove from active tunnels
 	delete(s.activeTunnels, tunnel.ID.String())
+	if process.HTTPAddr != "" {
+		if err := s.syncHTTPRouter(); err != nil {
+			log.Printf("Warning: failed to unroute tunnel %s: %v", tunnel.ID, err)
+		}
+	}
 
 	log.Printf("Tunnel stopped: %s (%s)", tunnel.Name, tunnel.ID)
 	return nil
 }
 
+// drainProcess sends a tunnel's process SIGTERM so it drains its connections,
+// and stops monitoring it
+func (s *TunnelService) drainProcess(process *TunnelProcess) {
+	if process.Process != nil && process.Process.Process != nil {
+		if err := process.Process.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("Warning: failed to signal tunnel process: %v", err)
+		}
+		go s.killAfterDrain(process)
+	}
+
+	// Signal stop
+	close(process.StopChannel)
+}
+
+// killAfterDrain kills a stopped tunnel's process if it is still running
+// once its connections had time to drain
+func (s *TunnelService) killAfterDrain(process *TunnelProcess) {
+	timer := time.NewTimer(s.config.Tunnels.DrainTimeout + drainKillMargin)
+	defer timer.Stop()
+
+	select {
+	case <-process.exited:
+	case <-timer.C:
+		log.Printf("Tunnel process did not exit after draining, killing it: %s", process.ID)
+		if err := process.Process.Process.Kill(); err != nil {
+			log.Printf("Warning: failed to kill tunnel process: %v", err)
+		}
+	}
+}
+
 // GetTunnelStatus returns tunnel status and last ping
 func (s *TunnelService) GetTunnelStatus(id uuid.UUID) (bool, *time.Time) {
 	s.tunnelsMux.RLock()
@@ -284,6 +454,62 @@ func (s *TunnelService) GetPerformanceMetrics(id uuid.UUID) (*PerformanceMetrics
 	return nil, fmt.Errorf("tunnel not running or metrics not available")
 }
 
+// TunnelTargets is the target pool membership of a tunnel and, while it
+// runs, the health of the members its process last reported
+type TunnelTargets struct {
+	Strategy    models.LoadBalanceStrategy `json:"strategy"`
+	HealthCheck models.HealthCheckType     `json:"health_check"`
+	Running     bool                       `json:"running"`
+	Pools       []TunnelTargetPool         `json:"pools"`
+	LastUpdated *time.Time                 `json:"last_updated,omitempty"`
+}
+
+// GetTunnelTargets returns the target pools of a tunnel. Until its process
+// reports them, the configured members are listed without health.
+func (s *TunnelService) GetTunnelTargets(tunnel *models.Tunnel) *TunnelTargets {
+	lb := tunnel.LoadBalancing
+	targets := &TunnelTargets{Strategy: lb.Strategy, HealthCheck: lb.HealthCheck}
+	if targets.Strategy == "" {
+		targets.Strategy = models.BalanceRoundRobin
+	}
+
+	s.tunnelsMux.RLock()
+	process, running := s.activeTunnels[tunnel.ID.String()]
+	if running && process.Metrics != nil {
+		targets.Pools = process.Metrics.Targets
+		updated := process.Metrics.LastUpdated
+		targets.LastUpdated = &updated
+	}
+	s.tunnelsMux.RUnlock()
+	targets.Running = running
+
+	if targets.Pools != nil {
+		return targets
+	}
+
+	pool := TunnelTargetPool{Target: tunnel.TargetSpec(), Balance: string(targets.Strategy)}
+	pool.Members = append(pool.Members, TunnelTargetMember{
+		Address: net.JoinHostPort(tunnel.TargetIP, strconv.Itoa(tunnel.TargetPort)),
+		Weight:  targetWeight(lb.TargetWeight),
+	})
+	for _, target := range lb.Targets {
+		pool.Members = append(pool.Members, TunnelTargetMember{
+			Address: net.JoinHostPort(target.IP, strconv.Itoa(target.Port)),
+			Weight:  targetWeight(target.Weight),
+		})
+	}
+	targets.Pools = []TunnelTargetPool{pool}
+	return targets
+}
+
+// targetWeight returns the weight stunnel-core gives a target, 1 when unset
+func targetWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
 // PerformanceMetrics represents tunnel performance data
 type PerformanceMetrics struct {
 	AvgLatency        float64 `json:"avg_latency"`
@@ -299,6 +525,9 @@ func (s *TunnelService) validateTunnelConfig(tunnel *models.Tunnel) error {
 	if tunnel.Name == "" {
 		return fmt.Errorf("tunnel name is required")
 	}
+	if !tunnel.Protocol.IsValid() {
+		return fmt.Errorf("unsupported protocol: %s", tunnel.Protocol)
+	}
 	if tunnel.ServerIP == "" {
 		return fmt.Errorf("server IP is required")
 	}
@@ -311,44 +540,140 @@ func (s *TunnelService) validateTunnelConfig(tunnel *models.Tunnel) error {
 	if tunnel.TargetPort <= 0 || tunnel.TargetPort > 65535 {
 		return fmt.Errorf("invalid target port")
 	}
+	for i, mapping := range tunnel.PortMappings {
+		if err := mapping.Validate(); err != nil {
+			return fmt.Errorf("port mapping %d: %w", i+1, err)
+		}
+	}
+	if err := tunnel.TLSConfig.Validate(tunnel.Protocol); err != nil {
+		return fmt.Errorf("invalid TLS config: %w", err)
+	}
+	if err := tunnel.LoadBalancing.Validate(tunnel.Protocol); err != nil {
+		return fmt.Errorf("invalid load balancing config: %w", err)
+	}
+	if !tunnel.ProxyProtocol.IsValid() {
+		return fmt.Errorf("unsupported PROXY protocol version %q", tunnel.ProxyProtocol)
+	}
+	if tunnel.ProxyProtocol != models.ProxyProtocolNone && tunnel.Protocol.ForwardsUDP() {
+		return fmt.Errorf("PROXY protocol headers are only sent to TCP targets")
+	}
+	if !tunnel.Compression.IsValid() {
+		return fmt.Errorf("unsupported compression %q", tunnel.Compression)
+	}
+	if tunnel.Compression != models.CompressionNone && tunnel.Protocol == models.ProtocolUDP {
+		return fmt.Errorf("the udp protocol has no links to compress")
+	}
+	if tunnel.Path != "" && !tunnel.Protocol.IsHTTP() {
+		return fmt.Errorf("only WebSocket, h2 and grpc links are requested on a path, got %s", tunnel.Protocol)
+	}
+	if tunnel.Path != "" && !strings.HasPrefix(tunnel.Path, "/") {
+		return fmt.Errorf("invalid path %q, it must start with /", tunnel.Path)
+	}
+	switch tunnel.Path {
+	case "/", "/health", "/stats":
+		return fmt.Errorf("invalid path %q, it is reserved", tunnel.Path)
+	}
+	if err := s.ValidateDecoy(tunnel.Protocol, tunnel.Decoy); err != nil {
+		return err
+	}
+	if err := tunnel.DynamicForwarding.Validate(tunnel.Protocol); err != nil {
+		return fmt.Errorf("invalid dynamic forwarding config: %w", err)
+	}
+	if tunnel.DynamicForwarding.Enabled && tunnel.HTTPRouting {
+		return fmt.Errorf("HTTP tunnels cannot take dynamic clients")
+	}
+	return nil
+}
+
+// checkServerAddress makes sure no port a tunnel listens on, its server port
+// or one of its port mappings, is taken by another tunnel of any user or by
+// the HTTP router, where an unspecified IP takes a port on every address
+func (s *TunnelService) checkServerAddress(db *gorm.DB, tunnel *models.Tunnel) error {
+	spans := tunnel.ListenPorts()
+
+	if routing := s.config.Tunnels.HTTP; routing.Enabled {
+		for _, addr := range []string{routing.HTTPListen, routing.HTTPSListen} {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				continue
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil || !sharesAddress(host, tunnel.ServerIP) {
+				continue
+			}
+			if conflict, ok := overlappingPort(spans, []models.PortSpan{{First: port, Last: port}}); ok {
+				return fmt.Errorf("server address %s is taken by the HTTP router",
+					net.JoinHostPort(tunnel.ServerIP, strconv.Itoa(conflict)))
+			}
+		}
+	}
+
+	var others []models.Tunnel
+	if err := db.Select("id", "server_ip", "server_port", "port_mappings").
+		Where("id <> ?", tunnel.ID).Find(&others).Error; err != nil {
+		return fmt.Errorf("failed to check server address: %w", err)
+	}
+	for i := range others {
+		if !sharesAddress(others[i].ServerIP, tunnel.ServerIP) {
+			continue
+		}
+		if conflict, ok := overlappingPort(spans, others[i].ListenPorts()); ok {
+			return fmt.Errorf("server address %s is already in use",
+				net.JoinHostPort(tunnel.ServerIP, strconv.Itoa(conflict)))
+		}
+	}
 	return nil
 }
 
+// sharesAddress reports whether listening on two IPs can collide, which is
+// when they are the same or either is unspecified
+func sharesAddress(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if a == "" || b == "" || (ipA != nil && ipA.IsUnspecified()) || (ipB != nil && ipB.IsUnspecified()) {
+		return true
+	}
+	if ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// overlappingPort returns the first port both lists of spans contain
+func overlappingPort(a, b []models.PortSpan) (int, bool) {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Overlaps(y) {
+				return max(x.First, y.First), true
+			}
+		}
+	}
+	return 0, false
+}
+
 func (s *TunnelService) createTunnelProcess(tunnel *models.Tunnel) (*TunnelProcess, error) {
-	// Build command based on protocol
-	var cmd *exec.Cmd
-	
-	switch tunnel.Protocol {
-	case models.ProtocolTCP:
-		cmd = exec.Command("stunnel-core",
-			"--mode", "server",
-			"--protocol", "tcp",
-			"--listen", fmt.Sprintf("%s:%d", tunnel.ServerIP, tunnel.ServerPort),
-			"--target", fmt.Sprintf("%s:%d", tunnel.TargetIP, tunnel.TargetPort),
-			"--token", tunnel.Token,
-		)
-	case models.ProtocolUDP:
-		cmd = exec.Command("stunnel-core",
-			"--mode", "server",
-			"--protocol", "udp",
-			"--listen", fmt.Sprintf("%s:%d", tunnel.ServerIP, tunnel.ServerPort),
-			"--target", fmt.Sprintf("%s:%d", tunnel.TargetIP, tunnel.TargetPort),
-			"--token", tunnel.Token,
-		)
-	case models.ProtocolWSS:
-		cmd = exec.Command("stunnel-core",
-			"--mode", "server",
-			"--protocol", "wss",
-			"--listen", fmt.Sprintf("%s:%d", tunnel.ServerIP, tunnel.ServerPort),
-			"--target", fmt.Sprintf("%s:%d", tunnel.TargetIP, tunnel.TargetPort),
-			"--token", tunnel.Token,
-			"--cert", tunnel.TLSConfig.CertFile,
-			"--key", tunnel.TLSConfig.KeyFile,
-		)
-	default:
+	if !tunnel.Protocol.IsValid() {
 		return nil, fmt.Errorf("unsupported protocol: %s", tunnel.Protocol)
 	}
 
+	var httpAddr string
+	if tunnel.HTTPRouting {
+		if !s.config.Tunnels.HTTP.Enabled {
+			return nil, errHTTPRoutingDisabled
+		}
+		addr, err := freeLoopbackAddr()
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick an HTTP address: %w", err)
+		}
+		httpAddr = addr
+	}
+
+	// Settings, including the token, go in a config file so they stay out of argv
+	configPath, err := s.writeTunnelConfig(tunnel, httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("stunnel-core", "--config", configPath)
+
 	return &TunnelProcess{
 		ID:          tunnel.ID.String(),
 		Tunnel:      tunnel,
@@ -357,6 +682,8 @@ func (s *TunnelService) createTunnelProcess(tunnel *models.Tunnel) (*TunnelProce
 		StartedAt:   time.Now(),
 		LastPing:    time.Now(),
 		StopChannel: make(chan bool),
+		exited:      make(chan struct{}),
+		HTTPAddr:    httpAddr,
 		Metrics: &TunnelMetrics{
 			LastUpdated: time.Now(),
 		},
@@ -371,48 +698,144 @@ func (s *TunnelService) monitorTunnel(process *TunnelProcess) {
 		select {
 		case <-process.StopChannel:
 			return
+		case <-process.exited:
+			log.Printf("Tunnel process exited: %s", process.ID)
+			s.handleTunnelExit(process)
+			return
 		case <-ticker.C:
 			// Update metrics
 			s.updateTunnelMetrics(process)
 			
-			// Check if process is still running
-			if process.Process.ProcessState != nil && process.Process.ProcessState.Exited() {
-				log.Printf("Tunnel process exited: %s", process.ID)
-				s.handleTunnelExit(process)
-				return
-			}
-			
 			process.LastPing = time.Now()
 		}
 	}
 }
 
 func (s *TunnelService) updateTunnelMetrics(process *TunnelProcess) {
-	// Simulate metrics collection (in real implementation, this would collect actual metrics)
-	process.Metrics.ConnectionCount++
-	process.Metrics.BytesIn += int64(1000 + (time.Now().UnixNano() % 5000))
-	process.Metrics.BytesOut += int64(800 + (time.Now().UnixNano() % 3000))
-	process.Metrics.Latency = float64(10 + (time.Now().UnixNano() % 50))
-	process.Metrics.LastUpdated = time.Now()
+	stats, err := fetchControlStats(context.Background(), s.tunnelControlPath(process.Tunnel))
+	if err != nil {
+		log.Printf("Failed to collect metrics for tunnel %s: %v", process.ID, err)
+		return
+	}
+
+	now := time.Now()
+	metrics := &TunnelMetrics{
+		BytesIn:           stats.BytesIn,
+		BytesOut:          stats.BytesOut,
+		ConnectionCount:   int(stats.Connections),
+		ActiveConnections: int(stats.ActiveConnections),
+		Latency:           stats.averageRTT(),
+		CPUSeconds:        stats.CPUSeconds,
+		MemoryUsage:       stats.MemoryBytes,
+		ErrorCount:        int(stats.Errors),
+		Reconnects:        stats.Reconnects,
+		ResumedStreams:    stats.ResumedStreams,
+		OrphanedStreams:   stats.OrphanedStreams,
+		UncompressedBytes: stats.UncompressedBytes,
+		CompressedBytes:   stats.CompressedBytes,
+		CompressionRatio:  stats.CompressionRatio,
+		CompressionSaved:  stats.CompressionSaved,
+		Sessions:          stats.Sessions,
+		Targets:           stats.Targets,
+		LastUpdated:       now,
+	}
+
+	s.tunnelsMux.Lock()
+	if previous := process.Metrics; previous != nil && previous.CPUSeconds > 0 {
+		if elapsed := now.Sub(previous.LastUpdated).Seconds(); elapsed > 0 {
+			metrics.CPUUsage = (metrics.CPUSeconds - previous.CPUSeconds) / elapsed * 100
+		}
+	}
+	process.Metrics = metrics
+	s.tunnelsMux.Unlock()
 
 	// Update database
 	s.db.Model(process.Tunnel).Updates(map[string]interface{}{
-		"bytes_in":         process.Metrics.BytesIn,
-		"bytes_out":        process.Metrics.BytesOut,
-		"connection_count": process.Metrics.ConnectionCount,
-		"last_seen":        time.Now(),
+		"bytes_in":         metrics.BytesIn,
+		"bytes_out":        metrics.BytesOut,
+		"connection_count": metrics.ConnectionCount,
+		"last_seen":        now,
 	})
+
+	if process.Tunnel.DynamicForwarding.Enabled {
+		s.logTunnelDestinations(process)
+	}
+}
+
+// logTunnelDestinations writes the destinations dynamic clients asked for
+// since the last poll to the tunnel's logs
+func (s *TunnelService) logTunnelDestinations(process *TunnelProcess) {
+	destinations, err := fetchControlDestinations(context.Background(), s.tunnelControlPath(process.Tunnel), process.lastDestination)
+	if err != nil {
+		log.Printf("Failed to collect destinations for tunnel %s: %v", process.ID, err)
+		return
+	}
+	if len(destinations) == 0 {
+		return
+	}
+
+	logs := make([]models.TunnelLog, 0, len(destinations))
+	for _, dest := range destinations {
+		entry := models.TunnelLog{
+			TunnelID:  process.Tunnel.ID,
+			Level:     "INFO",
+			Message:   fmt.Sprintf("%s %s from %s", dest.Network, dest.Destination, dest.Remote),
+			Timestamp: dest.Time,
+		}
+		switch {
+		case !dest.Allowed:
+			entry.Level = "WARN"
+			entry.Message += " refused"
+		case dest.Error != "":
+			entry.Level = "ERROR"
+			entry.Message += " failed: " + dest.Error
+		default:
+			entry.Message += " -> " + dest.Address
+		}
+		if metadata, err := json.Marshal(dest); err == nil {
+			entry.Metadata = string(metadata)
+		}
+		logs = append(logs, entry)
+	}
+
+	if err := s.db.Create(&logs).Error; err != nil {
+		log.Printf("Failed to log destinations for tunnel %s: %v", process.ID, err)
+		return
+	}
+	process.lastDestination = destinations[len(destinations)-1].Seq
+}
+
+// GetTunnelMetrics returns the latest metrics of a running tunnel
+func (s *TunnelService) GetTunnelMetrics(id string) (*TunnelMetrics, bool) {
+	s.tunnelsMux.RLock()
+	defer s.tunnelsMux.RUnlock()
+
+	process, exists := s.activeTunnels[id]
+	if !exists || process.Metrics == nil {
+		return nil, false
+	}
+	return process.Metrics, true
 }
 
 func (s *TunnelService) handleTunnelExit(process *TunnelProcess) {
 	s.tunnelsMux.Lock()
 	defer s.tunnelsMux.Unlock()
 
+	// A stopped tunnel may have been started again meanwhile
+	if s.activeTunnels[process.ID] != process {
+		return
+	}
+
 	// Update tunnel status
 	s.db.Model(process.Tunnel).Update("status", models.TunnelStatusError)
 
 	// Remove from active tunnels
 	delete(s.activeTunnels, process.ID)
+	if process.HTTPAddr != "" {
+		if err := s.syncHTTPRouter(); err != nil {
+			log.Printf("Warning: failed to unroute tunnel %s: %v", process.ID, err)
+		}
+	}
 
 	log.Printf("Tunnel process exited and cleaned up: %s", process.ID)
 }
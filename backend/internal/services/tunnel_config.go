@@ -0,0 +1,315 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"utunnel-pro/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tunnelCoreConfig is the stunnel-core config file of a managed tunnel. Its
+// keys are stunnel-core's flag names with underscores.
+type tunnelCoreConfig struct {
+	Mode     string   `yaml:"mode"`
+	Protocol string   `yaml:"protocol"`
+	Listen   string   `yaml:"listen"`
+	Target   string   `yaml:"target"`
+	Bind     string   `yaml:"bind,omitempty"`
+	Forwards []string `yaml:"forwards,omitempty"`
+	Token    string   `yaml:"token"`
+
+	// TLS, written when the tunnel's links use it
+	TLS                bool   `yaml:"tls,omitempty"`
+	CertFile           string `yaml:"cert,omitempty"`
+	KeyFile            string `yaml:"key,omitempty"`
+	CAFile             string `yaml:"ca,omitempty"`
+	TLSMinVersion      string `yaml:"tls_min_version,omitempty"`
+	TLSMaxVersion      string `yaml:"tls_max_version,omitempty"`
+	TLSCiphers         string `yaml:"tls_ciphers,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+
+	// Balancing over the target list and health checks of its members
+	Balance        string        `yaml:"balance,omitempty"`
+	HealthCheck    string        `yaml:"health_check,omitempty"`
+	HealthPath     string        `yaml:"health_path,omitempty"`
+	HealthInterval time.Duration `yaml:"health_interval,omitempty"`
+	HealthTimeout  time.Duration `yaml:"health_timeout,omitempty"`
+	HealthFails    int           `yaml:"health_fails,omitempty"`
+	HealthPasses   int           `yaml:"health_passes,omitempty"`
+
+	// PROXY protocol header sent to targets and parsing of incoming ones
+	ProxyProtocol       string `yaml:"proxy_protocol,omitempty"`
+	AcceptProxyProtocol bool   `yaml:"accept_proxy_protocol,omitempty"`
+
+	// Compression of the links, both ends must use the same
+	Compression string `yaml:"compress,omitempty"`
+
+	// Request path of WebSocket, h2 and grpc links and the site served to
+	// everything else
+	Path  string `yaml:"path,omitempty"`
+	Decoy string `yaml:"decoy,omitempty"`
+
+	// Dynamic clients and the destinations they may reach
+	Dynamic          bool     `yaml:"dynamic,omitempty"`
+	DynamicAllow     []string `yaml:"dynamic_allow,omitempty"`
+	DynamicDeny      []string `yaml:"dynamic_deny,omitempty"`
+	DynamicPorts     []string `yaml:"dynamic_ports,omitempty"`
+	DynamicDenyPorts []string `yaml:"dynamic_deny_ports,omitempty"`
+
+	// Control is where the process serves statistics for the backend to poll
+	Control string `yaml:"control"`
+
+	// Stopping drains connections, and a restarted tunnel listens alongside
+	// its draining process
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	ReusePort    bool          `yaml:"reuse_port"`
+
+	// The owner's limits, enforced by the process
+	MaxBandwidth   int `yaml:"max_bandwidth,omitempty"`
+	MaxConnections int `yaml:"max_connections,omitempty"`
+
+	// Mux tuning, only written for mux protocols
+	Mux              bool `yaml:"mux,omitempty"`
+	MuxStreams       int  `yaml:"mux_streams,omitempty"`
+	MuxFrameSize     int  `yaml:"mux_frame_size,omitempty"`
+	MuxReceiveBuffer int  `yaml:"mux_receive_buffer,omitempty"`
+	MuxStreamBuffer  int  `yaml:"mux_stream_buffer,omitempty"`
+
+	// Heartbeat of mux and WebSocket links in seconds
+	MuxHeartbeat int `yaml:"mux_heartbeat,omitempty"`
+}
+
+// newTunnelCoreConfig maps a tunnel onto stunnel-core settings
+func newTunnelCoreConfig(tunnel *models.Tunnel) *tunnelCoreConfig {
+	cfg := &tunnelCoreConfig{
+		Mode:     "server",
+		Protocol: string(tunnel.Protocol),
+		Listen:   fmt.Sprintf("%s:%d", tunnel.ServerIP, tunnel.ServerPort),
+		Target:   tunnel.TargetSpec(),
+		Token:    tunnel.Token,
+
+		ProxyProtocol:       string(tunnel.ProxyProtocol),
+		AcceptProxyProtocol: tunnel.AcceptProxyProtocol,
+
+		Compression: string(tunnel.Compression),
+		Path:        tunnel.Path,
+
+		MaxBandwidth:   tunnel.User.Limits.MaxBandwidthMBps,
+		MaxConnections: tunnel.User.Limits.MaxConnections,
+	}
+
+	if len(tunnel.PortMappings) > 0 {
+		// The main listen/target pair becomes the first entry of the table
+		cfg.Forwards = append(cfg.Forwards, cfg.Listen+"="+cfg.Target)
+		for _, mapping := range tunnel.PortMappings {
+			cfg.Forwards = append(cfg.Forwards, mapping.ForwardSpec(tunnel.ServerIP))
+		}
+	}
+
+	lb := tunnel.LoadBalancing
+	cfg.Balance = string(lb.Strategy)
+	cfg.HealthCheck = string(lb.HealthCheck)
+	cfg.HealthPath = lb.HealthPath
+	cfg.HealthInterval = time.Duration(lb.HealthInterval) * time.Second
+	cfg.HealthTimeout = time.Duration(lb.HealthTimeout) * time.Second
+	cfg.HealthFails = lb.HealthFails
+	cfg.HealthPasses = lb.HealthPasses
+
+	if dyn := tunnel.DynamicForwarding; dyn.Enabled {
+		cfg.Dynamic = true
+		cfg.DynamicAllow = dyn.AllowNets
+		cfg.DynamicDeny = dyn.DenyNets
+		cfg.DynamicPorts = dyn.AllowPorts
+		cfg.DynamicDenyPorts = dyn.DenyPorts
+	}
+
+	if tunnel.Protocol.IsMux() {
+		mux := tunnel.MuxConfig
+		cfg.Mux = mux.Enabled
+		cfg.MuxStreams = mux.ConnectionPool
+		cfg.MuxFrameSize = mux.FrameSize
+		cfg.MuxReceiveBuffer = mux.ReceiveBuffer
+		cfg.MuxStreamBuffer = mux.StreamBuffer
+	}
+	cfg.MuxHeartbeat = tunnel.MuxConfig.Heartbeat
+
+	if tunnel.UsesTLS() {
+		tls := tunnel.TLSConfig
+		cfg.TLS = tls.Enabled
+		cfg.CertFile = tls.CertFile
+		cfg.KeyFile = tls.KeyFile
+		// A CA makes the process require client certificates signed by it
+		cfg.CAFile = tls.CAFile
+		cfg.TLSMinVersion = tls.MinVersion
+		cfg.TLSMaxVersion = tls.MaxVersion
+		cfg.TLSCiphers = tls.CipherSuites
+		cfg.InsecureSkipVerify = tls.InsecureSkipVerify
+	}
+
+	return cfg
+}
+
+// tunnelConfigPath returns where a tunnel's stunnel-core config file lives
+func (s *TunnelService) tunnelConfigPath(tunnel *models.Tunnel) string {
+	return filepath.Join(s.config.Tunnels.ConfigDir, tunnel.ID.String()+".yaml")
+}
+
+// writeTunnelConfig writes a tunnel's config file readable only by the
+// backend's user, since it holds the tunnel token. An HTTP tunnel's process
+// runs as a reverse server whose public side is httpAddr, where the router
+// sends its requests; its client dials the tunnel's targets. Listening
+// sockets are opened with SO_REUSEPORT, so the tunnel's next process can take
+// them over.
+func (s *TunnelService) writeTunnelConfig(tunnel *models.Tunnel, httpAddr string) (string, error) {
+	cfg := newTunnelCoreConfig(tunnel)
+	if httpAddr != "" {
+		cfg.Bind = cfg.Listen
+		cfg.Listen = httpAddr
+		cfg.Forwards = []string{httpAddr + "=" + cfg.Target}
+	}
+	cfg.Control = "unix:" + s.tunnelControlPath(tunnel)
+	cfg.DrainTimeout = s.config.Tunnels.DrainTimeout
+	cfg.ReusePort = true
+	cfg.Decoy = s.decoySpec(tunnel.Decoy)
+	if tunnel.UsesTLS() && tunnel.TLSConfig.CertSource.IsManaged() {
+		cfg.CertFile, cfg.KeyFile = s.tunnelCertPaths(tunnel)
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode tunnel config: %w", err)
+	}
+
+	path := s.tunnelConfigPath(tunnel)
+	if err := s.writePrivateFile(path, data); err != nil {
+		return "", fmt.Errorf("failed to write tunnel config: %w", err)
+	}
+	return path, nil
+}
+
+// ValidateDecoy checks a tunnel's decoy site, which is either one of the
+// websites the admin allows or the name of a site in the decoy directory
+func (s *TunnelService) ValidateDecoy(protocol models.TunnelProtocol, decoy string) error {
+	if decoy == "" {
+		return nil
+	}
+	if !protocol.IsHTTP() {
+		return fmt.Errorf("only WebSocket, h2 and grpc tunnels serve a decoy site, got %s", protocol)
+	}
+	if strings.HasPrefix(decoy, "http://") || strings.HasPrefix(decoy, "https://") {
+		if !slices.Contains(s.config.Tunnels.DecoyURLs, decoy) {
+			return fmt.Errorf("decoy %q is not an allowed website", decoy)
+		}
+		return nil
+	}
+	if s.config.Tunnels.DecoyDir == "" {
+		return fmt.Errorf("no decoy directory is configured")
+	}
+	if !filepath.IsLocal(decoy) || filepath.Clean(decoy) != decoy {
+		return fmt.Errorf("invalid decoy %q, use the name of a site in the decoy directory or an allowed URL", decoy)
+	}
+	return nil
+}
+
+// decoySpec returns the stunnel-core decoy of a tunnel's decoy site
+func (s *TunnelService) decoySpec(decoy string) string {
+	if decoy == "" || strings.HasPrefix(decoy, "http://") || strings.HasPrefix(decoy, "https://") {
+		return decoy
+	}
+	return filepath.Join(s.config.Tunnels.DecoyDir, decoy)
+}
+
+// tunnelCertPaths returns where a tunnel's managed certificate and key are
+// written for its process
+func (s *TunnelService) tunnelCertPaths(tunnel *models.Tunnel) (certFile, keyFile string) {
+	base := filepath.Join(s.config.Tunnels.ConfigDir, tunnel.ID.String())
+	return base + ".crt", base + ".key"
+}
+
+// prepareTunnelCertificate writes the managed certificate of a tunnel about
+// to start, issuing it first if needed
+func (s *TunnelService) prepareTunnelCertificate(ctx context.Context, tunnel *models.Tunnel) error {
+	if !tunnel.UsesTLS() || !tunnel.TLSConfig.CertSource.IsManaged() {
+		return nil
+	}
+	if s.certificates == nil {
+		return errCertificatesDisabled
+	}
+
+	certPEM, keyPEM, err := s.certificates.TunnelCertificate(ctx, tunnel)
+	if err != nil {
+		return err
+	}
+	return s.writeTunnelCertificate(tunnel, certPEM, keyPEM)
+}
+
+// writeTunnelCertificate writes a tunnel's certificate chain and key, the key
+// readable only by the backend's user
+func (s *TunnelService) writeTunnelCertificate(tunnel *models.Tunnel, certPEM, keyPEM []byte) error {
+	certFile, keyFile := s.tunnelCertPaths(tunnel)
+
+	// The key goes first so a reload never pairs a new certificate with the old key
+	if err := s.writePrivateFile(keyFile, keyPEM); err != nil {
+		return fmt.Errorf("failed to write tunnel key: %w", err)
+	}
+	if err := s.writePrivateFile(certFile, certPEM); err != nil {
+		return fmt.Errorf("failed to write tunnel certificate: %w", err)
+	}
+	return nil
+}
+
+// rotateTunnelCertificate writes a renewed certificate and has the tunnel's
+// process, if running, load it. stunnel-core reloads certificates on SIGHUP
+// without dropping links.
+func (s *TunnelService) rotateTunnelCertificate(tunnel *models.Tunnel, certPEM, keyPEM []byte) error {
+	if err := s.writeTunnelCertificate(tunnel, certPEM, keyPEM); err != nil {
+		return err
+	}
+
+	s.tunnelsMux.RLock()
+	process, running := s.activeTunnels[tunnel.ID.String()]
+	s.tunnelsMux.RUnlock()
+	if !running || process.Process.Process == nil {
+		return nil
+	}
+
+	if err := process.Process.Process.Signal(syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to signal tunnel process: %w", err)
+	}
+	log.Printf("Pushed renewed certificate to tunnel %s", tunnel.ID)
+	return nil
+}
+
+// writePrivateFile replaces path with data, readable only by the backend's
+// user. It writes then renames so a reloading process never reads a partial
+// file.
+func (s *TunnelService) writePrivateFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tunnel-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"utunnel-pro/internal/models"
+)
+
+// controlTimeout bounds a control request, which waits on session pings
+const controlTimeout = 5 * time.Second
+
+// tunnelControlStats is the /stats response of stunnel-core's control endpoint
+type tunnelControlStats struct {
+	Mode              string               `json:"mode"`
+	Protocol          string               `json:"protocol"`
+	StartTime         time.Time            `json:"start_time"`
+	UptimeSeconds     float64              `json:"uptime_seconds"`
+	BytesIn           int64                `json:"bytes_in"`
+	BytesOut          int64                `json:"bytes_out"`
+	Connections       int64                `json:"connections"`
+	ActiveConnections int64                `json:"active_connections"`
+	Errors            int64                `json:"errors"`
+	Reconnects        int64                `json:"reconnects"`
+	ResumedStreams    int64                `json:"resumed_streams"`
+	OrphanedStreams   int64                `json:"orphaned_streams"`
+	UncompressedBytes int64                `json:"uncompressed_bytes"`
+	CompressedBytes   int64                `json:"compressed_bytes"`
+	CompressionRatio  float64              `json:"compression_ratio"`
+	CompressionSaved  int64                `json:"compression_saved_bytes"`
+	MemoryBytes       int64                `json:"memory_bytes"`
+	CPUSeconds        float64              `json:"cpu_seconds"`
+	Sessions          []TunnelSessionStats `json:"sessions"`
+	Targets           []TunnelTargetPool   `json:"targets"`
+}
+
+// TunnelSessionStats describes one mux session of a running tunnel
+type TunnelSessionStats struct {
+	ID          string    `json:"id"`
+	Remote      string    `json:"remote"`
+	Streams     int       `json:"streams"`
+	ConnectedAt time.Time `json:"connected_at"`
+	RTTMillis   float64   `json:"rtt_ms"`
+
+	// Bytes read from and written to the session's link, before
+	// compression, and the algorithm compressing it if any
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// TunnelTargetPool is a target list of a running tunnel and the health of
+// its members
+type TunnelTargetPool struct {
+	Target  string               `json:"target"`
+	Balance string               `json:"balance"`
+	Members []TunnelTargetMember `json:"members"`
+}
+
+// TunnelTargetMember is one target of a pool
+type TunnelTargetMember struct {
+	Address           string     `json:"address"`
+	Weight            int        `json:"weight"`
+	Healthy           bool       `json:"healthy"`
+	ActiveConnections int64      `json:"active_connections"`
+	Connections       int64      `json:"connections"`
+	Failures          int        `json:"consecutive_failures"`
+	LastCheck         *time.Time `json:"last_check,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+}
+
+// averageRTT returns the mean round trip time of the sessions in milliseconds
+func (st *tunnelControlStats) averageRTT() float64 {
+	var total float64
+	var measured int
+	for _, session := range st.Sessions {
+		if session.RTTMillis > 0 {
+			total += session.RTTMillis
+			measured++
+		}
+	}
+	if measured == 0 {
+		return 0
+	}
+	return total / float64(measured)
+}
+
+// tunnelControlPath returns the unix socket a tunnel's process serves
+// statistics on
+func (s *TunnelService) tunnelControlPath(tunnel *models.Tunnel) string {
+	return filepath.Join(s.config.Tunnels.ConfigDir, tunnel.ID.String()+".sock")
+}
+
+// fetchControlStats reads the statistics of the tunnel process listening on
+// socketPath
+func fetchControlStats(ctx context.Context, socketPath string) (*tunnelControlStats, error) {
+	var stats tunnelControlStats
+	if err := fetchControl(ctx, socketPath, "/stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// tunnelDestination is a destination a dynamic client asked the tunnel
+// process for, as listed by /destinations
+type tunnelDestination struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Remote      string    `json:"remote"`
+	Session     string    `json:"session,omitempty"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address,omitempty"`
+	Allowed     bool      `json:"allowed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// fetchControlDestinations reads the destinations numbered after seq from the
+// tunnel process listening on socketPath
+func fetchControlDestinations(ctx context.Context, socketPath string, seq uint64) ([]tunnelDestination, error) {
+	var destinations []tunnelDestination
+	if err := fetchControl(ctx, socketPath, "/destinations?after="+strconv.FormatUint(seq, 10), &destinations); err != nil {
+		return nil, err
+	}
+	return destinations, nil
+}
+
+// fetchControl decodes the JSON answer to a GET of path on the control
+// endpoint listening on socketPath into v
+func fetchControl(ctx context.Context, socketPath, path string, v interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(ctx, controlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://stunnel-core"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query tunnel control endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tunnel control endpoint returned %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode tunnel control response: %w", err)
+	}
+	return nil
+}
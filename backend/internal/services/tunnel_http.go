@@ -0,0 +1,334 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+
+	"utunnel-pro/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HTTP tunnels
+//
+// A tunnel with HTTPRouting runs its process as a reverse server: the tunnel
+// client connects to ServerIP:ServerPort as usual, while the public side
+// listens on a loopback port. One shared stunnel-core process in http mode
+// owns the public HTTP and HTTPS ports and sends every request to the
+// tunnel serving its host name. The router's host table is rewritten and
+// reloaded whenever an HTTP tunnel starts or stops.
+//
+// Users get <username>.<base domain> and every name below it. Other names
+// must be in a custom domain the user has verified, allowed with
+// CanUseCustomDomains. A name belongs to one tunnel at a time, and a wildcard
+// cannot cover another user's names.
+
+var errHTTPRoutingDisabled = errors.New("HTTP routing is not enabled on this server")
+
+// hostnameLabel is one DNS label
+var hostnameLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// normalizeHostname lowercases a host name and checks it is a DNS name,
+// optionally a *. wildcard
+func normalizeHostname(name string) (string, error) {
+	host := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	labels := strings.Split(strings.TrimPrefix(host, "*."), ".")
+	if len(host) > 253 || len(labels) < 2 {
+		return "", fmt.Errorf("invalid host name %q", name)
+	}
+	for _, label := range labels {
+		if !hostnameLabel.MatchString(label) {
+			return "", fmt.Errorf("invalid host name %q", name)
+		}
+	}
+	return host, nil
+}
+
+// hostnameSlug turns a tunnel name into a DNS label
+func hostnameSlug(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+	slug := strings.Trim(b.String(), "-")
+	if len(slug) > 63 {
+		slug = strings.TrimRight(slug[:63], "-")
+	}
+	if slug == "" {
+		slug = "tunnel"
+	}
+	return slug
+}
+
+// inDomain reports whether host, or the domain of a wildcard, is domain or
+// below it
+func inDomain(host, domain string) bool {
+	host = strings.TrimPrefix(host, "*.")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// AssignHostnames checks the host names of an HTTP tunnel against its
+// owner's limits and the names other tunnels hold, normalizing them. A
+// tunnel without names gets <tunnel name>.<username>.<base domain>.
+func (s *TunnelService) AssignHostnames(tunnel *models.Tunnel) error {
+	if !tunnel.HTTPRouting {
+		if len(tunnel.Hostnames) > 0 {
+			return fmt.Errorf("host names need HTTP routing")
+		}
+		return nil
+	}
+
+	routing := s.config.Tunnels.HTTP
+	if !routing.Enabled {
+		return errHTTPRoutingDisabled
+	}
+	if tunnel.Protocol != models.ProtocolTCP && !tunnel.Protocol.IsMux() || tunnel.Protocol.ForwardsUDP() {
+		return fmt.Errorf("HTTP routing needs tcp or a TCP mux protocol, got %s", tunnel.Protocol)
+	}
+	if len(tunnel.PortMappings) > 0 {
+		return fmt.Errorf("HTTP tunnels cannot have port mappings")
+	}
+	if tunnel.ProxyProtocol != models.ProxyProtocolNone {
+		return fmt.Errorf("HTTP tunnels get the client address in X-Forwarded-For, not a PROXY protocol header")
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", tunnel.UserID).Error; err != nil {
+		return fmt.Errorf("failed to load tunnel owner: %w", err)
+	}
+	if !user.Limits.CanCreatePublicTunnels {
+		return fmt.Errorf("your plan does not include public tunnels")
+	}
+
+	base := strings.ToLower(strings.TrimSuffix(routing.BaseDomain, "."))
+	zone := s.userZone(&user)
+
+	if len(tunnel.Hostnames) == 0 {
+		if zone == "" {
+			return fmt.Errorf("at least one host name is required")
+		}
+		tunnel.Hostnames = []string{hostnameSlug(tunnel.Name) + "." + zone}
+	}
+
+	var verified []string
+	seen := make(map[string]bool)
+	hostnames := make([]string, 0, len(tunnel.Hostnames))
+	for _, name := range tunnel.Hostnames {
+		host, err := normalizeHostname(name)
+		if err != nil {
+			return err
+		}
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+
+		switch {
+		case zone != "" && inDomain(host, zone):
+		case base != "" && inDomain(host, base):
+			return fmt.Errorf("host name %s is outside your domain %s", host, zone)
+		case !user.Limits.CanUseCustomDomains:
+			return fmt.Errorf("your plan does not include custom domains")
+		default:
+			if verified == nil {
+				if verified, err = s.verifiedDomains(user.ID); err != nil {
+					return err
+				}
+			}
+			if !slices.ContainsFunc(verified, func(domain string) bool { return inDomain(host, domain) }) {
+				return fmt.Errorf("host name %s is not in a custom domain you have verified", host)
+			}
+		}
+		hostnames = append(hostnames, host)
+	}
+
+	// Host names are unique across every user's tunnels, and names of
+	// different users must not overlap through wildcards
+	var others []models.Tunnel
+	if err := s.db.Select("id", "user_id", "hostnames").Where("http_routing = ? AND id <> ?", true, tunnel.ID).Find(&others).Error; err != nil {
+		return fmt.Errorf("failed to check host names: %w", err)
+	}
+	for _, other := range others {
+		for _, taken := range other.Hostnames {
+			if seen[taken] {
+				return fmt.Errorf("host name %s is already in use", taken)
+			}
+			if other.UserID == tunnel.UserID {
+				continue
+			}
+			for _, host := range hostnames {
+				if hostnamesOverlap(host, taken) {
+					return fmt.Errorf("host name %s overlaps %s, which is in use", host, taken)
+				}
+			}
+		}
+	}
+
+	tunnel.Hostnames = hostnames
+	return nil
+}
+
+// userZone returns <username>.<base domain>, or nothing without a base domain
+func (s *TunnelService) userZone(user *models.User) string {
+	base := strings.ToLower(strings.TrimSuffix(s.config.Tunnels.HTTP.BaseDomain, "."))
+	if base == "" {
+		return ""
+	}
+	return strings.ToLower(user.Username) + "." + base
+}
+
+// checkTLSDomain makes sure the internal CA is only asked to sign a name the
+// tunnel's owner holds: one of the tunnel's host names, a name in the owner's
+// zone or in a custom domain they verified. ACME names are left to the ACME
+// directory, which validates them itself.
+func (s *TunnelService) checkTLSDomain(tunnel *models.Tunnel) error {
+	if !tunnel.UsesTLS() || tunnel.TLSConfig.CertSource != models.CertificateSourceInternal || tunnel.TLSConfig.Domain == "" {
+		return nil
+	}
+	host, err := normalizeHostname(tunnel.TLSConfig.Domain)
+	if err != nil {
+		return fmt.Errorf("invalid TLS domain: %w", err)
+	}
+	for _, name := range tunnel.Hostnames {
+		if name == host || wildcardCovers(name, host) {
+			return nil
+		}
+	}
+
+	var user models.User
+	if err := s.db.First(&user, "id = ?", tunnel.UserID).Error; err != nil {
+		return fmt.Errorf("failed to load tunnel owner: %w", err)
+	}
+	if zone := s.userZone(&user); zone != "" && inDomain(host, zone) {
+		return nil
+	}
+	verified, err := s.verifiedDomains(user.ID)
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(verified, func(domain string) bool { return inDomain(host, domain) }) {
+		return nil
+	}
+	return fmt.Errorf("TLS domain %s is not one of the tunnel's host names, in your zone or in a custom domain you have verified", host)
+}
+
+// hostnamesOverlap reports whether a request could match both names, as a
+// wildcard matches every name below its domain
+func hostnamesOverlap(a, b string) bool {
+	return a == b || wildcardCovers(a, b) || wildcardCovers(b, a)
+}
+
+// wildcardCovers reports whether pattern is a wildcard matching name, or
+// every name name's wildcard matches
+func wildcardCovers(pattern, name string) bool {
+	domain, ok := strings.CutPrefix(pattern, "*.")
+	return ok && strings.HasSuffix(strings.TrimPrefix(name, "*."), "."+domain)
+}
+
+// freeLoopbackAddr returns a loopback address with a free TCP port, where an
+// HTTP tunnel's process receives the requests of the router
+func freeLoopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// httpRouterConfig is the stunnel-core config file of the shared router
+type httpRouterConfig struct {
+	Mode        string   `yaml:"mode"`
+	Listen      string   `yaml:"listen"`
+	HTTPSListen string   `yaml:"https_listen,omitempty"`
+	CertFile    string   `yaml:"cert,omitempty"`
+	KeyFile     string   `yaml:"key,omitempty"`
+	Hosts       []string `yaml:"hosts"`
+}
+
+// httpRouterConfigPath returns where the router's config file lives
+func (s *TunnelService) httpRouterConfigPath() string {
+	return filepath.Join(s.config.Tunnels.ConfigDir, "http-router.yaml")
+}
+
+// syncHTTPRouter points the router at the running HTTP tunnels, starting it
+// on the first one. A running router reloads its host table on SIGHUP
+// without dropping connections. Must be called with tunnelsMux held.
+func (s *TunnelService) syncHTTPRouter() error {
+	routing := s.config.Tunnels.HTTP
+	if !routing.Enabled {
+		return nil
+	}
+
+	cfg := &httpRouterConfig{
+		Mode:        "http",
+		Listen:      routing.HTTPListen,
+		HTTPSListen: routing.HTTPSListen,
+		CertFile:    routing.CertFile,
+		KeyFile:     routing.KeyFile,
+		Hosts:       []string{},
+	}
+	for _, process := range s.activeTunnels {
+		if process.HTTPAddr == "" {
+			continue
+		}
+		for _, host := range process.Tunnel.Hostnames {
+			cfg.Hosts = append(cfg.Hosts, host+"="+process.HTTPAddr)
+		}
+	}
+	if len(cfg.Hosts) == 0 && s.httpRouter == nil {
+		return nil
+	}
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to encode HTTP router config: %w", err)
+	}
+	path := s.httpRouterConfigPath()
+	if err := s.writePrivateFile(path, data); err != nil {
+		return fmt.Errorf("failed to write HTTP router config: %w", err)
+	}
+
+	if s.httpRouter != nil {
+		if err := s.httpRouter.Process.Signal(syscall.SIGHUP); err != nil {
+			return fmt.Errorf("failed to signal HTTP router: %w", err)
+		}
+		return nil
+	}
+
+	cmd := exec.Command("stunnel-core", "--config", path)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start HTTP router: %w", err)
+	}
+	s.httpRouter = cmd
+	go s.watchHTTPRouter(cmd)
+
+	log.Printf("HTTP router started on %s", routing.HTTPListen)
+	return nil
+}
+
+// watchHTTPRouter forgets the router when it exits, so the next HTTP tunnel
+// to start or stop starts it again
+func (s *TunnelService) watchHTTPRouter(cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	s.tunnelsMux.Lock()
+	defer s.tunnelsMux.Unlock()
+	if s.httpRouter == cmd {
+		s.httpRouter = nil
+	}
+	log.Printf("HTTP router exited: %v", err)
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"utunnel-pro/internal/config"
+	"utunnel-pro/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/suite"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type TunnelServiceTestSuite struct {
+	suite.Suite
+	db            *gorm.DB
+	tunnelService *TunnelService
+	txtRecords    map[string][]string
+}
+
+func (suite *TunnelServiceTestSuite) SetupTest() {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	suite.Require().NoError(err)
+	// Only the columns the tests use, since the models' defaults are
+	// PostgreSQL's
+	suite.Require().NoError(db.Exec(`CREATE TABLE tunnels (id uuid PRIMARY KEY,
+		user_id uuid, server_ip text, server_port integer, port_mappings text,
+		http_routing numeric, hostnames text,
+		created_at datetime, updated_at datetime, deleted_at datetime)`).Error)
+	suite.Require().NoError(db.Exec(`CREATE TABLE users (id uuid PRIMARY KEY,
+		username text, can_create_public_tunnels numeric, can_use_custom_domains numeric,
+		created_at datetime, updated_at datetime, deleted_at datetime)`).Error)
+	suite.Require().NoError(db.AutoMigrate(&models.Domain{}))
+	suite.db = db
+
+	suite.tunnelService = &TunnelService{
+		db: db,
+		config: &config.Config{
+			Tunnels: config.TunnelsConfig{
+				HTTP: config.HTTPRoutingConfig{Enabled: true, BaseDomain: "tunnels.test", HTTPListen: ":80", HTTPSListen: ":443"},
+			},
+		},
+		activeTunnels: make(map[string]*TunnelProcess),
+		lookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			return suite.txtRecords[name], nil
+		},
+	}
+	suite.txtRecords = make(map[string][]string)
+}
+
+func (suite *TunnelServiceTestSuite) createUser(customDomains bool) uuid.UUID {
+	id := uuid.New()
+	suite.Require().NoError(suite.db.Exec(`INSERT INTO users (id, username, can_create_public_tunnels, can_use_custom_domains)
+		VALUES (?, ?, ?, ?)`, id, "user"+id.String()[:8], true, customDomains).Error)
+	return id
+}
+
+func (suite *TunnelServiceTestSuite) createTunnel(ip string, port int, mappings ...models.PortMapping) *models.Tunnel {
+	tunnel := &models.Tunnel{ID: uuid.New(), ServerIP: ip, ServerPort: port, PortMappings: mappings}
+	err := suite.db.Select("id", "server_ip", "server_port", "port_mappings").Create(tunnel).Error
+	suite.Require().NoError(err)
+	return tunnel
+}
+
+func (suite *TunnelServiceTestSuite) TestServerAddressConflicts() {
+	suite.createTunnel("0.0.0.0", 8000, models.PortMapping{ListenPort: 9000, ListenPortEnd: 9100, TargetIP: "10.0.0.1"})
+
+	tests := []struct {
+		name     string
+		ip       string
+		port     int
+		mappings []models.PortMapping
+		conflict bool
+	}{
+		{"same server port", "192.0.2.1", 8000, nil, true},
+		{"server port inside a mapping range", "192.0.2.1", 9050, nil, true},
+		{"overlapping mapping range", "192.0.2.1", 8001, []models.PortMapping{{ListenPort: 9100, ListenPortEnd: 9200, TargetIP: "10.0.0.2"}}, true},
+		{"mapping on the server port", "192.0.2.1", 8001, []models.PortMapping{{ListenPort: 7990, ListenPortEnd: 8010, TargetIP: "10.0.0.2"}}, true},
+		{"HTTP router port", "192.0.2.1", 8001, []models.PortMapping{{ListenPort: 440, ListenPortEnd: 450, TargetIP: "10.0.0.2"}}, true},
+		{"free ports", "192.0.2.1", 8001, []models.PortMapping{{ListenPort: 9101, ListenPortEnd: 9200, TargetIP: "10.0.0.2"}}, false},
+	}
+
+	for _, tt := range tests {
+		suite.Run(tt.name, func() {
+			tunnel := &models.Tunnel{ID: uuid.New(), ServerIP: tt.ip, ServerPort: tt.port, PortMappings: tt.mappings}
+			err := suite.tunnelService.checkServerAddress(suite.db, tunnel)
+			if tt.conflict {
+				suite.Error(err)
+			} else {
+				suite.NoError(err)
+			}
+		})
+	}
+}
+
+func (suite *TunnelServiceTestSuite) TestServerAddressOnOtherIP() {
+	suite.createTunnel("192.0.2.1", 8000, models.PortMapping{ListenPort: 9000, ListenPortEnd: 9100, TargetIP: "10.0.0.1"})
+
+	other := &models.Tunnel{ID: uuid.New(), ServerIP: "192.0.2.2", ServerPort: 8000,
+		PortMappings: []models.PortMapping{{ListenPort: 9050, TargetIP: "10.0.0.2"}}}
+	suite.NoError(suite.tunnelService.checkServerAddress(suite.db, other))
+
+	other.ServerIP = "::"
+	suite.Error(suite.tunnelService.checkServerAddress(suite.db, other))
+}
+
+func (suite *TunnelServiceTestSuite) TestCustomDomainNeedsVerification() {
+	userID := suite.createUser(true)
+	tunnel := &models.Tunnel{ID: uuid.New(), UserID: userID, Name: "web", Protocol: models.ProtocolTCP,
+		HTTPRouting: true, Hostnames: []string{"www.example.com"}}
+	suite.Error(suite.tunnelService.AssignHostnames(tunnel))
+
+	domain, err := suite.tunnelService.ClaimDomain(userID, "Example.com")
+	suite.Require().NoError(err)
+	suite.Equal("example.com", domain.Name)
+	suite.Equal("_stunnel-challenge.example.com", domain.ChallengeName())
+
+	// A claimed domain is no use until its TXT record holds the token
+	suite.Error(suite.tunnelService.AssignHostnames(tunnel))
+	suite.txtRecords[domain.ChallengeName()] = []string{"some other token"}
+	_, err = suite.tunnelService.VerifyDomain(userID, domain.ID)
+	suite.Error(err)
+
+	suite.txtRecords[domain.ChallengeName()] = []string{"some other token", domain.Token}
+	verified, err := suite.tunnelService.VerifyDomain(userID, domain.ID)
+	suite.Require().NoError(err)
+	suite.True(verified.IsVerified())
+
+	tunnel.Hostnames = []string{"www.example.com", "*.example.com"}
+	suite.NoError(suite.tunnelService.AssignHostnames(tunnel))
+	tunnel.Hostnames = []string{"www.example.org"}
+	suite.Error(suite.tunnelService.AssignHostnames(tunnel))
+
+	// Another user's verification does not carry over
+	other := &models.Tunnel{ID: uuid.New(), UserID: suite.createUser(true), Name: "web", Protocol: models.ProtocolTCP,
+		HTTPRouting: true, Hostnames: []string{"api.example.com"}}
+	suite.Error(suite.tunnelService.AssignHostnames(other))
+	_, err = suite.tunnelService.VerifyDomain(other.UserID, domain.ID)
+	suite.Error(err)
+}
+
+func (suite *TunnelServiceTestSuite) TestClaimDomainLimits() {
+	_, err := suite.tunnelService.ClaimDomain(suite.createUser(false), "example.com")
+	suite.Error(err)
+
+	userID := suite.createUser(true)
+	_, err = suite.tunnelService.ClaimDomain(userID, "alice.tunnels.test")
+	suite.Error(err)
+	_, err = suite.tunnelService.ClaimDomain(userID, "*.example.com")
+	suite.Error(err)
+}
+
+func (suite *TunnelServiceTestSuite) TestTLSDomainMustBeOwned() {
+	userID := suite.createUser(true)
+	var username string
+	suite.Require().NoError(suite.db.Raw("SELECT username FROM users WHERE id = ?", userID).Scan(&username).Error)
+
+	tunnel := &models.Tunnel{ID: uuid.New(), UserID: userID, Protocol: models.ProtocolWSS,
+		TLSConfig: models.TLSConfig{CertSource: models.CertificateSourceInternal}}
+	check := func(domain string) error {
+		tunnel.TLSConfig.Domain = domain
+		return suite.tunnelService.checkTLSDomain(tunnel)
+	}
+
+	suite.NoError(check(""))
+	suite.NoError(check("api." + username + ".tunnels.test"))
+	suite.Error(check("bank.example.com"))
+	suite.Error(check("someone-else.tunnels.test"))
+
+	// Names the tunnel routes are the owner's
+	tunnel.Hostnames = []string{"*.example.net"}
+	suite.NoError(check("www.example.net"))
+	suite.Error(check("example.net"))
+
+	domain, err := suite.tunnelService.ClaimDomain(userID, "example.com")
+	suite.Require().NoError(err)
+	suite.Error(check("bank.example.com"))
+	suite.txtRecords[domain.ChallengeName()] = []string{domain.Token}
+	_, err = suite.tunnelService.VerifyDomain(userID, domain.ID)
+	suite.Require().NoError(err)
+	suite.NoError(check("bank.example.com"))
+
+	// ACME directories validate names themselves
+	tunnel.TLSConfig.CertSource = models.CertificateSourceACME
+	suite.NoError(check("example.org"))
+}
+
+func TestTunnelServiceTestSuite(t *testing.T) {
+	suite.Run(t, new(TunnelServiceTestSuite))
+}
@@ -0,0 +1,8 @@
+-- STunnel Pro HTTP/2 and gRPC protocols
+-- Version: 1.2.0
+
+ALTER TABLE tunnels DROP CONSTRAINT IF EXISTS tunnels_protocol_check;
+ALTER TABLE tunnels ADD CONSTRAINT tunnels_protocol_check
+    CHECK (protocol IN ('tcp', 'udp', 'ws', 'wss', 'h2', 'grpc', 'tcpmux', 'wsmux', 'wssmux', 'utcpmux', 'uwsmux', 'quic', 'uquic'));
+
+COMMENT ON COLUMN tunnels.protocol IS 'Tunnel protocol: tcp, udp, ws, wss, h2, grpc, tcpmux, wsmux, wssmux, utcpmux, uwsmux, quic, uquic';
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake wire format
+//
+// Every TCP or mux link starts with a framed handshake before any tunnel
+// data is exchanged. Each frame is
+//
+//	type (1 byte) | length (2 bytes, big endian) | payload
+//
+// and the exchange is
+//
+//	client -> server  hello:     version | flags | client nonce (32)
+//	server -> client  challenge: version | server nonce (32)
+//	client -> server  response:  client proof (32)
+//	server -> client  accept:    accepted flags | server proof (32)
+//	                  or reject: reason | message
+//
+// Proofs are HMAC-SHA256 keyed with the tunnel token over the transcript
+// version | flags | client nonce | server nonce. The client proof covers
+// "client" | transcript and the server proof covers "server" | transcript |
+// accepted flags, so each side proves it holds the token without the token
+// ever crossing the wire, and neither the offered nor the accepted flags can
+// be changed on the way. The client proves itself first: the server reveals
+// nothing derived from the token to a peer that does not hold it. A server
+// that does not speak the client's version answers the hello with a reject
+// frame.
+//
+// The accepted flags are the hello flags the server understood and was
+// configured to accept, so a client can tell which optional features it may
+// use.
+
+const (
+	protocolVersion byte = 2
+
+	frameHello     byte = 0x01
+	frameChallenge byte = 0x02
+	frameResponse  byte = 0x03
+	frameAccept    byte = 0x04
+	frameReject    byte = 0x05
+
+	// Sent by a reverse server first on every stream, see transport.go
+	frameTarget byte = 0x06
+
+	// Sent first on streams and links carrying a TCP connection, see proxyproto.go
+	frameOrigin byte = 0x07
+
+	// Sent by a dynamic client first on every stream or link and answered
+	// by the server, see dynamic.go
+	frameDestination byte = 0x08
+	frameDialResult  byte = 0x09
+
+	// Sent by a client resuming streams first on every stream and answered
+	// by the server when attaching, see resume.go
+	frameResume  byte = 0x0a
+	frameResumed byte = 0x0b
+
+	// Hello flags
+	flagMux     byte = 0x01
+	flagOrigin  byte = 0x02
+	flagDynamic byte = 0x04
+	flagResume  byte = 0x08
+
+	// Link compression, at most one is offered, see compress.go
+	flagZstd   byte = 0x10
+	flagSnappy byte = 0x20
+
+	// Flags this version understands
+	supportedFlags = flagMux | flagOrigin | flagDynamic | flagResume | flagZstd | flagSnappy
+
+	nonceSize = 32
+	proofSize = sha256.Size
+
+	maxFrameSize     = 1024
+	handshakeTimeout = 10 * time.Second
+)
+
+// Rejection reasons sent in a reject frame
+const (
+	rejectMalformed   byte = 0x01
+	rejectVersion     byte = 0x02
+	rejectBadToken    byte = 0x03
+	rejectServerError byte = 0x04
+)
+
+// handshakeError is returned when the peer refuses the handshake
+type handshakeError struct {
+	Reason  byte
+	Message string
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("handshake rejected (reason %d): %s", e.Reason, e.Message)
+}
+
+// clientHello is the first frame a client sends on a new link
+type clientHello struct {
+	Version byte
+	Flags   byte
+	Nonce   []byte
+
+	// Accepted holds the flags the server accepted
+	Accepted byte
+}
+
+// clientHandshake authenticates a new link to the server and returns the
+// flags the server accepted
+func clientHandshake(conn net.Conn, token string, flags byte) (byte, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		return 0, err
+	}
+
+	hello := append([]byte{protocolVersion, flags}, clientNonce...)
+	if err := writeFrame(conn, frameHello, hello); err != nil {
+		return 0, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read challenge: %w", err)
+	}
+	if frameType == frameReject {
+		return 0, parseReject(payload)
+	}
+	if frameType != frameChallenge || len(payload) != 1+nonceSize {
+		return 0, fmt.Errorf("unexpected handshake frame 0x%02x", frameType)
+	}
+	if payload[0] != protocolVersion {
+		return 0, fmt.Errorf("unsupported server version %d", payload[0])
+	}
+
+	transcript := handshakeTranscript(hello, payload[1:])
+	if err := writeFrame(conn, frameResponse, handshakeProof(token, "client", transcript)); err != nil {
+		return 0, fmt.Errorf("failed to send response: %w", err)
+	}
+
+	frameType, payload, err = readFrame(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read handshake result: %w", err)
+	}
+	switch frameType {
+	case frameAccept:
+		if len(payload) != 1+proofSize {
+			return 0, fmt.Errorf("malformed accept frame")
+		}
+		if !hmac.Equal(payload[1:], handshakeProof(token, "server", transcript, payload[:1])) {
+			return 0, fmt.Errorf("server failed to prove token")
+		}
+		return payload[0] & flags, nil
+	case frameReject:
+		return 0, parseReject(payload)
+	default:
+		return 0, fmt.Errorf("unexpected handshake frame 0x%02x", frameType)
+	}
+}
+
+// serverHandshake authenticates a link opened by a client and returns its
+// hello, accepting the hello flags in accept
+func serverHandshake(conn net.Conn, token string, accept byte) (*clientHello, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello: %w", err)
+	}
+	if frameType != frameHello || len(payload) != 2+nonceSize {
+		return nil, rejectHandshake(conn, rejectMalformed, "malformed hello")
+	}
+
+	helloPayload := payload
+	hello := &clientHello{
+		Version: payload[0],
+		Flags:   payload[1],
+		Nonce:   payload[2:],
+	}
+	if hello.Version != protocolVersion {
+		return nil, rejectHandshake(conn, rejectVersion, fmt.Sprintf("unsupported version %d", hello.Version))
+	}
+
+	serverNonce, err := newNonce()
+	if err != nil {
+		return nil, rejectHandshake(conn, rejectServerError, "internal error")
+	}
+
+	challenge := append([]byte{protocolVersion}, serverNonce...)
+	if err := writeFrame(conn, frameChallenge, challenge); err != nil {
+		return nil, fmt.Errorf("failed to send challenge: %w", err)
+	}
+
+	frameType, payload, err = readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if frameType != frameResponse {
+		return nil, rejectHandshake(conn, rejectMalformed, "expected response")
+	}
+	transcript := handshakeTranscript(helloPayload, serverNonce)
+	if !hmac.Equal(payload, handshakeProof(token, "client", transcript)) {
+		return nil, rejectHandshake(conn, rejectBadToken, "invalid token")
+	}
+
+	hello.Accepted = hello.Flags & accept
+	accepted := []byte{hello.Accepted}
+	if err := writeFrame(conn, frameAccept, append(accepted, handshakeProof(token, "server", transcript, accepted)...)); err != nil {
+		return nil, fmt.Errorf("failed to send accept: %w", err)
+	}
+	return hello, nil
+}
+
+// rejectHandshake tells the client why it was refused and returns the same error
+func rejectHandshake(conn net.Conn, reason byte, message string) error {
+	writeFrame(conn, frameReject, append([]byte{reason}, message...))
+	return &handshakeError{Reason: reason, Message: message}
+}
+
+func parseReject(payload []byte) error {
+	if len(payload) == 0 {
+		return &handshakeError{Reason: rejectMalformed, Message: "empty reject frame"}
+	}
+	return &handshakeError{Reason: payload[0], Message: string(payload[1:])}
+}
+
+// handshakeTranscript is what both proofs cover: the hello payload and the
+// server nonce
+func handshakeTranscript(hello, serverNonce []byte) []byte {
+	transcript := make([]byte, 0, len(hello)+len(serverNonce))
+	transcript = append(transcript, hello...)
+	return append(transcript, serverNonce...)
+}
+
+func handshakeProof(token, role string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(role))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+func writeFrame(w io.Writer, frameType byte, payload []byte) error {
+	frame := make([]byte, 3+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(payload)))
+	copy(frame[3:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint16(header[1:3])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("handshake frame too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// UDP datagram authentication
+//
+// UDP has no session to hang a handshake on, so every datagram between a
+// tunnel client and server is sealed on its own:
+//
+//	version (1) | sender (8) | sequence (8) | timestamp (8, unix nanoseconds) |
+//	payload | tag (16)
+//
+// The tag is HMAC-SHA256 keyed with the token over a direction label
+// ("client" or "server"), the header and the payload, truncated to 16 bytes.
+// The label stops a datagram from being reflected back at its sender.
+//
+// Every sealing end picks a random sender ID and numbers its datagrams from
+// 1. The opening end keeps a replay window per sender, the highest sequence
+// seen and a bitmap of the replayWindowSize before it, and drops datagrams
+// it has already opened or that fall behind the window. Datagrams whose
+// timestamp is more than udpMaxSkew away from the local clock are dropped
+// too, so a window can be forgotten once its sender has been quiet for
+// twice that long.
+
+const (
+	// datagramVersion is the sealing format, which changes independently of
+	// the handshake
+	datagramVersion byte = 2
+
+	udpSenderSize = 8
+	udpHeaderSize = 1 + udpSenderSize + 8 + 8
+	udpTagSize    = 16
+	udpMaxSkew    = 30 * time.Second
+
+	// replayWindowSize is how far behind the highest sequence of a sender a
+	// datagram may arrive and still be opened
+	replayWindowSize = 64
+
+	udpLabelClient = "client"
+	udpLabelServer = "server"
+)
+
+// datagramSealer seals the datagrams one end of a link sends in the
+// direction of its label
+type datagramSealer struct {
+	token    string
+	label    string
+	sender   [udpSenderSize]byte
+	sequence atomic.Uint64
+}
+
+func newDatagramSealer(token, label string) (*datagramSealer, error) {
+	s := &datagramSealer{token: token, label: label}
+	if _, err := rand.Read(s.sender[:]); err != nil {
+		return nil, fmt.Errorf("failed to pick datagram sender: %w", err)
+	}
+	return s, nil
+}
+
+// seal wraps a payload for transmission
+func (s *datagramSealer) seal(payload []byte) []byte {
+	packet := make([]byte, udpHeaderSize, udpHeaderSize+len(payload)+udpTagSize)
+	packet[0] = datagramVersion
+	copy(packet[1:], s.sender[:])
+	binary.BigEndian.PutUint64(packet[1+udpSenderSize:], s.sequence.Add(1))
+	binary.BigEndian.PutUint64(packet[1+udpSenderSize+8:], uint64(time.Now().UnixNano()))
+	packet = append(packet, payload...)
+	return append(packet, datagramTag(s.token, s.label, packet)...)
+}
+
+// datagramOpener opens the datagrams one end of a link receives from the
+// direction of its label, dropping replays
+type datagramOpener struct {
+	token string
+	label string
+
+	mu      sync.Mutex
+	windows map[[udpSenderSize]byte]*replayWindow
+	swept   time.Time
+}
+
+func newDatagramOpener(token, label string) *datagramOpener {
+	return &datagramOpener{
+		token:   token,
+		label:   label,
+		windows: make(map[[udpSenderSize]byte]*replayWindow),
+		swept:   time.Now(),
+	}
+}
+
+// open verifies a sealed datagram and returns its payload
+func (o *datagramOpener) open(packet []byte) ([]byte, error) {
+	if len(packet) < udpHeaderSize+udpTagSize {
+		return nil, fmt.Errorf("datagram too short")
+	}
+	if packet[0] != datagramVersion {
+		return nil, fmt.Errorf("unsupported datagram version %d", packet[0])
+	}
+
+	body := packet[:len(packet)-udpTagSize]
+	if !hmac.Equal(packet[len(body):], datagramTag(o.token, o.label, body)) {
+		return nil, fmt.Errorf("invalid datagram tag")
+	}
+
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(packet[1+udpSenderSize+8:])))
+	if skew := time.Since(sent); skew > udpMaxSkew || skew < -udpMaxSkew {
+		return nil, fmt.Errorf("datagram timestamp outside allowed window")
+	}
+
+	var sender [udpSenderSize]byte
+	copy(sender[:], packet[1:])
+	if !o.accept(sender, binary.BigEndian.Uint64(packet[1+udpSenderSize:])) {
+		return nil, fmt.Errorf("replayed datagram")
+	}
+	return body[udpHeaderSize:], nil
+}
+
+// accept records a sequence number of sender, reporting whether it is new
+func (o *datagramOpener) accept(sender [udpSenderSize]byte, sequence uint64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(o.swept) > udpMaxSkew {
+		// A datagram of a sender quiet this long fails the timestamp check
+		for id, window := range o.windows {
+			if now.Sub(window.seen) > 2*udpMaxSkew {
+				delete(o.windows, id)
+			}
+		}
+		o.swept = now
+	}
+
+	window, exists := o.windows[sender]
+	if !exists {
+		window = &replayWindow{}
+		o.windows[sender] = window
+	}
+	if !window.accept(sequence) {
+		return false
+	}
+	window.seen = now
+	return true
+}
+
+// replayWindow tracks the sequence numbers opened from one sender: the
+// highest, and in bitmap those up to replayWindowSize behind it, bit n
+// standing for highest-n
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64
+	seen    time.Time
+}
+
+// accept marks sequence as opened, reporting false if it already was or
+// is too far behind to tell
+func (w *replayWindow) accept(sequence uint64) bool {
+	if sequence == 0 {
+		return false
+	}
+	if sequence > w.highest {
+		if shift := sequence - w.highest; shift < replayWindowSize {
+			w.bitmap = w.bitmap<<shift | 1
+		} else {
+			w.bitmap = 1
+		}
+		w.highest = sequence
+		return true
+	}
+
+	offset := w.highest - sequence
+	if offset >= replayWindowSize || w.bitmap&(1<<offset) != 0 {
+		return false
+	}
+	w.bitmap |= 1 << offset
+	return true
+}
+
+func datagramTag(token, label string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(label))
+	mac.Write(body)
+	return mac.Sum(nil)[:udpTagSize]
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func runHandshake(clientToken, serverToken string, flags byte) (*clientHello, error, error) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	type result struct {
+		hello *clientHello
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		hello, err := serverHandshake(serverConn, serverToken, supportedFlags)
+		serverConn.Close()
+		done <- result{hello, err}
+	}()
+
+	_, clientErr := clientHandshake(clientConn, clientToken, flags)
+	clientConn.Close()
+	server := <-done
+	return server.hello, server.err, clientErr
+}
+
+func TestHandshakeAccepts(t *testing.T) {
+	hello, serverErr, clientErr := runHandshake("shared-token-0123456789", "shared-token-0123456789", flagMux)
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("handshake failed: server=%v client=%v", serverErr, clientErr)
+	}
+	if hello.Version != protocolVersion {
+		t.Fatalf("unexpected version %d", hello.Version)
+	}
+	if hello.Flags&flagMux == 0 {
+		t.Fatal("mux flag was not carried in hello")
+	}
+}
+
+func TestHandshakeAcceptsOnlyKnownFlags(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serverHandshake(serverConn, "shared-token-0123456789", supportedFlags)
+
+	accepted, err := clientHandshake(clientConn, "shared-token-0123456789", flagOrigin|0x80)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if accepted != flagOrigin {
+		t.Fatalf("expected only the origin flag to be accepted, got 0x%02x", accepted)
+	}
+}
+
+func TestHandshakeRejectsWrongToken(t *testing.T) {
+	_, serverErr, clientErr := runHandshake("client-token-0123456789", "server-token-0123456789", 0)
+	if serverErr == nil {
+		t.Fatal("server accepted a client with the wrong token")
+	}
+	if clientErr == nil {
+		t.Fatal("client accepted a server with the wrong token")
+	}
+}
+
+func TestHandshakeRevealsNothingBeforeClientProof(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serverHandshake(serverConn, "shared-token-0123456789", supportedFlags)
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := append([]byte{protocolVersion, 0}, make([]byte, nonceSize)...)
+	if err := writeFrame(clientConn, frameHello, hello); err != nil {
+		t.Fatalf("failed to write hello: %v", err)
+	}
+	frameType, payload, err := readFrame(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read challenge: %v", err)
+	}
+	if frameType != frameChallenge || len(payload) != 1+nonceSize {
+		t.Fatalf("challenge carries more than a nonce: frame 0x%02x, %d bytes", frameType, len(payload))
+	}
+
+	if err := writeFrame(clientConn, frameResponse, make([]byte, proofSize)); err != nil {
+		t.Fatalf("failed to write response: %v", err)
+	}
+	if frameType, _, err := readFrame(clientConn); err != nil || frameType != frameReject {
+		t.Fatalf("expected a reject for a bad proof, got frame 0x%02x: %v", frameType, err)
+	}
+}
+
+func TestHandshakeDetectsTamperedFlags(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		frame byte
+		flip  func(payload []byte)
+	}{
+		{"hello", frameHello, func(payload []byte) { payload[1] &^= flagZstd }},
+		{"accept", frameAccept, func(payload []byte) { payload[0] &^= flagMux }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, clientSide := net.Pipe()
+			serverSide, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			// An on-path relay strips a flag from one frame
+			tamper := func(from, to net.Conn) {
+				defer to.Close()
+				for {
+					frameType, payload, err := readFrame(from)
+					if err != nil {
+						return
+					}
+					if frameType == tt.frame {
+						tt.flip(payload)
+					}
+					if writeFrame(to, frameType, payload) != nil {
+						return
+					}
+				}
+			}
+			go tamper(clientSide, serverSide)
+			go tamper(serverSide, clientSide)
+
+			serverErr := make(chan error, 1)
+			go func() {
+				_, err := serverHandshake(serverConn, "shared-token-0123456789", supportedFlags)
+				serverErr <- err
+			}()
+
+			_, clientErr := clientHandshake(clientConn, "shared-token-0123456789", flagMux|flagZstd)
+			if clientErr == nil {
+				t.Fatal("the client accepted a handshake whose flags were changed")
+			}
+			if tt.frame == frameHello && <-serverErr == nil {
+				t.Fatal("the server accepted a hello whose flags were changed")
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsUnknownVersion(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go serverHandshake(serverConn, "shared-token-0123456789", supportedFlags)
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	hello := append([]byte{protocolVersion + 1, 0}, make([]byte, nonceSize)...)
+	if err := writeFrame(clientConn, frameHello, hello); err != nil {
+		t.Fatalf("failed to write hello: %v", err)
+	}
+
+	frameType, payload, err := readFrame(clientConn)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if frameType != frameReject || payload[0] != rejectVersion {
+		t.Fatalf("expected version rejection, got frame 0x%02x reason %v", frameType, payload)
+	}
+}
+
+func TestDatagramSealing(t *testing.T) {
+	token := "shared-token-0123456789"
+	payload := []byte("wireguard handshake")
+
+	sealer, err := newDatagramSealer(token, udpLabelClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := sealer.seal(payload)
+
+	if _, err := newDatagramOpener(token, udpLabelServer).open(packet); err == nil {
+		t.Fatal("datagram was accepted in the reverse direction")
+	}
+	if _, err := newDatagramOpener("other-token-0123456789", udpLabelClient).open(packet); err == nil {
+		t.Fatal("datagram was accepted with the wrong token")
+	}
+
+	opener := newDatagramOpener(token, udpLabelClient)
+	tampered := append([]byte(nil), packet...)
+	tampered[udpHeaderSize] ^= 0xff
+	if _, err := opener.open(tampered); err == nil {
+		t.Fatal("tampered datagram was accepted")
+	}
+
+	opened, err := opener.open(packet)
+	if err != nil {
+		t.Fatalf("failed to open datagram: %v", err)
+	}
+	if !bytes.Equal(opened, payload) {
+		t.Fatalf("payload mismatch: %q", opened)
+	}
+}
+
+func TestDatagramReplayDropped(t *testing.T) {
+	token := "shared-token-0123456789"
+	sealer, err := newDatagramSealer(token, udpLabelClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener := newDatagramOpener(token, udpLabelClient)
+
+	var packets [][]byte
+	for range replayWindowSize + 10 {
+		packets = append(packets, sealer.seal([]byte("datagram")))
+	}
+
+	// Out of order within the window is fine, once each
+	for _, i := range []int{1, 0, 3, 2} {
+		if _, err := opener.open(packets[i]); err != nil {
+			t.Fatalf("datagram %d was dropped: %v", i, err)
+		}
+	}
+	if _, err := opener.open(packets[0]); err == nil {
+		t.Fatal("a replayed datagram was opened")
+	}
+
+	// Far behind the highest sequence cannot be told apart from a replay
+	if _, err := opener.open(packets[len(packets)-1]); err != nil {
+		t.Fatalf("latest datagram was dropped: %v", err)
+	}
+	if _, err := opener.open(packets[4]); err == nil {
+		t.Fatal("a datagram behind the window was opened")
+	}
+
+	// Another sender has a window of its own
+	other, err := newDatagramSealer(token, udpLabelClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opener.open(other.seal([]byte("datagram"))); err != nil {
+		t.Fatalf("another sender's first datagram was dropped: %v", err)
+	}
+}
+
+func TestUDPLinkDropsReplayedDatagrams(t *testing.T) {
+	tm := newTunnelManager(&Config{Token: "test-token-0123456789"})
+	defer tm.cancel()
+
+	listener, err := udpTransport{}.Listen(tm, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	// A captured datagram resent from another address starts no flow
+	sealer, err := newDatagramSealer(tm.config.Token, udpLabelClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := sealer.seal([]byte("captured"))
+	for range 2 {
+		conn, err := net.Dial("udp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer conn.Close()
+		conn.Write(captured)
+	}
+
+	flow, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("accept failed: %v", err)
+	}
+	defer flow.Close()
+	buffer := make([]byte, 64)
+	if n, err := flow.Read(buffer); err != nil || string(buffer[:n]) != "captured" {
+		t.Fatalf("read %q, %v", buffer[:n], err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if replayed, err := listener.Accept(); err == nil {
+			accepted <- replayed
+		}
+	}()
+	select {
+	case replayed := <-accepted:
+		replayed.Close()
+		t.Fatal("the replayed datagram was accepted as a new flow")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
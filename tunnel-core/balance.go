@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Target pools
+//
+// A target may list several backends separated by commas, each optionally
+// weighted with @weight:
+//
+//	-target 10.0.0.1:80,10.0.0.2:80@3
+//
+// Forward entries take the same lists (listen=10.0.0.1:80,10.0.0.2:80).
+// Every distinct list is a pool that new connections are spread over
+// according to -balance:
+//
+//	round-robin  members in turn
+//	least-conn   the member with the fewest open connections for its weight
+//	weighted     members in turn, each picked in proportion to its weight
+//	source-hash  the same member for the same client IP while it is healthy
+//
+// A member that fails -health-fails health checks or dials in a row is
+// ejected and gets no new connections until it passes -health-passes checks
+// in a row. -health-check tcp connects to every member each -health-interval
+// and -health-check http also GETs -health-path from it, expecting a 2xx or
+// 3xx answer. Without health checks an ejected member is tried again once
+// -health-interval has passed, and a successful dial takes it back.
+//
+// A TCP dial that fails is retried on the next member the balancer picks,
+// each member at most once. When every member is ejected all of them are
+// tried anyway. UDP flows are spread the same way but never retried, since a
+// UDP dial cannot tell whether the target is up.
+//
+// Pools and the health of their members are listed under "targets" in /stats.
+
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceWeighted   = "weighted"
+	balanceSourceHash = "source-hash"
+
+	maxTargetWeight = 100
+
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+	defaultHealthFails    = 3
+	defaultHealthPasses   = 2
+)
+
+// poolMember is one target of a pool
+type poolMember struct {
+	addr   string
+	weight int
+
+	active atomic.Int64 // open connections
+	picked atomic.Int64 // connections ever sent to it
+
+	// current is the smooth weighted round robin state, guarded by the pool
+	current int
+
+	mu        sync.Mutex
+	healthy   bool
+	fails     int // failures in a row
+	passes    int // passed checks in a row while ejected
+	ejectedAt time.Time
+	lastCheck time.Time
+	lastError string
+}
+
+// targetPool spreads connections over the members of one target list
+type targetPool struct {
+	tm      *TunnelManager
+	spec    string
+	members []*poolMember
+	cancel  context.CancelFunc
+
+	mu   sync.Mutex
+	next int
+}
+
+// parseTargetPool parses a comma separated target list
+func parseTargetPool(spec string) ([]*poolMember, error) {
+	var members []*poolMember
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		addr, weightSpec, weighted := strings.Cut(entry, "@")
+
+		weight := 1
+		if weighted {
+			n, err := strconv.Atoi(weightSpec)
+			if err != nil || n < 1 || n > maxTargetWeight {
+				return nil, fmt.Errorf("invalid weight %q for target %s, use 1-%d", weightSpec, addr, maxTargetWeight)
+			}
+			weight = n
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid target %q: %w", entry, err)
+		}
+		members = append(members, &poolMember{addr: addr, weight: weight, healthy: true})
+	}
+	return members, nil
+}
+
+// validBalance reports whether tunnel-core implements a -balance strategy
+func validBalance(balance string) bool {
+	switch balance {
+	case balanceRoundRobin, balanceLeastConn, balanceWeighted, balanceSourceHash:
+		return true
+	}
+	return false
+}
+
+// targetPool returns the pool of a target list, creating it and starting
+// its health checks on first use
+func (tm *TunnelManager) targetPool(spec string) (*targetPool, error) {
+	tm.poolsMu.Lock()
+	defer tm.poolsMu.Unlock()
+
+	if pool, ok := tm.pools[spec]; ok {
+		return pool, nil
+	}
+
+	members, err := parseTargetPool(spec)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(tm.ctx)
+	pool := &targetPool{tm: tm, spec: spec, members: members, cancel: cancel}
+	tm.pools[spec] = pool
+
+	if tm.config.HealthCheck != "" {
+		go pool.checkHealth(ctx)
+	}
+	return pool, nil
+}
+
+// retainPools stops the pools of target lists no longer in use
+func (tm *TunnelManager) retainPools(specs map[string]bool) {
+	tm.poolsMu.Lock()
+	defer tm.poolsMu.Unlock()
+
+	for spec, pool := range tm.pools {
+		if !specs[spec] {
+			pool.cancel()
+			delete(tm.pools, spec)
+		}
+	}
+}
+
+// startPools creates the pools of target lists up front, so their health
+// checks run before the first connection
+func (tm *TunnelManager) startPools(specs map[string]bool) error {
+	for spec := range specs {
+		if spec == "" {
+			continue
+		}
+		if _, err := tm.targetPool(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialTarget connects to a TCP target, or a member of a target pool, and
+// starts the connection with a PROXY protocol header for origin when the
+// tunnel sends one. It records the member dialed on c when the target is a
+// pool.
+func (tm *TunnelManager) dialTarget(spec string, origin *connOrigin, c *connection) (net.Conn, error) {
+	pool, err := tm.targetPool(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var source string
+	if origin.known() {
+		source = origin.source.IP.String()
+	} else if c != nil {
+		source = c.host
+	}
+
+	tried := make(map[*poolMember]bool)
+	var lastErr error
+	for {
+		member := pool.pick(source, tried)
+		if member == nil {
+			return nil, lastErr
+		}
+		tried[member] = true
+
+		conn, err := tm.dialMember(member, origin)
+		if err != nil {
+			pool.report(member, false, err, false)
+			lastErr = err
+			if len(pool.members) > 1 {
+				log.Printf("Failed to connect to target %s, trying another: %v", member.addr, err)
+			}
+			continue
+		}
+		pool.report(member, true, nil, false)
+
+		if len(pool.members) > 1 && c != nil {
+			c.setTarget(member.addr)
+		}
+		member.picked.Add(1)
+		member.active.Add(1)
+		return &poolConn{Conn: conn, member: member}, nil
+	}
+}
+
+// dialMember dials one pool member and sends the PROXY header
+func (tm *TunnelManager) dialMember(member *poolMember, origin *connOrigin) (net.Conn, error) {
+	conn, err := tm.dialer().Dial("tcp", member.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	version := tm.proxyProtocol()
+	if version == "" {
+		return conn, nil
+	}
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	if _, err := conn.Write(proxyHeader(version, origin)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send PROXY header: %w", err)
+	}
+	return conn, nil
+}
+
+// pickUDPTarget returns the member of a target list a new UDP flow from
+// source goes to
+func (tm *TunnelManager) pickUDPTarget(spec, source string) (string, error) {
+	pool, err := tm.targetPool(spec)
+	if err != nil {
+		return "", err
+	}
+	member := pool.pick(remoteHost(source), nil)
+	member.picked.Add(1)
+	return member.addr, nil
+}
+
+// poolConn is a connection to a pool member, counted as open until closed
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() {
+		c.member.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// pick chooses the member for a new connection from source among those not
+// tried yet, nil when there is none left to try
+func (p *targetPool) pick(source string, tried map[*poolMember]bool) *poolMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var candidates, untried []*poolMember
+	anyHealthy := false
+	for _, member := range p.members {
+		available := p.available(member, now)
+		anyHealthy = anyHealthy || available
+		if tried[member] {
+			continue
+		}
+		untried = append(untried, member)
+		if available {
+			candidates = append(candidates, member)
+		}
+	}
+	if len(candidates) == 0 {
+		if anyHealthy {
+			return nil
+		}
+		// Everything is ejected, which may be the checks' mistake
+		candidates = untried
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.tm.config.Balance {
+	case balanceLeastConn:
+		best := candidates[0]
+		for _, member := range candidates[1:] {
+			if member.active.Load()*int64(best.weight) < best.active.Load()*int64(member.weight) {
+				best = member
+			}
+		}
+		return best
+
+	case balanceWeighted:
+		// Smooth weighted round robin, as nginx does it
+		total := 0
+		var best *poolMember
+		for _, member := range candidates {
+			member.current += member.weight
+			total += member.weight
+			if best == nil || member.current > best.current {
+				best = member
+			}
+		}
+		best.current -= total
+		return best
+
+	case balanceSourceHash:
+		// Rendezvous hashing keeps most sources on their member when
+		// another member comes or goes
+		var best *poolMember
+		var bestScore uint32
+		for _, member := range candidates {
+			h := fnv.New32a()
+			h.Write([]byte(source))
+			h.Write([]byte(member.addr))
+			if score := h.Sum32(); best == nil || score > bestScore {
+				best, bestScore = member, score
+			}
+		}
+		return best
+
+	default:
+		member := candidates[p.next%len(candidates)]
+		p.next++
+		return member
+	}
+}
+
+// available reports whether a member takes new connections
+func (p *targetPool) available(member *poolMember, now time.Time) bool {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+
+	if member.healthy {
+		return true
+	}
+	// Without health checks nothing else would bring the member back
+	return p.tm.config.HealthCheck == "" && now.Sub(member.ejectedAt) >= p.tm.healthInterval()
+}
+
+// report records the result of a dial or health check against a member,
+// ejecting it or taking it back when its results say so
+func (p *targetPool) report(member *poolMember, ok bool, err error, check bool) {
+	member.mu.Lock()
+	defer member.mu.Unlock()
+
+	if check {
+		member.lastCheck = time.Now()
+	}
+
+	if !ok {
+		member.passes = 0
+		member.fails++
+		member.lastError = err.Error()
+		if !member.healthy {
+			member.ejectedAt = time.Now()
+			return
+		}
+		if member.fails >= orDefault(p.tm.config.HealthFails, defaultHealthFails) {
+			member.healthy = false
+			member.ejectedAt = time.Now()
+			log.Printf("Target %s ejected after %d failures: %v", member.addr, member.fails, err)
+		}
+		return
+	}
+
+	member.fails = 0
+	if member.healthy {
+		member.lastError = ""
+		return
+	}
+	// With health checks on, only checks take a member back
+	if check {
+		member.passes++
+	}
+	if !check && p.tm.config.HealthCheck != "" {
+		return
+	}
+	if check && member.passes < orDefault(p.tm.config.HealthPasses, defaultHealthPasses) {
+		return
+	}
+	member.healthy = true
+	member.passes = 0
+	member.lastError = ""
+	log.Printf("Target %s is healthy again", member.addr)
+}
+
+// healthInterval returns how often members are checked, and how long an
+// ejected member waits without checks
+func (tm *TunnelManager) healthInterval() time.Duration {
+	if tm.config.HealthInterval > 0 {
+		return tm.config.HealthInterval
+	}
+	return defaultHealthInterval
+}
+
+func orDefault(n, fallback int) int {
+	if n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// checkHealth checks every member each health interval until ctx ends
+func (p *targetPool) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(p.tm.healthInterval())
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, member := range p.members {
+			wg.Add(1)
+			go func(member *poolMember) {
+				defer wg.Done()
+				err := p.tm.checkMember(ctx, member.addr)
+				if ctx.Err() != nil {
+					return
+				}
+				p.report(member, err == nil, err, true)
+			}(member)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkMember runs one health check against addr
+func (tm *TunnelManager) checkMember(ctx context.Context, addr string) error {
+	timeout := tm.config.HealthTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if tm.config.HealthCheck != "http" {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := tm.config.HealthPath
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		// Redirects count as healthy, there is no need to follow them
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// targetPoolStats describes a pool in /stats
+type targetPoolStats struct {
+	Target  string              `json:"target"`
+	Balance string              `json:"balance"`
+	Members []targetMemberStats `json:"members"`
+}
+
+// targetMemberStats describes one member of a pool
+type targetMemberStats struct {
+	Address           string     `json:"address"`
+	Weight            int        `json:"weight"`
+	Healthy           bool       `json:"healthy"`
+	ActiveConnections int64      `json:"active_connections"`
+	Connections       int64      `json:"connections"`
+	Failures          int        `json:"consecutive_failures"`
+	LastCheck         *time.Time `json:"last_check,omitempty"`
+	LastError         string     `json:"last_error,omitempty"`
+}
+
+// poolStats snapshots every pool in use, ordered by target
+func (tm *TunnelManager) poolStats() []targetPoolStats {
+	tm.poolsMu.Lock()
+	pools := make([]*targetPool, 0, len(tm.pools))
+	for _, pool := range tm.pools {
+		pools = append(pools, pool)
+	}
+	tm.poolsMu.Unlock()
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].spec < pools[j].spec
+	})
+
+	result := make([]targetPoolStats, len(pools))
+	for i, pool := range pools {
+		result[i] = targetPoolStats{Target: pool.spec, Balance: tm.config.Balance}
+		for _, member := range pool.members {
+			member.mu.Lock()
+			info := targetMemberStats{
+				Address:           member.addr,
+				Weight:            member.weight,
+				Healthy:           member.healthy,
+				ActiveConnections: member.active.Load(),
+				Connections:       member.picked.Load(),
+				Failures:          member.fails,
+				LastError:         member.lastError,
+			}
+			if !member.lastCheck.IsZero() {
+				lastCheck := member.lastCheck
+				info.LastCheck = &lastCheck
+			}
+			member.mu.Unlock()
+			result[i].Members = append(result[i].Members, info)
+		}
+	}
+	return result
+}
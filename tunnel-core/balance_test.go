@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseTargetPool(t *testing.T) {
+	members, err := parseTargetPool("10.0.0.1:80, 10.0.0.2:80@3")
+	if err != nil {
+		t.Fatalf("parseTargetPool failed: %v", err)
+	}
+	if len(members) != 2 || members[0].addr != "10.0.0.1:80" || members[0].weight != 1 || members[1].addr != "10.0.0.2:80" || members[1].weight != 3 {
+		t.Fatalf("unexpected members %+v %+v", members[0], members[1])
+	}
+
+	for _, spec := range []string{"", "10.0.0.1", "10.0.0.1:80,", "10.0.0.1:80@0", "10.0.0.1:80@101", "10.0.0.1:80@x"} {
+		if _, err := parseTargetPool(spec); err == nil {
+			t.Errorf("parseTargetPool(%q) succeeded", spec)
+		}
+	}
+}
+
+// newTestPool builds a pool for spec without starting health checks
+func newTestPool(t *testing.T, balance, spec string) *targetPool {
+	t.Helper()
+	tm := newTunnelManager(&Config{Balance: balance})
+	t.Cleanup(tm.cancel)
+
+	pool, err := tm.targetPool(spec)
+	if err != nil {
+		t.Fatalf("targetPool failed: %v", err)
+	}
+	return pool
+}
+
+// countPicks picks n members from pool and counts them by address
+func countPicks(pool *targetPool, source string, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[pool.pick(source, nil).addr]++
+	}
+	return counts
+}
+
+func TestBalanceStrategies(t *testing.T) {
+	t.Run("round-robin", func(t *testing.T) {
+		pool := newTestPool(t, balanceRoundRobin, "a:1,b:1@5,c:1")
+		counts := countPicks(pool, "", 9)
+		if counts["a:1"] != 3 || counts["b:1"] != 3 || counts["c:1"] != 3 {
+			t.Fatalf("round robin ignores weights, got %v", counts)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		pool := newTestPool(t, balanceWeighted, "a:1,b:1@3")
+		counts := countPicks(pool, "", 8)
+		if counts["a:1"] != 2 || counts["b:1"] != 6 {
+			t.Fatalf("expected a 1:3 spread, got %v", counts)
+		}
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		pool := newTestPool(t, balanceLeastConn, "a:1,b:1@2")
+		pool.members[0].active.Store(2)
+		pool.members[1].active.Store(3)
+		if member := pool.pick("", nil); member.addr != "b:1" {
+			t.Fatalf("expected the member with fewer connections for its weight, got %s", member.addr)
+		}
+	})
+
+	t.Run("source-hash", func(t *testing.T) {
+		pool := newTestPool(t, balanceSourceHash, "a:1,b:1,c:1")
+		first := pool.pick("203.0.113.7", nil)
+		for i := 0; i < 10; i++ {
+			if member := pool.pick("203.0.113.7", nil); member != first {
+				t.Fatalf("source moved from %s to %s", first.addr, member.addr)
+			}
+		}
+
+		// Ejecting another member keeps the source where it is
+		for _, member := range pool.members {
+			if member != first {
+				member.healthy = false
+				member.ejectedAt = time.Now()
+				break
+			}
+		}
+		if member := pool.pick("203.0.113.7", nil); member != first {
+			t.Fatalf("source moved from %s to %s after an ejection", first.addr, member.addr)
+		}
+	})
+}
+
+func TestTargetPoolRetriesAndEjects(t *testing.T) {
+	up, down := startBannerServer(t, "up\n"), freeAddr(t)
+	listen, local := freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:        "server",
+		Protocol:    "tcp",
+		Listen:      listen,
+		Target:      down + "," + up,
+		Token:       "test-token-0123456789",
+		Balance:     balanceRoundRobin,
+		HealthFails: 2,
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:     "client",
+		Protocol: "tcp",
+		Server:   listen,
+		Local:    local,
+		Token:    "test-token-0123456789",
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	// Every connection reaches the live member, dials to the dead one are
+	// retried until it is ejected
+	for i := 0; i < 4; i++ {
+		expectBanner(t, local, "up\n")
+	}
+
+	pools := server.poolStats()
+	if len(pools) != 1 || len(pools[0].Members) != 2 {
+		t.Fatalf("expected one pool with two members, got %+v", pools)
+	}
+	for _, member := range pools[0].Members {
+		if healthy := member.Address == up; member.Healthy != healthy {
+			t.Fatalf("member %s healthy = %v, want %v", member.Address, member.Healthy, healthy)
+		}
+	}
+}
+
+func TestHealthChecksEjectAndReadmit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start target: %v", err)
+	}
+	addr := l.Addr().String()
+
+	tm := newTunnelManager(&Config{
+		Balance:        balanceRoundRobin,
+		HealthCheck:    "tcp",
+		HealthInterval: 20 * time.Millisecond,
+		HealthTimeout:  time.Second,
+		HealthFails:    1,
+		HealthPasses:   2,
+	})
+	defer tm.cancel()
+	if err := tm.startPools(map[string]bool{addr: true}); err != nil {
+		t.Fatalf("startPools failed: %v", err)
+	}
+
+	waitHealthy := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if member := tm.poolStats()[0].Members[0]; member.Healthy == want && member.LastCheck != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("member never became healthy = %v", want)
+	}
+
+	waitHealthy(true)
+	l.Close()
+	waitHealthy(false)
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %v", addr, err)
+	}
+	defer l.Close()
+	waitHealthy(true)
+}
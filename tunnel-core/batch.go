@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+)
+
+// udpBatchSize is the most datagrams one recvmmsg or sendmmsg call moves
+const udpBatchSize = 16
+
+// udpBatchConn reads and writes the datagrams of a UDP socket shared by many
+// flows in batches. On Linux a batch is one recvmmsg or sendmmsg call, on
+// other platforms ipv4.PacketConn moves one datagram per call. An IPv6
+// socket writes to IPv4 peers one datagram at a time, as sendmmsg would
+// need their v4-mapped addresses.
+type udpBatchConn struct {
+	conn  *net.UDPConn
+	batch *ipv4.PacketConn
+	ipv6  bool
+	debug bool
+
+	// Datagrams read but not yet handed out by read
+	reads   []ipv4.Message
+	read    int
+	pending int
+
+	sends chan udpSend
+	done  chan struct{}
+	once  sync.Once
+}
+
+// udpSend is a datagram waiting in a udpBatchConn's send queue
+type udpSend struct {
+	buffer *[]byte
+	n      int
+	addr   *net.UDPAddr
+}
+
+func newUDPBatchConn(conn *net.UDPConn, debug bool) *udpBatchConn {
+	c := &udpBatchConn{
+		conn:  conn,
+		batch: ipv4.NewPacketConn(conn),
+		debug: debug,
+		reads: make([]ipv4.Message, udpBatchSize),
+		sends: make(chan udpSend, 4*udpBatchSize),
+		done:  make(chan struct{}),
+	}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		c.ipv6 = local.IP.To4() == nil
+	}
+	for i := range c.reads {
+		c.reads[i].Buffers = [][]byte{make([]byte, maxDatagramSize)}
+	}
+	go c.sendBatches()
+	return c
+}
+
+// readFrom returns the next datagram and its sender. The datagram is only
+// valid until the next call.
+func (c *udpBatchConn) readFrom() ([]byte, *net.UDPAddr, error) {
+	for {
+		for c.read == c.pending {
+			n, err := c.batch.ReadBatch(c.reads, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			c.read, c.pending = 0, n
+		}
+
+		message := &c.reads[c.read]
+		c.read++
+		if peer, ok := message.Addr.(*net.UDPAddr); ok {
+			return message.Buffers[0][:message.N], peer, nil
+		}
+	}
+}
+
+// WriteToUDP queues a datagram to addr. It only fails once the connection
+// is closed, like writing to a UDP socket the datagram may still be lost.
+func (c *udpBatchConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if c.ipv6 && addr.IP.To4() != nil {
+		return c.conn.WriteToUDP(b, addr)
+	}
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	buffer := datagramBuffers.get()
+	send := udpSend{buffer: buffer, n: copy(*buffer, b), addr: addr}
+	select {
+	case c.sends <- send:
+		return len(b), nil
+	case <-c.done:
+		datagramBuffers.put(buffer)
+		return 0, net.ErrClosed
+	}
+}
+
+// sendBatches writes the queued datagrams, as many per call as are waiting
+func (c *udpBatchConn) sendBatches() {
+	queued := make([]udpSend, 0, udpBatchSize)
+	messages := make([]ipv4.Message, udpBatchSize)
+	for i := range messages {
+		messages[i].Buffers = make([][]byte, 1)
+	}
+
+	for {
+		select {
+		case send := <-c.sends:
+			queued = append(queued[:0], send)
+		case <-c.done:
+			return
+		}
+	fill:
+		for len(queued) < udpBatchSize {
+			select {
+			case send := <-c.sends:
+				queued = append(queued, send)
+			default:
+				break fill
+			}
+		}
+
+		for i, send := range queued {
+			messages[i].Buffers[0] = (*send.buffer)[:send.n]
+			messages[i].Addr = send.addr
+		}
+		for sent := 0; sent < len(queued); {
+			n, err := c.batch.WriteBatch(messages[sent:len(queued)], 0)
+			if err != nil || n == 0 {
+				// The batch is dropped like datagrams a full socket drops
+				if c.debug {
+					log.Printf("UDP batch write error: %v", err)
+				}
+				break
+			}
+			sent += n
+		}
+		for _, send := range queued {
+			datagramBuffers.put(send.buffer)
+		}
+	}
+}
+
+// Close stops the send queue, the socket itself belongs to the caller
+func (c *udpBatchConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
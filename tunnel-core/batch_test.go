@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenUDP listens for UDP on a loopback address of network
+func listenUDP(tb testing.TB, network, address string) *net.UDPConn {
+	tb.Helper()
+	conn, err := net.ListenUDP(network, &net.UDPAddr{IP: net.ParseIP(address)})
+	if err != nil {
+		tb.Skipf("no %s loopback: %v", network, err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestUDPBatchConnEchoes(t *testing.T) {
+	for _, tt := range []struct{ network, address, peer string }{
+		{"udp4", "127.0.0.1", "127.0.0.1"},
+		{"udp6", "::1", "::1"},
+		// IPv4 peers of a dual-stack socket are written one at a time
+		{"udp", "::", "127.0.0.1"},
+	} {
+		t.Run(tt.network+" "+tt.address, func(t *testing.T) {
+			server := listenUDP(t, tt.network, tt.address)
+			batch := newUDPBatchConn(server, false)
+			defer batch.Close()
+
+			go func() {
+				for {
+					datagram, peer, err := batch.readFrom()
+					if err != nil {
+						return
+					}
+					batch.WriteToUDP(datagram, peer)
+				}
+			}()
+
+			port := server.LocalAddr().(*net.UDPAddr).Port
+			client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(tt.peer), Port: port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			// Bursts fill batches, each reply must match its datagram
+			buffer := make([]byte, 1024)
+			for burst := 0; burst < 10; burst++ {
+				for i := 0; i < udpBatchSize; i++ {
+					fmt.Fprintf(client, "datagram %d.%d", burst, i)
+				}
+				for i := 0; i < udpBatchSize; i++ {
+					client.SetReadDeadline(time.Now().Add(5 * time.Second))
+					n, err := client.Read(buffer)
+					if err != nil {
+						t.Fatalf("reply %d.%d: %v", burst, i, err)
+					}
+					if want := fmt.Sprintf("datagram %d.%d", burst, i); string(buffer[:n]) != want {
+						t.Fatalf("got %q, want %q", buffer[:n], want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUDPBatchConnClose(t *testing.T) {
+	batch := newUDPBatchConn(listenUDP(t, "udp4", "127.0.0.1"), false)
+	batch.Close()
+	if _, err := batch.WriteToUDP([]byte("late"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}); err != net.ErrClosed {
+		t.Fatalf("write after close returned %v, want net.ErrClosed", err)
+	}
+}
+
+// BenchmarkUDPRead reads datagrams a sender keeps sending, one per operation
+func BenchmarkUDPRead(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		read func(conn *net.UDPConn) func() error
+	}{
+		{"ReadFromUDP", func(conn *net.UDPConn) func() error {
+			buffer := make([]byte, maxDatagramSize)
+			return func() error {
+				_, _, err := conn.ReadFromUDP(buffer)
+				return err
+			}
+		}},
+		{"batch", func(conn *net.UDPConn) func() error {
+			batch := newUDPBatchConn(conn, false)
+			return func() error {
+				_, _, err := batch.readFrom()
+				return err
+			}
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			server := listenUDP(b, "udp4", "127.0.0.1")
+			read := bm.read(server)
+
+			client, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				datagram := make([]byte, 1200)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+						client.Write(datagram)
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.SetBytes(1200)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := read(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkUDPWrite writes one datagram to one of several peers per
+// operation, as flows answering through one socket do
+func BenchmarkUDPWrite(b *testing.B) {
+	for _, bm := range []struct {
+		name  string
+		write func(conn *net.UDPConn) func([]byte, *net.UDPAddr) error
+	}{
+		{"WriteToUDP", func(conn *net.UDPConn) func([]byte, *net.UDPAddr) error {
+			return func(b []byte, addr *net.UDPAddr) error {
+				_, err := conn.WriteToUDP(b, addr)
+				return err
+			}
+		}},
+		{"batch", func(conn *net.UDPConn) func([]byte, *net.UDPAddr) error {
+			batch := newUDPBatchConn(conn, false)
+			return func(b []byte, addr *net.UDPAddr) error {
+				_, err := batch.WriteToUDP(b, addr)
+				return err
+			}
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			write := bm.write(listenUDP(b, "udp4", "127.0.0.1"))
+
+			var peers []*net.UDPAddr
+			for i := 0; i < 4; i++ {
+				peer := listenUDP(b, "udp4", "127.0.0.1")
+				peers = append(peers, peer.LocalAddr().(*net.UDPAddr))
+			}
+
+			datagram := make([]byte, 1200)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(datagram)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := write(datagram, peers[i%len(peers)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+func (tm *TunnelManager) startClient() error {
+	if tm.config.Server == "" && len(tm.config.Forwards) == 0 {
+		return fmt.Errorf("server address is required in client mode")
+	}
+
+	spec, err := tm.protocolSpec()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tm.config.Local != "" || len(tm.config.Forwards) > 0:
+		return tm.startForwardClient()
+	case !spec.mux && tm.config.Protocol != "tcp":
+		return fmt.Errorf("reverse mode requires a multiplexed protocol, got %s", tm.config.Protocol)
+	}
+
+	log.Printf("Starting %s client connecting to %s -> %s", tm.config.Protocol, tm.config.Server, tm.config.Target)
+
+	if err := tm.startPools(map[string]bool{tm.config.Target: true}); err != nil {
+		return err
+	}
+
+	// Keep one link per pool slot so the server can spread streams across them
+	links := 1
+	if tm.config.MuxStreams > 1 {
+		links = tm.config.MuxStreams
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < links; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tm.maintainReverseLink()
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// maintainReverseLink keeps one link to the server open until shutdown,
+// backing off while the server cannot be reached
+func (tm *TunnelManager) maintainReverseLink() {
+	retry := tm.newBackoff()
+	connected := false
+	for {
+		err := tm.runClientSession(func() {
+			if connected {
+				stats.Reconnects.Add(1)
+			}
+			connected = true
+			retry.reset()
+		})
+		if tm.ctx.Err() != nil {
+			return
+		}
+
+		delay := retry.next()
+		log.Printf("Tunnel connection lost: %v, reconnecting in %s", err, delay.Round(time.Millisecond))
+
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runClientSession holds one control connection to the server and serves the
+// streams it opens until the connection drops. onConnect runs once the
+// connection is authenticated.
+func (tm *TunnelManager) runClientSession(onConnect func()) error {
+	conn, err := tm.dialLink(tm.config.Server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	compressed, flags, err := tm.clientLinkHandshake(conn, flagMux|flagOrigin)
+	if err != nil {
+		return err
+	}
+	tm.tuneLink(conn)
+
+	link := &meteredConn{Conn: compressed}
+	session, err := yamux.Client(link, tm.muxConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create yamux session: %w", err)
+	}
+	defer session.Close()
+
+	tracked := tm.trackSession(tm.config.Server, session, link, flags)
+	defer tm.untrackSession(tracked)
+
+	onConnect()
+	log.Printf("Connected to server %s", tm.config.Server)
+
+	go func() {
+		select {
+		case <-tm.ctx.Done():
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return fmt.Errorf("session closed: %w", err)
+		}
+
+		tm.wg.Add(1)
+		go tm.handleReverseStream(tm.wrapStream(stream), tracked)
+	}
+}
+
+func (tm *TunnelManager) handleReverseStream(stream net.Conn, tracked *trackedSession) {
+	defer tm.wg.Done()
+	defer stream.Close()
+
+	targetAddr, err := tm.readStreamTarget(stream)
+	if err != nil {
+		log.Printf("Dropping tunnel stream: %v", err)
+		stats.Errors.Add(1)
+		return
+	}
+
+	c, err := tm.openConnection("stream", tracked.remote, targetAddr, tracked.id)
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	if tm.forwardsUDP() {
+		tm.handleUDPStream(stream, targetAddr, c)
+		return
+	}
+
+	var origin *connOrigin
+	if tracked.flags&flagOrigin != 0 {
+		if origin, err = readOrigin(stream); err != nil {
+			log.Printf("Dropping tunnel stream: %v", err)
+			stats.Errors.Add(1)
+			c.fail(err.Error())
+			return
+		}
+	}
+
+	target, err := tm.dialTarget(targetAddr, origin, c)
+	if err != nil {
+		log.Printf("Failed to connect to target %s: %v", targetAddr, err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
+		return
+	}
+	defer target.Close()
+
+	tm.handleDirectConnection(stream, target, c)
+}
+
+// startForwardClient accepts local connections and carries each one to the
+// server, which forwards it to its own target
+func (tm *TunnelManager) startForwardClient() error {
+	forwards := forwardTable(tm.config, tm.config.Local, tm.config.Server)
+
+	// Forwards to the same server address share one pool
+	pools := make(map[string]*muxPool)
+	if tm.useMux() {
+		for _, fwd := range forwards {
+			if pools[fwd.Target] == nil {
+				pool := newMuxPool(tm, fwd.Target, tm.config.MuxStreams)
+				pools[fwd.Target] = pool
+				go pool.maintain()
+			}
+		}
+	}
+
+	return tm.serveForwards(forwards, func(fwd PortForward) error {
+		if tm.forwardsUDP() {
+			return tm.startForwardUDPClient(fwd, pools[fwd.Target])
+		}
+		return tm.startForwardTCPClient(fwd, pools[fwd.Target])
+	})
+}
+
+// startForwardTCPClient carries connections accepted on a local address to
+// the server address it forwards to
+func (tm *TunnelManager) startForwardTCPClient(fwd PortForward, pool *muxPool) error {
+	listener, err := tm.listenTCP(fwd.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer tm.closeOnDrain(listener)()
+
+	if tm.config.Dynamic {
+		log.Printf("Dynamic %s client proxying on %s through %s", tm.config.Protocol, fwd.Listen, fwd.Target)
+	} else {
+		log.Printf("Forward %s client listening on %s -> %s", tm.config.Protocol, fwd.Listen, fwd.Target)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if tm.draining() {
+				return nil
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+
+		tm.wg.Add(1)
+		if tm.config.Dynamic {
+			go tm.handleProxyConnection(conn, fwd.Target, pool)
+		} else {
+			go tm.handleForwardConnection(conn, fwd.Target, pool)
+		}
+	}
+}
+
+// startForwardUDPClient carries each local UDP flow to the server over its
+// own mux stream, or its own link when the tunnel is not multiplexed
+func (tm *TunnelManager) startForwardUDPClient(fwd PortForward, pool *muxPool) error {
+	addr, err := net.ResolveUDPAddr("udp", fwd.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to resolve local address: %w", err)
+	}
+
+	conn, err := tm.listenUDP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen UDP: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-tm.ctx.Done()
+		conn.Close()
+	}()
+
+	openStream := func(server string) (net.Conn, error) {
+		return tm.openLink(server, nil)
+	}
+	if pool != nil {
+		openStream = func(string) (net.Conn, error) {
+			return pool.openStream(nil)
+		}
+	}
+
+	log.Printf("Forward %s client listening on UDP %s -> %s", tm.config.Protocol, fwd.Listen, fwd.Target)
+	return tm.serveUDPFlows(conn, fwd, openStream)
+}
+
+func (tm *TunnelManager) handleForwardConnection(localConn net.Conn, server string, pool *muxPool) {
+	defer tm.wg.Done()
+	defer localConn.Close()
+
+	c, err := tm.openConnection("local", localConn.RemoteAddr().String(), server, "")
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	if pool != nil {
+		stream, err := pool.openStream(originOf(localConn))
+		if err != nil {
+			log.Printf("Failed to open mux stream: %v", err)
+			stats.Errors.Add(1)
+			c.fail(fmt.Sprintf("failed to open mux stream: %v", err))
+			return
+		}
+		defer stream.Close()
+
+		tm.handleDirectConnection(localConn, stream, c)
+		return
+	}
+
+	serverConn, err := tm.openLink(server, originOf(localConn))
+	if err != nil {
+		log.Printf("Failed to open link to %s: %v", server, err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to open link: %v", err))
+		return
+	}
+	defer serverConn.Close()
+
+	tm.handleDirectConnection(localConn, serverConn, c)
+}
+
+// openLink dials a raw link to the server that carries a single connection
+// or UDP flow. A link carrying a TCP connection offers its origin, UDP flows
+// pass a nil origin.
+func (tm *TunnelManager) openLink(server string, origin *connOrigin) (net.Conn, error) {
+	conn, err := tm.dialLink(server)
+	if err != nil {
+		return nil, err
+	}
+
+	// Raw links the transport authenticated carry no handshake
+	if tm.skipsHandshake() {
+		return conn, nil
+	}
+
+	var offer byte
+	if origin != nil {
+		offer = flagOrigin
+	}
+	compressed, flags, err := tm.clientLinkHandshake(conn, offer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if flags&flagOrigin != 0 {
+		if err := writeOrigin(compressed, origin); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return compressed, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a loopback address with a port that is currently free
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEchoServer starts a TCP server that echoes every line back
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dialEventually retries dialing until the address accepts connections
+func dialEventually(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to dial %s: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// startTunnel starts a server and, unless clientConfig is nil, a client
+// connected to it, and waits for both to listen. Modes, the token, free
+// loopback addresses and the client's protocol and server are filled in
+// where the configs leave them empty.
+func startTunnel(t *testing.T, serverConfig, clientConfig *Config) (server, client *TunnelManager) {
+	t.Helper()
+	transport := protocols[serverConfig.Protocol].transport
+	if serverConfig.Mode == "" {
+		serverConfig.Mode = "server"
+	}
+	if serverConfig.Token == "" {
+		serverConfig.Token = "test-token-0123456789"
+	}
+	if serverConfig.Listen == "" {
+		if transport == "udp" || transport == "quic" {
+			serverConfig.Listen = freeUDPAddr(t)
+		} else {
+			serverConfig.Listen = freeAddr(t)
+		}
+	}
+
+	server = newTunnelManager(serverConfig)
+	t.Cleanup(server.cancel)
+	go server.startServer()
+	if transport == "udp" || transport == "quic" {
+		// Nothing answers a probe, give the socket a moment instead
+		time.Sleep(100 * time.Millisecond)
+	} else {
+		dialEventually(t, serverConfig.Listen).Close()
+	}
+	if clientConfig == nil {
+		return server, nil
+	}
+
+	if clientConfig.Mode == "" {
+		clientConfig.Mode = "client"
+	}
+	if clientConfig.Protocol == "" {
+		clientConfig.Protocol = serverConfig.Protocol
+	}
+	if clientConfig.Server == "" {
+		clientConfig.Server = serverConfig.Listen
+	}
+	if clientConfig.Token == "" {
+		clientConfig.Token = serverConfig.Token
+	}
+	forwardsUDP := protocols[clientConfig.Protocol].udp || clientConfig.UDP
+	if clientConfig.Local == "" {
+		if forwardsUDP {
+			clientConfig.Local = freeUDPAddr(t)
+		} else {
+			clientConfig.Local = freeAddr(t)
+		}
+	}
+
+	client = newTunnelManager(clientConfig)
+	t.Cleanup(client.cancel)
+	go client.startClient()
+	if !forwardsUDP {
+		dialEventually(t, clientConfig.Local).Close()
+	}
+	return server, client
+}
+
+func TestReverseTunnel(t *testing.T) {
+	target := startEchoServer(t)
+	bind := freeAddr(t)
+	public := freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcp",
+		Listen:   public,
+		Bind:     bind,
+		Token:    "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, bind).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:     "client",
+		Protocol: "tcp",
+		Server:   bind,
+		Target:   target,
+		Token:    "test-token-0123456789",
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	// Wait for the client session to register on the server
+	deadline := time.Now().Add(5 * time.Second)
+	for server.pickSession() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel client never connected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	conn := dialEventually(t, public)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if line != "hello\n" {
+		t.Fatalf("unexpected echo: %q", line)
+	}
+}
+
+func TestReverseTunnelRejectsBadToken(t *testing.T) {
+	bind := freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcp",
+		Listen:   freeAddr(t),
+		Bind:     bind,
+		Token:    "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+
+	conn := dialEventually(t, bind)
+	defer conn.Close()
+
+	if _, err := clientHandshake(conn, "wrong-token-0123456789", flagMux); err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+}
+
+func TestForwardMuxTunnel(t *testing.T) {
+	target := startEchoServer(t)
+	listen := freeAddr(t)
+	local := freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:            "server",
+		Protocol:        "tcp",
+		Listen:          listen,
+		Target:          target,
+		Token:           "test-token-0123456789",
+		MuxStreamBuffer: 65536,
+		MuxHeartbeat:    30,
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:            "client",
+		Protocol:        "tcp",
+		Server:          listen,
+		Local:           local,
+		Token:           "test-token-0123456789",
+		MuxEnabled:      true,
+		MuxStreams:      2,
+		MuxFrameSize:    4,
+		MuxStreamBuffer: 65536,
+		MuxHeartbeat:    30,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	// Several concurrent connections share the two pooled links
+	for i := 0; i < 4; i++ {
+		conn := dialEventually(t, local)
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("multiplexed\n")); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if line != "multiplexed\n" {
+			t.Fatalf("unexpected echo: %q", line)
+		}
+	}
+
+	server.mu.RLock()
+	links := len(server.sessions)
+	server.mu.RUnlock()
+	if links != 2 {
+		t.Fatalf("expected 2 pooled links, got %d", links)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Link compression
+//
+// -compress zstd or -compress snappy compresses everything a link carries
+// after its handshake: origin and target frames, the mux session or the raw
+// connection. A client offers the algorithm it was configured with as a
+// hello flag and the server accepts it only when it was configured with the
+// same one, so a link is compressed when both ends ask for it and runs
+// uncompressed otherwise. Raw WebSocket links and h2 and grpc links have no
+// handshake and offer the algorithm in an X-Tunnel-Compression header of
+// their request instead, which the server echoes in its response when it
+// accepts.
+//
+// Every write to a compressed link is flushed as it is made, so interactive
+// traffic is never held back waiting for a block to fill. zstd runs at its
+// fastest level with a 1 MiB window and snappy is written in the snappy
+// framing format. The datagrams of the udp protocol and the QUIC datagrams
+// of uquic are not compressed.
+//
+// The stats endpoint reports the bytes that went through compression and
+// the bytes they took on the wire, with the ratio and the bytes saved.
+
+const (
+	compressionNone   = "none"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+
+	// compressionHeader offers and accepts the algorithm of raw WebSocket
+	// links and HTTP/2 links
+	compressionHeader = "X-Tunnel-Compression"
+
+	// zstdWindow bounds the memory a zstd link uses at either end
+	zstdWindow = 1 << 20
+)
+
+// compressionFlags maps algorithms to the hello flags that offer them
+var compressionFlags = map[string]byte{
+	compressionZstd:   flagZstd,
+	compressionSnappy: flagSnappy,
+}
+
+// validCompression reports whether name is an algorithm -compress takes
+func validCompression(name string) bool {
+	_, ok := compressionFlags[name]
+	return ok || name == "" || name == compressionNone
+}
+
+// compressionFlag returns the hello flag of the configured algorithm, 0 for none
+func (tm *TunnelManager) compressionFlag() byte {
+	return compressionFlags[tm.config.Compression]
+}
+
+// acceptFlags returns the hello flags a server accepts, which leaves out
+// the algorithms it was not configured with
+func (tm *TunnelManager) acceptFlags() byte {
+	return supportedFlags&^(flagZstd|flagSnappy) | tm.compressionFlag()
+}
+
+// compressionName returns the algorithm accepted flags compress with
+func compressionName(flags byte) string {
+	for name, flag := range compressionFlags {
+		if flags&flag != 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// clientLinkHandshake authenticates a new link to the server offering flags
+// and the configured compression, and compresses the link when the server
+// accepted it
+func (tm *TunnelManager) clientLinkHandshake(conn net.Conn, offer byte) (net.Conn, byte, error) {
+	flags, err := clientHandshake(conn, tm.config.Token, offer|tm.compressionFlag())
+	if err != nil {
+		return nil, 0, err
+	}
+	compressed, err := compressLink(conn, flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	return compressed, flags, nil
+}
+
+// compressLink compresses conn with the algorithm accepted flags name, or
+// returns it as it is when they name none
+func compressLink(conn net.Conn, flags byte) (net.Conn, error) {
+	wire := &wireConn{Conn: conn}
+	c := &compressedConn{Conn: conn}
+
+	switch compressionName(flags) {
+	case compressionZstd:
+		encoder, err := zstd.NewWriter(wire,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindow),
+			zstd.WithLowerEncoderMem(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		decoder, err := zstd.NewReader(wire,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(zstdWindow))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		c.writer, c.reader = encoder, decoder
+	case compressionSnappy:
+		c.writer = s2.NewWriter(wire, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+		c.reader = s2.NewReader(wire)
+	default:
+		return conn, nil
+	}
+	return c, nil
+}
+
+// compressWriter is the compressing side of a link
+type compressWriter interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// compressedConn compresses what is written to a link and decompresses what
+// is read from it
+type compressedConn struct {
+	net.Conn
+	reader io.Reader
+
+	writeMu sync.Mutex
+	writer  compressWriter
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	stats.Uncompressed.Add(int64(n))
+	return n, err
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if _, err := c.writer.Write(b); err != nil {
+		return 0, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return 0, err
+	}
+	stats.Uncompressed.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// CloseWrite ends the compressed stream and then the link's write side
+func (c *compressedConn) CloseWrite() error {
+	c.writeMu.Lock()
+	err := c.writer.Close()
+	c.writeMu.Unlock()
+
+	closeWrite(c.Conn)
+	return err
+}
+
+// wireConn counts the compressed bytes a link carries
+type wireConn struct {
+	net.Conn
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	stats.Compressed.Add(int64(n))
+	return n, err
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	stats.Compressed.Add(int64(n))
+	return n, err
+}
+
+// compressionRatio returns how many bytes went through compression per byte
+// on the wire, 0 before any did
+func compressionRatio(uncompressed, compressed int64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(uncompressed) / float64(compressed)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// sendCounted sends payload through the tunnel at local to a counting
+// server and checks its answer
+func sendCounted(t *testing.T, local string, payload []byte) {
+	t.Helper()
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if want := fmt.Sprintf("read %d\n", len(payload)); string(reply) != want {
+		t.Fatalf("got %q, want %q", reply, want)
+	}
+}
+
+func TestCompressedTunnel(t *testing.T) {
+	payload := bytes.Repeat([]byte("compressible tunnel payload "), 32*1024)
+	for _, protocol := range []string{"tcp", "ws", "tcpmux", "wsmux"} {
+		for _, compression := range []string{compressionZstd, compressionSnappy} {
+			t.Run(protocol+" "+compression, func(t *testing.T) {
+				_, client := startTunnel(t,
+					&Config{Protocol: protocol, Target: startCountingServer(t), Compression: compression},
+					&Config{MuxStreams: 1, Compression: compression})
+				local := client.config.Local
+
+				uncompressed, compressed := stats.Uncompressed.Load(), stats.Compressed.Load()
+				sendCounted(t, local, payload)
+				uncompressed = stats.Uncompressed.Load() - uncompressed
+				compressed = stats.Compressed.Load() - compressed
+
+				// Both ends count the payload on its way through
+				if uncompressed < 2*int64(len(payload)) {
+					t.Fatalf("%d bytes went through compression, want at least %d", uncompressed, 2*len(payload))
+				}
+				if compressed == 0 || compressed*4 > uncompressed {
+					t.Fatalf("%d bytes compressed to %d", uncompressed, compressed)
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionNeedsBothEnds(t *testing.T) {
+	for _, protocol := range []string{"tcp", "ws", "tcpmux"} {
+		for _, ends := range [][2]string{
+			{compressionNone, compressionZstd},
+			{compressionZstd, compressionNone},
+			{compressionZstd, compressionSnappy},
+		} {
+			t.Run(fmt.Sprintf("%s server %s client %s", protocol, ends[0], ends[1]), func(t *testing.T) {
+				_, client := startTunnel(t,
+					&Config{Protocol: protocol, Target: startCountingServer(t), Compression: ends[0]},
+					&Config{MuxStreams: 1, Compression: ends[1]})
+				local := client.config.Local
+
+				compressed := stats.Compressed.Load()
+				sendCounted(t, local, bytes.Repeat([]byte("x"), 64*1024))
+				if n := stats.Compressed.Load() - compressed; n != 0 {
+					t.Fatalf("%d bytes were compressed", n)
+				}
+			})
+		}
+	}
+}
+
+func TestHandshakeAcceptsConfiguredCompression(t *testing.T) {
+	tm := newTunnelManager(&Config{Mode: "server", Token: "shared-token-0123456789", Compression: compressionSnappy})
+	defer tm.cancel()
+
+	for _, tt := range []struct {
+		offer, want byte
+	}{
+		{flagMux | flagSnappy, flagMux | flagSnappy},
+		{flagMux | flagZstd, flagMux},
+	} {
+		clientConn, serverConn := net.Pipe()
+		go serverHandshake(serverConn, "shared-token-0123456789", tm.acceptFlags())
+
+		accepted, err := clientHandshake(clientConn, "shared-token-0123456789", tt.offer)
+		clientConn.Close()
+		serverConn.Close()
+		if err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if accepted != tt.want {
+			t.Fatalf("offered 0x%02x, accepted 0x%02x, want 0x%02x", tt.offer, accepted, tt.want)
+		}
+	}
+}
+
+func TestParseFlagsRejectsCompression(t *testing.T) {
+	if _, err := parseFlags([]string{"-compress", "gzip", "-token", "test-token-0123456789"}); err == nil {
+		t.Fatal("parseFlags accepted gzip compression")
+	}
+	config, err := parseFlags([]string{"-compress", "zstd", "-token", "test-token-0123456789"})
+	if err != nil {
+		t.Fatalf("parseFlags rejected zstd: %v", err)
+	}
+	if config.Compression != compressionZstd {
+		t.Fatalf("compression %q, want zstd", config.Compression)
+	}
+}
+
+// BenchmarkCompressedLink writes 1 MiB of text through a compressed link
+// per operation
+func BenchmarkCompressedLink(b *testing.B) {
+	payload := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 1024*1024/48)
+	for _, compression := range []string{compressionNone, compressionZstd, compressionSnappy} {
+		b.Run(compression, func(b *testing.B) {
+			writer, reader := tcpPair(b)
+			defer writer.Close()
+			defer reader.Close()
+
+			flag := compressionFlags[compression]
+			out, err := compressLink(writer, flag)
+			if err != nil {
+				b.Fatal(err)
+			}
+			in, err := compressLink(reader, flag)
+			if err != nil {
+				b.Fatal(err)
+			}
+			go io.Copy(io.Discard, in)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				for chunk := payload; len(chunk) > 0; chunk = chunk[min(len(chunk), copyBufferSize):] {
+					if _, err := out.Write(chunk[:min(len(chunk), copyBufferSize)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config files
+//
+// -config names a YAML file, or "-" for stdin, holding the same settings as
+// the flags. Keys are the flag names with dashes turned into underscores,
+// forwards is a list of -forward entries, sni_certs one of -sni entries,
+// hosts one of -host entries, headers one of -header entries and the
+// dynamic_* policies lists of networks or ports:
+//
+//	mode: server
+//	protocol: wssmux
+//	listen: 0.0.0.0:443
+//	target: 127.0.0.1:22
+//	token: <secret>
+//	cert: /etc/stunnel/cert.pem
+//	key: /etc/stunnel/key.pem
+//	forwards:
+//	  - 2000-2100=10.0.0.5
+//
+// Keeping the token in the file keeps it out of the process arguments.
+//
+// On SIGHUP the file is read again and reload applies what can change
+// without dropping links or sessions: forward targets, the HTTP router's
+// hosts, the dynamic forwarding policy, the UDP idle timeout, the connect
+// and read timeouts and lifetime of new connections, reconnect delays, the
+// resume grace, the drain timeout, traffic limits and TLS certificates, -sni
+// ones included. Other changes need a restart, which -reuse-port makes
+// seamless, see drain.go.
+
+// loadConfigFile reads the config file over config, then reapplies the flags
+// given on the command line so they take precedence
+func loadConfigFile(config *Config, flags *flag.FlagSet) error {
+	explicit := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	flagForwards := config.Forwards
+	flagSNICerts := config.SNICerts
+	flagHosts := config.Hosts
+	flagHeaders := config.Headers
+	flagDynamicAllow, flagDynamicDeny := config.DynamicAllow, config.DynamicDeny
+	flagDynamicPorts, flagDynamicDenyPorts := config.DynamicPorts, config.DynamicDenyPorts
+
+	var data []byte
+	var err error
+	if config.ConfigFile == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(config.ConfigFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to parse config file %s: %w", config.ConfigFile, err)
+	}
+
+	for name, value := range explicit {
+		switch name {
+		case "forward":
+			// Repeated flags cannot be set again from their joined value
+			config.Forwards = flagForwards
+		case "sni":
+			config.SNICerts = flagSNICerts
+		case "host":
+			config.Hosts = flagHosts
+		case "header":
+			config.Headers = flagHeaders
+		case "dynamic-allow":
+			config.DynamicAllow = flagDynamicAllow
+		case "dynamic-deny":
+			config.DynamicDeny = flagDynamicDeny
+		case "dynamic-ports":
+			config.DynamicPorts = flagDynamicPorts
+		case "dynamic-deny-ports":
+			config.DynamicDenyPorts = flagDynamicDenyPorts
+		case "config", "forwards-file":
+		default:
+			flags.Set(name, value)
+		}
+	}
+	return nil
+}
+
+// UnmarshalYAML reads forwards as a list of -forward entries
+func (l *forwardList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	forwards := forwardList{}
+	for _, spec := range specs {
+		if err := forwards.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = forwards
+	return nil
+}
+
+// UnmarshalYAML reads sni_certs as a list of -sni entries
+func (l *sniList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	certs := sniList{}
+	for _, spec := range specs {
+		if err := certs.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = certs
+	return nil
+}
+
+// UnmarshalYAML reads hosts as a list of -host entries
+func (l *hostList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	hosts := hostList{}
+	for _, spec := range specs {
+		if err := hosts.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = hosts
+	return nil
+}
+
+// UnmarshalYAML reads headers as a list of -header entries
+func (l *headerList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	headers := headerList{}
+	for _, spec := range specs {
+		if err := headers.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = headers
+	return nil
+}
+
+// UnmarshalYAML reads a list of networks, each entry like a -dynamic-allow flag
+func (l *netList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	networks := netList{}
+	for _, spec := range specs {
+		if err := networks.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = networks
+	return nil
+}
+
+// UnmarshalYAML reads a list of ports, each entry like a -dynamic-ports flag
+func (l *portList) UnmarshalYAML(value *yaml.Node) error {
+	var specs []string
+	if err := value.Decode(&specs); err != nil {
+		return err
+	}
+
+	ports := portList{}
+	for _, spec := range specs {
+		if err := ports.Set(spec); err != nil {
+			return err
+		}
+	}
+	*l = ports
+	return nil
+}
+
+// tlsSettingsChanged reports whether TLS settings a reload cannot apply differ
+func tlsSettingsChanged(current, next *Config) bool {
+	return next.TLS != current.TLS ||
+		next.CAFile != current.CAFile ||
+		next.TLSMinVersion != current.TLSMinVersion ||
+		next.TLSMaxVersion != current.TLSMaxVersion ||
+		next.TLSCiphers != current.TLSCiphers ||
+		next.ServerName != current.ServerName ||
+		next.InsecureSkipVerify != current.InsecureSkipVerify
+}
+
+// setRoutes records the target each listen address currently forwards to
+func (tm *TunnelManager) setRoutes(forwards []PortForward) {
+	tm.liveMu.Lock()
+	defer tm.liveMu.Unlock()
+
+	for _, fwd := range forwards {
+		tm.routes[fwd.Listen] = fwd.Target
+	}
+}
+
+// target returns where a forward's connections go now, which changes when a
+// reload moves its target
+func (tm *TunnelManager) target(fwd PortForward) string {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	if target, ok := tm.routes[fwd.Listen]; ok {
+		return target
+	}
+	return fwd.Target
+}
+
+// defaultTarget returns the configured -target
+func (tm *TunnelManager) defaultTarget() string {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+	return tm.config.Target
+}
+
+// reload applies a re-read configuration to the running tunnel. Targets and
+// target pools, the UDP idle timeout, the PROXY protocol version and TLS
+// certificates take effect for new connections and flows; listeners, links
+// and sessions already open are kept.
+func (tm *TunnelManager) reload(next *Config) error {
+	if next.Mode != tm.config.Mode || next.Protocol != tm.config.Protocol || next.Bind != tm.config.Bind || next.Token != tm.config.Token || next.Control != tm.config.Control || next.AcceptProxyProtocol != tm.config.AcceptProxyProtocol || next.HTTPSListen != tm.config.HTTPSListen || next.Dynamic != tm.config.Dynamic {
+		log.Println("Changes to mode, protocol, bind, token, control, accept_proxy_protocol, https_listen or dynamic need a restart and were not applied")
+	}
+	if tlsSettingsChanged(tm.config, next) {
+		log.Println("Changes to TLS settings other than certificates need a restart and were not applied")
+	}
+	if next.Balance != tm.config.Balance || next.HealthCheck != tm.config.HealthCheck || next.HealthPath != tm.config.HealthPath || next.HealthInterval != tm.config.HealthInterval || next.HealthTimeout != tm.config.HealthTimeout || next.HealthFails != tm.config.HealthFails || next.HealthPasses != tm.config.HealthPasses {
+		log.Println("Changes to balance or health check settings need a restart and were not applied")
+	}
+
+	if tm.config.Mode == "server" && tm.useTLS() || tm.config.Mode == "http" && tm.terminatesHTTPS() {
+		if err := tm.loadCertificates(next); err != nil {
+			return err
+		}
+	}
+	if tm.config.Mode == "http" {
+		if err := tm.reloadHosts(next); err != nil {
+			return err
+		}
+	}
+
+	routes := make(map[string]string)
+	if tm.config.Mode == "server" {
+		for _, fwd := range serverForwards(next) {
+			routes[fwd.Listen] = fwd.Target
+		}
+	}
+
+	// Pools of targets no forward uses any more stop their health checks.
+	// Reverse clients dial whatever the server names, so theirs stay.
+	if tm.config.Mode == "server" && tm.config.Bind == "" {
+		specs := make(map[string]bool)
+		for _, target := range routes {
+			specs[target] = true
+		}
+		if err := tm.startPools(specs); err != nil {
+			return err
+		}
+		tm.retainPools(specs)
+	}
+
+	tm.limits.configure(next)
+
+	tm.liveMu.Lock()
+	defer tm.liveMu.Unlock()
+
+	for listen, target := range routes {
+		if _, ok := tm.routes[listen]; !ok {
+			log.Printf("New forward on %s needs a restart and was not applied", listen)
+			continue
+		}
+		if tm.routes[listen] != target {
+			log.Printf("Forward on %s now goes to %s", listen, target)
+			tm.routes[listen] = target
+		}
+	}
+	for listen := range tm.routes {
+		if _, ok := routes[listen]; !ok && tm.config.Mode == "server" {
+			log.Printf("Forward on %s was removed, it keeps its target until a restart", listen)
+		}
+	}
+
+	tm.config.Target = next.Target
+	tm.config.UDPIdleTimeout = next.UDPIdleTimeout
+	tm.config.ConnectTimeout = next.ConnectTimeout
+	tm.config.ReadTimeout = next.ReadTimeout
+	tm.config.MaxLifetime = next.MaxLifetime
+	tm.config.ReconnectMin = next.ReconnectMin
+	tm.config.ReconnectMax = next.ReconnectMax
+	tm.config.ResumeGrace = next.ResumeGrace
+	tm.config.DrainTimeout = next.DrainTimeout
+	tm.config.ProxyProtocol = next.ProxyProtocol
+	tm.config.DynamicAllow = next.DynamicAllow
+	tm.config.DynamicDeny = next.DynamicDeny
+	tm.config.DynamicPorts = next.DynamicPorts
+	tm.config.DynamicDenyPorts = next.DynamicDenyPorts
+
+	log.Println("Configuration reloaded")
+	return nil
+}
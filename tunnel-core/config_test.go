@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tunnel.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseFlagsReadsConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+mode: client
+protocol: wsmux
+server: tunnel.example.com:443
+target: 127.0.0.1:22
+token: file-token-0123456789
+mux_streams: 4
+udp_idle_timeout: 30s
+forwards:
+  - 2000-2001=10.0.0.5
+`)
+
+	config, err := parseFlags([]string{"-config", path, "-target", "127.0.0.1:2222"})
+	if err != nil {
+		t.Fatalf("parseFlags failed: %v", err)
+	}
+
+	if config.Mode != "client" || config.Protocol != "wsmux" || config.Server != "tunnel.example.com:443" {
+		t.Errorf("file settings not applied: %+v", config)
+	}
+	if config.Token != "file-token-0123456789" {
+		t.Errorf("token = %q, want the file's token", config.Token)
+	}
+	if config.Target != "127.0.0.1:2222" {
+		t.Errorf("target = %q, command line flag should win", config.Target)
+	}
+	if config.MuxStreams != 4 || config.UDPIdleTimeout != 30*time.Second {
+		t.Errorf("mux_streams = %d, udp_idle_timeout = %s", config.MuxStreams, config.UDPIdleTimeout)
+	}
+	// Settings missing from the file keep their flag defaults
+	if config.MuxFrameSize != 32768 {
+		t.Errorf("mux_frame_size = %d, want the flag default", config.MuxFrameSize)
+	}
+
+	want := forwardList{
+		{Listen: ":2000", Target: "10.0.0.5:2000"},
+		{Listen: ":2001", Target: "10.0.0.5:2001"},
+	}
+	if !reflect.DeepEqual(config.Forwards, want) {
+		t.Errorf("forwards = %v, want %v", config.Forwards, want)
+	}
+}
+
+func TestParseFlagsRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "token: file-token-0123456789\nmux_stream: 4\n")
+
+	if _, err := parseFlags([]string{"-config", path}); err == nil {
+		t.Fatal("config file with an unknown key was accepted")
+	}
+}
+
+func TestReloadMovesTargets(t *testing.T) {
+	before, after := startBannerServer(t, "before\n"), startBannerServer(t, "after\n")
+	listen, local := freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Listen:   listen,
+		Target:   before,
+		Token:    "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:       "client",
+		Protocol:   "tcpmux",
+		Server:     listen,
+		Local:      local,
+		Token:      "test-token-0123456789",
+		MuxStreams: 1,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	expectBanner(t, local, "before\n")
+
+	err := server.reload(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Listen:   listen,
+		Target:   after,
+		Token:    "test-token-0123456789",
+	})
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+
+	// New streams on the existing mux session use the new target
+	expectBanner(t, local, "after\n")
+}
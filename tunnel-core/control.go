@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Control endpoint
+//
+// -control serves the tunnel's statistics over HTTP so the backend can poll
+// them, either on a unix socket (unix:/run/stunnel/<id>.sock) or on a TCP
+// address, which should stay on loopback:
+//
+//	GET /health       OK while the tunnel runs
+//	GET /stats        counters, reconnects, resumed streams and link
+//	                  compression included, process usage, the open mux
+//	                  sessions and the health of target pools as JSON
+//	GET /connections  open and recently closed connections with their traffic
+//	GET /destinations destinations dynamic clients asked for, numbered;
+//	                  ?after=<seq> lists only those after seq
+//
+// WebSocket servers answer /stats on their public listener as well.
+
+// controlStats is the /stats response
+type controlStats struct {
+	Mode              string         `json:"mode"`
+	Protocol          string         `json:"protocol"`
+	StartTime         time.Time      `json:"start_time"`
+	UptimeSeconds     float64        `json:"uptime_seconds"`
+	BytesIn           int64          `json:"bytes_in"`
+	BytesOut          int64          `json:"bytes_out"`
+	Connections       int64          `json:"connections"`
+	ActiveConnections int64          `json:"active_connections"`
+	Rejected          int64          `json:"rejected_connections"`
+	Dropped           int64          `json:"dropped_datagrams"`
+	Errors            int64          `json:"errors"`
+	Reconnects        int64          `json:"reconnects"`
+	ResumedStreams    int64          `json:"resumed_streams"`
+	OrphanedStreams   int64          `json:"orphaned_streams"`
+	UncompressedBytes int64          `json:"uncompressed_bytes"`
+	CompressedBytes   int64          `json:"compressed_bytes"`
+	CompressionRatio  float64        `json:"compression_ratio"`
+	CompressionSaved  int64          `json:"compression_saved_bytes"`
+	MemoryBytes       uint64         `json:"memory_bytes"`
+	CPUSeconds        float64        `json:"cpu_seconds"`
+	Draining          bool           `json:"draining"`
+	Sessions          []sessionStats `json:"sessions,omitempty"`
+
+	// Targets lists the target pools with the health of their members
+	Targets []targetPoolStats `json:"targets,omitempty"`
+}
+
+// sessionStats describes one open mux session
+type sessionStats struct {
+	ID          string    `json:"id"`
+	Remote      string    `json:"remote"`
+	Streams     int       `json:"streams"`
+	ConnectedAt time.Time `json:"connected_at"`
+	RTTMillis   float64   `json:"rtt_ms"`
+
+	// Bytes read from and written to the session's link, before
+	// compression, and the algorithm compressing it if any
+	BytesIn     int64  `json:"bytes_in"`
+	BytesOut    int64  `json:"bytes_out"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// sessionStats reports the open sessions, pinging each for its round trip time
+func (tm *TunnelManager) sessionStats() []sessionStats {
+	tm.mu.RLock()
+	tracked := make([]*trackedSession, 0, len(tm.sessions))
+	for _, ts := range tm.sessions {
+		tracked = append(tracked, ts)
+	}
+	tm.mu.RUnlock()
+
+	result := make([]sessionStats, len(tracked))
+	var wg sync.WaitGroup
+	for i, ts := range tracked {
+		result[i] = sessionStats{
+			ID:          ts.id,
+			Remote:      ts.remote,
+			Streams:     ts.session.NumStreams(),
+			ConnectedAt: ts.connectedAt,
+			BytesIn:     ts.link.read.Load(),
+			BytesOut:    ts.link.written.Load(),
+			Compression: compressionName(ts.flags),
+		}
+
+		// Pings wait on the peer, so send them all at once
+		wg.Add(1)
+		go func(i int, session *yamux.Session) {
+			defer wg.Done()
+			if rtt, err := session.Ping(); err == nil {
+				result[i].RTTMillis = float64(rtt.Microseconds()) / 1000
+			}
+		}(i, ts.session)
+	}
+	wg.Wait()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ConnectedAt.Before(result[j].ConnectedAt)
+	})
+	return result
+}
+
+// currentStats snapshots the tunnel's statistics
+func (tm *TunnelManager) currentStats() controlStats {
+	current := tm.totalStats()
+	current.Sessions = tm.sessionStats()
+	current.Targets = tm.poolStats()
+	return current
+}
+
+// totalStats snapshots the tunnel's totals, leaving out its sessions and
+// targets
+func (tm *TunnelManager) totalStats() controlStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	uncompressed, compressed := stats.Uncompressed.Load(), stats.Compressed.Load()
+	return controlStats{
+		Mode:              tm.config.Mode,
+		Protocol:          tm.config.Protocol,
+		StartTime:         stats.StartTime,
+		UptimeSeconds:     time.Since(stats.StartTime).Seconds(),
+		BytesIn:           stats.BytesIn.Load(),
+		BytesOut:          stats.BytesOut.Load(),
+		Connections:       stats.Connections.Load(),
+		ActiveConnections: stats.Active.Load(),
+		Rejected:          stats.Rejected.Load(),
+		Dropped:           stats.Dropped.Load(),
+		Errors:            stats.Errors.Load(),
+		Reconnects:        stats.Reconnects.Load(),
+		ResumedStreams:    stats.Resumed.Load(),
+		OrphanedStreams:   stats.Orphaned.Load(),
+		UncompressedBytes: uncompressed,
+		CompressedBytes:   compressed,
+		CompressionRatio:  compressionRatio(uncompressed, compressed),
+		CompressionSaved:  uncompressed - compressed,
+		MemoryBytes:       mem.Sys,
+		CPUSeconds:        processCPUSeconds(),
+		Draining:          tm.draining(),
+	}
+}
+
+func (tm *TunnelManager) handleStats(w http.ResponseWriter, r *http.Request) {
+	tm.writeJSON(w, tm.currentStats())
+}
+
+func (tm *TunnelManager) handleConnections(w http.ResponseWriter, r *http.Request) {
+	open, closed := tm.connections()
+	tm.writeJSON(w, map[string][]connectionInfo{
+		"open":   open,
+		"closed": closed,
+	})
+}
+
+func (tm *TunnelManager) handleDestinations(w http.ResponseWriter, r *http.Request) {
+	after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	tm.writeJSON(w, tm.destinationsAfter(after))
+}
+
+func (tm *TunnelManager) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil && tm.config.Debug {
+		log.Printf("Failed to write control response: %v", err)
+	}
+}
+
+// listenControl opens the control listener, replacing a stale unix socket
+// left behind by a previous run
+func listenControl(addr string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(addr, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	// A process taking over the tunnel replaces the socket while this one
+	// drains, so closing it leaves the path alone
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	return listener, nil
+}
+
+// startControlServer serves /health and /stats on addr until the manager stops
+func (tm *TunnelManager) startControlServer(addr string) error {
+	listener, err := listenControl(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control address %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "OK")
+	})
+	mux.HandleFunc("/stats", tm.handleStats)
+	mux.HandleFunc("/connections", tm.handleConnections)
+	mux.HandleFunc("/destinations", tm.handleDestinations)
+
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		<-tm.ctx.Done()
+		server.Close()
+	}()
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control endpoint error: %v", err)
+		}
+	}()
+
+	log.Printf("Control endpoint listening on %s", addr)
+	return nil
+}
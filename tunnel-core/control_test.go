@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestControlStats(t *testing.T) {
+	target, listen, local := startEchoServer(t), freeAddr(t), freeAddr(t)
+	socket := filepath.Join(t.TempDir(), "control.sock")
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Listen:   listen,
+		Target:   target,
+		Token:    "test-token-0123456789",
+	})
+	defer server.cancel()
+	if err := server.startControlServer("unix:" + socket); err != nil {
+		t.Fatalf("startControlServer failed: %v", err)
+	}
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:       "client",
+		Protocol:   "tcpmux",
+		Server:     listen,
+		Local:      local,
+		Token:      "test-token-0123456789",
+		MuxStreams: 1,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	expectTCPEcho(t, local)
+
+	httpClient := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := httpClient.Get("http://control/stats")
+	if err != nil {
+		t.Fatalf("GET /stats failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var got controlStats
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+
+	if got.Mode != "server" || got.Protocol != "tcpmux" {
+		t.Errorf("mode = %q, protocol = %q", got.Mode, got.Protocol)
+	}
+	if got.Connections == 0 || got.BytesIn == 0 || got.BytesOut == 0 {
+		t.Errorf("traffic not counted: %+v", got)
+	}
+	if len(got.Sessions) != 1 {
+		t.Fatalf("sessions = %+v, want the client's one mux session", got.Sessions)
+	}
+	if got.Sessions[0].RTTMillis <= 0 {
+		t.Errorf("session = %+v, want a measured RTT", got.Sessions[0])
+	}
+}
+
+func TestConnectionRegistry(t *testing.T) {
+	target, listen, local := startEchoServer(t), freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Listen:   listen,
+		Target:   target,
+		Token:    "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:       "client",
+		Protocol:   "tcpmux",
+		Server:     listen,
+		Local:      local,
+		Token:      "test-token-0123456789",
+		MuxStreams: 1,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	conn := dialEventually(t, local)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Traffic is visible while the connection is still open
+	open, _ := server.connections()
+	if len(open) != 1 {
+		t.Fatalf("open connections = %+v, want the one stream", open)
+	}
+	stream := open[0]
+	if stream.Kind != "stream" || stream.Target != target || stream.BytesIn != 5 || stream.BytesOut != 5 {
+		t.Errorf("open stream = %+v", stream)
+	}
+	sessions := server.sessionStats()
+	if len(sessions) != 1 || sessions[0].ID != stream.Session || sessions[0].BytesIn == 0 {
+		t.Errorf("sessions = %+v, want the stream's session with traffic", sessions)
+	}
+
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, closed := server.connections()
+		if len(closed) > 0 && closed[0].ID == stream.ID {
+			if closed[0].CloseReason != "client closed" {
+				t.Errorf("close reason = %q, want client closed", closed[0].CloseReason)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream never showed up as closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Forwarding path
+//
+// Connections are copied through buffers taken from a pool instead of one
+// allocated per connection and direction, and UDP flows read datagrams into
+// pooled buffers too. When both ends of a connection are plain TCP sockets
+// on Linux the bytes move through a pipe with splice(2) without being
+// brought into user space, see splice_linux.go. Every splice call is
+// counted as it returns, so spliced connections show their traffic as
+// promptly as buffered ones. Connections with bandwidth limits or a read
+// timeout are paced or timed per read and are always copied through a
+// buffer.
+//
+// UDP sockets shared by many flows read and write datagrams in batches with
+// recvmmsg(2) and sendmmsg(2) where the platform has them, see batch.go.
+// copy_test.go benchmarks both against plain io.Copy and single reads.
+
+const (
+	// copyBufferSize is the size of the buffers connections are copied with
+	copyBufferSize = 32 * 1024
+
+	// spliceChunk is the most one splice call moves, the default capacity of
+	// a pipe
+	spliceChunk = 64 * 1024
+
+	// datagramBufferSize fits the largest datagram behind the largest header
+	// put in front of one, a length prefix or a SOCKS UDP header
+	datagramBufferSize = maxDatagramSize + 512
+)
+
+// bufferPool hands out buffers of one size for reuse
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{}
+	p.pool.New = func() any {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+	return p
+}
+
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(buffer *[]byte) {
+	p.pool.Put(buffer)
+}
+
+var (
+	copyBuffers     = newBufferPool(copyBufferSize)
+	datagramBuffers = newBufferPool(datagramBufferSize)
+)
+
+// maySplice reports whether c may be copied with splice
+func (tm *TunnelManager) maySplice(c *connection) bool {
+	readTimeout, _ := tm.connTimeouts()
+	return readTimeout <= 0 && len(c.limitIn) == 0 && len(c.limitOut) == 0
+}
+
+// copyConn copies src to dst until src ends, passing the size of every read
+// to count before it is written. With splice it copies plain TCP
+// connections with splice(2) where the platform has it.
+func copyConn(dst, src net.Conn, count func(int64), splice bool) error {
+	if tcpDst, tcpSrc, ok := spliceable(dst, src); ok && splice {
+		return spliceConn(tcpDst, tcpSrc, count)
+	}
+
+	buffer := copyBuffers.get()
+	defer copyBuffers.put(buffer)
+
+	for {
+		n, err := src.Read(*buffer)
+		if n > 0 {
+			count(int64(n))
+			if _, werr := dst.Write((*buffer)[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spliceable returns the TCP sockets under dst and src when both are plain
+// TCP connections the kernel can move bytes between
+func spliceable(dst, src net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if !spliceAvailable {
+		return nil, nil, false
+	}
+	tcpDst, ok := plainTCP(dst)
+	if !ok {
+		return nil, nil, false
+	}
+	tcpSrc, ok := plainTCP(src)
+	return tcpDst, tcpSrc, ok
+}
+
+// plainTCP unwraps the wrappers that leave a connection's bytes untouched
+func plainTCP(conn net.Conn) (*net.TCPConn, bool) {
+	if pc, ok := conn.(*poolConn); ok {
+		conn = pc.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		tb.Fatal("accept failed")
+	}
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+// copyThrough sends payload into one TCP connection, copies it to another
+// with copy and returns what came out
+func copyThrough(tb testing.TB, payload []byte, copy func(dst, src net.Conn) error) []byte {
+	tb.Helper()
+	srcWriter, src := tcpPair(tb)
+	dst, dstReader := tcpPair(tb)
+	defer src.Close()
+	defer dst.Close()
+	defer dstReader.Close()
+
+	go func() {
+		srcWriter.Write(payload)
+		srcWriter.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		out, _ := io.ReadAll(dstReader)
+		received <- out
+	}()
+
+	if err := copy(dst, src); err != nil {
+		tb.Fatalf("copy failed: %v", err)
+	}
+	dst.CloseWrite()
+	return <-received
+}
+
+func TestCopyConn(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for _, splice := range []bool{false, true} {
+		var counted atomic.Int64
+		out := copyThrough(t, payload, func(dst, src net.Conn) error {
+			// Only plain TCP ends get spliced, poolConn is unwrapped
+			return copyConn(&poolConn{Conn: dst}, src, func(n int64) { counted.Add(n) }, splice)
+		})
+		if !bytes.Equal(out, payload) {
+			t.Fatalf("splice %v: copied %d bytes, want the %d sent", splice, len(out), len(payload))
+		}
+		if counted.Load() != int64(len(payload)) {
+			t.Fatalf("splice %v: counted %d bytes, want %d", splice, counted.Load(), len(payload))
+		}
+	}
+}
+
+func TestCopyConnCountsPromptly(t *testing.T) {
+	for _, splice := range []bool{false, true} {
+		srcWriter, src := tcpPair(t)
+		dst, dstReader := tcpPair(t)
+		defer srcWriter.Close()
+		defer dstReader.Close()
+
+		var counted atomic.Int64
+		done := make(chan error, 1)
+		go func() {
+			done <- copyConn(dst, src, func(n int64) { counted.Add(n) }, splice)
+		}()
+
+		// An interactive connection sends a little at a time and stays open
+		for i := 1; i <= 3; i++ {
+			srcWriter.Write([]byte("key"))
+			deadline := time.Now().Add(5 * time.Second)
+			for counted.Load() != int64(3*i) {
+				if time.Now().After(deadline) {
+					t.Fatalf("splice %v: counted %d bytes of the %d sent", splice, counted.Load(), 3*i)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		srcWriter.Close()
+		if err := <-done; err != nil {
+			t.Fatalf("splice %v: copy failed: %v", splice, err)
+		}
+		src.Close()
+		dst.Close()
+	}
+}
+
+// countingReader counts reads the way connections were copied before
+// copyConn, to benchmark against
+type countingReader struct {
+	r     io.Reader
+	count func(int64)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.count(int64(n))
+	}
+	return n, err
+}
+
+// BenchmarkCopyConnection copies one connection of 1 MiB per operation
+func BenchmarkCopyConnection(b *testing.B) {
+	payload := bytes.Repeat([]byte("x"), 1024*1024)
+	var counted atomic.Int64
+	count := func(n int64) { counted.Add(n) }
+
+	for _, bm := range []struct {
+		name string
+		copy func(dst, src net.Conn) error
+	}{
+		{"io.Copy", func(dst, src net.Conn) error {
+			_, err := io.Copy(dst, &countingReader{r: src, count: count})
+			return err
+		}},
+		{"pooled", func(dst, src net.Conn) error { return copyConn(dst, src, count, false) }},
+		{"splice", func(dst, src net.Conn) error { return copyConn(dst, src, count, true) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				srcWriter, src := tcpPair(b)
+				dst, dstReader := tcpPair(b)
+				go func() {
+					srcWriter.Write(payload)
+					srcWriter.Close()
+				}()
+				done := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, dstReader)
+					close(done)
+				}()
+				b.StartTimer()
+
+				if err := bm.copy(dst, src); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				dst.Close()
+				<-done
+				src.Close()
+				dstReader.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
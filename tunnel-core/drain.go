@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// Draining
+//
+// SIGTERM and SIGINT drain a tunnel rather than cut it off. Every listener
+// stops accepting, and mux sessions are told to go away so their peers
+// open no new streams on them. The connections, streams and UDP flows in
+// flight then carry on until they end or -drain-timeout passes, when the
+// tunnel closes whatever is left. A second signal closes everything at
+// once, as does a -drain-timeout of 0.
+//
+// Listeners whose links share their socket, as udp and QUIC ones do, keep
+// reading it while draining so those links carry on, but take no new flows
+// or connections. QUIC connections still open streams, as QUIC has no way
+// to turn them away that clients would retry elsewhere. HTTP/2 links finish
+// on their connections, which are sent a GOAWAY so clients make new ones.
+//
+// -reuse-port opens every listening socket with SO_REUSEPORT, so a new
+// process, running an upgraded binary or a changed configuration, can
+// listen on the same addresses while the old one, which must have been
+// started with -reuse-port too, still runs. Starting it
+// and then sending SIGTERM to the old one restarts a tunnel without
+// refusing connections: the kernel hands them to the new process once the
+// old one stops accepting. The few TCP connections queued on the old
+// socket as it closes are reset, and UDP datagrams are spread over both
+// processes by address meanwhile, so some flows and QUIC connections may
+// land on the process that does not know them and have to start over.
+
+const (
+	// defaultDrainTimeout is how long connections in flight get to finish
+	defaultDrainTimeout = 30 * time.Second
+
+	// drainCheckInterval is how often a drain looks for connections still
+	// in flight
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+// drainer is implemented by listeners whose links share their socket. drain
+// stops them taking new links, Close still ends the links they took.
+type drainer interface {
+	drain()
+}
+
+// closeOnDrain closes listener once the tunnel stops accepting, or only
+// drains it then and closes it on shutdown if it is a drainer. The returned
+// function closes it when its accept loop ends before that.
+func (tm *TunnelManager) closeOnDrain(listener net.Listener) func() {
+	closeAt := tm.accepting
+	if d, ok := listener.(drainer); ok {
+		context.AfterFunc(tm.accepting, d.drain)
+		closeAt = tm.ctx
+	}
+	context.AfterFunc(closeAt, func() { listener.Close() })
+
+	return func() {
+		if tm.accepting.Err() == nil {
+			listener.Close()
+		}
+	}
+}
+
+// draining reports whether the tunnel has stopped accepting connections
+func (tm *TunnelManager) draining() bool {
+	return tm.accepting.Err() != nil
+}
+
+// drain stops accepting connections and waits up to timeout for those in
+// flight to end before shutting the tunnel down
+func (tm *TunnelManager) drain(timeout time.Duration) {
+	tm.stopAccepting()
+	tm.goAwaySessions()
+
+	open := tm.openConnections()
+	if open > 0 {
+		log.Printf("Draining %d connections for up to %s", open, timeout)
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for tm.openConnections() > 0 {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-deadline.C:
+			log.Printf("Drain timed out, closing %d connections", tm.openConnections())
+			tm.cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+	tm.cancel()
+}
+
+// goAwaySessions tells the peer of every mux session to open no more
+// streams on it, the streams already open carry on
+func (tm *TunnelManager) goAwaySessions() {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	// Sending waits for the link, which may be stuck
+	for _, ts := range tm.sessions {
+		go ts.session.GoAway()
+	}
+}
+
+// openConnections counts the connections, streams and flows in flight
+func (tm *TunnelManager) openConnections() int {
+	tm.conns.mu.Lock()
+	defer tm.conns.mu.Unlock()
+	return len(tm.conns.open)
+}
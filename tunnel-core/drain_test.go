@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// openEcho opens a connection through the tunnel and checks it echoes
+func openEcho(t *testing.T, local string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn := dialEventually(t, local)
+	t.Cleanup(func() { conn.Close() })
+	reader := bufio.NewReader(conn)
+	echo(t, conn, reader)
+	return conn, reader
+}
+
+// echo sends a line on conn and waits for it to come back
+func echo(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if line != "ping\n" {
+		t.Fatalf("unexpected echo: %q", line)
+	}
+}
+
+// expectNoEcho checks that a new connection through the tunnel goes
+// nowhere
+func expectNoEcho(t *testing.T, local string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", local)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("ping\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Fatalf("a draining server carried a new connection: %q", line)
+	}
+}
+
+func TestDrainFinishesConnections(t *testing.T) {
+	for _, protocol := range []string{"tcp", "tcpmux", "ws", "wsmux", "h2", "quic"} {
+		t.Run(protocol, func(t *testing.T) {
+			serverConfig := &Config{Protocol: protocol, Target: startEchoServer(t)}
+			clientConfig := &Config{MuxStreams: 1}
+			if protocol == "quic" || protocol == "h2" {
+				pki := newTestPKI(t)
+				serverConfig.TLS, serverConfig.CertFile, serverConfig.KeyFile = true, pki.serverCert, pki.serverKey
+				clientConfig.TLS, clientConfig.CAFile = true, pki.caFile
+			}
+			server, client := startTunnel(t, serverConfig, clientConfig)
+			local := client.config.Local
+			conn, reader := openEcho(t, local)
+
+			drained := make(chan struct{})
+			go func() {
+				server.drain(10 * time.Second)
+				close(drained)
+			}()
+			time.Sleep(200 * time.Millisecond)
+
+			// QUIC connections keep opening streams while they drain
+			if protocol != "quic" {
+				expectNoEcho(t, local)
+			}
+			echo(t, conn, reader)
+
+			select {
+			case <-drained:
+				t.Fatal("the drain ended with a connection in flight")
+			default:
+			}
+
+			conn.Close()
+			select {
+			case <-drained:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the drain did not end once its connections closed")
+			}
+			if server.ctx.Err() == nil {
+				t.Fatal("the server kept running after the drain")
+			}
+		})
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	server, client := startTunnel(t, &Config{Protocol: "ws", Target: startEchoServer(t)}, &Config{})
+	conn, _ := openEcho(t, client.config.Local)
+
+	start := time.Now()
+	server.drain(300 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the drain took %s past its timeout", elapsed)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("the connection was not closed when the drain timed out: %v", err)
+	}
+	expectClosedFor(t, server, "shutdown")
+}
+
+func TestDrainUDPFlows(t *testing.T) {
+	server, client := startTunnel(t, &Config{Protocol: "udp", Target: startUDPEchoServer(t)}, &Config{})
+	local := client.config.Local
+
+	flow, err := net.Dial("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flow.Close()
+	exchange := func(conn net.Conn, within time.Duration) bool {
+		buffer := make([]byte, 64)
+		for deadline := time.Now().Add(within); time.Now().Before(deadline); {
+			conn.Write([]byte("datagram"))
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if n, err := conn.Read(buffer); err == nil && string(buffer[:n]) == "datagram" {
+				return true
+			}
+		}
+		return false
+	}
+	if !exchange(flow, 5*time.Second) {
+		t.Fatal("no echo before draining")
+	}
+
+	go server.drain(10 * time.Second)
+	time.Sleep(200 * time.Millisecond)
+
+	if !exchange(flow, 5*time.Second) {
+		t.Fatal("the flow in flight stopped when the server drained")
+	}
+	fresh, err := net.Dial("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if exchange(fresh, time.Second) {
+		t.Fatal("a draining server took a new flow")
+	}
+}
+
+func TestReusePortHandoff(t *testing.T) {
+	for _, protocol := range []string{"tcp", "wsmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			target := startEchoServer(t)
+			old, client := startTunnel(t, &Config{Protocol: protocol, Target: target, ReusePort: true}, &Config{MuxStreams: 1})
+			local := client.config.Local
+			conn, reader := openEcho(t, local)
+
+			// The new process listens alongside the old one
+			next, _ := startTunnel(t, &Config{Protocol: protocol, Listen: old.config.Listen, Target: target, ReusePort: true}, nil)
+			go old.drain(10 * time.Second)
+			time.Sleep(200 * time.Millisecond)
+
+			// New connections reach the new server, the old one's carry on
+			for range 5 {
+				expectTCPEcho(t, local)
+			}
+			echo(t, conn, reader)
+			if open, closed := next.connections(); len(open)+len(closed) == 0 {
+				t.Fatal("the new server carried no connections")
+			}
+
+			conn.Close()
+			select {
+			case <-old.ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("the old server did not finish draining")
+			}
+			expectTCPEcho(t, local)
+		})
+	}
+}
+
+func TestReusePortRefusedWithoutIt(t *testing.T) {
+	first, _ := startTunnel(t, &Config{Protocol: "tcp", Target: startEchoServer(t)}, nil)
+
+	second := newTunnelManager(&Config{
+		Mode:      "server",
+		Protocol:  "tcp",
+		Listen:    first.config.Listen,
+		Target:    startEchoServer(t),
+		Token:     "test-token-0123456789",
+		ReusePort: true,
+	})
+	defer second.cancel()
+	if err := second.startServer(); err == nil {
+		t.Fatal("shared an address the first server did not open for reuse")
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Dynamic forwarding
+//
+// A client started with -dynamic serves a proxy on its local addresses
+// instead of forwarding them to one target: SOCKS5 with CONNECT and UDP
+// ASSOCIATE, or HTTP CONNECT, told apart by the first byte a local client
+// sends, see socks.go. Every proxied connection, and every destination of a
+// UDP association, is carried to the server over a stream or link of its
+// own. The server resolves the destination, checks it against its policy
+// and dials it.
+//
+// A client offers flagDynamic in its hello. Its streams and links then start
+// with the destination instead of an origin frame:
+//
+//	0x08 | length (2 bytes, big endian) | network " " host:port
+//
+// where network is tcp or udp and host may be a name. The server answers
+// once it has dialed:
+//
+//	0x09 | length (2 bytes, big endian) | status | message
+//
+// status is a SOCKS5 reply code, 0 when the destination was reached, and the
+// connection or length-prefixed UDP datagrams follow. Dynamic destinations
+// are sent no PROXY protocol header.
+//
+// Servers refuse every destination unless started with -dynamic.
+// -dynamic-allow and -dynamic-deny restrict the addresses a destination may
+// resolve to by CIDR, -dynamic-ports and -dynamic-deny-ports its port. Deny
+// rules win, and when allow rules are given a destination must match them.
+// internalNetworks, the server's own host and networks and cloud metadata
+// services among them, are refused unless an allow rule covers them; the
+// backend leaves them to this rule rather than denying them itself.
+// Addresses a name resolves to are tried in order, skipping refused ones.
+// Every destination, refused or not, is kept for GET /destinations on the
+// control endpoint.
+
+const (
+	// dynamicDialTimeout bounds resolving and dialing a destination
+	dynamicDialTimeout = 10 * time.Second
+
+	// maxDestinationLog is how many destinations the control endpoint keeps
+	maxDestinationLog = 1024
+)
+
+// destination is where a dynamic connection or UDP flow asks to go
+type destination struct {
+	network string // tcp or udp
+	address string // host:port
+}
+
+func (d destination) String() string {
+	return d.network + " " + d.address
+}
+
+// writeDestination names the destination of a dynamic stream or link
+func writeDestination(w io.Writer, dest destination) error {
+	if err := writeFrame(w, frameDestination, []byte(dest.String())); err != nil {
+		return fmt.Errorf("failed to send destination: %w", err)
+	}
+	return nil
+}
+
+// readDestination reads the destination a dynamic client sent first on a
+// stream or link
+func readDestination(conn net.Conn) (destination, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return destination{}, fmt.Errorf("failed to read destination: %w", err)
+	}
+	if frameType != frameDestination {
+		return destination{}, fmt.Errorf("unexpected frame 0x%02x, expected destination", frameType)
+	}
+
+	network, address, _ := strings.Cut(string(payload), " ")
+	if network != "tcp" && network != "udp" {
+		return destination{}, fmt.Errorf("malformed destination %q", payload)
+	}
+	if _, _, err := splitDestination(address); err != nil {
+		return destination{}, err
+	}
+	return destination{network: network, address: address}, nil
+}
+
+// splitDestination splits a destination into its host and port
+func splitDestination(address string) (string, int, error) {
+	host, portSpec, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid destination %q: %w", address, err)
+	}
+	port, err := strconv.Atoi(portSpec)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("invalid destination %q", address)
+	}
+	return host, port, nil
+}
+
+// dialError is a destination the server could not or would not reach, with
+// the SOCKS5 reply code describing why
+type dialError struct {
+	code    byte
+	message string
+}
+
+func (e *dialError) Error() string {
+	return e.message
+}
+
+// writeDialResult answers a destination, a nil error meaning it was reached
+func writeDialResult(w io.Writer, err error) error {
+	payload := []byte{socksSucceeded}
+	if err != nil {
+		message := err.Error()
+		if len(message) > maxFrameSize-1 {
+			message = message[:maxFrameSize-1]
+		}
+		payload = append([]byte{dialFailureCode(err)}, message...)
+	}
+	return writeFrame(w, frameDialResult, payload)
+}
+
+// readDialResult waits for the server to reach the destination it was sent
+func readDialResult(conn net.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(dynamicDialTimeout + handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read dial result: %w", err)
+	}
+	if frameType != frameDialResult || len(payload) == 0 {
+		return fmt.Errorf("unexpected frame 0x%02x, expected dial result", frameType)
+	}
+	if payload[0] != socksSucceeded {
+		return &dialError{code: payload[0], message: string(payload[1:])}
+	}
+	return nil
+}
+
+// dialFailureCode returns the SOCKS5 reply code describing a failure to
+// reach a destination
+func dialFailureCode(err error) byte {
+	var dialErr *dialError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dialErr):
+		return dialErr.code
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// netList collects repeated CIDR flags, each a comma separated list in which
+// a bare address stands for itself
+type netList []*net.IPNet
+
+func (l *netList) String() string {
+	specs := make([]string, len(*l))
+	for i, network := range *l {
+		specs[i] = network.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *netList) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return fmt.Errorf("invalid network %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			item = fmt.Sprintf("%s/%d", item, bits)
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("invalid network %q", item)
+		}
+		*l = append(*l, network)
+	}
+	return nil
+}
+
+// contains reports whether any network of the list holds ip
+func (l netList) contains(ip net.IP) bool {
+	for _, network := range l {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	first, last int
+}
+
+// portList collects repeated port flags, each a comma separated list of
+// ports and first-last ranges
+type portList []portRange
+
+func (l *portList) String() string {
+	specs := make([]string, len(*l))
+	for i, ports := range *l {
+		specs[i] = strconv.Itoa(ports.first)
+		if ports.last != ports.first {
+			specs[i] += "-" + strconv.Itoa(ports.last)
+		}
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *portList) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		first, last, err := parsePortRange(strings.TrimSpace(item))
+		if err != nil {
+			return fmt.Errorf("invalid ports %q: %w", item, err)
+		}
+		*l = append(*l, portRange{first: first, last: last})
+	}
+	return nil
+}
+
+// contains reports whether any range of the list holds port
+func (l portList) contains(port int) bool {
+	for _, ports := range l {
+		if port >= ports.first && port <= ports.last {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationAllowed reports whether the policy lets dynamic connections
+// reach ip:port
+func (tm *TunnelManager) destinationAllowed(ip net.IP, port int) bool {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	config := tm.config
+	if config.DynamicDeny.contains(ip) || config.DynamicDenyPorts.contains(port) {
+		return false
+	}
+	if len(config.DynamicAllow) > 0 && !config.DynamicAllow.contains(ip) {
+		return false
+	}
+	if internalAddress(ip) && !config.DynamicAllow.contains(ip) {
+		return false
+	}
+	if len(config.DynamicPorts) > 0 && !config.DynamicPorts.contains(port) {
+		return false
+	}
+	return true
+}
+
+// internalNetworks are the server's own host and local networks: this host,
+// loopback, private and shared address space, link-local addresses with
+// cloud metadata services, and link-local multicast
+var internalNetworks = func() netList {
+	var l netList
+	if err := l.Set("0.0.0.0/8, 10.0.0.0/8, 100.64.0.0/10, 127.0.0.0/8, 169.254.0.0/16, " +
+		"172.16.0.0/12, 192.168.0.0/16, 224.0.0.0/24, ::/128, ::1/128, fc00::/7, fe80::/10, ff02::/16"); err != nil {
+		panic(err)
+	}
+	return l
+}()
+
+// internalAddress reports whether ip is on the server's host or its local
+// networks
+func internalAddress(ip net.IP) bool {
+	return internalNetworks.contains(ip)
+}
+
+// dialDestination resolves a destination and dials the first of its
+// addresses the policy allows
+func (tm *TunnelManager) dialDestination(dest destination) (net.Conn, error) {
+	if !tm.config.Dynamic {
+		return nil, &dialError{code: socksNotAllowed, message: "dynamic forwarding is disabled"}
+	}
+	host, port, err := splitDestination(dest.address)
+	if err != nil {
+		return nil, &dialError{code: socksAddressNotSupported, message: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(tm.ctx, dynamicDialTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, &dialError{code: socksHostUnreachable, message: fmt.Sprintf("failed to resolve %s: %v", host, err)}
+	}
+
+	var lastErr error = &dialError{code: socksNotAllowed, message: fmt.Sprintf("destination %s is not allowed", dest.address)}
+	dialer := tm.dialer()
+	for _, addr := range addrs {
+		if !tm.destinationAllowed(addr.IP, port) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, dest.network, net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// serveDynamic reads the destination of a dynamic client's stream or link,
+// dials it and relays the connection or UDP flow to it
+func (tm *TunnelManager) serveDynamic(conn net.Conn, kind, remote, session string) {
+	dest, err := readDestination(conn)
+	if err != nil {
+		log.Printf("Dropping %s from %s: %v", kind, remote, err)
+		stats.Errors.Add(1)
+		return
+	}
+
+	c, err := tm.openConnection(kind, remote, dest.address, session)
+	if err != nil {
+		writeDialResult(conn, &dialError{code: socksGeneralFailure, message: err.Error()})
+		return
+	}
+	defer tm.closeConnection(c)
+
+	target, err := tm.dialDestination(dest)
+	tm.logDestination(dest, remote, session, target, err)
+	if err != nil {
+		stats.Errors.Add(1)
+		c.fail(err.Error())
+		writeDialResult(conn, err)
+		return
+	}
+	defer target.Close()
+	c.setTarget(target.RemoteAddr().String())
+
+	if err := writeDialResult(conn, nil); err != nil {
+		c.fail(fmt.Sprintf("failed to send dial result: %v", err))
+		return
+	}
+
+	if dest.network == "udp" {
+		tm.relayUDPStream(conn, target, c)
+		return
+	}
+	tm.handleDirectConnection(conn, target, c)
+}
+
+// destinationEntry is one destination a dynamic client asked for, in
+// /destinations responses
+type destinationEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"time"`
+	Remote      string    `json:"remote"`
+	Session     string    `json:"session,omitempty"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	Address     string    `json:"address,omitempty"` // The address dialed
+	Allowed     bool      `json:"allowed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// destinationLog keeps the latest destinations, numbered so the backend can
+// ask for the ones it has not seen
+type destinationLog struct {
+	mu      sync.Mutex
+	seq     uint64
+	entries []destinationEntry
+}
+
+// logDestination records the outcome of dialing a destination
+func (tm *TunnelManager) logDestination(dest destination, remote, session string, target net.Conn, err error) {
+	entry := destinationEntry{
+		Time:        time.Now(),
+		Remote:      remote,
+		Session:     session,
+		Network:     dest.network,
+		Destination: dest.address,
+		Allowed:     true,
+	}
+	if target != nil {
+		entry.Address = target.RemoteAddr().String()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		var dialErr *dialError
+		entry.Allowed = !errors.As(err, &dialErr) || dialErr.code != socksNotAllowed
+	}
+
+	switch {
+	case !entry.Allowed:
+		log.Printf("Refused dynamic %s from %s to %s: %v", dest.network, remote, dest.address, err)
+	case err != nil && tm.config.Debug:
+		log.Printf("Failed dynamic %s from %s to %s: %v", dest.network, remote, dest.address, err)
+	case err == nil && tm.config.Debug:
+		log.Printf("Dynamic %s from %s to %s (%s)", dest.network, remote, dest.address, entry.Address)
+	}
+
+	tm.dests.mu.Lock()
+	defer tm.dests.mu.Unlock()
+
+	tm.dests.seq++
+	entry.Seq = tm.dests.seq
+	if len(tm.dests.entries) == maxDestinationLog {
+		copy(tm.dests.entries, tm.dests.entries[1:])
+		tm.dests.entries = tm.dests.entries[:maxDestinationLog-1]
+	}
+	tm.dests.entries = append(tm.dests.entries, entry)
+}
+
+// destinationsAfter returns the logged destinations numbered after seq
+func (tm *TunnelManager) destinationsAfter(seq uint64) []destinationEntry {
+	tm.dests.mu.Lock()
+	defer tm.dests.mu.Unlock()
+
+	result := []destinationEntry{}
+	for _, entry := range tm.dests.entries {
+		if entry.Seq > seq {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDynamicPolicy(t *testing.T) {
+	tm := newTunnelManager(&Config{Dynamic: true})
+	defer tm.cancel()
+	if err := tm.config.DynamicAllow.Set("10.0.0.0/8, 192.0.2.7"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	tm.config.DynamicDeny.Set("10.9.0.0/16")
+	tm.config.DynamicPorts.Set("80,443,8000-8100")
+	tm.config.DynamicDenyPorts.Set("8080")
+
+	tests := []struct {
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"10.1.2.3", 443, true},
+		{"192.0.2.7", 8000, true},
+		{"192.0.2.8", 443, false},
+		{"10.9.1.1", 443, false},
+		{"10.1.2.3", 22, false},
+		{"10.1.2.3", 8080, false},
+
+		// Internal addresses need an allow rule covering them
+		{"127.0.0.1", 443, false},
+		{"169.254.169.254", 80, false},
+		{"172.16.0.1", 443, false},
+		{"::1", 443, false},
+		{"fe80::1", 443, false},
+		{"0.0.0.0", 443, false},
+		{"0.1.2.3", 443, false},
+		{"100.64.0.1", 443, false},
+	}
+	for _, tt := range tests {
+		if got := tm.destinationAllowed(net.ParseIP(tt.ip), tt.port); got != tt.allowed {
+			t.Errorf("destinationAllowed(%s, %d) = %v, want %v", tt.ip, tt.port, got, tt.allowed)
+		}
+	}
+
+	// Without allow rules everything but internal addresses is allowed
+	open := newTunnelManager(&Config{Dynamic: true})
+	defer open.cancel()
+	for ip, allowed := range map[string]bool{
+		"192.0.2.7":       true,
+		"2001:db8::1":     true,
+		"10.1.2.3":        false,
+		"100.100.100.200": false,
+		"192.168.1.1":     false,
+		"127.0.0.1":       false,
+		"169.254.169.254": false,
+	} {
+		if got := open.destinationAllowed(net.ParseIP(ip), 443); got != allowed {
+			t.Errorf("destinationAllowed(%s) without allow rules = %v, want %v", ip, got, allowed)
+		}
+	}
+
+	var networks netList
+	var ports portList
+	for _, spec := range []string{"", "10.0.0.0/33", "example.com"} {
+		if err := networks.Set(spec); err == nil {
+			t.Errorf("netList.Set(%q) succeeded", spec)
+		}
+	}
+	for _, spec := range []string{"", "0", "90-80", "http"} {
+		if err := ports.Set(spec); err == nil {
+			t.Errorf("portList.Set(%q) succeeded", spec)
+		}
+	}
+}
+
+// socksRequest greets a SOCKS5 proxy and sends a request for address,
+// returning the reply code and bound address
+func socksRequest(t *testing.T, conn net.Conn, command byte, address string) (byte, string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte{socksVersion, 1, socksNoAuth}); err != nil {
+		t.Fatalf("failed to send greeting: %v", err)
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil || method[1] != socksNoAuth {
+		t.Fatalf("greeting answered %v: %v", method, err)
+	}
+
+	request, err := appendSOCKSAddr([]byte{socksVersion, command, 0}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	bound, err := readSOCKSAddr(conn)
+	if err != nil {
+		t.Fatalf("failed to read bound address: %v", err)
+	}
+	return reply[1], bound
+}
+
+func TestDynamicForwarding(t *testing.T) {
+	for _, protocol := range []string{"tcp", "tcpmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			allowed, denied := startBannerServer(t, "allowed\n"), startBannerServer(t, "denied\n")
+			_, deniedPort, _ := splitDestination(denied)
+			_, allowedPort, _ := splitDestination(allowed)
+			echo := startUDPEchoServer(t)
+			var loopback netList
+			loopback.Set("127.0.0.0/8, ::1")
+			server, client := startTunnel(t, &Config{
+				Protocol:         protocol,
+				Target:           "127.0.0.1:1",
+				Dynamic:          true,
+				DynamicAllow:     loopback,
+				DynamicDenyPorts: portList{{first: deniedPort, last: deniedPort}},
+			}, &Config{Dynamic: true, MuxStreams: 2})
+			local := client.config.Local
+
+			t.Run("socks connect", func(t *testing.T) {
+				conn := dialEventually(t, local)
+				defer conn.Close()
+
+				// Names resolve at the server
+				code, _ := socksRequest(t, conn, socksConnect, net.JoinHostPort("localhost", strconv.Itoa(allowedPort)))
+				if code != socksSucceeded {
+					t.Fatalf("CONNECT answered %d", code)
+				}
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil || line != "allowed\n" {
+					t.Fatalf("got %q, %v through SOCKS", line, err)
+				}
+			})
+
+			t.Run("socks refused", func(t *testing.T) {
+				conn := dialEventually(t, local)
+				defer conn.Close()
+				if code, _ := socksRequest(t, conn, socksConnect, denied); code != socksNotAllowed {
+					t.Fatalf("CONNECT to a denied port answered %d", code)
+				}
+			})
+
+			t.Run("http connect", func(t *testing.T) {
+				for _, tt := range []struct{ address, status string }{
+					{allowed, "HTTP/1.1 200 OK\r\n"},
+					{denied, "HTTP/1.1 403 Forbidden\r\n"},
+				} {
+					conn := dialEventually(t, local)
+					conn.SetDeadline(time.Now().Add(10 * time.Second))
+					io.WriteString(conn, "CONNECT "+tt.address+" HTTP/1.1\r\nHost: "+tt.address+"\r\n\r\n")
+
+					reader := bufio.NewReader(conn)
+					status, err := reader.ReadString('\n')
+					if err != nil || status != tt.status {
+						t.Fatalf("CONNECT %s answered %q, %v", tt.address, status, err)
+					}
+					if tt.address == allowed {
+						reader.ReadString('\n')
+						if line, _ := reader.ReadString('\n'); line != "allowed\n" {
+							t.Fatalf("got %q through CONNECT", line)
+						}
+					}
+					conn.Close()
+				}
+			})
+
+			t.Run("socks udp associate", func(t *testing.T) {
+				conn := dialEventually(t, local)
+				defer conn.Close()
+				code, relay := socksRequest(t, conn, socksUDPAssociate, "0.0.0.0:0")
+				if code != socksSucceeded {
+					t.Fatalf("UDP ASSOCIATE answered %d", code)
+				}
+
+				udp, err := net.Dial("udp", relay)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer udp.Close()
+
+				datagram, _ := appendSOCKSAddr(make([]byte, socksUDPHeaderSize), echo)
+				datagram = append(datagram, "ping"...)
+				if _, err := udp.Write(datagram); err != nil {
+					t.Fatal(err)
+				}
+				udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+				buffer := make([]byte, 1024)
+				n, err := udp.Read(buffer)
+				if err != nil {
+					t.Fatalf("no reply through the association: %v", err)
+				}
+				if !bytes.Equal(buffer[:n], datagram) {
+					t.Fatalf("got %q, want %q", buffer[:n], datagram)
+				}
+			})
+
+			var refused, reached int
+			for _, entry := range server.destinationsAfter(0) {
+				switch {
+				case !entry.Allowed:
+					refused++
+				case entry.Error == "":
+					reached++
+				}
+			}
+			if refused != 2 || reached != 3 {
+				t.Fatalf("logged %d refused and %d reached destinations: %+v", refused, reached, server.destinationsAfter(0))
+			}
+			if last := server.destinationsAfter(0); len(server.destinationsAfter(last[len(last)-1].Seq)) != 0 {
+				t.Fatal("destinations after the last one were listed")
+			}
+		})
+	}
+}
+
+func TestDynamicNeedsServerFlag(t *testing.T) {
+	target := startBannerServer(t, "target\n")
+	_, client := startTunnel(t, &Config{Protocol: "tcpmux", Target: "127.0.0.1:1"}, &Config{Dynamic: true, MuxStreams: 2})
+	local := client.config.Local
+
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	code, _ := socksRequest(t, conn, socksConnect, target)
+	if code != socksNotAllowed {
+		t.Fatalf("server without -dynamic answered %d", code)
+	}
+}
+
+func TestParseFlagsRejectsDynamicCombinations(t *testing.T) {
+	for _, args := range [][]string{
+		{"-mode", "client", "-dynamic", "-server", "127.0.0.1:1"},
+		{"-mode", "client", "-dynamic", "-local", "127.0.0.1:1080", "-protocol", "ws"},
+		{"-mode", "client", "-dynamic", "-local", "127.0.0.1:1080", "-udp"},
+		{"-mode", "server", "-dynamic", "-bind", "127.0.0.1:9000"},
+	} {
+		if _, err := parseFlags(append(args, "-token", "test-token-0123456789")); err == nil || !strings.Contains(err.Error(), "dynamic") {
+			t.Errorf("parseFlags(%v) = %v, want a dynamic error", args, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+module stunnel-core
+
+go 1.24
+
+require (
+	github.com/gorilla/websocket v1.5.1
+	github.com/hashicorp/yamux v0.1.1
+	github.com/klauspost/compress v1.18.0
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/net v0.28.0
+	golang.org/x/sys v0.23.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
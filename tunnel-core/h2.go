@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP/2 and gRPC transports
+//
+// The h2 protocol carries every link in one long-lived HTTP/2 POST: the
+// request body carries what the client sends and the response body what the
+// server sends. Links to a server share its HTTP/2 connections as streams,
+// and requests look like any other API call to proxies and CDNs that pass
+// HTTP/2 but break WebSocket upgrades. The grpc protocol does the same as a
+// bidirectional streaming RPC, for CDNs that only pass gRPC through: both
+// bodies are gRPC messages, each carrying a chunk of the link's bytes as the
+// protobuf message
+//
+//	message Chunk { bytes data = 1; }
+//
+// and the server ends its response with a grpc-status trailer.
+//
+// Requests go to -path, /tunnel for h2 and /stunnel.Tunnel/Stream for grpc,
+// and are shaped and answered as httplink.go describes. They carry the
+// token, so links skip the handshake and offer compression in the
+// X-Tunnel-Compression header, as raw WebSocket links do. -tls runs the
+// connections over TLS with ALPN, otherwise they are HTTP/2 over cleartext.
+// The listener answers requests that are not links over HTTP/1.1 as well.
+//
+// HTTP/2 servers cannot end a response while the request is still being
+// sent, so when the server's side of a link is done the whole link ends.
+
+const (
+	grpcDefaultPath = "/stunnel.Tunnel/Stream"
+
+	// h2MaxStreams is how many links one HTTP/2 connection may carry
+	h2MaxStreams = 1000
+
+	// grpcMaxMessage bounds the gRPC messages links accept
+	grpcMaxMessage = 1 << 20
+)
+
+// h2Transport carries links in the bodies of HTTP/2 requests, framed as gRPC
+// messages for grpc
+type h2Transport struct {
+	grpc bool
+}
+
+func init() {
+	registerTransport("h2", h2Transport{})
+	registerTransport("grpc", h2Transport{grpc: true})
+	registerProtocol("h2", protocolSpec{transport: "h2"})
+	registerProtocol("grpc", protocolSpec{transport: "grpc"})
+}
+
+func (h2Transport) authenticatesLinks() bool {
+	return true
+}
+
+// path returns the path links are requested on
+func (t h2Transport) path(tm *TunnelManager) string {
+	if t.grpc {
+		return tm.linkPath(grpcDefaultPath)
+	}
+	return tm.linkPath(linkDefaultPath)
+}
+
+// contentType returns the content type of link requests and responses
+func (t h2Transport) contentType() string {
+	if t.grpc {
+		return "application/grpc"
+	}
+	return "application/octet-stream"
+}
+
+func (t h2Transport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	listener, err := tm.listenLink(addr, http2.NextProtoTLS, "http/1.1")
+	if err != nil {
+		return nil, err
+	}
+
+	mux, err := tm.newLinkMux()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	l := newHTTPListener(listener)
+	mux.HandleFunc(t.path(tm), func(w http.ResponseWriter, r *http.Request) {
+		t.serveLink(tm, mux, l, w, r)
+	})
+
+	h2Server := &http2.Server{MaxConcurrentStreams: h2MaxStreams}
+	server := &http.Server{Handler: h2c.NewHandler(mux, h2Server)}
+	if err := http2.ConfigureServer(server, h2Server); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+	l.serve(server)
+	return l, nil
+}
+
+// serveLink hands the link a request opens to the listener and holds the
+// request open until the link closes
+func (t h2Transport) serveLink(tm *TunnelManager, mux *linkMux, l *httpListener, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.ProtoMajor != 2:
+		mux.refuse(w, r, http.StatusHTTPVersionNotSupported)
+		return
+	case r.Method != http.MethodPost:
+		mux.refuse(w, r, http.StatusMethodNotAllowed)
+		return
+	case !tm.authorizedRequest(r):
+		mux.refuse(w, r, http.StatusUnauthorized)
+		return
+	case t.grpc && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc"):
+		mux.refuse(w, r, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Links accept the compression they offer if it is ours
+	compress := tm.compressionFlag()
+	if compress == 0 || r.Header.Get(compressionHeader) != tm.config.Compression {
+		compress = 0
+	} else {
+		w.Header().Set(compressionHeader, tm.config.Compression)
+	}
+	w.Header().Set("Content-Type", t.contentType())
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+
+	conn := &h2Conn{
+		body:   r.Body,
+		send:   w,
+		flush:  flusher.Flush,
+		grpc:   t.grpc,
+		remote: parseAddr(r.RemoteAddr),
+		done:   make(chan struct{}),
+	}
+	conn.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	link, err := compressLink(conn, compress)
+	if err != nil {
+		log.Printf("HTTP/2 link from %s dropped: %v", r.RemoteAddr, err)
+		stats.Errors.Add(1)
+		return
+	}
+	l.push(link)
+
+	select {
+	case <-conn.done:
+	case <-r.Context().Done():
+		conn.Close()
+	}
+	if t.grpc {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}
+}
+
+func (t h2Transport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	scheme := "http"
+	if tm.useTLS() {
+		scheme = "https"
+	}
+
+	// Ending the request body ends the client's side of the link
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(tm.ctx)
+	conn := &h2Conn{send: pw, grpc: t.grpc, done: make(chan struct{})}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn.local, conn.remote = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodPost, tm.linkURL(scheme, server, t.path(tm)), pr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Host = tm.config.HostHeader
+	req.Header = tm.linkHeader()
+	req.Header.Set("Content-Type", t.contentType())
+	if t.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	offer := tm.compressionFlag()
+	if offer != 0 {
+		req.Header.Set(compressionHeader, tm.config.Compression)
+	}
+
+	timer := time.AfterFunc(tm.connectTimeout(), cancel)
+	resp, err := tm.h2.roundTripper(tm).RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	conn.body = resp.Body
+	conn.trailer = resp.Trailer
+	conn.cancel = cancel
+	if offer == 0 || resp.Header.Get(compressionHeader) != tm.config.Compression {
+		return conn, nil
+	}
+	compressed, err := compressLink(conn, offer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return compressed, nil
+}
+
+// h2Client holds the HTTP/2 client transport whose connections a client's
+// links to a server share
+type h2Client struct {
+	once      sync.Once
+	transport *http2.Transport
+}
+
+// roundTripper returns the client transport, created on first use
+func (c *h2Client) roundTripper(tm *TunnelManager) *http2.Transport {
+	c.once.Do(func() {
+		c.transport = &http2.Transport{
+			AllowHTTP:       !tm.useTLS(),
+			DialTLSContext:  tm.dialH2,
+			ReadIdleTimeout: tm.heartbeat(),
+		}
+		go func() {
+			<-tm.ctx.Done()
+			c.transport.CloseIdleConnections()
+		}()
+	})
+	return c.transport
+}
+
+// dialH2 connects to a server for the HTTP/2 transport, over TLS with ALPN
+// when the tunnel uses it
+func (tm *TunnelManager) dialH2(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+	conn, err := tm.dialServer(ctx, network, addr)
+	if err != nil || !tm.useTLS() {
+		return conn, err
+	}
+
+	cfg, err := tm.clientTLSConfig(addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		conn.Close()
+		return nil, fmt.Errorf("server at %s does not speak HTTP/2", addr)
+	}
+	return tlsConn, nil
+}
+
+// h2Conn adapts the two bodies of an HTTP/2 link request to net.Conn
+type h2Conn struct {
+	body    io.ReadCloser
+	send    io.Writer
+	flush   func()      // Server only, responses are flushed on every write
+	trailer http.Header // Client only, filled in once the response ends
+	cancel  func()      // Client only, resets the request
+	grpc    bool
+
+	local, remote net.Addr
+
+	// Reading gRPC messages
+	message []byte
+	pending []byte
+
+	writeMu sync.Mutex
+	closed  bool
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	if !c.grpc {
+		return c.body.Read(b)
+	}
+	for len(c.pending) == 0 {
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads the next gRPC message into pending
+func (c *h2Conn) readMessage() error {
+	var header [5]byte
+	if _, err := io.ReadFull(c.body, header[:]); err != nil {
+		if err == io.EOF {
+			return c.status()
+		}
+		return err
+	}
+	if header[0] != 0 {
+		return fmt.Errorf("compressed gRPC messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return fmt.Errorf("gRPC message too large: %d bytes", size)
+	}
+	if cap(c.message) < int(size) {
+		c.message = make([]byte, size)
+	}
+	message := c.message[:size]
+	if _, err := io.ReadFull(c.body, message); err != nil {
+		return err
+	}
+
+	// An empty chunk leaves out its only field
+	if len(message) == 0 {
+		return nil
+	}
+	length, n := binary.Uvarint(message[1:])
+	if message[0] != 0x0a || n <= 0 || uint64(len(message)-1-n) != length {
+		return fmt.Errorf("malformed gRPC message")
+	}
+	c.pending = message[1+n:]
+	return nil
+}
+
+// status returns the end of a gRPC response body as io.EOF, or as the error
+// its trailer reports
+func (c *h2Conn) status() error {
+	if c.trailer == nil {
+		return io.EOF
+	}
+	if status := c.trailer.Get("Grpc-Status"); status != "" && status != "0" {
+		return fmt.Errorf("gRPC status %s: %s", status, c.trailer.Get("Grpc-Message"))
+	}
+	return io.EOF
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if c.grpc {
+			if len(chunk) > grpcMaxMessage/2 {
+				chunk = chunk[:grpcMaxMessage/2]
+			}
+			if err := c.writePrefix(len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := c.send.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+	return written, nil
+}
+
+// writePrefix writes the gRPC message header and field tag of a chunk
+func (c *h2Conn) writePrefix(size int) error {
+	var prefix [5 + 1 + binary.MaxVarintLen32]byte
+	n := 6 + binary.PutUvarint(prefix[6:], uint64(size))
+	binary.BigEndian.PutUint32(prefix[1:5], uint32(n-5+size))
+	prefix[5] = 0x0a
+	_, err := c.send.Write(prefix[:n])
+	return err
+}
+
+// CloseWrite ends the request body on clients. Servers cannot end their
+// response alone, so they close the link.
+func (c *h2Conn) CloseWrite() error {
+	if pw, ok := c.send.(*io.PipeWriter); ok {
+		return pw.Close()
+	}
+	return c.Close()
+}
+
+// Close resets the request on clients and ends the response on servers
+func (c *h2Conn) Close() error {
+	c.once.Do(func() {
+		// Unblock a client's writes before waiting for them
+		if pw, ok := c.send.(*io.PipeWriter); ok {
+			pw.CloseWithError(net.ErrClosed)
+		}
+		if c.cancel != nil {
+			c.cancel()
+			c.body.Close()
+		}
+
+		// A server's response may not be written once its handler returns
+		c.writeMu.Lock()
+		c.closed = true
+		c.writeMu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *h2Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Deadlines are not supported, links end by closing
+func (c *h2Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *h2Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *h2Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// parseAddr turns the address of an HTTP request back into a net.Addr
+func parseAddr(addr string) net.Addr {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return tcpAddr
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHTTP2Server starts an h2 or grpc server forwarding to target and
+// waits for it to listen
+func startHTTP2Server(t *testing.T, config *Config) {
+	t.Helper()
+	server := newTunnelManager(config)
+	t.Cleanup(server.cancel)
+	go server.startServer()
+	dialEventually(t, config.Listen).Close()
+}
+
+func TestHTTP2Transports(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		protocol    string
+		tls         bool
+		udp         bool
+		compression string
+	}{
+		{name: "h2 tls", protocol: "h2", tls: true},
+		{name: "grpc tls", protocol: "grpc", tls: true},
+		{name: "h2 zstd", protocol: "h2", compression: compressionZstd},
+		{name: "grpc snappy", protocol: "grpc", compression: compressionSnappy},
+		{name: "grpc udp", protocol: "grpc", udp: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, local, target := freeAddr(t), freeAddr(t), ""
+			if tt.udp {
+				target, local = startUDPEchoServer(t), freeUDPAddr(t)
+			} else {
+				target = startEchoServer(t)
+			}
+
+			serverConfig := &Config{
+				Mode:        "server",
+				Protocol:    tt.protocol,
+				Listen:      listen,
+				Target:      target,
+				Token:       "test-token-0123456789",
+				Path:        "/api/v1/stream",
+				UDP:         tt.udp,
+				Compression: tt.compression,
+			}
+			clientConfig := &Config{
+				Mode:        "client",
+				Protocol:    tt.protocol,
+				Server:      listen,
+				Local:       local,
+				Token:       "test-token-0123456789",
+				Path:        "/api/v1/stream",
+				HostHeader:  "cdn.example.com",
+				UDP:         tt.udp,
+				Compression: tt.compression,
+			}
+			if tt.tls {
+				pki := newTestPKI(t)
+				serverConfig.TLS, serverConfig.CertFile, serverConfig.KeyFile = true, pki.serverCert, pki.serverKey
+				clientConfig.TLS, clientConfig.CAFile = true, pki.caFile
+			}
+			startHTTP2Server(t, serverConfig)
+
+			client := newTunnelManager(clientConfig)
+			defer client.cancel()
+			go client.startClient()
+
+			if tt.udp {
+				expectUDPEcho(t, local)
+			} else {
+				expectTCPEcho(t, local)
+				expectTCPEcho(t, local)
+			}
+		})
+	}
+}
+
+func TestHTTP2ServerEndsLink(t *testing.T) {
+	// A target that answers and closes, as HTTP/1.0 servers do
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("bye"))
+			conn.Close()
+		}
+	}()
+
+	for _, protocol := range []string{"h2", "grpc"} {
+		t.Run(protocol, func(t *testing.T) {
+			listen, local := freeAddr(t), freeAddr(t)
+			startHTTP2Server(t, &Config{
+				Mode:     "server",
+				Protocol: protocol,
+				Listen:   listen,
+				Target:   target.Addr().String(),
+				Token:    "test-token-0123456789",
+			})
+			client := newTunnelManager(&Config{
+				Mode:     "client",
+				Protocol: protocol,
+				Server:   listen,
+				Local:    local,
+				Token:    "test-token-0123456789",
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			conn := dialEventually(t, local)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("link did not end: %v", err)
+			}
+			if string(got) != "bye" {
+				t.Fatalf("unexpected reply: %q", got)
+			}
+		})
+	}
+}
+
+func TestHTTP2RejectsRequests(t *testing.T) {
+	listen := freeAddr(t)
+	startHTTP2Server(t, &Config{
+		Mode:     "server",
+		Protocol: "grpc",
+		Listen:   listen,
+		Target:   startEchoServer(t),
+		Token:    "test-token-0123456789",
+	})
+
+	wrong := newTunnelManager(&Config{
+		Mode:     "client",
+		Protocol: "grpc",
+		Server:   listen,
+		Token:    "wrong-token-0123456789",
+	})
+	defer wrong.cancel()
+	if _, err := wrong.dialLink(listen); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected the server to refuse the wrong token, got %v", err)
+	}
+
+	misrouted := newTunnelManager(&Config{
+		Mode:     "client",
+		Protocol: "grpc",
+		Server:   listen,
+		Token:    "test-token-0123456789",
+		Path:     "/other",
+	})
+	defer misrouted.cancel()
+	if _, err := misrouted.dialLink(listen); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected no link on another path, got %v", err)
+	}
+
+	// Plain HTTP/1.1 gets health checks but no links
+	resp, err := http.Get("http://" + listen + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("health check answered %s", resp.Status)
+	}
+	resp, err = http.Post("http://"+listen+grpcDefaultPath, "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusHTTPVersionNotSupported {
+		t.Fatalf("HTTP/1.1 link request answered %s", resp.Status)
+	}
+}
+
+func TestGRPCFraming(t *testing.T) {
+	var wire bytes.Buffer
+	writer := &h2Conn{send: &wire, grpc: true}
+	large := bytes.Repeat([]byte("x"), grpcMaxMessage)
+	for _, chunk := range [][]byte{[]byte("hello"), {}, large} {
+		if _, err := writer.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := &h2Conn{body: io.NopCloser(&wire), grpc: true, trailer: http.Header{}}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append([]byte("hello"), large...); !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, wrote %d", len(got), len(want))
+	}
+
+	reader = &h2Conn{body: io.NopCloser(&wire), grpc: true, trailer: http.Header{"Grpc-Status": {"14"}}}
+	if _, err := reader.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Fatalf("expected the trailer's status, got %v", err)
+	}
+
+	malformed := []byte{0, 0, 0, 0, 3, 0x12, 1, 'x'}
+	reader = &h2Conn{body: io.NopCloser(bytes.NewReader(malformed)), grpc: true}
+	if _, err := reader.Read(make([]byte, 1)); err == nil {
+		t.Fatal("accepted a message without the data field")
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP routing
+//
+// -mode http runs a router that shares one public HTTP listener, and
+// optionally an HTTPS one, between many tunnels. Each request goes to the
+// target of the host it names in its Host header:
+//
+//	-host app.example.com=127.0.0.1:9001
+//	-host *.alice.tunnels.example.com=127.0.0.1:9002
+//
+// A wildcard matches every name below its domain. An exact name wins over
+// wildcards and a longer wildcard over a shorter one. Targets may be pools
+// as with -target, see balance.go. Requests for hosts without a route are
+// answered with 404.
+//
+// Requests reach their target with X-Forwarded-For, X-Forwarded-Host and
+// X-Forwarded-Proto set by the router; values sent by clients are dropped.
+// Upgrades such as WebSocket pass through.
+//
+// -https-listen adds an HTTPS listener. With -cert or -sni certificates the
+// router terminates TLS there and routes the requests like plain ones.
+// Without certificates it passes connections through still encrypted,
+// routing them by the TLS server name (SNI) to a target that has to speak
+// TLS itself, and no headers are added.
+//
+// The host table is reloaded on SIGHUP.
+
+// hostRoute is one -host entry
+type hostRoute struct {
+	Pattern string
+	Target  string
+}
+
+// hostList collects repeated -host flags
+type hostList []hostRoute
+
+func (l *hostList) String() string {
+	specs := make([]string, len(*l))
+	for i, route := range *l {
+		specs[i] = route.Pattern + "=" + route.Target
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *hostList) Set(spec string) error {
+	pattern, target, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	if !ok || target == "" {
+		return fmt.Errorf("invalid host %q, want name=target", spec)
+	}
+	pattern = normalizeHost(pattern)
+	name := strings.TrimPrefix(pattern, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return fmt.Errorf("invalid host name %q", pattern)
+	}
+	if _, err := parseTargetPool(target); err != nil {
+		return fmt.Errorf("invalid host %q: %w", spec, err)
+	}
+	*l = append(*l, hostRoute{Pattern: pattern, Target: target})
+	return nil
+}
+
+// normalizeHost lowercases a host name and strips its port and trailing dot
+func normalizeHost(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// setHosts replaces the host table
+func (tm *TunnelManager) setHosts(routes hostList) {
+	hosts := make(map[string]string, len(routes))
+	for _, route := range routes {
+		hosts[route.Pattern] = route.Target
+	}
+
+	tm.liveMu.Lock()
+	defer tm.liveMu.Unlock()
+	tm.hosts = hosts
+}
+
+// hostTarget returns the target requests for host go to
+func (tm *TunnelManager) hostTarget(host string) (string, bool) {
+	name := normalizeHost(host)
+
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	if target, ok := tm.hosts[name]; ok {
+		return target, true
+	}
+	// Longest wildcard first
+	for domain := name; ; {
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return "", false
+		}
+		if target, ok := tm.hosts["*."+parent]; ok {
+			return target, true
+		}
+		domain = parent
+	}
+}
+
+// hostTargets returns every target in the host table
+func hostTargets(routes hostList) map[string]bool {
+	targets := make(map[string]bool)
+	for _, route := range routes {
+		targets[route.Target] = true
+	}
+	return targets
+}
+
+// terminatesHTTPS reports whether the router holds certificates to end TLS
+// on its HTTPS listener with
+func (tm *TunnelManager) terminatesHTTPS() bool {
+	return tm.config.HTTPSListen != "" && (tm.config.CertFile != "" || len(tm.config.SNICerts) > 0)
+}
+
+// startHTTPRouter serves the HTTP listener, and the HTTPS one if configured,
+// until shutdown
+func (tm *TunnelManager) startHTTPRouter() error {
+	tm.setHosts(tm.config.Hosts)
+	if err := tm.startPools(hostTargets(tm.config.Hosts)); err != nil {
+		return err
+	}
+
+	proxy := tm.newHTTPProxy()
+	listeners := []PortForward{{Listen: tm.config.Listen}}
+	if tm.config.HTTPSListen != "" {
+		listeners = append(listeners, PortForward{Listen: tm.config.HTTPSListen})
+	}
+
+	return tm.serveForwards(listeners, func(fwd PortForward) error {
+		if fwd.Listen != tm.config.HTTPSListen {
+			return tm.serveHTTP(fwd.Listen, proxy, nil)
+		}
+		if !tm.terminatesHTTPS() {
+			return tm.passHTTPS(fwd.Listen)
+		}
+		cfg, err := tm.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		return tm.serveHTTP(fwd.Listen, proxy, cfg)
+	})
+}
+
+// routeKey carries the target of a request from the handler to the proxy
+type routeKey struct{}
+
+// newHTTPProxy builds the reverse proxy requests are routed through. The
+// outgoing URL names the target hex encoded, so connections to different
+// targets are never reused for one another.
+func (tm *TunnelManager) newHTTPProxy() http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			target := r.In.Context().Value(routeKey{}).(string)
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = hex.EncodeToString([]byte(target))
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				host, _, _ := net.SplitHostPort(addr)
+				target, err := hex.DecodeString(host)
+				if err != nil {
+					return nil, fmt.Errorf("invalid route %q", host)
+				}
+				return tm.dialTarget(string(target), nil, nil)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to proxy %s%s: %v", r.Host, r.URL.Path, err)
+			stats.Errors.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := tm.hostTarget(r.Host)
+		if !ok {
+			if tm.config.Debug {
+				log.Printf("No route for host %q from %s", r.Host, r.RemoteAddr)
+			}
+			http.Error(w, "unknown host", http.StatusNotFound)
+			return
+		}
+		if c, ok := r.Context().Value(connectionKey{}).(*connection); ok {
+			c.setTarget(target)
+		}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, target)))
+	})
+}
+
+// serveHTTP serves routed HTTP on addr, over TLS when cfg is set
+func (tm *TunnelManager) serveHTTP(addr string, handler http.Handler, cfg *tls.Config) error {
+	listener, err := tm.listenTCP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	kind := "http"
+	var tracked net.Listener = &trackingListener{Listener: listener, tm: tm, kind: kind}
+	if cfg != nil {
+		kind = "https"
+		tracked = tls.NewListener(&trackingListener{Listener: listener, tm: tm, kind: kind}, cfg)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: handshakeTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				conn = tlsConn.NetConn()
+			}
+			if tc, ok := conn.(*trackedConn); ok {
+				return context.WithValue(ctx, connectionKey{}, tc.c)
+			}
+			return ctx
+		},
+	}
+
+	// Requests in flight finish while the tunnel drains
+	go func() {
+		<-tm.accepting.Done()
+		if err := server.Shutdown(tm.ctx); err != nil {
+			server.Close()
+		}
+	}()
+
+	log.Printf("HTTP router listening on %s (%s)", addr, kind)
+	if err := server.Serve(tracked); err != nil && !tm.draining() {
+		return err
+	}
+	return nil
+}
+
+// passHTTPS routes TLS connections on addr by server name without ending TLS
+func (tm *TunnelManager) passHTTPS(addr string) error {
+	listener, err := tm.listenTCP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer tm.closeOnDrain(listener)()
+
+	log.Printf("HTTP router listening on %s (TLS passthrough)", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if tm.draining() {
+				return nil
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+
+		tm.wg.Add(1)
+		go tm.handlePassthrough(conn)
+	}
+}
+
+func (tm *TunnelManager) handlePassthrough(clientConn net.Conn) {
+	defer tm.wg.Done()
+	defer clientConn.Close()
+
+	c, err := tm.openConnection("tls", clientConn.RemoteAddr().String(), "", "")
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	name, clientConn, err := readServerName(clientConn)
+	if err != nil {
+		if tm.config.Debug {
+			log.Printf("Dropping TLS connection from %s: %v", c.remote, err)
+		}
+		c.fail(err.Error())
+		return
+	}
+
+	target, ok := tm.hostTarget(name)
+	if !ok {
+		if tm.config.Debug {
+			log.Printf("No route for server name %q from %s", name, c.remote)
+		}
+		c.fail(fmt.Sprintf("no route for %s", name))
+		return
+	}
+	c.setTarget(target)
+
+	targetConn, err := tm.dialTarget(target, nil, c)
+	if err != nil {
+		log.Printf("Failed to connect to target %s: %v", target, err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
+		return
+	}
+	defer targetConn.Close()
+
+	tm.handleDirectConnection(clientConn, targetConn, c)
+}
+
+// errServerNameRead stops the handshake readServerName starts
+var errServerNameRead = errors.New("server name read")
+
+// readServerName reads the TLS ClientHello at the start of conn and returns
+// the server name it asks for, with a connection that replays the hello
+func readServerName(conn net.Conn) (string, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var hello bytes.Buffer
+	var name string
+	err := tls.Server(&sniffConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errServerNameRead
+		},
+	}).Handshake()
+	if name == "" {
+		if errors.Is(err, errServerNameRead) {
+			err = fmt.Errorf("client sent no server name")
+		}
+		return "", nil, fmt.Errorf("failed to read TLS server name: %w", err)
+	}
+	return name, &replayConn{Conn: conn, r: io.MultiReader(&hello, conn)}, nil
+}
+
+// sniffConn lets a TLS server read a ClientHello without answering it
+type sniffConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *sniffConn) Write([]byte) (int, error)  { return 0, io.ErrClosedPipe }
+
+// replayConn reads what was sniffed from a connection before the rest of it
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// connectionKey carries the registry entry of an HTTP connection in its
+// requests' contexts
+type connectionKey struct{}
+
+// trackingListener registers every accepted connection in the registry and
+// meters its traffic, refusing connections over the connection limit
+type trackingListener struct {
+	net.Listener
+	tm   *TunnelManager
+	kind string
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c, err := l.tm.openConnection(l.kind, conn.RemoteAddr().String(), "", "")
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return &trackedConn{Conn: conn, tm: l.tm, c: c}, nil
+	}
+}
+
+// trackedConn is an accepted connection counted in the registry until closed
+type trackedConn struct {
+	net.Conn
+	tm   *TunnelManager
+	c    *connection
+	once sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.c.carryIn(int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.c.carryOut(int64(n))
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tm.closeConnection(c.c)
+	})
+	return c.Conn.Close()
+}
+
+// reloadHosts applies the host table of a re-read configuration
+func (tm *TunnelManager) reloadHosts(next *Config) error {
+	targets := hostTargets(next.Hosts)
+	if err := tm.startPools(targets); err != nil {
+		return err
+	}
+
+	tm.liveMu.RLock()
+	current := make(map[string]string, len(tm.hosts))
+	for pattern, target := range tm.hosts {
+		current[pattern] = target
+	}
+	tm.liveMu.RUnlock()
+
+	var changes []string
+	for _, route := range next.Hosts {
+		if current[route.Pattern] != route.Target {
+			changes = append(changes, fmt.Sprintf("%s -> %s", route.Pattern, route.Target))
+		}
+		delete(current, route.Pattern)
+	}
+	for pattern := range current {
+		changes = append(changes, pattern+" removed")
+	}
+	sort.Strings(changes)
+	for _, change := range changes {
+		log.Printf("Host %s", change)
+	}
+
+	tm.setHosts(next.Hosts)
+	tm.retainPools(targets)
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostTarget(t *testing.T) {
+	var hosts hostList
+	for _, spec := range []string{
+		"app.example.com=10.0.0.1:80",
+		"*.example.com=10.0.0.2:80",
+		"*.alice.example.com=10.0.0.3:80",
+	} {
+		if err := hosts.Set(spec); err != nil {
+			t.Fatalf("Set(%q) failed: %v", spec, err)
+		}
+	}
+	tm := newTunnelManager(&Config{})
+	defer tm.cancel()
+	tm.setHosts(hosts)
+
+	for host, want := range map[string]string{
+		"app.example.com":       "10.0.0.1:80",
+		"APP.example.com.:8080": "10.0.0.1:80",
+		"other.example.com":     "10.0.0.2:80",
+		"web.alice.example.com": "10.0.0.3:80",
+		"a.b.alice.example.com": "10.0.0.3:80",
+		"alice.example.com":     "10.0.0.2:80",
+		"example.com":           "",
+		"app.example.org":       "",
+		"localhost":             "",
+	} {
+		got, ok := tm.hostTarget(host)
+		if got != want || ok != (want != "") {
+			t.Errorf("hostTarget(%q) = %q, %v, want %q", host, got, ok, want)
+		}
+	}
+}
+
+func TestHostListRejectsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "app.example.com", "=10.0.0.1:80", "*=10.0.0.1:80", "a.*.com=10.0.0.1:80", "app.example.com=10.0.0.1"} {
+		var hosts hostList
+		if err := hosts.Set(spec); err == nil {
+			t.Errorf("Set(%q) succeeded", spec)
+		}
+	}
+}
+
+// startHTTPBackend starts a server answering every request with its name and
+// the forwarding headers it received
+func startHTTPBackend(t *testing.T, name string, secure bool) string {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s host=%s for=%s proto=%s", name, r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"))
+	})
+	server := httptest.NewUnstartedServer(handler)
+	if secure {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// httpGet requests url with the given Host header
+func httpGet(t *testing.T, client *http.Client, url, host string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("X-Forwarded-For", "198.51.100.99")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s for %s failed: %v", url, host, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestHTTPRouting(t *testing.T) {
+	pki := newTestPKI(t)
+	first, second := startHTTPBackend(t, "first", false), startHTTPBackend(t, "second", false)
+	listen, httpsListen := freeAddr(t), freeAddr(t)
+
+	var hosts hostList
+	hosts.Set("app.example.com=" + first)
+	hosts.Set("*.alice.example.com=" + second)
+
+	router := newTunnelManager(&Config{
+		Mode:        "http",
+		Listen:      listen,
+		HTTPSListen: httpsListen,
+		Hosts:       hosts,
+		CertFile:    pki.serverCert,
+		KeyFile:     pki.serverKey,
+	})
+	defer router.cancel()
+	go router.startHTTPRouter()
+	dialEventually(t, listen).Close()
+	dialEventually(t, httpsListen).Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	tests := []struct {
+		url, host string
+		status    int
+		body      string
+	}{
+		{"http://" + listen + "/", "app.example.com", http.StatusOK, "first host=app.example.com for=127.0.0.1 proto=http"},
+		{"http://" + listen + "/", "web.alice.example.com", http.StatusOK, "second host=web.alice.example.com for=127.0.0.1 proto=http"},
+		{"https://" + httpsListen + "/", "app.example.com", http.StatusOK, "first host=app.example.com for=127.0.0.1 proto=https"},
+		{"http://" + listen + "/", "unknown.example.com", http.StatusNotFound, "unknown host\n"},
+	}
+	for _, tt := range tests {
+		status, body := httpGet(t, client, tt.url, tt.host)
+		if status != tt.status || body != tt.body {
+			t.Errorf("%s for %s = %d %q, want %d %q", tt.url, tt.host, status, body, tt.status, tt.body)
+		}
+	}
+
+	// Hosts move on reload
+	var moved hostList
+	moved.Set("app.example.com=" + second)
+	if err := router.reload(&Config{Mode: "http", Listen: listen, HTTPSListen: httpsListen, Hosts: moved, CertFile: pki.serverCert, KeyFile: pki.serverKey}); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if _, body := httpGet(t, client, "http://"+listen+"/", "app.example.com"); !strings.HasPrefix(body, "second ") {
+		t.Errorf("app.example.com still goes to %q after reload", body)
+	}
+	if status, _ := httpGet(t, client, "http://"+listen+"/", "web.alice.example.com"); status != http.StatusNotFound {
+		t.Errorf("removed host answered %d", status)
+	}
+}
+
+func TestHTTPSPassthrough(t *testing.T) {
+	backend := startHTTPBackend(t, "secure", true)
+	listen, httpsListen := freeAddr(t), freeAddr(t)
+
+	var hosts hostList
+	hosts.Set("secure.example.com=" + backend)
+
+	router := newTunnelManager(&Config{
+		Mode:        "http",
+		Listen:      listen,
+		HTTPSListen: httpsListen,
+		Hosts:       hosts,
+	})
+	defer router.cancel()
+	go router.startHTTPRouter()
+	dialEventually(t, httpsListen).Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "secure.example.com"},
+		},
+	}
+	status, body := httpGet(t, client, "https://"+httpsListen+"/", "secure.example.com")
+	if status != http.StatusOK || !strings.HasPrefix(body, "secure host=secure.example.com") {
+		t.Fatalf("got %d %q through passthrough", status, body)
+	}
+	// The target ends TLS itself, so nothing is added
+	if !strings.Contains(body, "for=198.51.100.99") {
+		t.Errorf("passthrough changed headers: %q", body)
+	}
+
+	// Unknown server names are dropped
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", httpsListen, &tls.Config{InsecureSkipVerify: true, ServerName: "other.example.com"})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS connection for an unknown server name was accepted")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// HTTP links
+//
+// The ws, h2 and grpc transports carry links in HTTP requests, which clients
+// shape to pass the proxies and CDNs between them and the server:
+//
+//	-path         the request path, /tunnel unless the transport says otherwise
+//	-host-header  the Host header, the server address by default
+//	-server-name  the TLS server name, see tls.go
+//	-header       extra headers as Name: value, repeatable
+//	-token-in     where the token goes: an Authorization bearer header, the
+//	              token query parameter or the token cookie
+//
+// Servers take the token from any of the three places and answer /health
+// besides the link path, and /stats with the tunnel's totals to requests
+// carrying the token. Sessions and targets are only listed on the -control
+// endpoint, see control.go. With -decoy they serve a website instead, from
+// a directory or by proxying to an http(s) URL: every request that is not a
+// link gets the decoy's answer, those probing the link path and /health and
+// /stats included, so the server looks like the site alone.
+
+const (
+	// linkDefaultPath is where links are requested unless -path says otherwise
+	linkDefaultPath = "/tunnel"
+
+	// tokenParam names the query parameter and cookie carrying the token
+	tokenParam = "token"
+)
+
+// headerList holds the extra headers of link requests
+type headerList []string
+
+func (l *headerList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *headerList) Set(spec string) error {
+	name, value, ok := strings.Cut(spec, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header %q, want Name: value", spec)
+	}
+	if textproto.CanonicalMIMEHeaderKey(name) == "Host" {
+		return fmt.Errorf("set the Host header with -host-header")
+	}
+	*l = append(*l, name+": "+strings.TrimSpace(value))
+	return nil
+}
+
+// linkPath returns the path links are requested on, fallback unless -path
+// says otherwise
+func (tm *TunnelManager) linkPath(fallback string) string {
+	if tm.config.Path != "" {
+		return tm.config.Path
+	}
+	return fallback
+}
+
+// linkURL returns the URL of link requests to server, carrying the token
+// when it goes in the query
+func (tm *TunnelManager) linkURL(scheme, server, path string) string {
+	u := url.URL{Scheme: scheme, Host: server, Path: path}
+	if tm.config.TokenIn == "query" {
+		u.RawQuery = url.Values{tokenParam: {tm.config.Token}}.Encode()
+	}
+	return u.String()
+}
+
+// linkHeader returns the headers of link requests, carrying the token
+// unless it goes in the query
+func (tm *TunnelManager) linkHeader() http.Header {
+	header := http.Header{}
+	for _, spec := range tm.config.Headers {
+		name, value, _ := strings.Cut(spec, ": ")
+		header.Add(name, value)
+	}
+	switch tm.config.TokenIn {
+	case "query":
+	case "cookie":
+		header.Add("Cookie", (&http.Cookie{Name: tokenParam, Value: tm.config.Token}).String())
+	default:
+		header.Set("Authorization", "Bearer "+tm.config.Token)
+	}
+	return header
+}
+
+// authorizedRequest reports whether an HTTP request carries the token, as a
+// bearer token, in the query or in a cookie
+func (tm *TunnelManager) authorizedRequest(r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && tm.validToken(token) {
+		return true
+	}
+	if tm.validToken(r.URL.Query().Get(tokenParam)) {
+		return true
+	}
+	cookie, err := r.Cookie(tokenParam)
+	return err == nil && tm.validToken(cookie.Value)
+}
+
+func (tm *TunnelManager) validToken(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(tm.config.Token)) == 1
+}
+
+// linkMux routes the requests of an HTTP link listener
+type linkMux struct {
+	*http.ServeMux
+	decoy http.Handler
+}
+
+// newLinkMux returns a mux answering /health and /stats, or serving the
+// decoy site to everything but links with -decoy
+func (tm *TunnelManager) newLinkMux() (*linkMux, error) {
+	m := &linkMux{ServeMux: http.NewServeMux()}
+	if tm.config.Decoy == "" {
+		m.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "OK")
+		})
+		m.HandleFunc("/stats", tm.handleLinkStats)
+		return m, nil
+	}
+
+	decoy, err := newDecoy(tm.config.Decoy)
+	if err != nil {
+		return nil, err
+	}
+	m.decoy = decoy
+	m.Handle("/", decoy)
+	return m, nil
+}
+
+// handleLinkStats answers /stats with the tunnel's totals, to requests
+// carrying the token only
+func (tm *TunnelManager) handleLinkStats(w http.ResponseWriter, r *http.Request) {
+	if !tm.authorizedRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+	tm.writeJSON(w, tm.totalStats())
+}
+
+// refuse answers a request on the link path that is not a link, with the
+// decoy site when there is one
+func (m *linkMux) refuse(w http.ResponseWriter, r *http.Request, status int) {
+	if m.decoy != nil {
+		m.decoy.ServeHTTP(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// newDecoy returns a handler serving the decoy site, proxied from an
+// http(s) URL or read from a directory
+func newDecoy(spec string) (http.Handler, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		target, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid decoy URL: %w", err)
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+			},
+		}, nil
+	}
+
+	// Requests cannot leave the directory, through .. or symlinks
+	root, err := os.OpenRoot(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load decoy site: %w", err)
+	}
+	return http.FileServerFS(root.FS()), nil
+}
+
+// httpListener hands out the links its HTTP server accepts, such as
+// WebSocket upgrades
+type httpListener struct {
+	net.Listener
+	server *http.Server
+	links  chan net.Conn
+
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newHTTPListener(listener net.Listener) *httpListener {
+	return &httpListener{
+		Listener: listener,
+		links:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// serve runs server on the listener until it is closed
+func (l *httpListener) serve(server *http.Server) {
+	l.server = server
+	go func() {
+		err := server.Serve(l.Listener)
+		l.close(err)
+	}()
+}
+
+// push hands a link to Accept, closing it if the listener closed first
+func (l *httpListener) push(link net.Conn) {
+	select {
+	case l.links <- link:
+	case <-l.done:
+		link.Close()
+	}
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+	select {
+	case link := <-l.links:
+		return link, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// close stops handing out links, Accept returning err from then on
+func (l *httpListener) close(err error) {
+	l.once.Do(func() {
+		if err == nil || err == http.ErrServerClosed {
+			err = net.ErrClosed
+		}
+		l.err = err
+		close(l.done)
+	})
+}
+
+// drain stops handing out links and shuts the HTTP server down gracefully,
+// links on its HTTP/2 connections finishing before they close
+func (l *httpListener) drain() {
+	l.close(net.ErrClosed)
+	go l.server.Shutdown(context.Background())
+}
+
+// Close stops the HTTP server, links already handed out stay open
+func (l *httpListener) Close() error {
+	l.close(net.ErrClosed)
+	return l.server.Close()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkRequestCarriesToken(t *testing.T) {
+	for _, tokenIn := range []string{"header", "query", "cookie"} {
+		t.Run(tokenIn, func(t *testing.T) {
+			tm := newTunnelManager(&Config{
+				Token:   "test-token-0123456789",
+				TokenIn: tokenIn,
+				Headers: headerList{"X-Client: mobile", "Cache-Control: no-cache"},
+			})
+			defer tm.cancel()
+
+			r := httptest.NewRequest(http.MethodGet, tm.linkURL("http", "example.com", "/api"), nil)
+			r.Header = tm.linkHeader()
+			if !tm.authorizedRequest(r) {
+				t.Fatalf("request with the token in the %s was refused", tokenIn)
+			}
+			if r.Header.Get("X-Client") != "mobile" || r.Header.Get("Cache-Control") != "no-cache" {
+				t.Fatalf("extra headers missing: %v", r.Header)
+			}
+			placed := map[string]bool{
+				"header": r.Header.Get("Authorization") != "",
+				"query":  r.URL.RawQuery != "",
+				"cookie": r.Header.Get("Cookie") != "",
+			}
+			for where, ok := range placed {
+				if ok != (where == tokenIn) {
+					t.Fatalf("token in the %s: %v", tokenIn, placed)
+				}
+			}
+
+			other := newTunnelManager(&Config{Token: "wrong-token-0123456789"})
+			defer other.cancel()
+			if other.authorizedRequest(r) {
+				t.Fatal("request with another token was authorized")
+			}
+		})
+	}
+}
+
+func TestHeaderListRejectsHost(t *testing.T) {
+	var headers headerList
+	if err := headers.Set("host: example.com"); err == nil {
+		t.Fatal("accepted a Host header")
+	}
+	if err := headers.Set("no colon"); err == nil {
+		t.Fatal("accepted a header without a value separator")
+	}
+	if err := headers.Set("X-Empty:"); err != nil {
+		t.Fatalf("refused an empty header value: %v", err)
+	}
+}
+
+func TestWebSocketEndpoint(t *testing.T) {
+	for _, tokenIn := range []string{"query", "cookie"} {
+		t.Run(tokenIn, func(t *testing.T) {
+			listen, local := freeAddr(t), freeAddr(t)
+			server := newTunnelManager(&Config{
+				Mode:     "server",
+				Protocol: "ws",
+				Listen:   listen,
+				Target:   startEchoServer(t),
+				Token:    "test-token-0123456789",
+				Path:     "/socket/v2",
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, listen).Close()
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   "ws",
+				Server:     listen,
+				Local:      local,
+				Token:      "test-token-0123456789",
+				Path:       "/socket/v2",
+				HostHeader: "cdn.example.com",
+				Headers:    headerList{"X-Client: mobile"},
+				TokenIn:    tokenIn,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			expectTCPEcho(t, local)
+
+			resp, err := http.Get("http://" + listen + "/tunnel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("the default path answered %s", resp.Status)
+			}
+		})
+	}
+}
+
+func TestLinkStatsNeedToken(t *testing.T) {
+	server, client := startTunnel(t, &Config{Protocol: "wsmux", Target: startEchoServer(t)}, &Config{MuxStreams: 1})
+	expectTCPEcho(t, client.config.Local)
+
+	stats := "http://" + server.config.Listen + "/stats"
+	resp, err := http.Get(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("/stats without the token answered %s", resp.Status)
+	}
+
+	resp, err = http.Get(stats + "?token=" + server.config.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"bytes_in"`) {
+		t.Fatalf("/stats with the token answered %s: %s", resp.Status, body)
+	}
+	if strings.Contains(string(body), "sessions") || strings.Contains(string(body), "127.0.0.1") {
+		t.Fatalf("/stats listed sessions: %s", body)
+	}
+}
+
+func TestDecoySite(t *testing.T) {
+	site := t.TempDir()
+	if err := os.WriteFile(filepath.Join(site, "index.html"), []byte("<h1>Welcome</h1>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	for _, tt := range []struct {
+		protocol, decoy, want string
+	}{
+		{"ws", site, "<h1>Welcome</h1>"},
+		{"h2", upstream.URL, "upstream /"},
+	} {
+		t.Run(tt.protocol, func(t *testing.T) {
+			listen, local := freeAddr(t), freeAddr(t)
+			server := newTunnelManager(&Config{
+				Mode:     "server",
+				Protocol: tt.protocol,
+				Listen:   listen,
+				Target:   startEchoServer(t),
+				Token:    "test-token-0123456789",
+				Decoy:    tt.decoy,
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, listen).Close()
+
+			// Probes of the site, the link path and the tunnel's own
+			// endpoints all get the decoy
+			for _, path := range []string{"/", "/tunnel", "/health", "/stats"} {
+				resp, err := http.Get("http://" + listen + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if path == "/" && string(body) != tt.want {
+					t.Fatalf("%s answered %q", path, body)
+				}
+				if strings.Contains(string(body), "OK") || strings.Contains(string(body), "connections") {
+					t.Fatalf("%s gave the tunnel away: %q", path, body)
+				}
+			}
+
+			client := newTunnelManager(&Config{
+				Mode:     "client",
+				Protocol: tt.protocol,
+				Server:   listen,
+				Local:    local,
+				Token:    "test-token-0123456789",
+			})
+			defer client.cancel()
+			go client.startClient()
+			expectTCPEcho(t, local)
+		})
+	}
+}
+
+func TestDecoyStaysInsideItsDirectory(t *testing.T) {
+	site, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(site, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	decoy, err := newDecoy(site)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/escape/secret", "/../" + filepath.Base(outside) + "/secret"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.URL.Path = path
+		decoy.ServeHTTP(w, r)
+		if strings.Contains(w.Body.String(), "secret") {
+			t.Fatalf("%s was served from outside the decoy site", path)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Traffic limits
+//
+// -max-bandwidth, -client-bandwidth and -conn-bandwidth cap the MB/s each
+// direction may carry for the whole tunnel, for each client IP and for each
+// connection. TCP connections and streams are slowed down to fit, UDP
+// datagrams over a limit are dropped. -max-connections refuses connections
+// and UDP flows while that many are open.
+//
+// A reload applies new tunnel and client limits at once and connection
+// limits to new connections.
+
+const bytesPerMB = 1 << 20
+
+// rateLimiter is a token bucket that holds up to one second of traffic
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(mbps float64) *rateLimiter {
+	l := &rateLimiter{last: time.Now()}
+	l.setRate(mbps)
+	return l
+}
+
+// setRate changes the limit, 0 lifts it
+func (l *rateLimiter) setRate(mbps float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = mbps * bytesPerMB
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+// refill adds the tokens earned since the last call, callers hold mu
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must
+// wait until they are earned
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes n bytes from the bucket if they are available now
+func (l *rateLimiter) allow(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	l.refill()
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// bandwidth limits each direction of some traffic separately
+type bandwidth struct {
+	in  *rateLimiter
+	out *rateLimiter
+}
+
+func newBandwidth(mbps float64) bandwidth {
+	return bandwidth{in: newRateLimiter(mbps), out: newRateLimiter(mbps)}
+}
+
+func (b bandwidth) setRate(mbps float64) {
+	b.in.setRate(mbps)
+	b.out.setRate(mbps)
+}
+
+// clientBandwidth is the bandwidth shared by the open connections of one
+// client IP
+type clientBandwidth struct {
+	bandwidth
+	refs int
+}
+
+// trafficLimits holds the tunnel's limits and the buckets shared between
+// connections
+type trafficLimits struct {
+	mu             sync.Mutex
+	tunnel         bandwidth
+	clients        map[string]*clientBandwidth
+	clientRate     float64
+	connRate       float64
+	maxConnections int
+}
+
+func newTrafficLimits(config *Config) *trafficLimits {
+	limits := &trafficLimits{
+		tunnel:  newBandwidth(0),
+		clients: make(map[string]*clientBandwidth),
+	}
+	limits.configure(config)
+	return limits
+}
+
+// configure applies the limits in config, updating shared buckets in place
+func (tl *trafficLimits) configure(config *Config) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	tl.tunnel.setRate(config.MaxBandwidth)
+	if config.ClientBandwidth != tl.clientRate {
+		for _, client := range tl.clients {
+			client.setRate(config.ClientBandwidth)
+		}
+	}
+	tl.clientRate = config.ClientBandwidth
+	tl.connRate = config.ConnBandwidth
+	tl.maxConnections = config.MaxConnections
+}
+
+// acquire returns the buckets a new connection from host passes through,
+// tunnel first and its own last
+func (tl *trafficLimits) acquire(host string) (in, out []*rateLimiter) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	in = []*rateLimiter{tl.tunnel.in}
+	out = []*rateLimiter{tl.tunnel.out}
+
+	client, ok := tl.clients[host]
+	if !ok {
+		client = &clientBandwidth{bandwidth: newBandwidth(tl.clientRate)}
+		tl.clients[host] = client
+	}
+	client.refs++
+	in = append(in, client.in)
+	out = append(out, client.out)
+
+	if tl.connRate > 0 {
+		own := newBandwidth(tl.connRate)
+		in = append(in, own.in)
+		out = append(out, own.out)
+	}
+	return in, out
+}
+
+// release drops a closed connection's hold on its client's buckets
+func (tl *trafficLimits) release(host string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if client, ok := tl.clients[host]; ok {
+		client.refs--
+		if client.refs <= 0 {
+			delete(tl.clients, host)
+		}
+	}
+}
+
+// checkCapacity refuses a new connection while open connections are at the
+// limit
+func (tl *trafficLimits) checkCapacity(open int) error {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.maxConnections > 0 && open >= tl.maxConnections {
+		return fmt.Errorf("connection limit of %d reached", tl.maxConnections)
+	}
+	return nil
+}
+
+// waitFor blocks until every bucket lets n bytes through or ctx ends
+func waitFor(ctx context.Context, limiters []*rateLimiter, n int) {
+	var delay time.Duration
+	for _, l := range limiters {
+		if d := l.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// allowAll reports whether every bucket has room for n bytes now
+func allowAll(limiters []*rateLimiter, n int) bool {
+	for _, l := range limiters {
+		if !l.allow(n) {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteHost returns the IP part of a remote address, which client limits
+// are keyed by
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
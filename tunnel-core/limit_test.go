@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1)
+
+	// A full bucket lets one second of traffic through at once
+	if delay := l.reserve(bytesPerMB); delay != 0 {
+		t.Fatalf("first reserve waited %s", delay)
+	}
+	if l.allow(1024) {
+		t.Fatal("empty bucket allowed a datagram")
+	}
+	delay := l.reserve(bytesPerMB / 2)
+	if delay < 400*time.Millisecond || delay > 600*time.Millisecond {
+		t.Fatalf("reserve of half a second of traffic waits %s", delay)
+	}
+
+	l.setRate(0)
+	if delay := l.reserve(10 * bytesPerMB); delay != 0 || !l.allow(10*bytesPerMB) {
+		t.Fatal("unlimited bucket held traffic back")
+	}
+}
+
+func TestWaitForHonoursContext(t *testing.T) {
+	l := newRateLimiter(1)
+	l.reserve(bytesPerMB)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	waitFor(ctx, []*rateLimiter{l}, 10*bytesPerMB)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("waitFor ignored a cancelled context for %s", elapsed)
+	}
+}
+
+func TestClientBandwidthIsShared(t *testing.T) {
+	limits := newTrafficLimits(&Config{ClientBandwidth: 1})
+
+	firstIn, _ := limits.acquire("10.0.0.1")
+	secondIn, _ := limits.acquire("10.0.0.1")
+	otherIn, _ := limits.acquire("10.0.0.2")
+
+	if firstIn[1] != secondIn[1] {
+		t.Fatal("connections from one client got separate buckets")
+	}
+	if firstIn[1] == otherIn[1] {
+		t.Fatal("different clients share a bucket")
+	}
+
+	limits.release("10.0.0.1")
+	limits.release("10.0.0.1")
+	if _, ok := limits.clients["10.0.0.1"]; ok {
+		t.Fatal("client bucket kept after its last connection closed")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	target, listen := startEchoServer(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:           "server",
+		Protocol:       "tcp",
+		Listen:         listen,
+		Target:         target,
+		Token:          "test-token-0123456789",
+		MaxConnections: 1,
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	// The first link holds the only slot
+	first := dialEventually(t, listen)
+	defer first.Close()
+	if _, err := clientHandshake(first, "test-token-0123456789", 0); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	first.Write([]byte("ping\n"))
+	if _, err := io.ReadFull(first, make([]byte, 5)); err != nil {
+		t.Fatalf("first link was not served: %v", err)
+	}
+
+	rejected := stats.Rejected.Load()
+	second := dialEventually(t, listen)
+	defer second.Close()
+	if _, err := clientHandshake(second, "test-token-0123456789", 0); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("second link over the limit was served: %v", err)
+	}
+	if stats.Rejected.Load() != rejected+1 {
+		t.Fatal("refused connection was not counted")
+	}
+
+	// Closing the first link frees its slot
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn := dialEventually(t, listen)
+		if _, err := clientHandshake(conn, "test-token-0123456789", 0); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		conn.Write([]byte("ping\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(make([]byte, 5))
+		conn.Close()
+		if n == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not freed after the first link closed")
+		}
+	}
+}
@@ -5,82 +5,246 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/hashicorp/yamux"
 )
 
-// Configuration
+// Configuration, the yaml keys are the flag names with underscores
 type Config struct {
-	Mode       string
-	Protocol   string
-	Listen     string
-	Target     string
-	Token      string
-	CertFile   string
-	KeyFile    string
-	MuxEnabled bool
-	MuxStreams int
-	Debug      bool
+	Mode       string      `yaml:"mode"`
+	Protocol   string      `yaml:"protocol"`
+	Listen     string      `yaml:"listen"`
+	Target     string      `yaml:"target"`
+	Bind       string      `yaml:"bind"`
+	Server     string      `yaml:"server"`
+	Local      string      `yaml:"local"`
+	Forwards   forwardList `yaml:"forwards"`
+	Token      string      `yaml:"token"`
+	CertFile   string      `yaml:"cert"`
+	KeyFile    string      `yaml:"key"`
+	SNICerts   sniList     `yaml:"sni_certs"`
+	MuxEnabled bool        `yaml:"mux"`
+	MuxStreams int         `yaml:"mux_streams"`
+	UDP        bool        `yaml:"udp"`
+	Debug      bool        `yaml:"debug"`
+
+	// HTTP routing by host name, see http.go
+	HTTPSListen string   `yaml:"https_listen"`
+	Hosts       hostList `yaml:"hosts"`
+
+	// Control is where statistics are served, unix:/path or host:port
+	Control string `yaml:"control"`
+
+	// PROXY protocol header sent to targets (v1 or v2) and parsing of
+	// incoming ones, see proxyproto.go
+	ProxyProtocol       string `yaml:"proxy_protocol"`
+	AcceptProxyProtocol bool   `yaml:"accept_proxy_protocol"`
+
+	// Dynamic forwarding through a local SOCKS5 or HTTP CONNECT proxy, and
+	// the destinations a server lets it reach, see dynamic.go
+	Dynamic          bool     `yaml:"dynamic"`
+	DynamicAllow     netList  `yaml:"dynamic_allow"`
+	DynamicDeny      netList  `yaml:"dynamic_deny"`
+	DynamicPorts     portList `yaml:"dynamic_ports"`
+	DynamicDenyPorts portList `yaml:"dynamic_deny_ports"`
+
+	// Target pools, see balance.go
+	Balance        string        `yaml:"balance"`
+	HealthCheck    string        `yaml:"health_check"`
+	HealthPath     string        `yaml:"health_path"`
+	HealthInterval time.Duration `yaml:"health_interval"`
+	HealthTimeout  time.Duration `yaml:"health_timeout"`
+	HealthFails    int           `yaml:"health_fails"`
+	HealthPasses   int           `yaml:"health_passes"`
+
+	// TLS for links, see tls.go
+	TLS                bool   `yaml:"tls"`
+	CAFile             string `yaml:"ca"`
+	TLSMinVersion      string `yaml:"tls_min_version"`
+	TLSMaxVersion      string `yaml:"tls_max_version"`
+	TLSCiphers         string `yaml:"tls_ciphers"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+
+	// Traffic limits in MB/s per direction and open connections, 0 for none
+	MaxBandwidth    float64 `yaml:"max_bandwidth"`
+	ClientBandwidth float64 `yaml:"client_bandwidth"`
+	ConnBandwidth   float64 `yaml:"conn_bandwidth"`
+	MaxConnections  int     `yaml:"max_connections"`
+
+	// UDPIdleTimeout expires UDP flows that carried no datagrams for this long
+	UDPIdleTimeout time.Duration `yaml:"udp_idle_timeout"`
+
+	// Keepalives and timeouts of links and forwarded connections, see
+	// timeouts.go
+	TCPKeepAlive   time.Duration `yaml:"tcp_keepalive"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	MaxLifetime    time.Duration `yaml:"max_lifetime"`
+
+	// Delays between reconnects, see reconnect.go, and how long a server
+	// keeps streams whose link broke, see resume.go
+	ReconnectMin time.Duration `yaml:"reconnect_min"`
+	ReconnectMax time.Duration `yaml:"reconnect_max"`
+	ResumeGrace  time.Duration `yaml:"resume_grace"`
+
+	// Compression of links: none, zstd or snappy, see compress.go
+	Compression string `yaml:"compress"`
+
+	// Requests of ws, h2 and grpc links and the decoy site answering the
+	// rest, see httplink.go
+	Path       string     `yaml:"path"`
+	HostHeader string     `yaml:"host_header"`
+	Headers    headerList `yaml:"headers"`
+	TokenIn    string     `yaml:"token_in"`
+	Decoy      string     `yaml:"decoy"`
+
+	// Proxy clients dial servers through, see upstream.go
+	Proxy string `yaml:"proxy"`
+
+	// How long connections get to finish on SIGTERM and whether listening
+	// sockets are shared with a new process, see drain.go
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	ReusePort    bool          `yaml:"reuse_port"`
+
+	// Mux tuning, mirrors models.MuxConfig
+	MuxFrameSize     int `yaml:"mux_frame_size"`
+	MuxReceiveBuffer int `yaml:"mux_receive_buffer"`
+	MuxStreamBuffer  int `yaml:"mux_stream_buffer"`
+	MuxHeartbeat     int `yaml:"mux_heartbeat"`
+
+	// ConfigFile is the file the configuration was read from, "-" for stdin
+	ConfigFile string `yaml:"-"`
 }
 
 // TunnelManager manages tunnel connections
 type TunnelManager struct {
 	config    *Config
-	listener  net.Listener
-	sessions  map[string]*yamux.Session
+	sessions  map[string]*trackedSession
 	mu        sync.RWMutex
 	ctx       context.Context
 	cancel    context.CancelFunc
 	wg        sync.WaitGroup
+
+	// accepting ends when the tunnel stops taking connections, before ctx
+	// when it drains, see drain.go
+	accepting     context.Context
+	stopAccepting context.CancelFunc
+
+	// conns registers every tunneled connection, see registry.go
+	conns  connectionRegistry
+	limits *trafficLimits
+
+	// Settings SIGHUP can change while the tunnel runs, see reload
+	liveMu   sync.RWMutex
+	routes   map[string]string
+	cert     *tls.Certificate
+	sniCerts map[string]*tls.Certificate
+	hosts    map[string]string
+
+	// pools holds a pool per target list in use, see balance.go
+	poolsMu sync.Mutex
+	pools   map[string]*targetPool
+
+	// dests logs the destinations of dynamic clients, see dynamic.go
+	dests destinationLog
+
+	// resumes holds the streams that survive broken links, see resume.go
+	resumes resumeTable
+
+	// quic holds a client's QUIC connections, see quic.go
+	quic quicSessions
+
+	// h2 holds a client's HTTP/2 connections, see h2.go
+	h2 h2Client
 }
 
-// ConnectionStats tracks connection statistics
+// ConnectionStats tracks connection statistics, updated from every
+// connection's goroutines
 type ConnectionStats struct {
-	BytesIn     int64
-	BytesOut    int64
-	Connections int64
-	Errors      int64
+	BytesIn     atomic.Int64
+	BytesOut    atomic.Int64
+	Connections atomic.Int64
+	Active      atomic.Int64
+	Rejected    atomic.Int64
+	Dropped     atomic.Int64
+	Errors      atomic.Int64
 	StartTime   time.Time
+
+	// Links set up again after a loss, streams moved to a new link and
+	// streams waiting for one, see resume.go
+	Reconnects atomic.Int64
+	Resumed    atomic.Int64
+	Orphaned   atomic.Int64
+
+	// Bytes through link compression and the bytes they took on the wire,
+	// see compress.go
+	Uncompressed atomic.Int64
+	Compressed   atomic.Int64
 }
 
 var stats = &ConnectionStats{StartTime: time.Now()}
 
 func main() {
-	config := parseFlags()
+	config, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
 	
 	if config.Debug {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 		log.Println("Debug mode enabled")
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	manager := newTunnelManager(config)
+	defer manager.cancel()
 
-	manager := &TunnelManager{
-		config:   config,
-		sessions: make(map[string]*yamux.Session),
-		ctx:      ctx,
-		cancel:   cancel,
+	if config.Control != "" {
+		if err := manager.startControlServer(config.Control); err != nil {
+			log.Fatalf("Failed to start control endpoint: %v", err)
+		}
 	}
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown, a second signal ends the drain
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
 		<-sigChan
 		log.Println("Shutting down gracefully...")
-		cancel()
+		go manager.drain(config.DrainTimeout)
+		<-sigChan
+		log.Println("Closing all connections")
+		manager.cancel()
+	}()
+
+	// Reload the configuration on SIGHUP
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	go func() {
+		for range hupChan {
+			if config.ConfigFile == "-" {
+				log.Println("Configuration read from stdin cannot be reloaded")
+				continue
+			}
+			next, err := parseFlags(os.Args[1:])
+			if err == nil {
+				err = manager.reload(next)
+			}
+			if err != nil {
+				log.Printf("Failed to reload configuration: %v", err)
+			}
+		}
 	}()
 
 	// Start tunnel based on mode
@@ -95,132 +259,346 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to start client: %v", err)
 		}
+	case "http":
+		err := manager.startHTTPRouter()
+		if err != nil {
+			log.Fatalf("Failed to start HTTP router: %v", err)
+		}
 	default:
-		log.Fatalf("Invalid mode: %s. Use 'server' or 'client'", config.Mode)
+		log.Fatalf("Invalid mode: %s. Use 'server', 'client' or 'http'", config.Mode)
 	}
 
 	manager.wg.Wait()
 	log.Println("Tunnel stopped")
 }
 
-func parseFlags() *Config {
+// newTunnelManager creates a tunnel manager for the given configuration
+func newTunnelManager(config *Config) *TunnelManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	accepting, stopAccepting := context.WithCancel(ctx)
+	return &TunnelManager{
+		config:   config,
+		sessions: make(map[string]*trackedSession),
+		ctx:      ctx,
+		cancel:   cancel,
+		routes:   make(map[string]string),
+		pools:    make(map[string]*targetPool),
+		conns:    connectionRegistry{open: make(map[uint64]*connection)},
+		limits:   newTrafficLimits(config),
+		resumes:  resumeTable{streams: make(map[resumeKey]*resumableConn)},
+
+		accepting:     accepting,
+		stopAccepting: stopAccepting,
+	}
+}
+
+// parseFlags builds the configuration from the command line and the config
+// file it names. Flags given on the command line override the file.
+func parseFlags(args []string) (*Config, error) {
 	config := &Config{}
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	flags.StringVar(&config.ConfigFile, "config", "", "YAML config file, - reads it from stdin")
+	flags.StringVar(&config.Mode, "mode", "server", "Mode: server, client or http")
+	flags.StringVar(&config.Protocol, "protocol", "tcp", "Protocol: "+protocolNames())
+	flags.StringVar(&config.Listen, "listen", "0.0.0.0:8080", "Listen address")
+	flags.StringVar(&config.Target, "target", "127.0.0.1:22", "Target address")
+	flags.StringVar(&config.Bind, "bind", "", "Tunnel address clients connect to (server, enables reverse mode)")
+	flags.StringVar(&config.Server, "server", "", "Server tunnel address to connect to (client)")
+	flags.StringVar(&config.Local, "local", "", "Local listen address (client, enables forward mode)")
+	flags.StringVar(&config.HTTPSListen, "https-listen", "", "HTTPS listen address (http)")
+	flags.Var(&config.Hosts, "host", "Route a host name, or *.domain, to a target as name=target (http, repeatable)")
+	flags.Var(&config.Forwards, "forward", "Forward listen[=target], ports may be ranges like 1000-1100 (repeatable)")
+	forwardsFile := flags.String("forwards-file", "", "File with one -forward entry per line")
+	flags.StringVar(&config.Token, "token", "", "Authentication token (visible to other users in ps, prefer -config)")
+	flags.StringVar(&config.CertFile, "cert", "", "TLS certificate file")
+	flags.StringVar(&config.KeyFile, "key", "", "TLS private key file")
+	flags.Var(&config.SNICerts, "sni", "Certificate for a server name as name=cert,key (repeatable)")
+	flags.BoolVar(&config.TLS, "tls", false, "Run tcp, ws, h2, grpc and mux links over TLS (wss and wssmux always do)")
+	flags.StringVar(&config.CAFile, "ca", "", "CA file verifying client certificates (server) or the server (client)")
+	flags.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flags.StringVar(&config.TLSMaxVersion, "tls-max-version", "", "Maximum TLS version, empty for the newest")
+	flags.StringVar(&config.TLSCiphers, "tls-ciphers", "", "Comma separated TLS 1.2 cipher suites, empty for Go's defaults")
+	flags.StringVar(&config.ServerName, "server-name", "", "TLS server name to send and verify (client, defaults to the server host)")
+	flags.BoolVar(&config.InsecureSkipVerify, "insecure-skip-verify", false, "Skip server certificate verification (client)")
+	flags.StringVar(&config.ProxyProtocol, "proxy-protocol", "", "Send a PROXY protocol header to targets: v1 or v2 (empty for none)")
+	flags.BoolVar(&config.AcceptProxyProtocol, "accept-proxy-protocol", false, "Expect a PROXY protocol header on every accepted TCP connection")
+	flags.BoolVar(&config.Dynamic, "dynamic", false, "Serve a SOCKS5 and HTTP CONNECT proxy on the local addresses (client) or accept dynamic clients (server)")
+	flags.Var(&config.DynamicAllow, "dynamic-allow", "Networks dynamic clients may reach as CIDRs, empty for all but internal ones (server, repeatable)")
+	flags.Var(&config.DynamicDeny, "dynamic-deny", "Networks dynamic clients may not reach as CIDRs (server, repeatable)")
+	flags.Var(&config.DynamicPorts, "dynamic-ports", "Ports and ranges dynamic clients may reach, empty for all (server, repeatable)")
+	flags.Var(&config.DynamicDenyPorts, "dynamic-deny-ports", "Ports and ranges dynamic clients may not reach (server, repeatable)")
+	flags.StringVar(&config.Balance, "balance", balanceRoundRobin, "How to spread connections over target lists: round-robin, least-conn, weighted or source-hash")
+	flags.StringVar(&config.HealthCheck, "health-check", "", "Check targets actively: tcp or http (empty for none)")
+	flags.StringVar(&config.HealthPath, "health-path", "/", "Path requested by http health checks")
+	flags.DurationVar(&config.HealthInterval, "health-interval", defaultHealthInterval, "Time between health checks")
+	flags.DurationVar(&config.HealthTimeout, "health-timeout", defaultHealthTimeout, "Timeout of one health check")
+	flags.IntVar(&config.HealthFails, "health-fails", defaultHealthFails, "Failures in a row that eject a target")
+	flags.IntVar(&config.HealthPasses, "health-passes", defaultHealthPasses, "Passed checks in a row that take an ejected target back")
+	flags.BoolVar(&config.MuxEnabled, "mux", false, "Enable multiplexing for tcp client links (mux protocols always multiplex)")
+	flags.IntVar(&config.MuxStreams, "mux-streams", 8, "Number of pooled mux connections (client)")
+	flags.IntVar(&config.MuxFrameSize, "mux-frame-size", 32768, "Maximum mux frame size in bytes")
+	flags.IntVar(&config.MuxReceiveBuffer, "mux-receive-buffer", 4194304, "Mux connection receive buffer in bytes")
+	flags.IntVar(&config.MuxStreamBuffer, "mux-stream-buffer", 65536, "Mux per-stream window in bytes")
+	flags.IntVar(&config.MuxHeartbeat, "mux-heartbeat", 30, "Heartbeat interval of mux and WebSocket links in seconds (0 disables)")
+	flags.StringVar(&config.Compression, "compress", compressionNone, "Compress links: none, zstd or snappy (used when both ends ask for the same)")
+	flags.StringVar(&config.Path, "path", "", "Request path of ws, h2 and grpc links, empty for the protocol's default")
+	flags.StringVar(&config.HostHeader, "host-header", "", "Host header of ws, h2 and grpc links (client, defaults to the server address)")
+	flags.Var(&config.Headers, "header", "Extra header of ws, h2 and grpc link requests as Name: value (client, repeatable)")
+	flags.StringVar(&config.TokenIn, "token-in", "header", "Where ws, h2 and grpc clients send the token: header, query or cookie")
+	flags.StringVar(&config.Decoy, "decoy", "", "Website answering requests that are not links, a directory or an http(s) URL (server)")
+	flags.StringVar(&config.Proxy, "proxy", "", "Dial the server through an http, https, socks5 or socks5h proxy URL (client)")
+	flags.BoolVar(&config.UDP, "udp", false, "Forward UDP instead of TCP over tcp, ws, wss, h2, grpc, quic and mux links")
+	flags.DurationVar(&config.UDPIdleTimeout, "udp-idle-timeout", defaultUDPIdleTimeout, "Expire UDP flows idle for this long")
+	flags.DurationVar(&config.TCPKeepAlive, "tcp-keepalive", defaultTCPKeepAlive, "TCP keepalive interval of links and target connections (0 disables)")
+	flags.DurationVar(&config.ConnectTimeout, "connect-timeout", defaultConnectTimeout, "Timeout for connecting to servers and targets")
+	flags.DurationVar(&config.ReadTimeout, "read-timeout", 0, "Close connections that carry no data either way for this long (0 for none)")
+	flags.DurationVar(&config.MaxLifetime, "max-lifetime", 0, "Close connections open for longer than this (0 for none)")
+	flags.DurationVar(&config.ReconnectMin, "reconnect-min", defaultReconnectMin, "First delay before reconnecting a lost link (client)")
+	flags.DurationVar(&config.ReconnectMax, "reconnect-max", defaultReconnectMax, "Longest delay between reconnect attempts (client)")
+	flags.DurationVar(&config.ResumeGrace, "resume-grace", defaultResumeGrace, "Keep streams whose link broke this long for the client to resume")
+	flags.StringVar(&config.Control, "control", "", "Serve statistics on unix:/path or host:port")
+	flags.DurationVar(&config.DrainTimeout, "drain-timeout", defaultDrainTimeout, "Time connections get to finish on SIGTERM before they are closed (0 closes them at once)")
+	flags.BoolVar(&config.ReusePort, "reuse-port", false, "Open listening sockets with SO_REUSEPORT so a new process can take over the addresses")
+	flags.Float64Var(&config.MaxBandwidth, "max-bandwidth", 0, "Tunnel bandwidth limit in MB/s per direction (0 for none)")
+	flags.Float64Var(&config.ClientBandwidth, "client-bandwidth", 0, "Bandwidth limit per client IP in MB/s per direction (0 for none)")
+	flags.Float64Var(&config.ConnBandwidth, "conn-bandwidth", 0, "Bandwidth limit per connection in MB/s per direction (0 for none)")
+	flags.IntVar(&config.MaxConnections, "max-connections", 0, "Maximum open connections and UDP flows (0 for none)")
+	flags.BoolVar(&config.Debug, "debug", false, "Enable debug logging")
 	
-	flag.StringVar(&config.Mode, "mode", "server", "Mode: server or client")
-	flag.StringVar(&config.Protocol, "protocol", "tcp", "Protocol: tcp, udp, ws, wss")
-	flag.StringVar(&config.Listen, "listen", "0.0.0.0:8080", "Listen address")
-	flag.StringVar(&config.Target, "target", "127.0.0.1:22", "Target address")
-	flag.StringVar(&config.Token, "token", "", "Authentication token")
-	flag.StringVar(&config.CertFile, "cert", "", "TLS certificate file")
-	flag.StringVar(&config.KeyFile, "key", "", "TLS private key file")
-	flag.BoolVar(&config.MuxEnabled, "mux", true, "Enable multiplexing")
-	flag.IntVar(&config.MuxStreams, "mux-streams", 8, "Number of multiplexed streams")
-	flag.BoolVar(&config.Debug, "debug", false, "Enable debug logging")
-	
-	flag.Parse()
-	
-	if config.Token == "" {
-		log.Fatal("Token is required")
+	flags.Parse(args)
+
+	if config.ConfigFile != "" {
+		if err := loadConfigFile(config, flags); err != nil {
+			return nil, err
+		}
 	}
-	
-	return config
-}
 
-func (tm *TunnelManager) startServer() error {
-	log.Printf("Starting %s server on %s -> %s", tm.config.Protocol, tm.config.Listen, tm.config.Target)
-
-	switch tm.config.Protocol {
-	case "tcp":
-		return tm.startTCPServer()
-	case "udp":
-		return tm.startUDPServer()
-	case "ws":
-		return tm.startWebSocketServer(false)
-	case "wss":
-		return tm.startWebSocketServer(true)
+	// The HTTP router carries no tunnel links
+	if config.Token == "" && config.Mode != "http" {
+		return nil, fmt.Errorf("token is required")
+	}
+
+	switch config.ProxyProtocol {
+	case "", "v1", "v2":
 	default:
-		return fmt.Errorf("unsupported protocol: %s", tm.config.Protocol)
+		return nil, fmt.Errorf("invalid proxy protocol %q, use v1 or v2", config.ProxyProtocol)
+	}
+	if config.ProxyProtocol != "" && config.Mode == "http" {
+		return nil, fmt.Errorf("http mode sends X-Forwarded-For instead of PROXY protocol headers")
 	}
-}
 
-func (tm *TunnelManager) startTCPServer() error {
-	listener, err := net.Listen("tcp", tm.config.Listen)
-	if err != nil {
-		return fmt.Errorf("failed to listen: %w", err)
+	if config.Dynamic {
+		spec := protocols[config.Protocol]
+		switch {
+		case config.Mode == "server" && config.Bind != "":
+			return nil, fmt.Errorf("reverse servers do not take dynamic clients")
+		case config.Mode == "client" && config.Local == "" && len(config.Forwards) == 0:
+			return nil, fmt.Errorf("dynamic clients need -local")
+		case spec.udp || config.UDP:
+			return nil, fmt.Errorf("dynamic forwarding carries UDP itself, use a TCP protocol without -udp")
+		case !spec.mux && spec.authenticatesLinks():
+			return nil, fmt.Errorf("dynamic forwarding needs tcp or a mux protocol, got %s", config.Protocol)
+		}
 	}
-	defer listener.Close()
 
-	tm.listener = listener
-	log.Printf("TCP server listening on %s", tm.config.Listen)
+	switch {
+	case config.Path != "" && !strings.HasPrefix(config.Path, "/"):
+		return nil, fmt.Errorf("invalid path %q, it must start with /", config.Path)
+	case config.Path == "/" || config.Path == "/health" || config.Path == "/stats":
+		return nil, fmt.Errorf("path %s is taken by the link listener", config.Path)
+	}
+	switch config.TokenIn {
+	case "", "header", "query", "cookie":
+	default:
+		return nil, fmt.Errorf("invalid token-in %q, use header, query or cookie", config.TokenIn)
+	}
+	if config.Proxy != "" {
+		if err := validProxy(config.Proxy); err != nil {
+			return nil, err
+		}
+		if transport := protocols[config.Protocol].transport; transport == "udp" || transport == "quic" {
+			return nil, fmt.Errorf("the %s protocol cannot be dialed through a proxy", config.Protocol)
+		}
+	}
 
-	for {
-		select {
-		case <-tm.ctx.Done():
-			return nil
-		default:
+	if !validCompression(config.Compression) {
+		return nil, fmt.Errorf("invalid compression %q, use none, zstd or snappy", config.Compression)
+	}
+
+	if !validBalance(config.Balance) {
+		return nil, fmt.Errorf("invalid balance %q, use round-robin, least-conn, weighted or source-hash", config.Balance)
+	}
+	switch config.HealthCheck {
+	case "", "tcp", "http":
+	default:
+		return nil, fmt.Errorf("invalid health check %q, use tcp or http", config.HealthCheck)
+	}
+	if config.ReconnectMin <= 0 || config.ReconnectMax < config.ReconnectMin {
+		return nil, fmt.Errorf("reconnect delays must be positive with reconnect-max at least reconnect-min")
+	}
+	if config.ResumeGrace <= 0 {
+		return nil, fmt.Errorf("resume grace must be positive")
+	}
+	if config.ConnectTimeout <= 0 {
+		return nil, fmt.Errorf("connect timeout must be positive")
+	}
+	if config.TCPKeepAlive < 0 || config.ReadTimeout < 0 || config.MaxLifetime < 0 || config.MuxHeartbeat < 0 || config.DrainTimeout < 0 {
+		return nil, fmt.Errorf("keepalives and timeouts must not be negative")
+	}
+	if config.ReusePort && !reusePortAvailable {
+		return nil, fmt.Errorf("reuse-port is not available on this platform")
+	}
+	if config.Target != "" {
+		if _, err := parseTargetPool(config.Target); err != nil {
+			return nil, err
 		}
+	}
 
-		conn, err := listener.Accept()
+	if *forwardsFile != "" {
+		forwards, err := loadForwards(*forwardsFile)
 		if err != nil {
-			if tm.ctx.Err() != nil {
-				return nil
-			}
-			log.Printf("Accept error: %v", err)
-			continue
+			return nil, err
 		}
+		config.Forwards = append(config.Forwards, forwards...)
+	}
 
-		tm.wg.Add(1)
-		go tm.handleTCPConnection(conn)
+	return config, nil
+}
+
+func (tm *TunnelManager) startServer() error {
+	if tm.config.Bind != "" {
+		return tm.startReverseServer()
 	}
+
+	transport, err := tm.transport()
+	if err != nil {
+		return err
+	}
+
+	forwards := serverForwards(tm.config)
+	tm.setRoutes(forwards)
+
+	targets := make(map[string]bool)
+	for _, fwd := range forwards {
+		targets[fwd.Target] = true
+	}
+	if err := tm.startPools(targets); err != nil {
+		return err
+	}
+
+	return tm.serveForwards(forwards, func(fwd PortForward) error {
+		log.Printf("Starting %s server on %s -> %s", tm.config.Protocol, fwd.Listen, fwd.Target)
+
+		listener, err := transport.Listen(tm, fwd.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+
+		return tm.acceptLinks(listener, func(link net.Conn) {
+			tm.handleLink(link, fwd)
+		})
+	})
 }
 
-func (tm *TunnelManager) handleTCPConnection(clientConn net.Conn) {
-	defer tm.wg.Done()
-	defer clientConn.Close()
+// handleLink serves a link accepted for a forward, raw links the transport
+// authenticated skip the handshake
+func (tm *TunnelManager) handleLink(link net.Conn, fwd PortForward) {
+	if tm.skipsHandshake() {
+		tm.serveRawLink(link, fwd)
+		return
+	}
+	tm.serveLink(link, fwd)
+}
 
-	stats.Connections++
-	
+// serveLink authenticates a client link and forwards its traffic to the
+// forward's target
+func (tm *TunnelManager) serveLink(clientConn net.Conn, fwd PortForward) {
 	if tm.config.Debug {
-		log.Printf("New TCP connection from %s", clientConn.RemoteAddr())
+		log.Printf("New link from %s", clientConn.RemoteAddr())
+	}
+
+	hello, err := serverHandshake(clientConn, tm.config.Token, tm.acceptFlags())
+	if err != nil {
+		log.Printf("Client %s rejected: %v", clientConn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		return
+	}
+	compressed, err := compressLink(clientConn, hello.Accepted)
+	if err != nil {
+		log.Printf("Client %s dropped: %v", clientConn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		return
+	}
+	clientConn = compressed
+
+	// Handle multiplexing if the client asked for it
+	if hello.Flags&flagMux != 0 {
+		tm.handleMuxConnection(clientConn, fwd, hello.Accepted)
+		return
+	}
+	if hello.Flags&flagDynamic != 0 {
+		tm.serveDynamic(clientConn, "link", clientConn.RemoteAddr().String(), "")
+		return
+	}
+
+	target := tm.target(fwd)
+	c, err := tm.openConnection("link", clientConn.RemoteAddr().String(), target, "")
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	if tm.forwardsUDP() {
+		tm.handleUDPStream(clientConn, target, c)
+		return
+	}
+
+	var origin *connOrigin
+	if hello.Flags&flagOrigin != 0 {
+		if origin, err = readOrigin(clientConn); err != nil {
+			log.Printf("Dropping link from %s: %v", clientConn.RemoteAddr(), err)
+			stats.Errors.Add(1)
+			c.fail(err.Error())
+			return
+		}
 	}
 
 	// Connect to target
-	targetConn, err := net.DialTimeout("tcp", tm.config.Target, 10*time.Second)
+	targetConn, err := tm.dialTarget(target, origin, c)
 	if err != nil {
-		log.Printf("Failed to connect to target %s: %v", tm.config.Target, err)
-		stats.Errors++
+		log.Printf("Failed to connect to target %s: %v", target, err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
 		return
 	}
 	defer targetConn.Close()
 
-	// Handle multiplexing if enabled
-	if tm.config.MuxEnabled {
-		tm.handleMuxConnection(clientConn, targetConn)
-	} else {
-		tm.handleDirectConnection(clientConn, targetConn)
-	}
+	tm.handleDirectConnection(clientConn, targetConn, c)
 }
 
-func (tm *TunnelManager) handleMuxConnection(clientConn, targetConn net.Conn) {
+func (tm *TunnelManager) handleMuxConnection(clientConn net.Conn, fwd PortForward, flags byte) {
+	tm.tuneLink(clientConn)
+
 	// Create yamux session
-	session, err := yamux.Server(clientConn, yamux.DefaultConfig())
+	link := &meteredConn{Conn: clientConn}
+	session, err := yamux.Server(link, tm.muxConfig())
 	if err != nil {
 		log.Printf("Failed to create yamux session: %v", err)
-		stats.Errors++
+		stats.Errors.Add(1)
 		return
 	}
 	defer session.Close()
 
-	// Store session
-	sessionID := fmt.Sprintf("%s-%d", clientConn.RemoteAddr(), time.Now().UnixNano())
-	tm.mu.Lock()
-	tm.sessions[sessionID] = session
-	tm.mu.Unlock()
+	tracked := tm.trackSession(clientConn.RemoteAddr().String(), session, link, flags)
+	defer tm.untrackSession(tracked)
 
-	defer func() {
-		tm.mu.Lock()
-		delete(tm.sessions, sessionID)
-		tm.mu.Unlock()
+	go func() {
+		select {
+		case <-tm.ctx.Done():
+			session.Close()
+		case <-session.CloseChan():
+		}
 	}()
 
 	// Handle streams
@@ -233,35 +611,89 @@ func (tm *TunnelManager) handleMuxConnection(clientConn, targetConn net.Conn) {
 			break
 		}
 
-		go tm.handleStream(stream, targetConn)
+		tm.wg.Add(1)
+		go tm.handleStream(tm.wrapStream(stream), fwd, tracked)
 	}
 }
 
-func (tm *TunnelManager) handleStream(stream net.Conn, targetConn net.Conn) {
+func (tm *TunnelManager) handleStream(stream net.Conn, fwd PortForward, tracked *trackedSession) {
+	defer tm.wg.Done()
+
+	// A stream resuming another one hands itself over to it
+	if tracked.flags&flagResume != 0 {
+		if stream = tm.acceptResumable(stream); stream == nil {
+			return
+		}
+	}
 	defer stream.Close()
 
+	if tracked.flags&flagDynamic != 0 {
+		tm.serveDynamic(stream, "stream", tracked.remote, tracked.id)
+		return
+	}
+
+	targetAddr := tm.target(fwd)
+	c, err := tm.openConnection("stream", tracked.remote, targetAddr, tracked.id)
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	if tm.forwardsUDP() {
+		tm.handleUDPStream(stream, targetAddr, c)
+		return
+	}
+
+	var origin *connOrigin
+	if tracked.flags&flagOrigin != 0 {
+		if origin, err = readOrigin(stream); err != nil {
+			log.Printf("Dropping stream: %v", err)
+			stats.Errors.Add(1)
+			c.fail(err.Error())
+			return
+		}
+	}
+
 	// Create new connection to target for each stream
-	target, err := net.DialTimeout("tcp", tm.config.Target, 10*time.Second)
+	target, err := tm.dialTarget(targetAddr, origin, c)
 	if err != nil {
 		log.Printf("Failed to connect to target: %v", err)
-		stats.Errors++
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
 		return
 	}
 	defer target.Close()
 
-	tm.handleDirectConnection(stream, target)
+	tm.handleDirectConnection(stream, target, c)
 }
 
-func (tm *TunnelManager) handleDirectConnection(client, target net.Conn) {
+// handleDirectConnection copies between client and target, counting the
+// traffic on c as it flows
+func (tm *TunnelManager) handleDirectConnection(client, target net.Conn, c *connection) {
+	stop := tm.enforceTimeouts(c, func() {
+		client.Close()
+		target.Close()
+	})
+	defer stop()
+
+	// Shutdown ends the connections a drain left open
+	defer context.AfterFunc(tm.ctx, func() {
+		c.fail("shutdown")
+		client.Close()
+		target.Close()
+	})()
+
 	// Bidirectional copy
+	splice := tm.maySplice(c)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	// Client to target
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(target, client)
-		stats.BytesIn += n
+		err := copyConn(target, client, c.carryIn, splice)
+		c.fail(copyEnded("client", err))
+		closeWrite(target)
 		if err != nil && tm.config.Debug {
 			log.Printf("Client to target copy error: %v", err)
 		}
@@ -270,8 +702,9 @@ func (tm *TunnelManager) handleDirectConnection(client, target net.Conn) {
 	// Target to client
 	go func() {
 		defer wg.Done()
-		n, err := io.Copy(client, target)
-		stats.BytesOut += n
+		err := copyConn(client, target, c.carryOut, splice)
+		c.fail(copyEnded("target", err))
+		closeWrite(client)
 		if err != nil && tm.config.Debug {
 			log.Printf("Target to client copy error: %v", err)
 		}
@@ -280,231 +713,31 @@ func (tm *TunnelManager) handleDirectConnection(client, target net.Conn) {
 	wg.Wait()
 }
 
-func (tm *TunnelManager) startUDPServer() error {
-	addr, err := net.ResolveUDPAddr("udp", tm.config.Listen)
+// serveRawLink forwards the traffic of a raw link its transport
+// authenticated to the forward's target
+func (tm *TunnelManager) serveRawLink(link net.Conn, fwd PortForward) {
+	spec, _ := tm.protocolSpec()
+	target := tm.target(fwd)
+	c, err := tm.openConnection(spec.transport, link.RemoteAddr().String(), target, "")
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
-	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen UDP: %w", err)
-	}
-	defer conn.Close()
-
-	log.Printf("UDP server listening on %s", tm.config.Listen)
-
-	buffer := make([]byte, 65536)
-	clientMap := make(map[string]*net.UDPConn)
-	var mu sync.RWMutex
-
-	for {
-		select {
-		case <-tm.ctx.Done():
-			return nil
-		default:
-		}
-
-		n, clientAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			if tm.ctx.Err() != nil {
-				return nil
-			}
-			log.Printf("UDP read error: %v", err)
-			continue
-		}
-
-		stats.BytesIn += int64(n)
-		clientKey := clientAddr.String()
-
-		mu.RLock()
-		targetConn, exists := clientMap[clientKey]
-		mu.RUnlock()
-
-		if !exists {
-			// Create new connection to target
-			targetAddr, err := net.ResolveUDPAddr("udp", tm.config.Target)
-			if err != nil {
-				log.Printf("Failed to resolve target address: %v", err)
-				continue
-			}
-
-			targetConn, err = net.DialUDP("udp", nil, targetAddr)
-			if err != nil {
-				log.Printf("Failed to connect to target: %v", err)
-				continue
-			}
-
-			mu.Lock()
-			clientMap[clientKey] = targetConn
-			mu.Unlock()
-
-			// Start response handler
-			go tm.handleUDPResponse(conn, targetConn, clientAddr, clientKey, clientMap, &mu)
-		}
-
-		// Forward to target
-		_, err = targetConn.Write(buffer[:n])
-		if err != nil {
-			log.Printf("Failed to write to target: %v", err)
-			mu.Lock()
-			delete(clientMap, clientKey)
-			mu.Unlock()
-			targetConn.Close()
-		}
-	}
-}
-
-func (tm *TunnelManager) handleUDPResponse(serverConn *net.UDPConn, targetConn *net.UDPConn, clientAddr *net.UDPAddr, clientKey string, clientMap map[string]*net.UDPConn, mu *sync.RWMutex) {
-	defer func() {
-		mu.Lock()
-		delete(clientMap, clientKey)
-		mu.Unlock()
-		targetConn.Close()
-	}()
-
-	buffer := make([]byte, 65536)
-	targetConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-
-	for {
-		n, err := targetConn.Read(buffer)
-		if err != nil {
-			if tm.config.Debug {
-				log.Printf("UDP target read error: %v", err)
-			}
-			break
-		}
-
-		stats.BytesOut += int64(n)
-
-		_, err = serverConn.WriteToUDP(buffer[:n], clientAddr)
-		if err != nil {
-			log.Printf("Failed to write to client: %v", err)
-			break
-		}
-
-		targetConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-	}
-}
-
-func (tm *TunnelManager) startWebSocketServer(useSSL bool) error {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			// Validate token
-			token := r.Header.Get("Authorization")
-			return token == "Bearer "+tm.config.Token
-		},
-	}
-
-	http.HandleFunc("/tunnel", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("WebSocket upgrade error: %v", err)
-			return
-		}
-		defer conn.Close()
-
-		stats.Connections++
-		tm.handleWebSocketConnection(conn)
-	})
-
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "OK")
-	})
-
-	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprintf(w, `{
-			"bytes_in": %d,
-			"bytes_out": %d,
-			"connections": %d,
-			"errors": %d,
-			"uptime": "%s"
-		}`, stats.BytesIn, stats.BytesOut, stats.Connections, stats.Errors, time.Since(stats.StartTime))
-	})
-
-	server := &http.Server{
-		Addr:    tm.config.Listen,
-		Handler: nil,
+		return
 	}
+	defer tm.closeConnection(c)
 
-	if useSSL {
-		if tm.config.CertFile == "" || tm.config.KeyFile == "" {
-			return fmt.Errorf("SSL certificate and key files are required for WSS")
-		}
-		
-		cert, err := tls.LoadX509KeyPair(tm.config.CertFile, tm.config.KeyFile)
-		if err != nil {
-			return fmt.Errorf("failed to load SSL certificate: %w", err)
-		}
-		
-		server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-		
-		log.Printf("WSS server listening on %s", tm.config.Listen)
-		return server.ListenAndServeTLS("", "")
-	} else {
-		log.Printf("WS server listening on %s", tm.config.Listen)
-		return server.ListenAndServe()
+	if tm.forwardsUDP() {
+		tm.handleUDPStream(link, target, c)
+		return
 	}
-}
 
-func (tm *TunnelManager) handleWebSocketConnection(wsConn *websocket.Conn) {
-	// Connect to target
-	targetConn, err := net.DialTimeout("tcp", tm.config.Target, 10*time.Second)
+	// Raw links have no handshake to carry an origin
+	targetConn, err := tm.dialTarget(target, nil, c)
 	if err != nil {
 		log.Printf("Failed to connect to target: %v", err)
-		stats.Errors++
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
 		return
 	}
 	defer targetConn.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// WebSocket to target
-	go func() {
-		defer wg.Done()
-		for {
-			_, data, err := wsConn.ReadMessage()
-			if err != nil {
-				break
-			}
-			stats.BytesIn += int64(len(data))
-			_, err = targetConn.Write(data)
-			if err != nil {
-				break
-			}
-		}
-	}()
-
-	// Target to WebSocket
-	go func() {
-		defer wg.Done()
-		buffer := make([]byte, 32768)
-		for {
-			n, err := targetConn.Read(buffer)
-			if err != nil {
-				break
-			}
-			stats.BytesOut += int64(n)
-			err = wsConn.WriteMessage(websocket.BinaryMessage, buffer[:n])
-			if err != nil {
-				break
-			}
-		}
-	}()
-
-	wg.Wait()
-}
-
-func (tm *TunnelManager) startClient() error {
-	log.Printf("Starting %s client connecting to %s", tm.config.Protocol, tm.config.Listen)
-	
-	// Client mode implementation would go here
-	// This would connect to a server and establish the tunnel from the client side
-	
-	return fmt.Errorf("client mode not implemented yet")
+	tm.handleDirectConnection(link, targetConn, c)
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// yamux refuses stream windows below its initial 256 KiB window
+const minStreamWindow = 256 * 1024
+
+// muxConfig builds the yamux configuration from the mux flags
+func (tm *TunnelManager) muxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+
+	if tm.config.MuxHeartbeat > 0 {
+		cfg.EnableKeepAlive = true
+		cfg.KeepAliveInterval = time.Duration(tm.config.MuxHeartbeat) * time.Second
+	} else {
+		cfg.EnableKeepAlive = false
+	}
+
+	window := tm.config.MuxStreamBuffer
+	if window < minStreamWindow {
+		window = minStreamWindow
+	}
+	cfg.MaxStreamWindowSize = uint32(window)
+
+	return cfg
+}
+
+// tuneLink applies the mux receive buffer to the physical connection
+func (tm *TunnelManager) tuneLink(conn net.Conn) {
+	if cc, ok := conn.(*compressedConn); ok {
+		conn = cc.Conn
+	}
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.ws.UnderlyingConn()
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && tm.config.MuxReceiveBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(tm.config.MuxReceiveBuffer); err != nil && tm.config.Debug {
+			log.Printf("Failed to set receive buffer: %v", err)
+		}
+	}
+}
+
+// wrapStream limits the size of the frames a stream writes to the link
+func (tm *TunnelManager) wrapStream(stream net.Conn) net.Conn {
+	if tm.config.MuxFrameSize <= 0 {
+		return stream
+	}
+	return &frameConn{Conn: stream, frameSize: tm.config.MuxFrameSize}
+}
+
+// frameConn caps each write so a single stream cannot hold the shared link
+// with one large frame while other streams wait
+type frameConn struct {
+	net.Conn
+	frameSize int
+}
+
+func (c *frameConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.frameSize {
+			chunk = chunk[:c.frameSize]
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// muxPool keeps a fixed number of authenticated yamux sessions to a server
+// and spreads new streams across them
+type muxPool struct {
+	tm     *TunnelManager
+	server string
+	mu     sync.Mutex
+	slots  []*trackedSession
+	next   int
+}
+
+func newMuxPool(tm *TunnelManager, server string, size int) *muxPool {
+	if size < 1 {
+		size = 1
+	}
+	return &muxPool{
+		tm:     tm,
+		server: server,
+		slots:  make([]*trackedSession, size),
+	}
+}
+
+// poolCheckInterval is how often a pool looks for dead sessions while all
+// of its slots are connected
+const poolCheckInterval = 5 * time.Second
+
+// maintain fills empty or dead slots until the manager stops, backing off
+// while the server cannot be reached
+func (p *muxPool) maintain() {
+	retry := p.tm.newBackoff()
+	for {
+		failed := false
+		for i := range p.slots {
+			if _, err := p.session(i); err != nil {
+				log.Printf("Failed to establish mux connection %d: %v", i, err)
+				failed = true
+			}
+		}
+
+		if failed {
+			if !retry.wait(p.tm.ctx) {
+				p.close()
+				return
+			}
+			continue
+		}
+		retry.reset()
+
+		select {
+		case <-p.tm.ctx.Done():
+			p.close()
+			return
+		case <-time.After(poolCheckInterval):
+		}
+	}
+}
+
+// openStream opens a logical stream on the next session in the pool. A
+// stream carrying a TCP connection starts with its origin when the server
+// understands origin frames; UDP flows pass a nil origin and send none.
+func (p *muxPool) openStream(origin *connOrigin) (net.Conn, error) {
+	tracked, err := p.nextSession()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := tracked.session.Open()
+	if errors.Is(err, yamux.ErrRemoteGoAway) {
+		// The server is draining, a new link reaches its successor
+		tracked.goneAway.Store(true)
+		if tracked, err = p.nextSession(); err != nil {
+			return nil, err
+		}
+		raw, err = tracked.session.Open()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	stream := p.tm.wrapStream(raw)
+
+	// The origin goes inside a resumable stream, ahead of its data
+	if tracked.flags&flagResume != 0 {
+		if stream, err = p.tm.openResumable(stream, p.reattachStream); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+	if origin != nil && tracked.flags&flagOrigin != 0 {
+		if err := writeOrigin(stream, origin); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return stream, nil
+}
+
+// reattachStream opens a stream to carry a resumable stream whose own broke
+func (p *muxPool) reattachStream() (net.Conn, error) {
+	tracked, err := p.nextSession()
+	if err != nil {
+		return nil, err
+	}
+	if tracked.flags&flagResume == 0 {
+		return nil, errResumeUnknown
+	}
+
+	stream, err := tracked.session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return p.tm.wrapStream(stream), nil
+}
+
+// nextSession returns the session of the next slot in turn
+func (p *muxPool) nextSession() (*trackedSession, error) {
+	p.mu.Lock()
+	slot := p.next % len(p.slots)
+	p.next++
+	p.mu.Unlock()
+
+	return p.session(slot)
+}
+
+// session returns the live session in a slot, dialing a new one if needed
+func (p *muxPool) session(slot int) (*trackedSession, error) {
+	p.mu.Lock()
+	tracked := p.slots[slot]
+	p.mu.Unlock()
+
+	if tracked.usable() {
+		return tracked, nil
+	}
+
+	// A slot that held a session before lost it
+	lost := tracked != nil
+
+	tracked, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Another caller may have refilled the slot while we were dialing
+	if current := p.slots[slot]; current.usable() {
+		tracked.session.Close()
+		return current, nil
+	}
+	// A session the server sent away finishes its streams, the server
+	// closes it once it has drained
+	if old := p.slots[slot]; old != nil && !old.session.IsClosed() {
+		go func() {
+			select {
+			case <-p.tm.ctx.Done():
+				old.session.Close()
+			case <-old.session.CloseChan():
+			}
+		}()
+	}
+	p.slots[slot] = tracked
+	if lost {
+		stats.Reconnects.Add(1)
+		log.Printf("Mux connection %d to %s reconnected", slot, p.server)
+	}
+	return tracked, nil
+}
+
+func (p *muxPool) dial() (*trackedSession, error) {
+	conn, err := p.tm.dialLink(p.server)
+	if err != nil {
+		return nil, err
+	}
+
+	offer := flagMux | flagOrigin
+	if p.tm.config.Dynamic {
+		offer |= flagDynamic
+	}
+	if p.tm.resumesStreams() {
+		offer |= flagResume
+	}
+	compressed, flags, err := p.tm.clientLinkHandshake(conn, offer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.tm.tuneLink(conn)
+
+	link := &meteredConn{Conn: compressed}
+	session, err := yamux.Client(link, p.tm.muxConfig())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+
+	tracked := p.tm.trackSession(p.server, session, link, flags)
+	go func() {
+		<-session.CloseChan()
+		p.tm.untrackSession(tracked)
+	}()
+
+	if p.tm.config.Debug {
+		log.Printf("Mux connection established to %s", p.server)
+	}
+	return tracked, nil
+}
+
+func (p *muxPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, tracked := range p.slots {
+		if tracked != nil {
+			tracked.session.Close()
+			p.slots[i] = nil
+		}
+	}
+}
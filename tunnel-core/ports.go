@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Port forwards
+//
+// A forwarding table lets one process serve many listen -> target pairs. Each
+// entry is written as
+//
+//	listen[=target]
+//
+// where listen is [host:]port or [host:]first-last and target is host,
+// host:port or host:first-last. A target without a port keeps the listen
+// port, a single target port takes every listen port, and a target range
+// must be as long as the listen range. An entry without a target uses the
+// process's default target. The target may also be a comma separated pool
+// of such targets, each expanded on its own, see balance.go.
+//
+// What the pairs mean follows the mode: on a server they replace -listen and
+// -target, on a reverse server the target is dialed by the tunnel client, and
+// on a forward client they replace -local and -server.
+
+// maxForwardPorts bounds how many ports a single entry may expand to
+const maxForwardPorts = 4096
+
+// PortForward is one listen address and the target it forwards to
+type PortForward struct {
+	Listen string
+	Target string
+}
+
+// forwardList collects repeated -forward flags
+type forwardList []PortForward
+
+func (l *forwardList) String() string {
+	specs := make([]string, len(*l))
+	for i, fwd := range *l {
+		specs[i] = fwd.Listen + "=" + fwd.Target
+	}
+	return strings.Join(specs, ",")
+}
+
+func (l *forwardList) Set(spec string) error {
+	forwards, err := parseForward(spec)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, forwards...)
+	return nil
+}
+
+// parseForward expands one forwarding entry into its port pairs
+func parseForward(spec string) ([]PortForward, error) {
+	listenSpec, targetSpec, _ := strings.Cut(strings.TrimSpace(spec), "=")
+
+	listenHost, listenPorts := "", listenSpec
+	if i := strings.LastIndex(listenSpec, ":"); i >= 0 {
+		listenHost, listenPorts = strings.Trim(listenSpec[:i], "[]"), listenSpec[i+1:]
+	}
+	first, last, err := parsePortRange(listenPorts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+	if last-first+1 > maxForwardPorts {
+		return nil, fmt.Errorf("invalid forward %q: more than %d ports", spec, maxForwardPorts)
+	}
+
+	forwards := make([]PortForward, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		forwards = append(forwards, PortForward{Listen: net.JoinHostPort(listenHost, strconv.Itoa(port))})
+	}
+	if targetSpec == "" {
+		return forwards, nil
+	}
+
+	// Every member of a target list expands on its own
+	targets := make([][]string, len(forwards))
+	for _, member := range strings.Split(targetSpec, ",") {
+		expanded, err := expandTarget(strings.TrimSpace(member), first, last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward %q: %w", spec, err)
+		}
+		for i := range targets {
+			targets[i] = append(targets[i], expanded[i])
+		}
+	}
+	for i := range forwards {
+		forwards[i].Target = strings.Join(targets[i], ",")
+	}
+	// Ports only differ in port numbers, checking the first checks the weights
+	if _, err := parseTargetPool(forwards[0].Target); err != nil {
+		return nil, fmt.Errorf("invalid forward %q: %w", spec, err)
+	}
+	return forwards, nil
+}
+
+// expandTarget expands one target, optionally weighted with @weight, into
+// the target of every listen port from first to last
+func expandTarget(member string, first, last int) ([]string, error) {
+	targetSpec, weight, weighted := strings.Cut(member, "@")
+	if weighted {
+		weight = "@" + weight
+	}
+
+	targets := make([]string, last-first+1)
+	targetHost, targetPorts, err := net.SplitHostPort(targetSpec)
+	if err != nil {
+		// No port, keep the listen ports
+		targetHost = strings.Trim(targetSpec, "[]")
+		for i := range targets {
+			targets[i] = net.JoinHostPort(targetHost, strconv.Itoa(first+i)) + weight
+		}
+		return targets, nil
+	}
+
+	targetFirst, targetLast, err := parsePortRange(targetPorts)
+	if err != nil {
+		return nil, err
+	}
+	if targetFirst != targetLast && targetLast-targetFirst != last-first {
+		return nil, fmt.Errorf("target range does not match listen range")
+	}
+
+	for i := range targets {
+		port := targetFirst
+		if targetFirst != targetLast {
+			port += i
+		}
+		targets[i] = net.JoinHostPort(targetHost, strconv.Itoa(port)) + weight
+	}
+	return targets, nil
+}
+
+// parsePortRange parses "port" or "first-last"
+func parsePortRange(s string) (int, int, error) {
+	firstSpec, lastSpec, isRange := strings.Cut(s, "-")
+	first, err := parsePort(firstSpec)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err := parsePort(lastSpec)
+	if err != nil {
+		return 0, 0, err
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("port range %s is reversed", s)
+	}
+	return first, last, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// loadForwards reads a forwarding table file with one entry per line. Blank
+// lines and lines starting with # are ignored.
+func loadForwards(path string) ([]PortForward, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open forwards file: %w", err)
+	}
+	defer file.Close()
+
+	var forwards []PortForward
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		spec := strings.TrimSpace(scanner.Text())
+		if spec == "" || strings.HasPrefix(spec, "#") {
+			continue
+		}
+		entries, err := parseForward(spec)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		forwards = append(forwards, entries...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read forwards file: %w", err)
+	}
+	return forwards, nil
+}
+
+// forwardTable returns the configured forwarding table, or the single pair
+// given by the listen and target flags. Entries without a target get target.
+func forwardTable(config *Config, listen, target string) []PortForward {
+	if len(config.Forwards) == 0 {
+		return []PortForward{{Listen: listen, Target: target}}
+	}
+
+	forwards := make([]PortForward, len(config.Forwards))
+	for i, fwd := range config.Forwards {
+		if fwd.Target == "" {
+			fwd.Target = target
+		}
+		forwards[i] = fwd
+	}
+	return forwards
+}
+
+// serverForwards returns the forwards a server listens on. Public forwards
+// of a reverse server without a target use the tunnel client's -target.
+func serverForwards(config *Config) []PortForward {
+	if config.Bind != "" {
+		return forwardTable(config, config.Listen, "")
+	}
+	return forwardTable(config, config.Listen, config.Target)
+}
+
+// serveForwards runs serve for every forward until all of them return. The
+// first one to fail stops the tunnel.
+func (tm *TunnelManager) serveForwards(forwards []PortForward, serve func(PortForward) error) error {
+	errs := make(chan error, len(forwards))
+	for _, fwd := range forwards {
+		go func(fwd PortForward) {
+			errs <- serve(fwd)
+		}(fwd)
+	}
+
+	var firstErr error
+	for range forwards {
+		// Errors after draining starts are just the listeners closing
+		if err := <-errs; err != nil && firstErr == nil && !tm.draining() {
+			firstErr = err
+			tm.cancel()
+		}
+	}
+	return firstErr
+}
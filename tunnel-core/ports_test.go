@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []PortForward
+	}{
+		{"8080", []PortForward{{Listen: ":8080"}}},
+		{"0.0.0.0:8080=10.0.0.5:80", []PortForward{{Listen: "0.0.0.0:8080", Target: "10.0.0.5:80"}}},
+		{"1000-1002=10.0.0.5", []PortForward{
+			{Listen: ":1000", Target: "10.0.0.5:1000"},
+			{Listen: ":1001", Target: "10.0.0.5:1001"},
+			{Listen: ":1002", Target: "10.0.0.5:1002"},
+		}},
+		{"127.0.0.1:1000-1001=10.0.0.5:2000-2001", []PortForward{
+			{Listen: "127.0.0.1:1000", Target: "10.0.0.5:2000"},
+			{Listen: "127.0.0.1:1001", Target: "10.0.0.5:2001"},
+		}},
+		{"1000-1001=10.0.0.5:22", []PortForward{
+			{Listen: ":1000", Target: "10.0.0.5:22"},
+			{Listen: ":1001", Target: "10.0.0.5:22"},
+		}},
+		{"[::1]:53=[2001:db8::1]", []PortForward{{Listen: "[::1]:53", Target: "[2001:db8::1]:53"}}},
+		{"1000-1001=10.0.0.5,10.0.0.6:22@3", []PortForward{
+			{Listen: ":1000", Target: "10.0.0.5:1000,10.0.0.6:22@3"},
+			{Listen: ":1001", Target: "10.0.0.5:1001,10.0.0.6:22@3"},
+		}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseForward(tt.spec)
+		if err != nil {
+			t.Errorf("parseForward(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseForward(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseForwardRejectsInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"0",
+		"70000",
+		"1100-1000",
+		"1000-1010=10.0.0.5:2000-2005",
+		"1-65535",
+		"host:port=10.0.0.5",
+		"80=10.0.0.5:80,10.0.0.6:80@0",
+		"1000-1001=10.0.0.5,10.0.0.6:2000-2005",
+	} {
+		if _, err := parseForward(spec); err == nil {
+			t.Errorf("parseForward(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestLoadForwards(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "forwards")
+	content := "# game servers\n2000-2001=10.0.0.5\n\n8080=127.0.0.1:80\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	forwards, err := loadForwards(path)
+	if err != nil {
+		t.Fatalf("loadForwards failed: %v", err)
+	}
+	want := []PortForward{
+		{Listen: ":2000", Target: "10.0.0.5:2000"},
+		{Listen: ":2001", Target: "10.0.0.5:2001"},
+		{Listen: ":8080", Target: "127.0.0.1:80"},
+	}
+	if !reflect.DeepEqual(forwards, want) {
+		t.Fatalf("loadForwards = %v, want %v", forwards, want)
+	}
+}
+
+func TestMultiPortForward(t *testing.T) {
+	first, second := startEchoServer(t), startEchoServer(t)
+	listenFirst, listenSecond := freeAddr(t), freeAddr(t)
+	localFirst, localSecond := freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Forwards: []PortForward{
+			{Listen: listenFirst, Target: first},
+			{Listen: listenSecond, Target: second},
+		},
+		Token: "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listenFirst).Close()
+	dialEventually(t, listenSecond).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:     "client",
+		Protocol: "tcpmux",
+		Forwards: []PortForward{
+			{Listen: localFirst, Target: listenFirst},
+			{Listen: localSecond, Target: listenSecond},
+		},
+		Token:      "test-token-0123456789",
+		MuxStreams: 1,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	expectTCPEcho(t, localFirst)
+	expectTCPEcho(t, localSecond)
+}
+
+// startBannerServer starts a TCP server that greets every connection with banner
+func startBannerServer(t *testing.T, banner string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start banner server: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func expectBanner(t *testing.T, addr, banner string) {
+	t.Helper()
+	conn := dialEventually(t, addr)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read from %s failed: %v", addr, err)
+	}
+	if line != banner {
+		t.Fatalf("got banner %q from %s, want %q", line, addr, banner)
+	}
+}
+
+func TestReversePortForwards(t *testing.T) {
+	mapped, fallback := startBannerServer(t, "mapped\n"), startBannerServer(t, "fallback\n")
+	bind, publicMapped, publicFallback := freeAddr(t), freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Bind:     bind,
+		Forwards: []PortForward{
+			{Listen: publicMapped, Target: mapped},
+			{Listen: publicFallback},
+		},
+		Token: "test-token-0123456789",
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, bind).Close()
+
+	client := newTunnelManager(&Config{
+		Mode:       "client",
+		Protocol:   "tcpmux",
+		Server:     bind,
+		Target:     fallback,
+		Token:      "test-token-0123456789",
+		MuxStreams: 1,
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.pickSession() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel client never connected")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	expectBanner(t, publicMapped, "mapped\n")
+	expectBanner(t, publicFallback, "fallback\n")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol
+//
+// -proxy-protocol v1 or v2 makes the side that dials the target start every
+// TCP target connection with a HAProxy PROXY protocol header naming the
+// address the forwarded connection really came from and the address it
+// reached, so targets see the real client instead of tunnel-core. When the
+// origin is unknown, as on raw WebSocket links or with peers too old to send
+// it, the header says so (UNKNOWN in v1, LOCAL in v2) and the target falls
+// back to the connection's own addresses.
+//
+// The origin crosses the tunnel in an origin frame, framed like the
+// handshake, sent first on every mux stream or raw link that carries a TCP
+// connection (after the target frame in reverse mode):
+//
+//	0x07 | length (2 bytes, big endian) | source address " " destination address
+//
+// A client offers origin frames with the flagOrigin hello flag and the
+// server answers with the flags it accepted in the accept frame's payload,
+// so origin frames are only sent when both sides understand them.
+//
+// -accept-proxy-protocol makes every TCP listener (links, reverse public
+// ports and forward client local ports) expect a v1 or v2 header on each
+// connection, as sent by a load balancer in front of tunnel-core, and use
+// the addresses in it as the connection's own. Connections without a valid
+// header are dropped.
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// maxProxyV1Header is the longest v1 header the specification allows
+	maxProxyV1Header = 107
+
+	proxyV2Local byte = 0x20
+	proxyV2Proxy byte = 0x21
+
+	proxyV2Unspec byte = 0x00
+	proxyV2TCP4   byte = 0x11
+	proxyV2TCP6   byte = 0x21
+)
+
+// connOrigin is where a forwarded connection came from and the address it
+// reached on the listening side. Nil addresses are unknown.
+type connOrigin struct {
+	source      *net.TCPAddr
+	destination *net.TCPAddr
+}
+
+// known reports whether both addresses of the origin are known
+func (o *connOrigin) known() bool {
+	return o != nil && o.source != nil && o.destination != nil
+}
+
+// originOf returns the origin of a connection accepted on a TCP listener
+func originOf(conn net.Conn) *connOrigin {
+	source, _ := conn.RemoteAddr().(*net.TCPAddr)
+	destination, _ := conn.LocalAddr().(*net.TCPAddr)
+	return &connOrigin{source: source, destination: destination}
+}
+
+// writeOrigin sends the origin frame, an empty one when the origin is unknown
+func writeOrigin(w io.Writer, origin *connOrigin) error {
+	var payload []byte
+	if origin.known() {
+		payload = []byte(origin.source.String() + " " + origin.destination.String())
+	}
+	if err := writeFrame(w, frameOrigin, payload); err != nil {
+		return fmt.Errorf("failed to send origin: %w", err)
+	}
+	return nil
+}
+
+// readOrigin reads the origin frame the accepting side sent first on a
+// stream or link
+func readOrigin(conn net.Conn) (*connOrigin, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read origin: %w", err)
+	}
+	if frameType != frameOrigin {
+		return nil, fmt.Errorf("unexpected frame 0x%02x, expected origin", frameType)
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	source, destination, ok := strings.Cut(string(payload), " ")
+	if !ok {
+		return nil, fmt.Errorf("malformed origin %q", payload)
+	}
+	origin := &connOrigin{}
+	if origin.source, err = parseTCPAddr(source); err != nil {
+		return nil, err
+	}
+	if origin.destination, err = parseTCPAddr(destination); err != nil {
+		return nil, err
+	}
+	return origin, nil
+}
+
+func parseTCPAddr(s string) (*net.TCPAddr, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	return net.TCPAddrFromAddrPort(addrPort), nil
+}
+
+// proxyProtocol returns the PROXY protocol version sent to targets, empty
+// for none
+func (tm *TunnelManager) proxyProtocol() string {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+	return tm.config.ProxyProtocol
+}
+
+// proxyHeader encodes a v1 or v2 PROXY protocol header for origin
+func proxyHeader(version string, origin *connOrigin) []byte {
+	var source, destination netip.AddrPort
+	known := false
+	if origin.known() {
+		source = origin.source.AddrPort()
+		destination = origin.destination.AddrPort()
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+		known = source.Addr().Is4() == destination.Addr().Is4()
+	}
+
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if source.Addr().Is4() {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family,
+			source.Addr().WithZone(""), destination.Addr().WithZone(""), source.Port(), destination.Port()))
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	if !known {
+		return append(header, proxyV2Local, proxyV2Unspec, 0, 0)
+	}
+
+	var addrs []byte
+	family := proxyV2TCP6
+	if source.Addr().Is4() {
+		family = proxyV2TCP4
+		src, dst := source.Addr().As4(), destination.Addr().As4()
+		addrs = append(src[:], dst[:]...)
+	} else {
+		src, dst := source.Addr().As16(), destination.Addr().As16()
+		addrs = append(src[:], dst[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, source.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, destination.Port())
+
+	header = append(header, proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header. It returns nil
+// when the header does not carry TCP addresses, as for LOCAL or UNKNOWN.
+func readProxyHeader(r *bufio.Reader) (*connOrigin, error) {
+	// Look at the first byte alone so a client that sends no header is
+	// turned away at once rather than waiting for more bytes
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	switch first[0] {
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	case 'P':
+		return readProxyV1(r)
+	default:
+		return nil, fmt.Errorf("missing PROXY protocol header")
+	}
+}
+
+func readProxyV1(r *bufio.Reader) (*connOrigin, error) {
+	var line []byte
+	for len(line) <= maxProxyV1Header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if len(line) > maxProxyV1Header || !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed PROXY v1 header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	origin := &connOrigin{}
+	var err error
+	if origin.source, err = parseV1Addr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if origin.destination, err = parseV1Addr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+	return origin, nil
+}
+
+func parseV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 address %q: %w", ip, err)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 port %q: %w", port, err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+func readProxyV2(r *bufio.Reader) (*connOrigin, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) || header[12]&0xf0 != 0x20 {
+		return nil, fmt.Errorf("malformed PROXY v2 header")
+	}
+	command := header[12]
+	family := header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+	}
+
+	switch command {
+	case proxyV2Local:
+		return nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command 0x%02x", command)
+	}
+
+	// Addresses of other families (UDP, unix sockets) are not TCP origins
+	var size int
+	switch family {
+	case proxyV2TCP4:
+		size = 4
+	case proxyV2TCP6:
+		size = 16
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, fmt.Errorf("malformed PROXY v2 header")
+	}
+
+	source, _ := netip.AddrFromSlice(body[:size])
+	destination, _ := netip.AddrFromSlice(body[size : 2*size])
+	ports := body[2*size:]
+	return &connOrigin{
+		source:      net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, binary.BigEndian.Uint16(ports))),
+		destination: net.TCPAddrFromAddrPort(netip.AddrPortFrom(destination, binary.BigEndian.Uint16(ports[2:]))),
+	}, nil
+}
+
+// listenTCP listens on addr with the tunnel's TCP keepalives, expecting a
+// PROXY protocol header on every connection when the tunnel accepts them
+func (tm *TunnelManager) listenTCP(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: tm.tcpKeepAlive()}
+	if tm.config.ReusePort {
+		lc.Control = reusePort
+	}
+	listener, err := lc.Listen(tm.ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !tm.config.AcceptProxyProtocol {
+		return listener, nil
+	}
+	return &proxyListener{Listener: listener}, nil
+}
+
+// proxyListener hands out connections that read a PROXY protocol header
+// before anything else
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY header on first use, in the goroutine serving
+// the connection rather than the Accept loop, and reports the addresses it
+// names as its own
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	origin *connOrigin
+	err    error
+
+	// The read deadline the user set, restored after the header is read
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		c.origin, c.err = readProxyHeader(c.reader)
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.readHeader() == nil && c.origin != nil {
+		return c.origin.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.readHeader() == nil && c.origin != nil {
+		return c.origin.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
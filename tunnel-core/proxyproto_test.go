@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	origins := map[string]*connOrigin{
+		"ipv4": {
+			source:      &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234},
+			destination: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		},
+		"ipv6": {
+			source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234},
+			destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		},
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		for name, origin := range origins {
+			t.Run(version+"/"+name, func(t *testing.T) {
+				header := proxyHeader(version, origin)
+				reader := bufio.NewReader(bytes.NewReader(append(header, "data"...)))
+
+				parsed, err := readProxyHeader(reader)
+				if err != nil {
+					t.Fatalf("failed to parse header %q: %v", header, err)
+				}
+				if parsed.source.String() != origin.source.String() || parsed.destination.String() != origin.destination.String() {
+					t.Fatalf("expected %s -> %s, got %s -> %s", origin.source, origin.destination, parsed.source, parsed.destination)
+				}
+
+				rest, _ := reader.ReadString('\n')
+				if rest != "data" {
+					t.Fatalf("header parsing consumed data, left %q", rest)
+				}
+			})
+		}
+
+		t.Run(version+"/unknown", func(t *testing.T) {
+			parsed, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(version, nil))))
+			if err != nil {
+				t.Fatalf("failed to parse header: %v", err)
+			}
+			if parsed != nil {
+				t.Fatalf("expected no origin, got %s -> %s", parsed.source, parsed.destination)
+			}
+		})
+	}
+}
+
+func TestProxyHeaderRejectsMalformed(t *testing.T) {
+	for name, header := range map[string]string{
+		"missing":  "GET / HTTP/1.1\r\n\r\n",
+		"fields":   "PROXY TCP4 203.0.113.7 198.51.100.1 51234\r\n",
+		"address":  "PROXY TCP4 not-an-ip 198.51.100.1 51234 443\r\n",
+		"too long": "PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 120)) + "\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString(header))); err == nil {
+				t.Fatalf("accepted %q", header)
+			}
+		})
+	}
+}
+
+// startProxyTarget starts an echo server that reads a PROXY header on every
+// connection and reports the origin it names
+func startProxyTarget(t *testing.T) (string, <-chan *connOrigin) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start target: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	origins := make(chan *connOrigin, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				origin, err := readProxyHeader(reader)
+				if err != nil {
+					return
+				}
+				origins <- origin
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), origins
+}
+
+// expectOrigin checks the origin the target saw for the next connection
+func expectOrigin(t *testing.T, origins <-chan *connOrigin, source string) {
+	t.Helper()
+	select {
+	case origin := <-origins:
+		if source == "" {
+			if origin != nil {
+				t.Fatalf("expected an unknown origin, got %s", origin.source)
+			}
+			return
+		}
+		if origin == nil || origin.source.String() != source {
+			t.Fatalf("expected origin %s, got %v", source, origin)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target saw no PROXY header")
+	}
+}
+
+func TestProxyProtocolForward(t *testing.T) {
+	for _, protocol := range []string{"tcp", "tcpmux", "ws"} {
+		for _, version := range []string{"v1", "v2"} {
+			t.Run(protocol+"/"+version, func(t *testing.T) {
+				target, origins := startProxyTarget(t)
+				listen, local := freeAddr(t), freeAddr(t)
+
+				server := newTunnelManager(&Config{
+					Mode:          "server",
+					Protocol:      protocol,
+					Listen:        listen,
+					Target:        target,
+					Token:         "test-token-0123456789",
+					ProxyProtocol: version,
+				})
+				defer server.cancel()
+				go server.startServer()
+				dialEventually(t, listen).Close()
+
+				client := newTunnelManager(&Config{
+					Mode:       "client",
+					Protocol:   protocol,
+					Server:     listen,
+					Local:      local,
+					Token:      "test-token-0123456789",
+					MuxStreams: 1,
+				})
+				defer client.cancel()
+				go client.startClient()
+
+				conn := dialEventually(t, local)
+				defer conn.Close()
+				conn.Write([]byte("ping\n"))
+
+				// Raw WebSocket links carry no origin
+				source := conn.LocalAddr().String()
+				if protocol == "ws" {
+					source = ""
+				}
+				expectOrigin(t, origins, source)
+			})
+		}
+	}
+}
+
+func TestProxyProtocolReverseBehindLoadBalancer(t *testing.T) {
+	target, origins := startProxyTarget(t)
+	bind, public := freeAddr(t), freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:                "server",
+		Protocol:            "tcp",
+		Listen:              public,
+		Bind:                bind,
+		Token:               "test-token-0123456789",
+		AcceptProxyProtocol: true,
+	})
+	defer server.cancel()
+	go server.startServer()
+
+	// The tunnel client reaches the bind address through the load balancer too
+	lb := startProxyPrepender(t, bind)
+
+	client := newTunnelManager(&Config{
+		Mode:          "client",
+		Protocol:      "tcp",
+		Server:        lb,
+		Target:        target,
+		Token:         "test-token-0123456789",
+		ProxyProtocol: "v2",
+	})
+	defer client.cancel()
+	go client.startClient()
+
+	for server.pickSession() == nil {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	conn := dialEventually(t, public)
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 51234 443\r\nping\n"))
+
+	expectOrigin(t, origins, "203.0.113.7:51234")
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("expected echo, got %q: %v", line, err)
+	}
+
+	// Connections without a header are dropped
+	bare := dialEventually(t, public)
+	defer bare.Close()
+	bare.Write([]byte("ping\n"))
+	bare.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = bare.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("connection without a PROXY header was not dropped: %v", err)
+	}
+}
+
+// startProxyPrepender relays connections to addr, starting each with a v1
+// PROXY header like a load balancer would
+func startProxyPrepender(t *testing.T, addr string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start load balancer: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := net.Dial("tcp", addr)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+
+				upstream.Write(proxyHeader("v1", originOf(conn)))
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC transport
+//
+// The quic protocol carries every forwarded connection on its own stream of
+// one QUIC connection per server, so a lost packet only stalls the streams
+// it carried data for. uquic forwards UDP, as does quic with -udp: each flow
+// is a stream as well, and its datagrams travel as QUIC datagrams that lead
+// with the flow's id:
+//
+//	flow id (4 bytes, big endian) | datagram
+//
+// The client opens a flow's stream with its id and the server answers one
+// byte once it knows the flow. Until then, and whenever a datagram does not
+// fit into one QUIC packet, datagrams go on the stream length-prefixed.
+//
+// QUIC always runs over TLS 1.3, with the same -cert, -key, -ca and -sni
+// settings as the other protocols. The first stream of a connection runs the
+// handshake described in auth.go, so the token authenticates connections
+// rather than links, and the compression it agrees on applies to every
+// stream. Clients remember session tickets, so reconnecting to a server
+// sends the handshake in 0-RTT data; the handshake's server nonce keeps
+// replayed 0-RTT data from authenticating.
+//
+// QUIC connections are known by their connection ids rather than addresses,
+// so they survive NAT rebinding. Clients also watch which local address
+// routes to the server and move the connection to a new socket when it
+// changes, as it does when a phone switches networks.
+
+const (
+	// quicALPN is the application protocol QUIC connections negotiate
+	quicALPN = "stunnel"
+
+	// quicMaxStreams is how many streams one connection may have open
+	quicMaxStreams = 4096
+
+	// quicRouteInterval is how often clients check the route to the server
+	quicRouteInterval = 5 * time.Second
+
+	// Application error codes QUIC connections close with
+	quicCodeClosed   quic.ApplicationErrorCode = 0
+	quicCodeRejected quic.ApplicationErrorCode = 1
+)
+
+// quicTransport carries links as streams of QUIC connections
+type quicTransport struct{}
+
+func init() {
+	registerTransport("quic", quicTransport{})
+	registerProtocol("quic", protocolSpec{transport: "quic", tls: true})
+	registerProtocol("uquic", protocolSpec{transport: "quic", tls: true, udp: true})
+}
+
+func (quicTransport) authenticatesLinks() bool {
+	return true
+}
+
+// quicConfig returns the QUIC settings of both sides
+func (tm *TunnelManager) quicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: tm.connectTimeout(),
+		KeepAlivePeriod:      tm.heartbeat(),
+		MaxIncomingStreams:   quicMaxStreams,
+		Allow0RTT:            true,
+		EnableDatagrams:      true,
+	}
+}
+
+// quicTLSConfig adapts a link TLS configuration to QUIC
+func quicTLSConfig(cfg *tls.Config) (*tls.Config, error) {
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < tls.VersionTLS13 {
+		return nil, fmt.Errorf("QUIC needs TLS 1.3, the TLS max version is below it")
+	}
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{quicALPN}
+	return cfg, nil
+}
+
+func (quicTransport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	cfg, err := tm.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := quicTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tm.listenUDP(udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.ListenEarly(tlsConfig, tm.quicConfig())
+	if err != nil {
+		transport.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	l := &quicListener{
+		tm:        tm,
+		conn:      conn,
+		transport: transport,
+		listener:  listener,
+		links:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (quicTransport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	session, err := tm.quic.session(tm, server)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(tm.ctx, tm.connectTimeout())
+	defer cancel()
+	stream, err := session.conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open QUIC stream: %w", err)
+	}
+
+	if tm.forwardsUDP() {
+		return session.openFlow(stream)
+	}
+	return session.streamLink(stream)
+}
+
+// quicListener accepts the streams of authenticated QUIC connections as links
+type quicListener struct {
+	tm        *TunnelManager
+	conn      *net.UDPConn
+	transport *quic.Transport
+	listener  *quic.EarlyListener
+	links     chan net.Conn
+
+	done    chan struct{}
+	once    sync.Once
+	drained chan struct{}
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			// A drained listener keeps the socket for the connections it took
+			select {
+			case <-l.drained:
+			default:
+				l.Close()
+			}
+			return
+		}
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn authenticates a connection on its first stream and hands out
+// its other streams
+func (l *quicListener) serveConn(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), handshakeTimeout)
+	control, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		conn.CloseWithError(quicCodeRejected, "no handshake")
+		return
+	}
+
+	hello, err := serverHandshake(&quicStream{Stream: control, conn: conn}, l.tm.config.Token, l.tm.acceptFlags())
+	if err != nil {
+		log.Printf("QUIC client %s rejected: %v", conn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		conn.CloseWithError(quicCodeRejected, "rejected")
+		return
+	}
+
+	session := newQUICSession(conn, hello.Accepted)
+	if l.tm.forwardsUDP() {
+		go session.receiveDatagrams()
+	}
+	if l.tm.config.Debug {
+		log.Printf("QUIC client %s connected", conn.RemoteAddr())
+	}
+
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
+		go l.acceptStream(session, stream)
+	}
+}
+
+func (l *quicListener) acceptStream(session *quicSession, stream *quic.Stream) {
+	var link net.Conn
+	var err error
+	if l.tm.forwardsUDP() {
+		link, err = session.acceptFlow(stream)
+	} else {
+		link, err = session.streamLink(stream)
+	}
+	if err != nil {
+		log.Printf("QUIC stream from %s dropped: %v", session.conn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		stream.CancelRead(0)
+		stream.Close()
+		return
+	}
+
+	select {
+	case l.links <- link:
+	case <-l.done:
+		link.Close()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case link := <-l.links:
+		return link, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// drain stops the listener taking new connections, those it took keep the
+// socket and their streams until Close
+func (l *quicListener) drain() {
+	close(l.drained)
+	l.listener.Close()
+}
+
+// Close closes the socket along with every connection accepted on it
+func (l *quicListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		l.transport.Close()
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// quicSessions holds a client's QUIC connection to each server and the
+// session tickets that resume them
+type quicSessions struct {
+	mu      sync.Mutex
+	conns   map[string]*quicSession
+	tickets tls.ClientSessionCache
+}
+
+// session returns the live connection to server, dialing a new one when
+// there is none
+func (q *quicSessions) session(tm *TunnelManager, server string) (*quicSession, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if session := q.conns[server]; session != nil && session.conn.Context().Err() == nil {
+		return session, nil
+	}
+	if q.conns == nil {
+		q.conns = make(map[string]*quicSession)
+		q.tickets = tls.NewLRUClientSessionCache(0)
+	}
+
+	session, err := q.dial(tm, server)
+	if err != nil {
+		return nil, err
+	}
+	q.conns[server] = session
+	return session, nil
+}
+
+// dial connects and authenticates a new connection to server
+func (q *quicSessions) dial(tm *TunnelManager, server string) (*quicSession, error) {
+	cfg, err := tm.clientTLSConfig(server)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := quicTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientSessionCache = q.tickets
+
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server address: %w", err)
+	}
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	transport := &quic.Transport{Conn: socket}
+	closeTransport := func() {
+		transport.Close()
+		socket.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(tm.ctx, tm.connectTimeout())
+	defer cancel()
+
+	conn, err := transport.DialEarly(ctx, addr, tlsConfig, tm.quicConfig())
+	if err != nil {
+		closeTransport()
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+
+	flags, err := tm.authenticateQUIC(conn)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// The server forgot the ticket, run the handshake again in 1-RTT
+		if conn, err = conn.NextConnection(ctx); err == nil {
+			flags, err = tm.authenticateQUIC(conn)
+		}
+	}
+	if err != nil {
+		conn.CloseWithError(quicCodeRejected, "handshake failed")
+		closeTransport()
+		return nil, err
+	}
+
+	session := newQUICSession(conn, flags)
+	session.closers = append(session.closers, closeTransport)
+	if tm.config.Debug {
+		log.Printf("QUIC connection to %s established, 0-RTT: %v", server, conn.ConnectionState().Used0RTT)
+	}
+
+	go func() {
+		select {
+		case <-tm.ctx.Done():
+			conn.CloseWithError(quicCodeClosed, "shutdown")
+		case <-conn.Context().Done():
+		}
+		session.close()
+	}()
+	if tm.forwardsUDP() {
+		go session.receiveDatagrams()
+	}
+	go session.followRoute(addr, tm.config.Debug)
+	return session, nil
+}
+
+// authenticateQUIC runs the handshake on a new connection's first stream
+func (tm *TunnelManager) authenticateQUIC(conn *quic.Conn) (byte, error) {
+	control, err := conn.OpenStream()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open QUIC stream: %w", err)
+	}
+	return clientHandshake(&quicStream{Stream: control, conn: conn}, tm.config.Token, tm.compressionFlag())
+}
+
+// quicSession is one authenticated QUIC connection with its UDP flows
+type quicSession struct {
+	conn  *quic.Conn
+	flags byte
+
+	// datagrams is set when the peer takes QUIC datagrams
+	datagrams bool
+
+	mu       sync.Mutex
+	flows    map[uint32]*quicFlow
+	nextFlow uint32
+	closers  []func()
+}
+
+func newQUICSession(conn *quic.Conn, flags byte) *quicSession {
+	return &quicSession{
+		conn:      conn,
+		flags:     flags,
+		datagrams: conn.ConnectionState().SupportsDatagrams,
+		flows:     make(map[uint32]*quicFlow),
+	}
+}
+
+// close releases the sockets the session's connection used
+func (s *quicSession) close() {
+	s.mu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.mu.Unlock()
+
+	for _, closeSocket := range closers {
+		closeSocket()
+	}
+}
+
+// streamLink makes a stream carrying a TCP connection a link, compressed as
+// the handshake agreed
+func (s *quicSession) streamLink(stream *quic.Stream) (net.Conn, error) {
+	return compressLink(&quicStream{Stream: stream, conn: s.conn}, s.flags)
+}
+
+// openFlow starts a UDP flow on a stream the client opened
+func (s *quicSession) openFlow(stream *quic.Stream) (net.Conn, error) {
+	s.mu.Lock()
+	s.nextFlow++
+	flow := newQUICFlow(s, stream, s.nextFlow)
+	s.flows[flow.id] = flow
+	s.mu.Unlock()
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], flow.id)
+	if _, err := flow.stream.Write(header[:]); err != nil {
+		flow.Close()
+		return nil, fmt.Errorf("failed to open UDP flow: %w", err)
+	}
+
+	go flow.readStream(true)
+	return flow, nil
+}
+
+// acceptFlow starts a UDP flow on a stream the server accepted
+func (s *quicSession) acceptFlow(stream *quic.Stream) (net.Conn, error) {
+	var header [4]byte
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, err := io.ReadFull(stream, header[:])
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UDP flow id: %w", err)
+	}
+
+	s.mu.Lock()
+	id := binary.BigEndian.Uint32(header[:])
+	if s.flows[id] != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("UDP flow %d opened twice", id)
+	}
+	flow := newQUICFlow(s, stream, id)
+	s.flows[id] = flow
+	s.mu.Unlock()
+
+	// Tell the client its datagrams can go out as QUIC datagrams now
+	if _, err := flow.stream.Write([]byte{0}); err != nil {
+		flow.Close()
+		return nil, fmt.Errorf("failed to accept UDP flow: %w", err)
+	}
+	flow.ready.Store(true)
+
+	go flow.readStream(false)
+	return flow, nil
+}
+
+// receiveDatagrams hands the connection's QUIC datagrams to their flows
+func (s *quicSession) receiveDatagrams() {
+	for {
+		datagram, err := s.conn.ReceiveDatagram(s.conn.Context())
+		if err != nil {
+			return
+		}
+		if len(datagram) < 4 {
+			stats.Errors.Add(1)
+			continue
+		}
+
+		s.mu.Lock()
+		flow := s.flows[binary.BigEndian.Uint32(datagram)]
+		s.mu.Unlock()
+		if flow == nil {
+			stats.Dropped.Add(1)
+			continue
+		}
+		flow.datagrams.push(datagram[4:])
+	}
+}
+
+// sendDatagram sends a flow's datagram as a QUIC datagram
+func (s *quicSession) sendDatagram(id uint32, payload []byte) error {
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+
+	datagram := (*buffer)[:4+len(payload)]
+	binary.BigEndian.PutUint32(datagram, id)
+	copy(datagram[4:], payload)
+	return s.conn.SendDatagram(datagram)
+}
+
+// followRoute moves the connection to a new socket whenever the local
+// address routing to the server changes
+func (s *quicSession) followRoute(server *net.UDPAddr, debug bool) {
+	ticker := time.NewTicker(quicRouteInterval)
+	defer ticker.Stop()
+
+	local := routeIP(server)
+	for {
+		select {
+		case <-s.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		ip := routeIP(server)
+		if ip == nil || ip.Equal(local) {
+			continue
+		}
+		log.Printf("Route to %s now leaves from %s, migrating QUIC connection", server, ip)
+		if err := s.migrate(); err != nil {
+			log.Printf("QUIC connection migration failed: %v", err)
+			continue
+		}
+		local = ip
+	}
+}
+
+// routeIP returns the local address the system routes to addr from
+func routeIP(addr *net.UDPAddr) net.IP {
+	// Connecting a UDP socket picks the route without sending anything
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// migrate moves the connection to a new socket once the server answered
+// on it
+func (s *quicSession) migrate() error {
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	transport := &quic.Transport{Conn: socket}
+	closeTransport := func() {
+		transport.Close()
+		socket.Close()
+	}
+
+	path, err := s.conn.AddPath(transport)
+	if err != nil {
+		closeTransport()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(s.conn.Context(), handshakeTimeout)
+	defer cancel()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		closeTransport()
+		return fmt.Errorf("failed to probe new path: %w", err)
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		closeTransport()
+		return fmt.Errorf("failed to switch to new path: %w", err)
+	}
+
+	// The old sockets are only released with the connection
+	s.mu.Lock()
+	s.closers = append(s.closers, closeTransport)
+	s.mu.Unlock()
+	return nil
+}
+
+// quicStream adapts a QUIC stream to net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// CloseWrite ends the stream's sending side
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close ends both sides of the stream
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// quicFlow is a UDP flow over a QUIC connection, its datagrams sent as QUIC
+// datagrams and kept apart from other flows by the id its stream opened
+// with
+type quicFlow struct {
+	session   *quicSession
+	stream    *quicStream
+	id        uint32
+	datagrams datagramQueue
+
+	// ready is set once the other end knows the flow's id
+	ready   atomic.Bool
+	writeMu sync.Mutex
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newQUICFlow(session *quicSession, stream *quic.Stream, id uint32) *quicFlow {
+	return &quicFlow{
+		session:   session,
+		stream:    &quicStream{Stream: stream, conn: session.conn},
+		id:        id,
+		datagrams: newDatagramQueue(),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (f *quicFlow) keepsDatagrams() {}
+
+// readStream queues the datagrams arriving on the flow's stream until it
+// ends, which ends the flow. The client waits for the server's answer first.
+func (f *quicFlow) readStream(awaitAnswer bool) {
+	defer f.Close()
+
+	if awaitAnswer {
+		var answer [1]byte
+		if _, err := io.ReadFull(f.stream, answer[:]); err != nil {
+			return
+		}
+		f.ready.Store(true)
+	}
+
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+	for {
+		n, err := readDatagram(f.stream, *buffer)
+		if err != nil {
+			return
+		}
+		f.datagrams.push((*buffer)[:n])
+	}
+}
+
+func (f *quicFlow) Read(b []byte) (int, error) {
+	return f.datagrams.pop(b, f.closed, f.session.conn.Context().Done())
+}
+
+func (f *quicFlow) Write(b []byte) (int, error) {
+	if f.ready.Load() && f.session.datagrams {
+		err := f.session.sendDatagram(f.id, b)
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			if err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+	}
+
+	// The stream carries what QUIC datagrams cannot yet or do not fit
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+	if err := writeDatagram(f.stream, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the flow and its stream
+func (f *quicFlow) Close() error {
+	f.once.Do(func() {
+		close(f.closed)
+
+		f.session.mu.Lock()
+		if f.session.flows[f.id] == f {
+			delete(f.session.flows, f.id)
+		}
+		f.session.mu.Unlock()
+
+		f.stream.Close()
+	})
+	return nil
+}
+
+func (f *quicFlow) LocalAddr() net.Addr {
+	return f.stream.LocalAddr()
+}
+
+func (f *quicFlow) RemoteAddr() net.Addr {
+	return f.stream.RemoteAddr()
+}
+
+// Deadlines are not supported, flows end by closing
+func (f *quicFlow) SetDeadline(t time.Time) error      { return nil }
+func (f *quicFlow) SetReadDeadline(t time.Time) error  { return nil }
+func (f *quicFlow) SetWriteDeadline(t time.Time) error { return nil }
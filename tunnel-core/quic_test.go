@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestQUICTransport(t *testing.T) {
+	for _, tt := range []struct {
+		name, protocol, compression string
+	}{
+		{"quic", "quic", compressionNone},
+		{"quic zstd", "quic", compressionZstd},
+		{"uquic", "uquic", compressionNone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			udp := protocols[tt.protocol].udp
+			target, local := "", ""
+			if udp {
+				target, local = startUDPEchoServer(t), freeUDPAddr(t)
+			} else {
+				target, local = startEchoServer(t), freeAddr(t)
+			}
+
+			pki := newTestPKI(t)
+			startTunnel(t,
+				&Config{Protocol: tt.protocol, Target: target, Compression: tt.compression, CertFile: pki.serverCert, KeyFile: pki.serverKey},
+				&Config{Local: local, Compression: tt.compression, CAFile: pki.caFile})
+
+			if udp {
+				expectUDPEcho(t, local)
+			} else {
+				expectTCPEcho(t, local)
+				expectTCPEcho(t, local)
+			}
+		})
+	}
+}
+
+func TestQUICCarriesLargeDatagramsOnStreams(t *testing.T) {
+	pki := newTestPKI(t)
+	_, client := startTunnel(t,
+		&Config{Protocol: "uquic", Target: startUDPEchoServer(t), CertFile: pki.serverCert, KeyFile: pki.serverKey},
+		&Config{CAFile: pki.caFile})
+	expectUDPEcho(t, client.config.Local)
+
+	conn, err := net.Dial("udp", client.config.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Larger than any QUIC packet on the path
+	datagram := bytes.Repeat([]byte("d"), 8000)
+	buffer := make([]byte, 16384)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write(datagram)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if n, err := conn.Read(buffer); err == nil {
+			if !bytes.Equal(buffer[:n], datagram) {
+				t.Fatalf("echo of %d bytes differs", n)
+			}
+			return
+		}
+	}
+	t.Fatal("no reply to a large datagram")
+}
+
+func TestQUICRejectsWrongToken(t *testing.T) {
+	pki := newTestPKI(t)
+	server, _ := startTunnel(t, &Config{Protocol: "quic", Target: startEchoServer(t), CertFile: pki.serverCert, KeyFile: pki.serverKey}, nil)
+	clientConfig := &Config{Mode: "client", Protocol: "quic", Server: server.config.Listen, Token: server.config.Token, CAFile: pki.caFile}
+
+	// Wait for the server with the right token first
+	client := newTunnelManager(clientConfig)
+	defer client.cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		link, err := client.dialLink(clientConfig.Server)
+		if err == nil {
+			link.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("link failed with the right token: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	wrongConfig := *clientConfig
+	wrongConfig.Token = "wrong-token-0123456789"
+	wrong := newTunnelManager(&wrongConfig)
+	defer wrong.cancel()
+	if _, err := wrong.dialLink(clientConfig.Server); err == nil {
+		t.Fatal("link opened with the wrong token")
+	}
+}
+
+func TestQUICResumesWithZeroRTT(t *testing.T) {
+	pki := newTestPKI(t)
+	_, client := startTunnel(t,
+		&Config{Protocol: "quic", Target: startEchoServer(t), CertFile: pki.serverCert, KeyFile: pki.serverKey},
+		&Config{CAFile: pki.caFile})
+	expectTCPEcho(t, client.config.Local)
+
+	first, err := client.quic.session(client, client.config.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.conn.ConnectionState().Used0RTT {
+		t.Fatal("first connection used 0-RTT")
+	}
+	first.conn.CloseWithError(quicCodeClosed, "test")
+	<-first.conn.Context().Done()
+
+	expectTCPEcho(t, client.config.Local)
+	second, err := client.quic.session(client, client.config.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("closed connection was reused")
+	}
+	if !second.conn.ConnectionState().Used0RTT {
+		t.Fatal("reconnect did not use 0-RTT")
+	}
+}
+
+func TestQUICMigratesConnection(t *testing.T) {
+	pki := newTestPKI(t)
+	_, client := startTunnel(t,
+		&Config{Protocol: "quic", Target: startEchoServer(t), CertFile: pki.serverCert, KeyFile: pki.serverKey},
+		&Config{CAFile: pki.caFile})
+	expectTCPEcho(t, client.config.Local)
+
+	session, err := client.quic.session(client, client.config.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := session.conn.LocalAddr().String()
+	if err := session.migrate(); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	expectTCPEcho(t, client.config.Local)
+	after, err := client.quic.session(client, client.config.Server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != session {
+		t.Fatal("migration replaced the connection")
+	}
+	if session.conn.LocalAddr().String() == before {
+		t.Fatalf("connection still leaves from %s", before)
+	}
+}
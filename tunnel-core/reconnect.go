@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Reconnects
+//
+// Clients that lose a link try again after a delay that doubles from
+// -reconnect-min up to -reconnect-max, with up to half of it taken off at
+// random so clients that lost the same server do not all come back in the
+// same instant. A link that connects resets the delay. Every link set up
+// again after a loss counts in the reconnects of /stats, and the streams it
+// saved in resumed_streams, see resume.go.
+
+const (
+	defaultReconnectMin = time.Second
+	defaultReconnectMax = time.Minute
+)
+
+// backoff spaces the attempts to set up one link again
+type backoff struct {
+	tm      *TunnelManager
+	attempt int
+}
+
+func (tm *TunnelManager) newBackoff() *backoff {
+	return &backoff{tm: tm}
+}
+
+// reconnectDelays returns the first and longest delay between attempts
+func (tm *TunnelManager) reconnectDelays() (time.Duration, time.Duration) {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	min, max := tm.config.ReconnectMin, tm.config.ReconnectMax
+	if min <= 0 {
+		min = defaultReconnectMin
+	}
+	if max <= 0 {
+		max = defaultReconnectMax
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+// next returns the delay before the next attempt
+func (b *backoff) next() time.Duration {
+	min, max := b.tm.reconnectDelays()
+
+	delay := max
+	if b.attempt < 32 {
+		if d := min << b.attempt; d > 0 && d < max {
+			delay = d
+		}
+	}
+	b.attempt++
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reset starts over from the shortest delay after a link connected
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// wait sleeps until the next attempt, returning false if ctx ends first
+func (b *backoff) wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.next())
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Connection registry
+//
+// Every tunneled connection, mux stream and UDP flow is registered while it
+// is open, with the bytes it carried counted as they are copied rather than
+// when it closes: per buffer for copied connections and per splice(2) call
+// into the pipe for spliced ones, see copy.go. The latest closed
+// connections are kept with the reason they ended. Mux sessions count the
+// bytes of their whole link, framing included, so a busy client shows up
+// even when its streams are short lived.
+
+// maxClosedConnections is how many closed connections the registry keeps
+const maxClosedConnections = 256
+
+// connection is one tunneled connection as seen by the registry. BytesIn
+// travels towards the target, BytesOut comes back from it.
+type connection struct {
+	id      uint64
+	kind    string
+	remote  string
+	session string
+	started time.Time
+
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	active   atomic.Int64 // When bytes last went either way, in UnixNano
+
+	// Buckets each direction's traffic passes through, see limit.go
+	ctx      context.Context
+	host     string
+	limitIn  []*rateLimiter
+	limitOut []*rateLimiter
+
+	mu       sync.Mutex
+	target   string // The pool member once one is picked
+	reason   string
+	closedAt time.Time
+}
+
+// connectionInfo is a connection in /connections responses
+type connectionInfo struct {
+	ID          uint64     `json:"id"`
+	Kind        string     `json:"kind"`
+	Remote      string     `json:"remote"`
+	Target      string     `json:"target"`
+	Session     string     `json:"session,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	BytesIn     int64      `json:"bytes_in"`
+	BytesOut    int64      `json:"bytes_out"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	CloseReason string     `json:"close_reason,omitempty"`
+}
+
+// connectionRegistry holds the open connections and the latest closed ones
+type connectionRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	open   map[uint64]*connection
+	closed []*connection
+}
+
+// openConnection registers a connection from remote to target, session
+// naming the mux session that carries it if known. It fails while the
+// tunnel is at its connection limit.
+func (tm *TunnelManager) openConnection(kind, remote, target, session string) (*connection, error) {
+	tm.conns.mu.Lock()
+	defer tm.conns.mu.Unlock()
+
+	if err := tm.limits.checkCapacity(len(tm.conns.open)); err != nil {
+		stats.Rejected.Add(1)
+		if tm.config.Debug {
+			log.Printf("Refusing %s from %s: %v", kind, remote, err)
+		}
+		return nil, err
+	}
+
+	tm.conns.nextID++
+	c := &connection{
+		id:      tm.conns.nextID,
+		kind:    kind,
+		remote:  remote,
+		target:  target,
+		session: session,
+		started: time.Now(),
+		ctx:     tm.ctx,
+		host:    remoteHost(remote),
+	}
+	c.active.Store(c.started.UnixNano())
+	c.limitIn, c.limitOut = tm.limits.acquire(c.host)
+	tm.conns.open[c.id] = c
+
+	stats.Connections.Add(1)
+	stats.Active.Add(1)
+	return c, nil
+}
+
+// closeConnection unregisters a connection and keeps it among the closed ones
+func (tm *TunnelManager) closeConnection(c *connection) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = "closed"
+		if tm.ctx.Err() != nil {
+			c.reason = "shutdown"
+		}
+	}
+	c.closedAt = time.Now()
+	c.mu.Unlock()
+
+	tm.conns.mu.Lock()
+	defer tm.conns.mu.Unlock()
+
+	if _, ok := tm.conns.open[c.id]; !ok {
+		return
+	}
+	delete(tm.conns.open, c.id)
+	tm.limits.release(c.host)
+	stats.Active.Add(-1)
+
+	if len(tm.conns.closed) == maxClosedConnections {
+		copy(tm.conns.closed, tm.conns.closed[1:])
+		tm.conns.closed = tm.conns.closed[:maxClosedConnections-1]
+	}
+	tm.conns.closed = append(tm.conns.closed, c)
+}
+
+// addIn counts bytes sent towards the target
+func (c *connection) addIn(n int64) {
+	c.bytesIn.Add(n)
+	c.active.Store(time.Now().UnixNano())
+	stats.BytesIn.Add(n)
+}
+
+// addOut counts bytes sent back from the target
+func (c *connection) addOut(n int64) {
+	c.bytesOut.Add(n)
+	c.active.Store(time.Now().UnixNano())
+	stats.BytesOut.Add(n)
+}
+
+// lastActive returns when the connection last carried bytes
+func (c *connection) lastActive() time.Time {
+	return time.Unix(0, c.active.Load())
+}
+
+// carryIn counts bytes read for the target, then waits while they put the
+// connection over its bandwidth limits
+func (c *connection) carryIn(n int64) {
+	c.addIn(n)
+	waitFor(c.ctx, c.limitIn, int(n))
+}
+
+// carryOut counts bytes read from the target, then waits while they put the
+// connection over its bandwidth limits
+func (c *connection) carryOut(n int64) {
+	c.addOut(n)
+	waitFor(c.ctx, c.limitOut, int(n))
+}
+
+// admitIn counts a datagram for the target unless it is over the bandwidth
+// limits, in which case it should be dropped
+func (c *connection) admitIn(n int) bool {
+	if !allowAll(c.limitIn, n) {
+		stats.Dropped.Add(1)
+		return false
+	}
+	c.addIn(int64(n))
+	return true
+}
+
+// admitOut counts a datagram from the target unless it is over the
+// bandwidth limits, in which case it should be dropped
+func (c *connection) admitOut(n int) bool {
+	if !allowAll(c.limitOut, n) {
+		stats.Dropped.Add(1)
+		return false
+	}
+	c.addOut(int64(n))
+	return true
+}
+
+// fail records why the connection ended, the first reason given is kept
+func (c *connection) fail(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == "" {
+		c.reason = reason
+	}
+}
+
+// setTarget records the pool member the connection went to
+func (c *connection) setTarget(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = target
+}
+
+// info snapshots the connection for /connections
+func (c *connection) info() connectionInfo {
+	info := connectionInfo{
+		ID:        c.id,
+		Kind:      c.kind,
+		Remote:    c.remote,
+		Session:   c.session,
+		StartedAt: c.started,
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info.Target = c.target
+	if !c.closedAt.IsZero() {
+		closedAt := c.closedAt
+		info.ClosedAt = &closedAt
+		info.CloseReason = c.reason
+	}
+	return info
+}
+
+// connections lists the open connections busiest first and the closed ones
+// most recent first
+func (tm *TunnelManager) connections() (open, closed []connectionInfo) {
+	tm.conns.mu.Lock()
+	openConns := make([]*connection, 0, len(tm.conns.open))
+	for _, c := range tm.conns.open {
+		openConns = append(openConns, c)
+	}
+	closedConns := append([]*connection(nil), tm.conns.closed...)
+	tm.conns.mu.Unlock()
+
+	open = make([]connectionInfo, 0, len(openConns))
+	for _, c := range openConns {
+		open = append(open, c.info())
+	}
+	sort.Slice(open, func(i, j int) bool {
+		return open[i].BytesIn+open[i].BytesOut > open[j].BytesIn+open[j].BytesOut
+	})
+
+	closed = make([]connectionInfo, 0, len(closedConns))
+	for i := len(closedConns) - 1; i >= 0; i-- {
+		closed = append(closed, closedConns[i].info())
+	}
+	return open, closed
+}
+
+// copyEnded describes why copying from one side of a connection stopped
+func copyEnded(from string, err error) string {
+	if err == nil {
+		return from + " closed"
+	}
+	return fmt.Sprintf("%s copy failed: %v", from, err)
+}
+
+// closeWrite passes the end of one direction on to conn while leaving the
+// other direction open, so both copies of a connection finish
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+	case *frameConn:
+		closeWrite(c.Conn)
+	case *proxyConn:
+		closeWrite(c.Conn)
+	case *poolConn:
+		closeWrite(c.Conn)
+	case *replayConn:
+		closeWrite(c.Conn)
+	case *trackedConn:
+		closeWrite(c.Conn)
+	case *meteredConn:
+		closeWrite(c.Conn)
+	case *yamux.Stream:
+		// Closing a yamux stream only ends our side of it
+		c.Close()
+	}
+}
+
+// meteredConn counts the bytes read from and written to a link
+type meteredConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// trackedSession is a mux session registered for load balancing and /stats
+type trackedSession struct {
+	id          string
+	session     *yamux.Session
+	link        *meteredConn
+	remote      string
+	connectedAt time.Time
+
+	// Hello flags both ends of the link understand
+	flags byte
+
+	// goneAway is set once the peer refuses new streams, see drain.go
+	goneAway atomic.Bool
+}
+
+// usable reports whether new streams can be opened on the session
+func (ts *trackedSession) usable() bool {
+	return ts != nil && !ts.session.IsClosed() && !ts.goneAway.Load()
+}
+
+// trackSession registers a session running over link until untrackSession
+func (tm *TunnelManager) trackSession(remote string, session *yamux.Session, link *meteredConn, flags byte) *trackedSession {
+	now := time.Now()
+	ts := &trackedSession{
+		id:          fmt.Sprintf("%s-%d", remote, now.UnixNano()),
+		session:     session,
+		link:        link,
+		remote:      remote,
+		connectedAt: now,
+		flags:       flags,
+	}
+
+	tm.mu.Lock()
+	tm.sessions[ts.id] = ts
+	tm.mu.Unlock()
+	return ts
+}
+
+func (tm *TunnelManager) untrackSession(ts *trackedSession) {
+	tm.mu.Lock()
+	delete(tm.sessions, ts.id)
+	tm.mu.Unlock()
+}
@@ -0,0 +1,736 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Resumable streams
+//
+// A client forwarding TCP offers flagResume on its mux links. Every stream
+// it opens then starts with a resume frame
+//
+//	kind (1) | client session ID (16) | stream number (4) | bytes received (8)
+//
+// kind is resumeOpen for a new logical stream and resumeAttach for one whose
+// mux stream broke. The server answers an attach with a resumed frame
+// holding the bytes it received, or an empty one when the stream is gone.
+// The client session ID is drawn at random with the client's first stream
+// and stream numbers count up from 1, so only the client that opened a stream can
+// resume it.
+//
+// After the resume frame both ends send chunks in the handshake frame
+// layout: data, an acknowledgement of the bytes read so far (8), the end of
+// one direction or the close of the whole stream. Each end keeps what it sent
+// until the other acknowledges it, at most resumeWindow bytes, and sends it
+// again after an attach from where the other end says it stopped receiving.
+//
+// A mux stream that ends without a close chunk leaves its logical stream
+// orphaned: the target connection stays open while the client reconnects
+// with backoff and attaches the stream to a new mux stream. A stream the
+// server does not know and never answered on is opened again, as its open
+// frame may have been lost with the link. The server
+// closes streams that stay orphaned for -resume-grace. Streams over raw
+// links, UDP flows and dynamic streams are not resumed.
+
+const (
+	// Resume frame kinds
+	resumeOpen   byte = 0x01
+	resumeAttach byte = 0x02
+
+	// Chunk types
+	chunkData  byte = 0x01
+	chunkAck   byte = 0x02
+	chunkFin   byte = 0x03
+	chunkClose byte = 0x04
+
+	resumeFrameSize = 1 + 16 + 4 + 8
+
+	// maxChunkSize caps the data of one chunk
+	maxChunkSize = 16 * 1024
+
+	// resumeWindow is how much each end sends ahead of the acknowledgements
+	resumeWindow = 1024 * 1024
+
+	defaultResumeGrace = 30 * time.Second
+)
+
+var (
+	errResumeExpired = errors.New("stream was not resumed in time")
+	errResumeUnknown = errors.New("server no longer knows the stream")
+	errResumeGap     = errors.New("data needed to resume the stream is gone")
+)
+
+// resumeKey names a logical stream across the mux streams carrying it
+type resumeKey struct {
+	session [16]byte
+	stream  uint32
+}
+
+func (k resumeKey) String() string {
+	return fmt.Sprintf("%x/%d", k.session[:4], k.stream)
+}
+
+// resumeTable holds a server's resumable streams and a client's session ID
+type resumeTable struct {
+	mu      sync.Mutex
+	streams map[resumeKey]*resumableConn
+
+	// The client side names its streams with these
+	session [16]byte
+	next    uint32
+}
+
+// resumeGrace returns how long a server keeps an orphaned stream
+func (tm *TunnelManager) resumeGrace() time.Duration {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	if tm.config.ResumeGrace > 0 {
+		return tm.config.ResumeGrace
+	}
+	return defaultResumeGrace
+}
+
+// resumesStreams reports whether a client offers to resume its streams
+func (tm *TunnelManager) resumesStreams() bool {
+	return !tm.forwardsUDP() && !tm.config.Dynamic
+}
+
+func writeResume(w io.Writer, kind byte, key resumeKey, received uint64) error {
+	payload := make([]byte, resumeFrameSize)
+	payload[0] = kind
+	copy(payload[1:17], key.session[:])
+	binary.BigEndian.PutUint32(payload[17:21], key.stream)
+	binary.BigEndian.PutUint64(payload[21:], received)
+	return writeFrame(w, frameResume, payload)
+}
+
+func readResume(conn net.Conn) (byte, resumeKey, uint64, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var key resumeKey
+	frameType, payload, err := readFrame(conn)
+	if err != nil {
+		return 0, key, 0, fmt.Errorf("failed to read resume frame: %w", err)
+	}
+	if frameType != frameResume || len(payload) != resumeFrameSize {
+		return 0, key, 0, fmt.Errorf("unexpected frame 0x%02x, expected resume", frameType)
+	}
+	if payload[0] != resumeOpen && payload[0] != resumeAttach {
+		return 0, key, 0, fmt.Errorf("unknown resume kind 0x%02x", payload[0])
+	}
+	copy(key.session[:], payload[1:17])
+	key.stream = binary.BigEndian.Uint32(payload[17:21])
+	return payload[0], key, binary.BigEndian.Uint64(payload[21:]), nil
+}
+
+// readChunk reads one chunk, which may be larger than a handshake frame
+func readChunk(r io.Reader) (byte, []byte, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint16(header[1:3])
+	if size > maxChunkSize {
+		return 0, nil, fmt.Errorf("chunk too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// resumableConn is a logical stream that outlives the mux streams carrying
+// it. Reads and writes go on while it waits for a new carrier, as far as
+// the window allows.
+type resumableConn struct {
+	tm  *TunnelManager
+	key resumeKey
+
+	// reattach opens a new carrier for a client's broken stream, it is nil
+	// on servers, which wait for the client to attach
+	reattach func() (net.Conn, error)
+
+	localAddr, remoteAddr net.Addr
+	stopWatch             func() bool
+
+	// writeMu keeps chunks whole and in order on the carrier
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	carrier    net.Conn
+	generation int
+	orphaned   bool
+	err        error // Set once the stream is closed or lost
+
+	sent    uint64 // Bytes written
+	acked   uint64 // Bytes the other end has read
+	unacked []byte // Bytes from acked to sent
+	finSent bool
+
+	received    uint64 // Bytes received
+	consumed    uint64 // Bytes returned by Read
+	ackSent     uint64 // Bytes last acknowledged
+	pending     []byte // Bytes received but not yet read
+	finReceived bool
+	peerClosed  bool
+
+	readDeadline time.Time
+	readTimer    *time.Timer
+}
+
+func newResumableConn(tm *TunnelManager, key resumeKey, carrier net.Conn, reattach func() (net.Conn, error)) *resumableConn {
+	c := &resumableConn{
+		tm:         tm,
+		key:        key,
+		reattach:   reattach,
+		localAddr:  carrier.LocalAddr(),
+		remoteAddr: carrier.RemoteAddr(),
+		carrier:    carrier,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.stopWatch = context.AfterFunc(tm.ctx, func() {
+		c.fail(fmt.Errorf("tunnel shut down"))
+	})
+	go c.readLoop(carrier, 0)
+	return c
+}
+
+// openResumable starts a new logical stream on carrier for a client
+func (tm *TunnelManager) openResumable(carrier net.Conn, reattach func() (net.Conn, error)) (*resumableConn, error) {
+	tm.resumes.mu.Lock()
+	if tm.resumes.next == 0 {
+		rand.Read(tm.resumes.session[:])
+	}
+	tm.resumes.next++
+	key := resumeKey{session: tm.resumes.session, stream: tm.resumes.next}
+	tm.resumes.mu.Unlock()
+
+	if err := writeResume(carrier, resumeOpen, key, 0); err != nil {
+		return nil, fmt.Errorf("failed to send resume frame: %w", err)
+	}
+	return newResumableConn(tm, key, carrier, reattach), nil
+}
+
+// acceptResumable reads the resume frame a stream from a client offering
+// flagResume starts with. A new logical stream comes back as a resumable
+// connection. A stream attaching to an orphaned one carries it from then on
+// and nil comes back, as it does when the stream is refused.
+func (tm *TunnelManager) acceptResumable(stream net.Conn) net.Conn {
+	kind, key, received, err := readResume(stream)
+	if err != nil {
+		log.Printf("Dropping stream: %v", err)
+		stats.Errors.Add(1)
+		stream.Close()
+		return nil
+	}
+
+	if kind == resumeOpen {
+		tm.resumes.mu.Lock()
+		defer tm.resumes.mu.Unlock()
+
+		if tm.resumes.streams[key] != nil {
+			log.Printf("Dropping stream: stream %s is already open", key)
+			stats.Errors.Add(1)
+			stream.Close()
+			return nil
+		}
+		c := newResumableConn(tm, key, stream, nil)
+		tm.resumes.streams[key] = c
+		return c
+	}
+
+	tm.resumes.mu.Lock()
+	c := tm.resumes.streams[key]
+	tm.resumes.mu.Unlock()
+
+	if c == nil {
+		if tm.config.Debug {
+			log.Printf("Refusing to resume unknown stream %s", key)
+		}
+		writeFrame(stream, frameResumed, nil)
+		stream.Close()
+		return nil
+	}
+	if err := c.attach(stream, received, true); err != nil {
+		log.Printf("Failed to resume stream %s: %v", key, err)
+		stream.Close()
+		return nil
+	}
+	stats.Resumed.Add(1)
+	if tm.config.Debug {
+		log.Printf("Resumed stream %s", key)
+	}
+	return nil
+}
+
+// readLoop takes the chunks of one carrier until it breaks or is replaced
+func (c *resumableConn) readLoop(carrier net.Conn, generation int) {
+	for {
+		chunkType, payload, err := readChunk(carrier)
+		if err != nil {
+			c.detach(generation, err)
+			return
+		}
+
+		c.mu.Lock()
+		if c.generation != generation {
+			c.mu.Unlock()
+			return
+		}
+		switch chunkType {
+		case chunkData:
+			c.pending = append(c.pending, payload...)
+			c.received += uint64(len(payload))
+		case chunkAck:
+			if len(payload) == 8 {
+				c.acknowledge(binary.BigEndian.Uint64(payload))
+			}
+		case chunkFin:
+			c.finReceived = true
+		case chunkClose:
+			c.finReceived = true
+			c.peerClosed = true
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if chunkType == chunkClose {
+			return
+		}
+	}
+}
+
+// acknowledge drops the sent bytes the other end has read up to n. Must be
+// called with mu held.
+func (c *resumableConn) acknowledge(n uint64) {
+	if n <= c.acked || n > c.sent {
+		return
+	}
+	c.unacked = c.unacked[n-c.acked:]
+	c.acked = n
+}
+
+// detach drops a broken carrier. The stream waits for a new one: a client
+// goes to open it, a server gives the client -resume-grace to come back.
+func (c *resumableConn) detach(generation int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation || c.carrier == nil {
+		return
+	}
+	c.carrier.Close()
+	c.carrier = nil
+	c.generation++
+	if c.err != nil || c.peerClosed {
+		return
+	}
+
+	c.orphaned = true
+	stats.Orphaned.Add(1)
+	if c.tm.config.Debug {
+		log.Printf("Stream %s lost its carrier: %v", c.key, err)
+	}
+
+	grace := c.tm.resumeGrace()
+	orphanedAt := c.generation
+	time.AfterFunc(grace, func() {
+		c.mu.Lock()
+		expired := c.generation == orphanedAt && c.carrier == nil
+		c.mu.Unlock()
+		if expired {
+			c.fail(errResumeExpired)
+		}
+	})
+	if c.reattach != nil {
+		go c.reconnect(time.Now().Add(grace))
+	}
+}
+
+// reconnect attaches a client's orphaned stream to a new carrier, trying
+// with backoff until deadline
+func (c *resumableConn) reconnect(deadline time.Time) {
+	retry := c.tm.newBackoff()
+	for {
+		err := c.resume(resumeAttach)
+		if errors.Is(err, errResumeUnknown) && c.unanswered() {
+			// The open frame may have been lost with the link
+			err = c.resume(resumeOpen)
+		}
+		if err == nil {
+			stats.Resumed.Add(1)
+			if c.tm.config.Debug {
+				log.Printf("Resumed stream %s", c.key)
+			}
+			return
+		}
+		if errors.Is(err, errResumeUnknown) || errors.Is(err, errResumeGap) {
+			c.fail(err)
+			return
+		}
+		if c.tm.config.Debug {
+			log.Printf("Failed to resume stream %s: %v", c.key, err)
+		}
+
+		if !retry.wait(c.tm.ctx) || time.Now().After(deadline) {
+			c.fail(errResumeExpired)
+			return
+		}
+		c.mu.Lock()
+		done := c.err != nil
+		c.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// unanswered reports whether the server has not sent or acknowledged
+// anything on the stream
+func (c *resumableConn) unanswered() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received == 0 && c.acked == 0
+}
+
+// resume opens a new carrier for a client's stream and attaches it, or with
+// resumeOpen opens the stream again from its first byte
+func (c *resumableConn) resume(kind byte) error {
+	c.mu.Lock()
+	received := c.received
+	c.mu.Unlock()
+
+	carrier, err := c.reattach()
+	if err != nil {
+		return err
+	}
+	if err := writeResume(carrier, kind, c.key, received); err != nil {
+		carrier.Close()
+		return fmt.Errorf("failed to send resume frame: %w", err)
+	}
+
+	// Only an attach is answered
+	var peerReceived uint64
+	if kind == resumeAttach {
+		if peerReceived, err = readResumed(carrier); err != nil {
+			carrier.Close()
+			return err
+		}
+	}
+
+	if err := c.attach(carrier, peerReceived, false); err != nil {
+		carrier.Close()
+		return err
+	}
+	return nil
+}
+
+// readResumed reads the server's answer to an attach
+func readResumed(conn net.Conn) (uint64, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(conn)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("failed to read resumed frame: %w", err)
+	case frameType != frameResumed:
+		return 0, fmt.Errorf("unexpected frame 0x%02x, expected resumed", frameType)
+	case len(payload) == 0:
+		return 0, errResumeUnknown
+	case len(payload) != 8:
+		return 0, fmt.Errorf("malformed resumed frame")
+	}
+	return binary.BigEndian.Uint64(payload), nil
+}
+
+// attach makes carrier carry the stream, sending again what the other end
+// did not receive of it. A server answers with what it received first.
+func (c *resumableConn) attach(carrier net.Conn, peerReceived uint64, answer bool) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	if peerReceived < c.acked || peerReceived > c.sent {
+		c.mu.Unlock()
+		c.fail(errResumeGap)
+		return errResumeGap
+	}
+
+	// The old carrier may not have noticed it is broken yet
+	if c.carrier != nil {
+		c.carrier.Close()
+	}
+	c.carrier = carrier
+	c.generation++
+	generation := c.generation
+	if c.orphaned {
+		c.orphaned = false
+		stats.Orphaned.Add(-1)
+	}
+
+	c.acknowledge(peerReceived)
+	resend := append([]byte(nil), c.unacked...)
+	received, finSent := c.received, c.finSent
+	c.ackSent = c.consumed
+	c.mu.Unlock()
+
+	err := func() error {
+		if answer {
+			var payload [8]byte
+			binary.BigEndian.PutUint64(payload[:], received)
+			if err := writeFrame(carrier, frameResumed, payload[:]); err != nil {
+				return err
+			}
+		}
+		for len(resend) > 0 {
+			n := min(len(resend), maxChunkSize)
+			if err := writeFrame(carrier, chunkData, resend[:n]); err != nil {
+				return err
+			}
+			resend = resend[n:]
+		}
+		if finSent {
+			return writeFrame(carrier, chunkFin, nil)
+		}
+		return nil
+	}()
+
+	go c.readLoop(carrier, generation)
+	if err != nil {
+		go c.detach(generation, err)
+	}
+	return nil
+}
+
+// send writes a chunk to the current carrier, if the stream has one
+func (c *resumableConn) send(chunkType byte, payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.mu.Lock()
+	carrier, generation := c.carrier, c.generation
+	c.mu.Unlock()
+
+	if carrier == nil {
+		return
+	}
+	if err := writeFrame(carrier, chunkType, payload); err != nil {
+		c.detach(generation, err)
+	}
+}
+
+func (c *resumableConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	for len(c.pending) == 0 && !c.finReceived && c.err == nil && !c.readExpired() {
+		c.cond.Wait()
+	}
+
+	switch {
+	case len(c.pending) > 0:
+	case c.finReceived:
+		c.mu.Unlock()
+		return 0, io.EOF
+	case c.err != nil:
+		err := c.err
+		c.mu.Unlock()
+		return 0, err
+	default:
+		c.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	c.consumed += uint64(n)
+
+	var ack []byte
+	if c.consumed-c.ackSent >= resumeWindow/4 {
+		c.ackSent = c.consumed
+		ack = binary.BigEndian.AppendUint64(nil, c.consumed)
+	}
+	c.mu.Unlock()
+
+	if ack != nil {
+		c.send(chunkAck, ack)
+	}
+	return n, nil
+}
+
+// readExpired reports whether the read deadline passed. Must be called
+// with mu held.
+func (c *resumableConn) readExpired() bool {
+	return !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline)
+}
+
+func (c *resumableConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxChunkSize)]
+
+		c.mu.Lock()
+		for c.err == nil && !c.peerClosed && !c.finSent && len(c.unacked)+len(chunk) > resumeWindow {
+			c.cond.Wait()
+		}
+		switch {
+		case c.err != nil:
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		case c.peerClosed || c.finSent:
+			c.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		c.unacked = append(c.unacked, chunk...)
+		c.sent += uint64(len(chunk))
+		generation := c.generation
+		c.mu.Unlock()
+
+		// An attach in between already sent the chunk again
+		c.writeMu.Lock()
+		c.mu.Lock()
+		carrier := c.carrier
+		current := c.generation == generation
+		c.mu.Unlock()
+		if carrier != nil && current {
+			if err := writeFrame(carrier, chunkData, chunk); err != nil {
+				c.detach(generation, err)
+			}
+		}
+		c.writeMu.Unlock()
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite ends the stream towards the other end, which reads EOF once it
+// has everything sent before
+func (c *resumableConn) CloseWrite() error {
+	c.mu.Lock()
+	if c.err != nil || c.finSent {
+		c.mu.Unlock()
+		return nil
+	}
+	c.finSent = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	c.send(chunkFin, nil)
+	return nil
+}
+
+// Close ends the logical stream at both ends
+func (c *resumableConn) Close() error {
+	c.mu.Lock()
+	closed := c.err != nil
+	if !closed {
+		c.err = net.ErrClosed
+	}
+	peerClosed := c.peerClosed
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	if !peerClosed {
+		c.send(chunkClose, nil)
+	}
+	c.release()
+	return nil
+}
+
+// fail ends the stream without telling the other end, which is out of reach
+func (c *resumableConn) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if c.tm.config.Debug && err != net.ErrClosed {
+		log.Printf("Stream %s ended: %v", c.key, err)
+	}
+	c.release()
+}
+
+// release drops the carrier and forgets the stream
+func (c *resumableConn) release() {
+	c.stopWatch()
+
+	c.mu.Lock()
+	if c.carrier != nil {
+		c.carrier.Close()
+		c.carrier = nil
+	}
+	c.generation++
+	if c.orphaned {
+		c.orphaned = false
+		stats.Orphaned.Add(-1)
+	}
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.tm.resumes.mu.Lock()
+	if c.tm.resumes.streams[c.key] == c {
+		delete(c.tm.resumes.streams, c.key)
+	}
+	c.tm.resumes.mu.Unlock()
+}
+
+func (c *resumableConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *resumableConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (c *resumableConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline bounds reads, whatever carrier they wait on
+func (c *resumableConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if !t.IsZero() {
+		c.readTimer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+// SetWriteDeadline is not supported, writes only wait for the window
+func (c *resumableConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelays(t *testing.T) {
+	tm := newTunnelManager(&Config{ReconnectMin: 100 * time.Millisecond, ReconnectMax: time.Second})
+	defer tm.cancel()
+
+	retry := tm.newBackoff()
+	for _, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		if delay := retry.next(); delay < want/2 || delay > want {
+			t.Errorf("delay %s outside [%s, %s]", delay, want/2, want)
+		}
+	}
+
+	retry.reset()
+	if delay := retry.next(); delay > 100*time.Millisecond {
+		t.Errorf("delay %s after reset, want at most 100ms", delay)
+	}
+}
+
+// breakLinks closes every mux session of tm as if its links had dropped
+func breakLinks(tm *TunnelManager) {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	for _, tracked := range tm.sessions {
+		tracked.link.Close()
+	}
+}
+
+func TestStreamResumesAfterLinkLoss(t *testing.T) {
+	_, client := startTunnel(t,
+		&Config{Protocol: "tcpmux", Target: startEchoServer(t), ResumeGrace: time.Minute},
+		&Config{MuxStreams: 1, ReconnectMin: 50 * time.Millisecond, ReconnectMax: 200 * time.Millisecond})
+	local := client.config.Local
+	reconnects, resumed := stats.Reconnects.Load(), stats.Resumed.Load()
+
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, "hello\n")
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("read %q, %v before the link dropped", line, err)
+	}
+
+	// The link drops while lines are on their way in both directions
+	padding := bytes.Repeat([]byte("x"), 100)
+	for round := 0; round < 3; round++ {
+		go func(round int) {
+			for i := 0; i < 500; i++ {
+				fmt.Fprintf(conn, "line %d.%d %s\n", round, i, padding)
+				if i == 250 {
+					breakLinks(client)
+				}
+			}
+		}(round)
+
+		for i := 0; i < 500; i++ {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read %d.%d failed: %v", round, i, err)
+			}
+			if want := fmt.Sprintf("line %d.%d %s\n", round, i, padding); line != want {
+				t.Fatalf("read %q, want %q", line, want)
+			}
+		}
+	}
+
+	if got := stats.Reconnects.Load() - reconnects; got < 3 {
+		t.Errorf("counted %d reconnects, want at least 3", got)
+	}
+	if got := stats.Resumed.Load() - resumed; got < 3 {
+		t.Errorf("counted %d resumed streams, want at least 3", got)
+	}
+}
+
+func TestOrphanedStreamExpires(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received, targetClosed := make(chan struct{}, 1), make(chan struct{}, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if line, _ := bufio.NewReader(conn).ReadString('\n'); line == "hello\n" {
+					received <- struct{}{}
+					io.Copy(io.Discard, conn)
+				}
+				conn.Close()
+				targetClosed <- struct{}{}
+			}()
+		}
+	}()
+
+	server, client := startTunnel(t,
+		&Config{Protocol: "tcpmux", Target: l.Addr().String(), ResumeGrace: 300 * time.Millisecond},
+		&Config{MuxStreams: 1, ReconnectMin: 50 * time.Millisecond, ReconnectMax: 200 * time.Millisecond})
+	local := client.config.Local
+
+	// The probe dialed by startTunnel ends first
+	select {
+	case <-targetClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe connection was not closed")
+	}
+
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	io.WriteString(conn, "hello\n")
+
+	// Take the client away once the stream reached the target, its links
+	// first so the connections it closes on shutdown never reach the server
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never reached the target")
+	}
+	breakLinks(client)
+	client.cancel()
+
+	select {
+	case <-targetClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target connection outlived the resume grace")
+	}
+
+	server.resumes.mu.Lock()
+	defer server.resumes.mu.Unlock()
+	if len(server.resumes.streams) != 0 {
+		t.Fatalf("server still holds %d streams", len(server.resumes.streams))
+	}
+}
+
+func TestParseFlagsRejectsReconnectDelays(t *testing.T) {
+	for _, args := range [][]string{
+		{"-reconnect-min", "0s"},
+		{"-reconnect-min", "10s", "-reconnect-max", "5s"},
+		{"-resume-grace", "0s"},
+	} {
+		if _, err := parseFlags(append(args, "-token", "test-token-0123456789")); err == nil {
+			t.Errorf("parseFlags(%v) succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import "syscall"
+
+// reusePortAvailable reports whether -reuse-port works on this platform
+const reusePortAvailable = false
+
+// reusePort is not available on this platform
+func reusePort(network, address string, conn syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// startReverseServer accepts tunnel clients on the bind address and carries
+// public connections from the listen address back to them
+func (tm *TunnelManager) startReverseServer() error {
+	log.Printf("Starting reverse %s server: tunnel on %s", tm.config.Protocol, tm.config.Bind)
+
+	spec, err := tm.protocolSpec()
+	if err != nil {
+		return err
+	}
+	if !spec.mux && tm.config.Protocol != "tcp" {
+		return fmt.Errorf("reverse mode requires a multiplexed protocol, got %s", tm.config.Protocol)
+	}
+
+	tunnelListener, err := transports[spec.transport].Listen(tm, tm.config.Bind)
+	if err != nil {
+		return fmt.Errorf("failed to listen on tunnel address: %w", err)
+	}
+
+	go func() {
+		if err := tm.acceptLinks(tunnelListener, tm.serveTunnelClient); err != nil {
+			log.Printf("Tunnel server failed: %v", err)
+			tm.cancel()
+		}
+	}()
+
+	forwards := serverForwards(tm.config)
+	tm.setRoutes(forwards)
+
+	return tm.serveForwards(forwards, func(fwd PortForward) error {
+		if tm.forwardsUDP() {
+			return tm.startReverseUDPPublic(fwd)
+		}
+		return tm.startReversePublic(fwd)
+	})
+}
+
+// startReversePublic carries public TCP connections back to tunnel clients
+func (tm *TunnelManager) startReversePublic(fwd PortForward) error {
+	publicListener, err := tm.listenTCP(fwd.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on public address: %w", err)
+	}
+
+	// Unblock the Accept loop once the tunnel drains
+	defer tm.closeOnDrain(publicListener)()
+
+	log.Printf("Reverse tunnel listening on %s, public on %s", tm.config.Bind, fwd.Listen)
+
+	for {
+		conn, err := publicListener.Accept()
+		if err != nil {
+			if tm.draining() {
+				return nil
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+
+		tm.wg.Add(1)
+		go tm.handlePublicConnection(conn, tm.target(fwd))
+	}
+}
+
+// startReverseUDPPublic carries public UDP flows back to tunnel clients
+func (tm *TunnelManager) startReverseUDPPublic(fwd PortForward) error {
+	addr, err := net.ResolveUDPAddr("udp", fwd.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+
+	conn, err := tm.listenUDP(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen UDP: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-tm.ctx.Done()
+		conn.Close()
+	}()
+
+	log.Printf("Reverse tunnel listening on %s, public UDP on %s", tm.config.Bind, fwd.Listen)
+	return tm.serveUDPFlows(conn, fwd, func(target string) (net.Conn, error) {
+		return tm.openReverseStream(target, nil)
+	})
+}
+
+// serveTunnelClient authenticates a client link and registers its session
+// until the link drops
+func (tm *TunnelManager) serveTunnelClient(conn net.Conn) {
+	hello, err := serverHandshake(conn, tm.config.Token, tm.acceptFlags())
+	if err != nil {
+		log.Printf("Tunnel client %s rejected: %v", conn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		return
+	}
+	compressed, err := compressLink(conn, hello.Accepted)
+	if err != nil {
+		log.Printf("Tunnel client %s dropped: %v", conn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		return
+	}
+	conn = compressed
+
+	tm.tuneLink(conn)
+
+	link := &meteredConn{Conn: conn}
+	session, err := yamux.Server(link, tm.muxConfig())
+	if err != nil {
+		log.Printf("Failed to create yamux session: %v", err)
+		stats.Errors.Add(1)
+		return
+	}
+	defer session.Close()
+
+	tracked := tm.trackSession(conn.RemoteAddr().String(), session, link, hello.Accepted)
+	defer tm.untrackSession(tracked)
+
+	log.Printf("Tunnel client connected: %s", conn.RemoteAddr())
+
+	select {
+	case <-session.CloseChan():
+	case <-tm.ctx.Done():
+	}
+
+	log.Printf("Tunnel client disconnected: %s", conn.RemoteAddr())
+}
+
+func (tm *TunnelManager) handlePublicConnection(conn net.Conn, target string) {
+	defer tm.wg.Done()
+	defer conn.Close()
+
+	if tm.config.Debug {
+		log.Printf("New public connection from %s", conn.RemoteAddr())
+	}
+
+	c, err := tm.openConnection("public", conn.RemoteAddr().String(), target, "")
+	if err != nil {
+		return
+	}
+	defer tm.closeConnection(c)
+
+	stream, err := tm.openReverseStream(target, originOf(conn))
+	if err != nil {
+		log.Printf("Dropping %s: %v", conn.RemoteAddr(), err)
+		stats.Errors.Add(1)
+		c.fail(err.Error())
+		return
+	}
+	defer stream.Close()
+
+	tm.handleDirectConnection(conn, stream, c)
+}
+
+// openReverseStream opens a stream to the least loaded tunnel client and
+// tells it which target to dial, empty meaning its own -target, and where a
+// TCP connection came from. UDP flows pass a nil origin.
+func (tm *TunnelManager) openReverseStream(target string, origin *connOrigin) (net.Conn, error) {
+	tracked := tm.pickSession()
+	if tracked == nil {
+		return nil, fmt.Errorf("no tunnel client connected")
+	}
+
+	stream, err := tracked.session.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tunnel stream: %w", err)
+	}
+
+	if err := writeFrame(stream, frameTarget, []byte(target)); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("failed to send stream target: %w", err)
+	}
+	if origin != nil && tracked.flags&flagOrigin != 0 {
+		if err := writeOrigin(stream, origin); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return tm.wrapStream(stream), nil
+}
+
+// readStreamTarget reads the target the reverse server sent for a stream
+func (tm *TunnelManager) readStreamTarget(stream net.Conn) (string, error) {
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	frameType, payload, err := readFrame(stream)
+	if err != nil {
+		return "", fmt.Errorf("failed to read stream target: %w", err)
+	}
+	if frameType != frameTarget {
+		return "", fmt.Errorf("unexpected stream frame 0x%02x", frameType)
+	}
+	if len(payload) == 0 {
+		return tm.defaultTarget(), nil
+	}
+	return string(payload), nil
+}
+
+// pickSession returns the live tunnel client session carrying the fewest streams
+func (tm *TunnelManager) pickSession() *trackedSession {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+
+	var best *trackedSession
+	for _, tracked := range tm.sessions {
+		if tracked.session.IsClosed() {
+			continue
+		}
+		if best == nil || tracked.session.NumStreams() < best.session.NumStreams() {
+			best = tracked
+		}
+	}
+	return best
+}
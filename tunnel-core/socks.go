@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Local proxies of dynamic clients
+//
+// A dynamic client answers SOCKS5 (RFC 1928) without authentication, with
+// CONNECT and UDP ASSOCIATE, and HTTP CONNECT on the same local addresses.
+// Fragmented SOCKS5 datagrams are dropped, and a UDP association only
+// relays datagrams from the address that asked for it. See dynamic.go for
+// how destinations reach the server.
+
+const (
+	socksVersion       byte = 0x05
+	socksNoAuth        byte = 0x00
+	socksNoAcceptable  byte = 0xff
+	socksConnect       byte = 0x01
+	socksUDPAssociate  byte = 0x03
+	socksAddrIPv4      byte = 0x01
+	socksAddrDomain    byte = 0x03
+	socksAddrIPv6      byte = 0x04
+	socksUDPHeaderSize      = 3 // Reserved (2) and fragment (1) before the address
+
+	// Reply codes, also the status of dial result frames
+	socksSucceeded           byte = 0x00
+	socksGeneralFailure      byte = 0x01
+	socksNotAllowed          byte = 0x02
+	socksNetworkUnreachable  byte = 0x03
+	socksHostUnreachable     byte = 0x04
+	socksConnectionRefused   byte = 0x05
+	socksCommandNotSupported byte = 0x07
+	socksAddressNotSupported byte = 0x08
+)
+
+// openDestination opens a stream to the server, or a link of its own when
+// the tunnel is not multiplexed, and has the server dial dest over it
+func (tm *TunnelManager) openDestination(server string, pool *muxPool, dest destination) (net.Conn, error) {
+	var conn net.Conn
+	var flags byte
+	if pool != nil {
+		tracked, err := pool.nextSession()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := tracked.session.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream: %w", err)
+		}
+		conn, flags = tm.wrapStream(stream), tracked.flags
+	} else {
+		link, err := tm.dialLink(server)
+		if err != nil {
+			return nil, err
+		}
+		compressed, accepted, err := tm.clientLinkHandshake(link, flagDynamic)
+		if err != nil {
+			link.Close()
+			return nil, err
+		}
+		conn, flags = compressed, accepted
+	}
+
+	if flags&flagDynamic == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("server does not support dynamic forwarding")
+	}
+	if err := writeDestination(conn, dest); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readDialResult(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// handleProxyConnection serves one local proxy client, SOCKS5 or HTTP
+// CONNECT, through the server
+func (tm *TunnelManager) handleProxyConnection(conn net.Conn, server string, pool *muxPool) {
+	defer tm.wg.Done()
+	defer conn.Close()
+
+	// Requests must arrive quickly, the deadline is lifted once relaying starts
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	client := &replayConn{Conn: conn, r: reader}
+
+	if first[0] == socksVersion {
+		err = tm.serveSOCKS(client, server, pool)
+	} else {
+		err = tm.serveHTTPConnect(client, reader, server, pool)
+	}
+	if err != nil && tm.config.Debug {
+		log.Printf("Proxy client %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// relayDestination carries a local proxy client's connection to dest once
+// reply has told it whether the server reached it
+func (tm *TunnelManager) relayDestination(client net.Conn, kind string, dest destination, server string, pool *muxPool, reply func(error) error) error {
+	c, err := tm.openConnection(kind, client.RemoteAddr().String(), dest.address, "")
+	if err != nil {
+		reply(err)
+		return err
+	}
+	defer tm.closeConnection(c)
+
+	stream, err := tm.openDestination(server, pool, dest)
+	if err != nil {
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to reach destination: %v", err))
+		reply(err)
+		return err
+	}
+	defer stream.Close()
+
+	if err := reply(nil); err != nil {
+		return err
+	}
+	client.SetReadDeadline(time.Time{})
+	tm.handleDirectConnection(client, stream, c)
+	return nil
+}
+
+// replyCode returns the SOCKS5 reply code for a destination the client
+// could not reach
+func replyCode(err error) byte {
+	var dialErr *dialError
+	if errors.As(err, &dialErr) {
+		return dialErr.code
+	}
+	return socksGeneralFailure
+}
+
+// serveSOCKS negotiates a SOCKS5 request and carries it out
+func (tm *TunnelManager) serveSOCKS(client net.Conn, server string, pool *muxPool) error {
+	// Greeting: version | method count | methods
+	var greeting [2]byte
+	if _, err := io.ReadFull(client, greeting[:]); err != nil {
+		return fmt.Errorf("failed to read SOCKS greeting: %w", err)
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(client, methods); err != nil {
+		return fmt.Errorf("failed to read SOCKS methods: %w", err)
+	}
+	if bytes.IndexByte(methods, socksNoAuth) < 0 {
+		client.Write([]byte{socksVersion, socksNoAcceptable})
+		return fmt.Errorf("SOCKS client requires authentication")
+	}
+	if _, err := client.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return err
+	}
+
+	// Request: version | command | reserved | address
+	var request [3]byte
+	if _, err := io.ReadFull(client, request[:]); err != nil {
+		return fmt.Errorf("failed to read SOCKS request: %w", err)
+	}
+	if request[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	address, err := readSOCKSAddr(client)
+	if err != nil {
+		writeSOCKSReply(client, socksAddressNotSupported, "")
+		return err
+	}
+
+	switch request[1] {
+	case socksConnect:
+		return tm.relayDestination(client, "socks", destination{network: "tcp", address: address}, server, pool, func(err error) error {
+			if err != nil {
+				return writeSOCKSReply(client, replyCode(err), "")
+			}
+			return writeSOCKSReply(client, socksSucceeded, "")
+		})
+	case socksUDPAssociate:
+		return tm.serveSOCKSAssociate(client, server, pool)
+	default:
+		writeSOCKSReply(client, socksCommandNotSupported, "")
+		return fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+}
+
+// serveSOCKSAssociate relays the datagrams of a UDP association until its
+// TCP connection closes. Each destination gets a flow of its own.
+func (tm *TunnelManager) serveSOCKSAssociate(client net.Conn, server string, pool *muxPool) error {
+	local, _ := client.LocalAddr().(*net.TCPAddr)
+	peerAddr, _ := client.RemoteAddr().(*net.TCPAddr)
+	if local == nil || peerAddr == nil {
+		writeSOCKSReply(client, socksGeneralFailure, "")
+		return fmt.Errorf("UDP associations need a TCP client")
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		writeSOCKSReply(client, socksGeneralFailure, "")
+		return fmt.Errorf("failed to listen UDP: %w", err)
+	}
+	defer relay.Close()
+
+	if err := writeSOCKSReply(client, socksSucceeded, relay.LocalAddr().String()); err != nil {
+		return err
+	}
+
+	// The association lasts as long as its TCP connection
+	client.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		io.Copy(io.Discard, client)
+		relay.Close()
+	}()
+	go func() {
+		select {
+		case <-tm.ctx.Done():
+			relay.Close()
+		case <-done:
+		}
+	}()
+
+	pooled := datagramBuffers.get()
+	defer datagramBuffers.put(pooled)
+	buffer := *pooled
+	flows := make(map[string]*udpFlow)
+	var mu sync.Mutex
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+	}()
+
+	for {
+		n, peer, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			return nil
+		}
+		if !peer.IP.Equal(peerAddr.IP) || n < socksUDPHeaderSize || buffer[2] != 0 {
+			stats.Dropped.Add(1)
+			continue
+		}
+
+		datagram := bytes.NewReader(buffer[socksUDPHeaderSize:n])
+		address, err := readSOCKSAddr(datagram)
+		if err != nil {
+			stats.Dropped.Add(1)
+			continue
+		}
+		payload := buffer[n-datagram.Len() : n]
+
+		flowKey := peer.String() + " " + address
+		mu.Lock()
+		flow, exists := flows[flowKey]
+		mu.Unlock()
+
+		if !exists {
+			record, err := tm.openConnection("socks-udp", peer.String(), address, "")
+			if err != nil {
+				continue
+			}
+
+			stream, err := tm.openDestination(server, pool, destination{network: "udp", address: address})
+			if err != nil {
+				if tm.config.Debug {
+					log.Printf("Failed to open UDP flow to %s: %v", address, err)
+				}
+				stats.Errors.Add(1)
+				record.fail(fmt.Sprintf("failed to reach destination: %v", err))
+				tm.closeConnection(record)
+				continue
+			}
+
+			flow = newUDPFlow(stream, tm.udpIdleTimeout(), record)
+			mu.Lock()
+			flows[flowKey] = flow
+			mu.Unlock()
+
+			tm.wg.Add(1)
+			go func(flow *udpFlow, peer *net.UDPAddr, flowKey, address string) {
+				defer tm.wg.Done()
+				defer tm.closeConnection(flow.record)
+				defer func() {
+					mu.Lock()
+					if flows[flowKey] == flow {
+						delete(flows, flowKey)
+					}
+					mu.Unlock()
+					flow.Close()
+				}()
+				tm.relaySOCKSReplies(relay, flow, peer, address)
+			}(flow, peer, flowKey, address)
+		}
+
+		flow.touch()
+		if !flow.record.admitIn(len(payload)) {
+			continue
+		}
+		if err := writeDatagram(flow.conn, payload); err != nil {
+			flow.record.fail(fmt.Sprintf("failed to write flow: %v", err))
+			mu.Lock()
+			delete(flows, flowKey)
+			mu.Unlock()
+			flow.Close()
+		}
+	}
+}
+
+// relaySOCKSReplies returns the datagrams of a flow to the SOCKS client,
+// headed with the destination they come from
+func (tm *TunnelManager) relaySOCKSReplies(relay *net.UDPConn, flow *udpFlow, peer *net.UDPAddr, address string) {
+	header, err := appendSOCKSAddr(make([]byte, socksUDPHeaderSize), address)
+	if err != nil {
+		return
+	}
+	// Datagrams are read in behind the header
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+	reply := append((*buffer)[:0], header...)
+
+	for {
+		n, err := readDatagram(flow.conn, reply[len(header):cap(reply)])
+		if err != nil {
+			return
+		}
+		flow.touch()
+		if !flow.record.admitOut(n) {
+			continue
+		}
+		if _, err := relay.WriteToUDP(reply[:len(header)+n], peer); err != nil {
+			return
+		}
+	}
+}
+
+// serveHTTPConnect answers an HTTP CONNECT request and relays the
+// connection it opens
+func (tm *TunnelManager) serveHTTPConnect(client net.Conn, reader *bufio.Reader, server string, pool *muxPool) error {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy request: %w", err)
+	}
+	if req.Method != http.MethodConnect {
+		writeProxyStatus(client, http.StatusMethodNotAllowed)
+		return fmt.Errorf("unsupported proxy method %s", req.Method)
+	}
+	if _, _, err := splitDestination(req.Host); err != nil {
+		writeProxyStatus(client, http.StatusBadRequest)
+		return err
+	}
+
+	return tm.relayDestination(client, "connect", destination{network: "tcp", address: req.Host}, server, pool, func(err error) error {
+		switch {
+		case err == nil:
+			return writeProxyStatus(client, http.StatusOK)
+		case replyCode(err) == socksNotAllowed:
+			return writeProxyStatus(client, http.StatusForbidden)
+		default:
+			return writeProxyStatus(client, http.StatusBadGateway)
+		}
+	})
+}
+
+// writeProxyStatus writes the response to a CONNECT request. Failures close
+// the connection.
+func writeProxyStatus(w io.Writer, status int) error {
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	if status != http.StatusOK {
+		response += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	_, err := io.WriteString(w, response+"\r\n")
+	return err
+}
+
+// readSOCKSAddr reads a SOCKS5 address and port as host:port
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var kind [1]byte
+	if _, err := io.ReadFull(r, kind[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch kind[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if kind[0] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", kind[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// appendSOCKSAddr appends host:port to b as a SOCKS5 address
+func appendSOCKSAddr(b []byte, address string) ([]byte, error) {
+	host, portSpec, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q is too long", host)
+		}
+		b = append(b, socksAddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// writeSOCKSReply answers a SOCKS5 request, naming the bound address if any
+func writeSOCKSReply(w io.Writer, code byte, bound string) error {
+	if bound == "" {
+		bound = "0.0.0.0:0"
+	}
+	reply, err := appendSOCKSAddr([]byte{socksVersion, code, 0}, bound)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(reply)
+	return err
+}
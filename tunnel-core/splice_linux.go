@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceAvailable reports whether copyConn may splice TCP connections
+const spliceAvailable = true
+
+// spliceConn moves src to dst through a pipe with splice(2), counting every
+// splice out of src as it returns, until src ends
+func spliceConn(dst, src *net.TCPConn, count func(int64)) error {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return err
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var pipe [2]int
+	if err := unix.Pipe2(pipe[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return os.NewSyscallError("pipe2", err)
+	}
+	defer unix.Close(pipe[0])
+	defer unix.Close(pipe[1])
+
+	for {
+		n, err := splice(srcRaw.Read, pipe[1], spliceChunk, true)
+		if err != nil {
+			return err
+		}
+		// Nothing moved means src ended
+		if n == 0 {
+			return nil
+		}
+		count(int64(n))
+
+		// The pipe is emptied every time, so the next splice into it always
+		// has room
+		for pending := n; pending > 0; {
+			moved, err := splice(dstRaw.Write, pipe[0], pending, false)
+			if err != nil {
+				return err
+			}
+			if moved == 0 {
+				return io.ErrShortWrite
+			}
+			pending -= moved
+		}
+	}
+}
+
+// splice moves up to size bytes between the socket wait runs its callback
+// with and a pipe end, from the socket when in is set and to it otherwise,
+// waiting for the socket while it is not ready
+func splice(wait func(func(fd uintptr) bool) error, pipe, size int, in bool) (int, error) {
+	var n int
+	var serr error
+	err := wait(func(fd uintptr) bool {
+		for {
+			if in {
+				n, serr = spliceFDs(int(fd), pipe, size)
+			} else {
+				n, serr = spliceFDs(pipe, int(fd), size)
+			}
+			if serr != syscall.EINTR {
+				return serr != syscall.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return n, nil
+}
+
+func spliceFDs(from, to, size int) (int, error) {
+	n, err := unix.Splice(from, nil, to, nil, size, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+	return int(n), err
+}
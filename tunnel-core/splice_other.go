@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// spliceAvailable reports whether copyConn may splice TCP connections
+const spliceAvailable = false
+
+// spliceConn is never called where splice(2) is missing
+func spliceConn(dst, src *net.TCPConn, count func(int64)) error {
+	return errors.New("splice is not available on this platform")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keepalives and timeouts
+//
+// Every TCP connection the tunnel dials or accepts sends TCP keepalive probes
+// every -tcp-keepalive, so a link or target that vanishes without a FIN or
+// RST fails the copies waiting on it instead of pinning them. On top of
+// that, links send heartbeats every -mux-heartbeat seconds: mux links ping
+// through yamux and close when a ping goes unanswered, WebSocket links send
+// WebSocket pings and close after missedPongs of them go unanswered, which
+// also keeps proxies in between from dropping quiet links.
+//
+// -connect-timeout bounds connecting to servers and targets. A forwarded
+// connection that carries no data either way for -read-timeout is closed,
+// and so is one open for longer than -max-lifetime, both are off at 0.
+//
+// When one side of a forwarded connection ends, the end is passed on with
+// CloseWrite and the other direction keeps flowing until it ends too, so
+// protocols that half-close, like rsync, finish. Raw WebSocket links carry
+// the end as a close frame the other side reads as EOF while it can still
+// send.
+
+const (
+	defaultTCPKeepAlive   = 30 * time.Second
+	defaultConnectTimeout = 10 * time.Second
+
+	// missedPongs is how many heartbeats a WebSocket link may leave
+	// unanswered before it is considered dead
+	missedPongs = 3
+)
+
+// tcpKeepAlive returns the keepalive period for net.Dialer and
+// net.ListenConfig, negative when keepalives are off
+func (tm *TunnelManager) tcpKeepAlive() time.Duration {
+	if tm.config.TCPKeepAlive > 0 {
+		return tm.config.TCPKeepAlive
+	}
+	return -1
+}
+
+// connectTimeout returns how long connecting to a server or target may take
+func (tm *TunnelManager) connectTimeout() time.Duration {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	if tm.config.ConnectTimeout > 0 {
+		return tm.config.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// connTimeouts returns the read timeout and lifetime of new connections,
+// 0 for none
+func (tm *TunnelManager) connTimeouts() (time.Duration, time.Duration) {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+	return tm.config.ReadTimeout, tm.config.MaxLifetime
+}
+
+// heartbeat returns the interval of link heartbeats, 0 when they are off
+func (tm *TunnelManager) heartbeat() time.Duration {
+	return time.Duration(tm.config.MuxHeartbeat) * time.Second
+}
+
+// dialer returns a dialer with the tunnel's connect timeout and keepalives
+func (tm *TunnelManager) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: tm.connectTimeout(), KeepAlive: tm.tcpKeepAlive()}
+}
+
+// enforceTimeouts calls end once c stays idle past the read timeout or
+// outlives its lifetime. The returned function stops watching.
+func (tm *TunnelManager) enforceTimeouts(c *connection, end func()) func() {
+	readTimeout, lifetime := tm.connTimeouts()
+	if readTimeout <= 0 && lifetime <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			now := time.Now()
+			wait := time.Duration(1<<63 - 1)
+			if lifetime > 0 {
+				left := lifetime - now.Sub(c.started)
+				if left <= 0 {
+					c.fail("lifetime exceeded")
+					end()
+					return
+				}
+				wait = left
+			}
+			if readTimeout > 0 {
+				left := readTimeout - now.Sub(c.lastActive())
+				if left <= 0 {
+					c.fail("read timeout")
+					end()
+					return
+				}
+				wait = min(wait, left)
+			}
+			timer.Reset(wait)
+		}
+	}()
+	return func() { close(done) }
+}
+
+// keepWebSocketAlive starts the heartbeat of a WebSocket link
+func (tm *TunnelManager) keepWebSocketAlive(c *wsConn) {
+	if interval := tm.heartbeat(); interval > 0 {
+		go c.heartbeat(interval, tm.config.Debug)
+	}
+}
+
+// heartbeat pings the other end every interval until the link closes, and
+// closes it once missedPongs pings went unanswered. Pongs are only seen
+// while the link is read, which the copies and mux sessions of links do.
+func (c *wsConn) heartbeat(interval time.Duration, debug bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		// The other end answers nothing after its close frame
+		if c.closeReceived.Load() {
+			return
+		}
+		if now.Sub(time.Unix(0, c.lastPong.Load())) > missedPongs*interval {
+			if debug {
+				log.Printf("WebSocket link to %s stopped answering pings", c.RemoteAddr())
+			}
+			c.Close()
+			return
+		}
+		// Fails once the link is closed or has sent its close frame
+		if err := c.ws.WriteControl(websocket.PingMessage, nil, now.Add(interval)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startCountingServer starts a TCP server that reads until EOF and then
+// answers with the number of bytes it read
+func startCountingServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start counting server: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				n, _ := io.Copy(io.Discard, conn)
+				fmt.Fprintf(conn, "read %d\n", n)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestHalfCloseFinishes(t *testing.T) {
+	for _, protocol := range []string{"tcp", "ws", "tcpmux", "wsmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			_, client := startTunnel(t, &Config{Protocol: protocol, Target: startCountingServer(t)}, &Config{MuxStreams: 1})
+			local := client.config.Local
+
+			conn := dialEventually(t, local)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			payload := bytes.Repeat([]byte("x"), 256*1024)
+			if _, err := conn.Write(payload); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+
+			// The answer only comes after the target read EOF
+			reply, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			if want := fmt.Sprintf("read %d\n", len(payload)); string(reply) != want {
+				t.Fatalf("got %q, want %q", reply, want)
+			}
+		})
+	}
+}
+
+// expectClosedFor waits for the server to close a connection for reason
+func expectClosedFor(t *testing.T, server *TunnelManager, reason string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, closed := server.connections()
+		for _, info := range closed {
+			if info.CloseReason == reason {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connection closed for %q: %+v", reason, closed)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReadTimeoutClosesIdleConnections(t *testing.T) {
+	server, client := startTunnel(t, &Config{
+		Protocol:    "tcp",
+		Target:      startEchoServer(t),
+		ReadTimeout: 300 * time.Millisecond,
+	}, &Config{MuxStreams: 1})
+	local := client.config.Local
+
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Traffic keeps the connection open past the timeout
+	buffer := make([]byte, 5)
+	for i := 0; i < 5; i++ {
+		io.WriteString(conn, "ping\n")
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			t.Fatalf("echo %d failed: %v", i, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := conn.Read(buffer); err != io.EOF {
+		t.Fatalf("idle connection read %v, want EOF", err)
+	}
+	expectClosedFor(t, server, "read timeout")
+}
+
+func TestMaxLifetimeClosesBusyConnections(t *testing.T) {
+	server, client := startTunnel(t, &Config{
+		Protocol:    "tcpmux",
+		Target:      startEchoServer(t),
+		MaxLifetime: 300 * time.Millisecond,
+	}, &Config{MuxStreams: 1})
+	local := client.config.Local
+
+	conn := dialEventually(t, local)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, 5)
+	for {
+		io.WriteString(conn, "ping\n")
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	expectClosedFor(t, server, "lifetime exceeded")
+}
+
+func TestWebSocketHeartbeat(t *testing.T) {
+	links := make(chan *wsConn)
+	upgrader := websocket.Upgrader{}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		link := newWSConn(ws)
+		go link.heartbeat(50*time.Millisecond, false)
+		links <- link
+	}))
+	defer httpServer.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+
+	for _, answering := range []bool{true, false} {
+		peer, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		link := <-links
+
+		// Reading answers pings with pongs
+		if answering {
+			go io.Copy(io.Discard, newWSConn(peer))
+		}
+
+		ended := make(chan error, 1)
+		go func() {
+			_, err := link.Read(make([]byte, 1))
+			ended <- err
+		}()
+		select {
+		case err := <-ended:
+			if answering {
+				t.Fatalf("answered link ended: %v", err)
+			}
+		case <-time.After(time.Second):
+			if !answering {
+				t.Fatal("unanswered link stayed open")
+			}
+		}
+		link.Close()
+	}
+}
+
+func TestParseFlagsRejectsTimeouts(t *testing.T) {
+	for _, args := range [][]string{
+		{"-connect-timeout", "0s"},
+		{"-read-timeout", "-1s"},
+		{"-max-lifetime", "-1s"},
+		{"-tcp-keepalive", "-1s"},
+	} {
+		if _, err := parseFlags(append(args, "-token", "test-token-0123456789")); err == nil {
+			t.Errorf("parseFlags(%v) succeeded", args)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLS
+//
+// wss and wssmux always run over TLS, -tls adds it to the links of tcp, ws,
+// h2, grpc and the other mux protocols. quic and uquic always run over TLS 1.3, see
+// quic.go. The udp protocol seals its datagrams instead and cannot use TLS.
+//
+// Servers present -cert/-key, or the -sni certificate whose name matches the
+// name the client asked for. Names may start with a "*." wildcard:
+//
+//	-sni tunnel.example.com=/etc/stunnel/tunnel.pem,/etc/stunnel/tunnel.key
+//
+// With -ca a server only accepts clients presenting a certificate signed by
+// that CA, and a client only trusts servers signed by it instead of the
+// system roots. Clients send -cert/-key as their certificate when given.
+//
+// -tls-min-version and -tls-max-version take 1.0 to 1.3. -tls-ciphers is a
+// comma separated list of Go cipher suite names such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; it applies up to TLS 1.2 since
+// TLS 1.3 suites are not configurable.
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// sniCert is a certificate served for one server name
+type sniCert struct {
+	Name     string
+	CertFile string
+	KeyFile  string
+}
+
+// sniList collects repeated -sni flags
+type sniList []sniCert
+
+func (l *sniList) String() string {
+	specs := make([]string, len(*l))
+	for i, c := range *l {
+		specs[i] = fmt.Sprintf("%s=%s,%s", c.Name, c.CertFile, c.KeyFile)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (l *sniList) Set(spec string) error {
+	name, files, ok := strings.Cut(spec, "=")
+	certFile, keyFile, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || name == "" || certFile == "" || keyFile == "" {
+		return fmt.Errorf("invalid SNI certificate %q, want name=cert,key", spec)
+	}
+	*l = append(*l, sniCert{Name: strings.ToLower(name), CertFile: certFile, KeyFile: keyFile})
+	return nil
+}
+
+// useTLS reports whether the tunnel's links run over TLS
+func (tm *TunnelManager) useTLS() bool {
+	return protocols[tm.config.Protocol].tls || tm.config.TLS
+}
+
+// baseTLSConfig applies the version and cipher settings shared by both sides
+func (tm *TunnelManager) baseTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tm.config.TLSMinVersion != "" {
+		version, ok := tlsVersions[tm.config.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", tm.config.TLSMinVersion)
+		}
+		cfg.MinVersion = version
+	}
+	if tm.config.TLSMaxVersion != "" {
+		version, ok := tlsVersions[tm.config.TLSMaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version: %s", tm.config.TLSMaxVersion)
+		}
+		cfg.MaxVersion = version
+	}
+	if cfg.MaxVersion != 0 && cfg.MaxVersion < cfg.MinVersion {
+		return nil, fmt.Errorf("TLS max version %s is below min version", tm.config.TLSMaxVersion)
+	}
+
+	if tm.config.TLSCiphers != "" {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(tm.config.TLSCiphers, ",") {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported or insecure cipher suite: %s", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadCA reads the -ca certificate pool
+func (tm *TunnelManager) loadCA() (*x509.CertPool, error) {
+	pem, err := os.ReadFile(tm.config.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", tm.config.CAFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig builds the TLS configuration servers accept links with
+func (tm *TunnelManager) serverTLSConfig() (*tls.Config, error) {
+	cfg, err := tm.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.loadCertificates(tm.config); err != nil {
+		return nil, err
+	}
+
+	// Certificates are looked up per handshake so a reload can replace them
+	cfg.GetCertificate = tm.getCertificate
+
+	if tm.config.CAFile != "" {
+		pool, err := tm.loadCA()
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// clientTLSConfig builds the TLS configuration clients dial server with
+func (tm *TunnelManager) clientTLSConfig(server string) (*tls.Config, error) {
+	cfg, err := tm.baseTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ServerName = tm.config.ServerName
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		cfg.ServerName = host
+	}
+	cfg.InsecureSkipVerify = tm.config.InsecureSkipVerify
+
+	if tm.config.CAFile != "" {
+		pool, err := tm.loadCA()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if tm.config.CertFile != "" && tm.config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tm.config.CertFile, tm.config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// listenLink listens for links on addr, over TLS when the tunnel uses it,
+// offering nextProtos in ALPN
+func (tm *TunnelManager) listenLink(addr string, nextProtos ...string) (net.Listener, error) {
+	listener, err := tm.listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !tm.useTLS() {
+		return listener, nil
+	}
+
+	cfg, err := tm.serverTLSConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	cfg.NextProtos = nextProtos
+	return tls.NewListener(listener, cfg), nil
+}
+
+// loadCertificates loads the default and SNI certificates servers present
+func (tm *TunnelManager) loadCertificates(config *Config) error {
+	if (config.CertFile == "" || config.KeyFile == "") && len(config.SNICerts) == 0 {
+		return fmt.Errorf("SSL certificate and key files are required for TLS")
+	}
+
+	var cert *tls.Certificate
+	if config.CertFile != "" && config.KeyFile != "" {
+		loaded, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load SSL certificate: %w", err)
+		}
+		cert = &loaded
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	for _, sni := range config.SNICerts {
+		loaded, err := tls.LoadX509KeyPair(sni.CertFile, sni.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load SSL certificate for %s: %w", sni.Name, err)
+		}
+		byName[sni.Name] = &loaded
+	}
+
+	tm.liveMu.Lock()
+	tm.cert = cert
+	tm.sniCerts = byName
+	tm.liveMu.Unlock()
+	return nil
+}
+
+// getCertificate hands TLS handshakes the certificate for the requested
+// server name, falling back to the default one
+func (tm *TunnelManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	name := strings.ToLower(hello.ServerName)
+	if cert, ok := tm.sniCerts[name]; ok {
+		return cert, nil
+	}
+	if _, domain, ok := strings.Cut(name, "."); ok {
+		if cert, ok := tm.sniCerts["*."+domain]; ok {
+			return cert, nil
+		}
+	}
+	if tm.cert == nil {
+		return nil, fmt.Errorf("no certificate for server name %q", hello.ServerName)
+	}
+	return tm.cert, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a throwaway CA with server and client certificates in files
+type testPKI struct {
+	caFile     string
+	serverCert string
+	serverKey  string
+	altCert    string
+	altKey     string
+	clientCert string
+	clientKey  string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	serial := int64(1)
+	issue := func(name string, usage x509.ExtKeyUsage, dnsNames []string) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			DNSNames:     dnsNames,
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return write(name+".pem", "CERTIFICATE", der), write(name+".key", "EC PRIVATE KEY", keyDER)
+	}
+
+	pki := &testPKI{caFile: write("ca.pem", "CERTIFICATE", caDER)}
+	pki.serverCert, pki.serverKey = issue("server", x509.ExtKeyUsageServerAuth, []string{"localhost"})
+	pki.altCert, pki.altKey = issue("alt", x509.ExtKeyUsageServerAuth, []string{"alt.example.com"})
+	pki.clientCert, pki.clientKey = issue("client", x509.ExtKeyUsageClientAuth, nil)
+	return pki
+}
+
+func TestMutualTLSTransports(t *testing.T) {
+	pki := newTestPKI(t)
+
+	for _, protocol := range []string{"tcp", "tcpmux", "ws", "wssmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			listen, local, target := freeAddr(t), freeAddr(t), startEchoServer(t)
+
+			server := newTunnelManager(&Config{
+				Mode:       "server",
+				Protocol:   protocol,
+				Listen:     listen,
+				Target:     target,
+				Token:      "test-token-0123456789",
+				TLS:        true,
+				CertFile:   pki.serverCert,
+				KeyFile:    pki.serverKey,
+				CAFile:     pki.caFile,
+				MuxStreams: 1,
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, listen).Close()
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   protocol,
+				Server:     listen,
+				Local:      local,
+				Token:      "test-token-0123456789",
+				TLS:        true,
+				CertFile:   pki.clientCert,
+				KeyFile:    pki.clientKey,
+				CAFile:     pki.caFile,
+				MuxStreams: 1,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			expectTCPEcho(t, local)
+		})
+	}
+}
+
+func TestMutualTLSRejectsClientWithoutCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	listen := freeAddr(t)
+
+	server := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "tcpmux",
+		Listen:   listen,
+		Target:   startEchoServer(t),
+		Token:    "test-token-0123456789",
+		TLS:      true,
+		CertFile: pki.serverCert,
+		KeyFile:  pki.serverKey,
+		CAFile:   pki.caFile,
+	})
+	defer server.cancel()
+	go server.startServer()
+	dialEventually(t, listen).Close()
+
+	roots := x509.NewCertPool()
+	caPEM, err := os.ReadFile(pki.caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots.AppendCertsFromPEM(caPEM)
+
+	conn, err := tls.Dial("tcp", listen, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if err != nil {
+		// TLS 1.2 refuses the handshake itself
+		return
+	}
+	defer conn.Close()
+
+	// TLS 1.3 reports the missing certificate on the first read
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientHandshake(conn, "test-token-0123456789", flagMux); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+}
+
+func TestSNICertificates(t *testing.T) {
+	pki := newTestPKI(t)
+
+	tm := newTunnelManager(&Config{
+		Mode:     "server",
+		Protocol: "wss",
+		CertFile: pki.serverCert,
+		KeyFile:  pki.serverKey,
+		SNICerts: sniList{{Name: "*.example.com", CertFile: pki.altCert, KeyFile: pki.altKey}},
+	})
+	if err := tm.loadCertificates(tm.config); err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+
+	for name, want := range map[string]string{
+		"alt.example.com": "alt",
+		"ALT.example.com": "alt",
+		"localhost":       "server",
+		"":                "server",
+	} {
+		cert, err := tm.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != want {
+			t.Fatalf("%q: got certificate %q, want %q", name, leaf.Subject.CommonName, want)
+		}
+	}
+}
+
+func TestTLSVersionsAndCiphers(t *testing.T) {
+	tm := newTunnelManager(&Config{
+		Protocol:      "tcpmux",
+		TLSMinVersion: "1.2",
+		TLSMaxVersion: "1.2",
+		TLSCiphers:    "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	})
+	cfg, err := tm.baseTLSConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected versions %x-%x", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) != 2 {
+		t.Fatalf("expected 2 cipher suites, got %d", len(cfg.CipherSuites))
+	}
+
+	for _, bad := range []*Config{
+		{Protocol: "tcpmux", TLSMinVersion: "1.4"},
+		{Protocol: "tcpmux", TLSMinVersion: "1.3", TLSMaxVersion: "1.2"},
+		{Protocol: "tcpmux", TLSCiphers: "TLS_RSA_WITH_RC4_128_SHA"},
+	} {
+		if _, err := newTunnelManager(bad).baseTLSConfig(); err == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Transports
+//
+// A tunnel is made of links between a client and a server. A transport
+// carries those links: it listens for them and dials them, and hands them
+// over as byte streams. Everything above a link is shared by every
+// transport: the handshake and compression, mux sessions, the connection
+// registry, limits, timeouts and statistics. The protocol picks the
+// transport, whether links are multiplexed, and whether the forwarded
+// traffic is TCP or UDP:
+//
+//	protocol  transport  link contents          forwarded traffic
+//	tcp       tcp        handshake, raw or mux  TCP
+//	udp       udp        sealed datagrams       UDP
+//	ws        ws         raw                    TCP
+//	wss       ws+TLS     raw                    TCP
+//	h2        h2         raw                    TCP
+//	grpc      grpc       raw                    TCP
+//	tcpmux    tcp        handshake, mux         TCP
+//	wsmux     ws         handshake, mux         TCP
+//	wssmux    ws+TLS     handshake, mux         TCP
+//	utcpmux   tcp        handshake, mux         UDP
+//	uwsmux    ws         handshake, mux         UDP
+//	quic      quic       handshake, streams     TCP
+//	uquic     quic       handshake, streams     UDP
+//
+// A transport registers itself and its protocols from an init function with
+// registerTransport and registerProtocol, see tcpTransport below,
+// websocket.go, h2.go, udplink.go and quic.go, so adding one needs no
+// changes elsewhere. Mux is not a transport but a session layer over the
+// links of any of them. The ws, h2 and grpc transports shape their requests
+// alike, see httplink.go, and clients of every TCP based transport dial
+// through -proxy, see upstream.go.
+//
+// Transports that authenticate links themselves, as WebSocket upgrades and
+// HTTP/2 requests carrying the token, UDP sealing every datagram and QUIC
+// handshaking once per connection do, implement
+// linkAuthenticator. Their raw links skip the handshake, so they carry no
+// origin frames and take no dynamic clients.
+//
+// "handshake" is the framed HMAC handshake described in auth.go. A mux link
+// carries a yamux session after it: the side accepting forwarded connections
+// opens one stream per connection and the other side dials the target for
+// it. A raw link carries a single forwarded connection's bytes directly.
+//
+// In reverse mode every stream the server opens starts with a target frame,
+// framed like the handshake, naming the address the client should dial:
+//
+//	0x06 | length (2 bytes, big endian) | target
+//
+// An empty target means the client's own -target. This lets one reverse
+// server map each of its public ports to a different target.
+//
+// The -udp flag makes tcp, ws, wss, h2, grpc, quic and the TCP mux protocols
+// forward UDP as well, which lets UDP cross networks that only pass TCP or
+// HTTPS.
+// When UDP is carried over links, every mux stream or raw link is one UDP
+// flow, keyed by the source address of its first datagram. Datagrams on it
+// are length-prefixed:
+//
+//	length (2 bytes, big endian) | datagram
+//
+// unless the link keeps datagram boundaries itself, see datagramLink. A flow
+// that carries no datagram in either direction for -udp-idle-timeout expires
+// and its stream or link is closed.
+//
+// -tls runs the links of tcp, ws, h2, grpc and the mux protocols over TLS as
+// wss and wssmux always do, see tls.go.
+
+// Transport listens for and dials the links of a tunnel
+type Transport interface {
+	// Listen accepts links on addr until the listener is closed
+	Listen(tm *TunnelManager, addr string) (net.Listener, error)
+
+	// Dial opens a link to a server address
+	Dial(tm *TunnelManager, server string) (net.Conn, error)
+}
+
+// linkAuthenticator is implemented by transports that authenticate every
+// link with the token themselves
+type linkAuthenticator interface {
+	authenticatesLinks() bool
+}
+
+// protocolSpec describes how a protocol builds its links
+type protocolSpec struct {
+	transport string
+	tls       bool
+	mux       bool
+	udp       bool
+}
+
+var (
+	transports = make(map[string]Transport)
+	protocols  = make(map[string]protocolSpec)
+)
+
+// registerTransport makes a transport available to protocols under name
+func registerTransport(name string, t Transport) {
+	if _, exists := transports[name]; exists {
+		panic("transport registered twice: " + name)
+	}
+	transports[name] = t
+}
+
+// registerProtocol makes a protocol available to -protocol
+func registerProtocol(name string, spec protocolSpec) {
+	if _, exists := transports[spec.transport]; !exists {
+		panic("protocol " + name + " uses unknown transport " + spec.transport)
+	}
+	if _, exists := protocols[name]; exists {
+		panic("protocol registered twice: " + name)
+	}
+	protocols[name] = spec
+}
+
+// protocolNames lists the registered protocols
+func protocolNames() string {
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// authenticatesLinks reports whether the protocol's transport authenticates
+// its links, so raw ones skip the handshake
+func (s protocolSpec) authenticatesLinks() bool {
+	auth, ok := transports[s.transport].(linkAuthenticator)
+	return ok && auth.authenticatesLinks()
+}
+
+// protocolSpec returns the spec of the configured protocol
+func (tm *TunnelManager) protocolSpec() (protocolSpec, error) {
+	spec, ok := protocols[tm.config.Protocol]
+	if !ok {
+		return protocolSpec{}, fmt.Errorf("unsupported protocol: %s", tm.config.Protocol)
+	}
+	if tm.config.TLS && spec.transport == "udp" {
+		return protocolSpec{}, fmt.Errorf("TLS is not available for the udp protocol, use utcpmux or uwsmux")
+	}
+	return spec, nil
+}
+
+// transport returns the transport of the configured protocol
+func (tm *TunnelManager) transport() (Transport, error) {
+	spec, err := tm.protocolSpec()
+	if err != nil {
+		return nil, err
+	}
+	return transports[spec.transport], nil
+}
+
+// useMux reports whether client links for this tunnel are multiplexed
+func (tm *TunnelManager) useMux() bool {
+	spec := protocols[tm.config.Protocol]
+	return spec.mux || (tm.config.Protocol == "tcp" && tm.config.MuxEnabled)
+}
+
+// forwardsUDP reports whether the tunnel forwards UDP rather than TCP
+func (tm *TunnelManager) forwardsUDP() bool {
+	return protocols[tm.config.Protocol].udp || tm.config.UDP
+}
+
+// skipsHandshake reports whether the tunnel's links are raw links its
+// transport authenticated
+func (tm *TunnelManager) skipsHandshake() bool {
+	return !tm.useMux() && protocols[tm.config.Protocol].authenticatesLinks()
+}
+
+// dialLink opens a new link to a server address over the protocol's transport
+func (tm *TunnelManager) dialLink(server string) (net.Conn, error) {
+	transport, err := tm.transport()
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial(tm, server)
+}
+
+// acceptLinks hands every link accepted on listener to handle on its own
+// goroutine, closing it once handle returns, until the tunnel stops
+// accepting, see drain.go
+func (tm *TunnelManager) acceptLinks(listener net.Listener, handle func(net.Conn)) error {
+	// Unblock the Accept loop once the tunnel drains
+	defer tm.closeOnDrain(listener)()
+
+	for {
+		link, err := listener.Accept()
+		if err != nil {
+			if tm.draining() {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("listener on %s closed: %w", listener.Addr(), err)
+			}
+			log.Printf("Accept error: %v", err)
+			continue
+		}
+
+		tm.wg.Add(1)
+		go func() {
+			defer tm.wg.Done()
+			defer link.Close()
+			handle(link)
+		}()
+	}
+}
+
+// tcpTransport carries links over TCP connections, with TLS when the tunnel
+// uses it
+type tcpTransport struct{}
+
+func init() {
+	registerTransport("tcp", tcpTransport{})
+	registerProtocol("tcp", protocolSpec{transport: "tcp"})
+	registerProtocol("tcpmux", protocolSpec{transport: "tcp", mux: true})
+	registerProtocol("utcpmux", protocolSpec{transport: "tcp", mux: true, udp: true})
+}
+
+func (tcpTransport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	return tm.listenLink(addr)
+}
+
+func (tcpTransport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(tm.ctx, tm.connectTimeout())
+	defer cancel()
+
+	conn, err := tm.dialServer(ctx, "tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	if !tm.useTLS() {
+		return conn, nil
+	}
+
+	tlsConfig, err := tm.clientTLSConfig(server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return tlsConn, nil
+}
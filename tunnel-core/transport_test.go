@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUDPEchoServer starts a UDP server that echoes every datagram back
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start UDP echo server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// freeUDPAddr returns a loopback UDP address with a port that is currently free
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve UDP port: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func expectTCPEcho(t *testing.T, addr string) {
+	t.Helper()
+	conn := dialEventually(t, addr)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if line != "ping\n" {
+		t.Fatalf("unexpected echo: %q", line)
+	}
+}
+
+func expectUDPEcho(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	// The tunnel may still be coming up, so resend until a reply arrives
+	buffer := make([]byte, 1024)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write([]byte("datagram"))
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buffer)
+		if err == nil {
+			if string(buffer[:n]) != "datagram" {
+				t.Fatalf("unexpected echo: %q", buffer[:n])
+			}
+			return
+		}
+	}
+	t.Fatalf("no UDP reply through %s", addr)
+}
+
+func TestForwardTransports(t *testing.T) {
+	for _, protocol := range []string{"tcp", "ws", "h2", "grpc", "tcpmux", "wsmux", "utcpmux", "uwsmux", "udp"} {
+		t.Run(protocol, func(t *testing.T) {
+			udp := protocols[protocol].udp
+			listen, local, target := freeAddr(t), freeAddr(t), ""
+			if udp {
+				target, local = startUDPEchoServer(t), freeUDPAddr(t)
+			} else {
+				target = startEchoServer(t)
+			}
+			if protocol == "udp" {
+				listen = freeUDPAddr(t)
+			}
+
+			server := newTunnelManager(&Config{
+				Mode:       "server",
+				Protocol:   protocol,
+				Listen:     listen,
+				Target:     target,
+				Token:      "test-token-0123456789",
+				MuxStreams: 1,
+			})
+			defer server.cancel()
+			go server.startServer()
+			if protocol != "udp" {
+				dialEventually(t, listen).Close()
+			}
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   protocol,
+				Server:     listen,
+				Local:      local,
+				Token:      "test-token-0123456789",
+				MuxStreams: 1,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			if udp {
+				expectUDPEcho(t, local)
+			} else {
+				expectTCPEcho(t, local)
+			}
+		})
+	}
+}
+
+func TestReverseTransports(t *testing.T) {
+	for _, protocol := range []string{"tcpmux", "wsmux", "utcpmux", "uwsmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			udp := protocols[protocol].udp
+			bind, public, target := freeAddr(t), freeAddr(t), ""
+			if udp {
+				target, public = startUDPEchoServer(t), freeUDPAddr(t)
+			} else {
+				target = startEchoServer(t)
+			}
+
+			server := newTunnelManager(&Config{
+				Mode:     "server",
+				Protocol: protocol,
+				Listen:   public,
+				Bind:     bind,
+				Token:    "test-token-0123456789",
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, bind).Close()
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   protocol,
+				Server:     bind,
+				Target:     target,
+				Token:      "test-token-0123456789",
+				MuxStreams: 1,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for server.pickSession() == nil {
+				if time.Now().After(deadline) {
+					t.Fatal("tunnel client never connected")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			if udp {
+				expectUDPEcho(t, public)
+			} else {
+				expectTCPEcho(t, public)
+			}
+		})
+	}
+}
+
+// countingTransport is tcpTransport counting the links it dials and accepts
+type countingTransport struct {
+	tcpTransport
+	dials, accepts atomic.Int64
+}
+
+func (t *countingTransport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	listener, err := t.tcpTransport.Listen(tm, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingListener{Listener: listener, accepts: &t.accepts}, nil
+}
+
+func (t *countingTransport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	t.dials.Add(1)
+	return t.tcpTransport.Dial(tm, server)
+}
+
+type countingListener struct {
+	net.Listener
+	accepts *atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepts.Add(1)
+	}
+	return conn, err
+}
+
+var (
+	counting         = &countingTransport{}
+	registerCounting sync.Once
+)
+
+func TestRegisteredTransport(t *testing.T) {
+	registerCounting.Do(func() {
+		registerTransport("counting", counting)
+		registerProtocol("counting", protocolSpec{transport: "counting"})
+		registerProtocol("countingmux", protocolSpec{transport: "counting", mux: true})
+	})
+
+	for _, protocol := range []string{"counting", "countingmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			dials, accepts := counting.dials.Load(), counting.accepts.Load()
+			listen, local := freeAddr(t), freeAddr(t)
+
+			server := newTunnelManager(&Config{
+				Mode:     "server",
+				Protocol: protocol,
+				Listen:   listen,
+				Target:   startEchoServer(t),
+				Token:    "test-token-0123456789",
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, listen).Close()
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   protocol,
+				Server:     listen,
+				Local:      local,
+				Token:      "test-token-0123456789",
+				MuxStreams: 1,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			expectTCPEcho(t, local)
+			if counting.dials.Load() == dials {
+				t.Fatal("client dialed no link through the transport")
+			}
+			if counting.accepts.Load() == accepts {
+				t.Fatal("server accepted no link through the transport")
+			}
+		})
+	}
+}
+
+func TestUDPListenerAcceptsFlowPerPeer(t *testing.T) {
+	tm := newTunnelManager(&Config{Mode: "server", Token: "test-token-0123456789"})
+	defer tm.cancel()
+
+	listener, err := udpTransport{}.Listen(tm, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	// A datagram sealed with another token accepts no flow
+	forged, err := net.Dial("udp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer forged.Close()
+	forger, err := newDatagramSealer("wrong-token-0123456789", udpLabelClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Write(forger.seal([]byte("forged")))
+
+	for _, payload := range []string{"first", "second"} {
+		link, err := udpTransport{}.Dial(tm, listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial failed: %v", err)
+		}
+		defer link.Close()
+		if _, err := link.Write([]byte(payload)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+
+		flow, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept failed: %v", err)
+		}
+		defer flow.Close()
+		if flow.RemoteAddr().String() != link.LocalAddr().String() {
+			t.Fatalf("flow from %s, want %s", flow.RemoteAddr(), link.LocalAddr())
+		}
+
+		buffer := make([]byte, 64)
+		n, err := flow.Read(buffer)
+		if err != nil || string(buffer[:n]) != payload {
+			t.Fatalf("flow read %q, %v, want %q", buffer[:n], err, payload)
+		}
+
+		if _, err := flow.Write([]byte("reply " + payload)); err != nil {
+			t.Fatalf("flow write failed: %v", err)
+		}
+		link.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err = link.Read(buffer); err != nil || string(buffer[:n]) != "reply "+payload {
+			t.Fatalf("link read %q, %v", buffer[:n], err)
+		}
+	}
+}
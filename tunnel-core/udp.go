@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxDatagramSize = 65535
+
+	defaultUDPIdleTimeout = 5 * time.Minute
+)
+
+// writeDatagram frames one datagram onto a stream, links keeping datagram
+// boundaries take it as it is
+func writeDatagram(w io.Writer, payload []byte) error {
+	if len(payload) > maxDatagramSize {
+		return fmt.Errorf("datagram too large: %d bytes", len(payload))
+	}
+	if _, ok := w.(datagramLink); ok {
+		_, err := w.Write(payload)
+		return err
+	}
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+
+	frame := (*buffer)[:2+len(payload)]
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads one framed datagram from a stream into buffer
+func readDatagram(r io.Reader, buffer []byte) (int, error) {
+	if _, ok := r.(datagramLink); ok {
+		return r.Read(buffer)
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buffer) {
+		return 0, fmt.Errorf("datagram larger than buffer: %d bytes", size)
+	}
+	return io.ReadFull(r, buffer[:size])
+}
+
+// udpFlow is one UDP flow keyed by its source address. It expires once no
+// datagram has crossed it in either direction for the idle timeout.
+type udpFlow struct {
+	conn       net.Conn
+	record     *connection
+	lastActive atomic.Int64
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+// newUDPFlow tracks conn as a flow and closes it once idle for timeout,
+// counting its traffic on record
+func newUDPFlow(conn net.Conn, timeout time.Duration, record *connection) *udpFlow {
+	flow := &udpFlow{conn: conn, record: record}
+	flow.touch()
+
+	flow.mu.Lock()
+	flow.timer = time.AfterFunc(timeout, func() { flow.expire(timeout) })
+	flow.mu.Unlock()
+	return flow
+}
+
+// touch records traffic on the flow
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) expire(timeout time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+	if idle := time.Since(time.Unix(0, f.lastActive.Load())); idle < timeout {
+		f.timer.Reset(timeout - idle)
+		return
+	}
+	f.closed = true
+	f.record.fail("idle timeout")
+	f.conn.Close()
+}
+
+// Close stops the idle timer and closes the flow's connection
+func (f *udpFlow) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.timer.Stop()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.conn.Close()
+}
+
+// udpIdleTimeout returns how long a UDP flow may stay idle before it expires
+func (tm *TunnelManager) udpIdleTimeout() time.Duration {
+	tm.liveMu.RLock()
+	defer tm.liveMu.RUnlock()
+
+	if tm.config.UDPIdleTimeout > 0 {
+		return tm.config.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// listenUDP opens a UDP socket on addr, which other processes may share
+// with -reuse-port
+func (tm *TunnelManager) listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if !tm.config.ReusePort {
+		return net.ListenUDP("udp", addr)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	conn, err := lc.ListenPacket(tm.ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// serveUDPFlows reads datagrams from a local UDP socket and carries each
+// source address's flow over its own stream, opened towards the forward's
+// current target. A draining tunnel starts no new flows.
+func (tm *TunnelManager) serveUDPFlows(conn *net.UDPConn, fwd PortForward, openStream func(target string) (net.Conn, error)) error {
+	batch := newUDPBatchConn(conn, tm.config.Debug)
+	defer batch.Close()
+
+	flows := make(map[string]*udpFlow)
+	var mu sync.Mutex
+
+	// Flows left when the socket closes end with it
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, flow := range flows {
+			flow.Close()
+		}
+	}()
+
+	for {
+		datagram, peer, err := batch.readFrom()
+		if err != nil {
+			if tm.ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("UDP read error: %v", err)
+			continue
+		}
+
+		flowKey := peer.String()
+
+		mu.Lock()
+		flow, exists := flows[flowKey]
+		mu.Unlock()
+
+		if !exists {
+			if tm.draining() {
+				stats.Dropped.Add(1)
+				continue
+			}
+			target := tm.target(fwd)
+			record, err := tm.openConnection("udp", flowKey, target, "")
+			if err != nil {
+				continue
+			}
+
+			stream, err := openStream(target)
+			if err != nil {
+				log.Printf("Failed to open stream for UDP flow %s: %v", flowKey, err)
+				stats.Errors.Add(1)
+				record.fail(fmt.Sprintf("failed to open stream: %v", err))
+				tm.closeConnection(record)
+				continue
+			}
+
+			flow = newUDPFlow(stream, tm.udpIdleTimeout(), record)
+			mu.Lock()
+			flows[flowKey] = flow
+			mu.Unlock()
+
+			tm.wg.Add(1)
+			go func(flow *udpFlow, peer *net.UDPAddr, flowKey string) {
+				defer tm.wg.Done()
+				defer tm.closeConnection(flow.record)
+				defer func() {
+					mu.Lock()
+					if flows[flowKey] == flow {
+						delete(flows, flowKey)
+					}
+					mu.Unlock()
+					flow.Close()
+				}()
+				tm.relayUDPFlowReplies(batch, flow, peer)
+			}(flow, peer, flowKey)
+		}
+
+		flow.touch()
+		if !flow.record.admitIn(len(datagram)) {
+			continue
+		}
+		if err := writeDatagram(flow.conn, datagram); err != nil {
+			log.Printf("Failed to write UDP flow %s: %v", flowKey, err)
+			flow.record.fail(fmt.Sprintf("failed to write flow: %v", err))
+			mu.Lock()
+			delete(flows, flowKey)
+			mu.Unlock()
+			flow.Close()
+		}
+	}
+}
+
+// relayUDPFlowReplies writes datagrams coming back on a flow's stream to the
+// peer that started the flow
+func (tm *TunnelManager) relayUDPFlowReplies(conn *udpBatchConn, flow *udpFlow, peer *net.UDPAddr) {
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+
+	for {
+		n, err := readDatagram(flow.conn, *buffer)
+		if err != nil {
+			if tm.config.Debug {
+				log.Printf("UDP flow %s closed: %v", peer, err)
+			}
+			return
+		}
+
+		flow.touch()
+		if !flow.record.admitOut(n) {
+			continue
+		}
+
+		if _, err := conn.WriteToUDP((*buffer)[:n], peer); err != nil {
+			log.Printf("Failed to write to UDP peer %s: %v", peer, err)
+			return
+		}
+	}
+}
+
+// handleUDPStream relays the datagrams of one flow between a stream and the
+// UDP target, counting them on c
+func (tm *TunnelManager) handleUDPStream(stream net.Conn, targetAddress string, c *connection) {
+	member, err := tm.pickUDPTarget(targetAddress, c.remote)
+	if err != nil {
+		log.Printf("Invalid target: %v", err)
+		stats.Errors.Add(1)
+		c.fail(err.Error())
+		return
+	}
+	if member != targetAddress {
+		c.setTarget(member)
+	}
+
+	targetAddr, err := net.ResolveUDPAddr("udp", member)
+	if err != nil {
+		log.Printf("Failed to resolve target address: %v", err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to resolve target address: %v", err))
+		return
+	}
+
+	target, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		log.Printf("Failed to connect to target: %v", err)
+		stats.Errors.Add(1)
+		c.fail(fmt.Sprintf("failed to connect to target: %v", err))
+		return
+	}
+
+	tm.relayUDPStream(stream, target, c)
+}
+
+// relayUDPStream relays datagrams between a stream and a connected UDP
+// socket until either side ends or the flow expires
+func (tm *TunnelManager) relayUDPStream(stream, target net.Conn, c *connection) {
+	// Expiring the flow closes the target, which ends both directions, as
+	// does shutdown once a drain is over
+	flow := newUDPFlow(target, tm.udpIdleTimeout(), c)
+	defer flow.Close()
+	defer context.AfterFunc(tm.ctx, func() { flow.Close() })()
+
+	// Target to stream
+	go func() {
+		defer stream.Close()
+
+		buffer := datagramBuffers.get()
+		defer datagramBuffers.put(buffer)
+		for {
+			n, err := target.Read(*buffer)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			if !c.admitOut(n) {
+				continue
+			}
+			if err := writeDatagram(stream, (*buffer)[:n]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Stream to target
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+	for {
+		n, err := readDatagram(stream, *buffer)
+		if err != nil {
+			if tm.config.Debug && err != io.EOF {
+				log.Printf("UDP stream read error: %v", err)
+			}
+			return
+		}
+		flow.touch()
+		if !c.admitIn(n) {
+			continue
+		}
+		if _, err := target.Write((*buffer)[:n]); err != nil {
+			log.Printf("Failed to write to target: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	for _, payload := range [][]byte{[]byte("first"), {}, []byte("third")} {
+		if err := writeDatagram(&buf, payload); err != nil {
+			t.Fatalf("writeDatagram failed: %v", err)
+		}
+	}
+
+	buffer := make([]byte, maxDatagramSize)
+	for _, want := range []string{"first", "", "third"} {
+		n, err := readDatagram(&buf, buffer)
+		if err != nil {
+			t.Fatalf("readDatagram failed: %v", err)
+		}
+		if string(buffer[:n]) != want {
+			t.Fatalf("got %q, want %q", buffer[:n], want)
+		}
+	}
+
+	if err := writeDatagram(&buf, make([]byte, maxDatagramSize+1)); err == nil {
+		t.Fatal("oversized datagram was framed")
+	}
+}
+
+func TestUDPFlowExpiresWhenIdle(t *testing.T) {
+	conn, err := net.Dial("udp", startUDPEchoServer(t))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	tm := newTunnelManager(&Config{})
+	defer tm.cancel()
+	record, err := tm.openConnection("udp", "test", conn.RemoteAddr().String(), "")
+	if err != nil {
+		t.Fatalf("openConnection failed: %v", err)
+	}
+
+	flow := newUDPFlow(conn, 200*time.Millisecond, record)
+	defer flow.Close()
+
+	// Traffic keeps the flow alive past its timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		flow.touch()
+	}
+	if _, err := conn.Write([]byte("x")); err != nil {
+		t.Fatalf("active flow was expired: %v", err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Fatal("idle flow was not expired")
+	}
+
+	tm.closeConnection(record)
+	if info := record.info(); info.CloseReason != "idle timeout" {
+		t.Fatalf("close reason = %q, want idle timeout", info.CloseReason)
+	}
+}
+
+func TestUDPOverLinks(t *testing.T) {
+	for _, protocol := range []string{"tcp", "ws", "tcpmux", "wsmux"} {
+		t.Run(protocol, func(t *testing.T) {
+			listen, local, target := freeAddr(t), freeUDPAddr(t), startUDPEchoServer(t)
+
+			server := newTunnelManager(&Config{
+				Mode:     "server",
+				Protocol: protocol,
+				Listen:   listen,
+				Target:   target,
+				Token:    "test-token-0123456789",
+				UDP:      true,
+			})
+			defer server.cancel()
+			go server.startServer()
+			dialEventually(t, listen).Close()
+
+			client := newTunnelManager(&Config{
+				Mode:       "client",
+				Protocol:   protocol,
+				Server:     listen,
+				Local:      local,
+				Token:      "test-token-0123456789",
+				MuxStreams: 1,
+				UDP:        true,
+			})
+			defer client.cancel()
+			go client.startClient()
+
+			expectUDPEcho(t, local)
+		})
+	}
+}
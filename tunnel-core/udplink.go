@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// UDP transport
+//
+// The udp protocol carries every flow as sealed datagrams, see auth.go,
+// between a client socket dialed for the flow and the server's one socket.
+// The server tells flows apart by their source address: the first datagram
+// from an address accepts a new link, and its later datagrams are read from
+// that link until it closes. Sealing authenticates every datagram, so links
+// skip the handshake, and they keep datagram boundaries, so flows need no
+// length prefix on them.
+
+// udpAcceptBacklog is how many new flows wait to be accepted, and how many
+// datagrams wait on a flow, before more are dropped
+const udpAcceptBacklog = 64
+
+// udpTransport carries links as sealed UDP datagrams
+type udpTransport struct{}
+
+func init() {
+	registerTransport("udp", udpTransport{})
+	registerProtocol("udp", protocolSpec{transport: "udp", udp: true})
+}
+
+func (udpTransport) authenticatesLinks() bool {
+	return true
+}
+
+func (udpTransport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newDatagramSealer(tm.config.Token, udpLabelServer)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tm.listenUDP(udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{
+		tm:     tm,
+		conn:   conn,
+		batch:  newUDPBatchConn(conn, tm.config.Debug),
+		sealer: sealer,
+		opener: newDatagramOpener(tm.config.Token, udpLabelClient),
+		flows:  make(map[string]*udpFlowLink),
+		links:  make(chan net.Conn, udpAcceptBacklog),
+		done:   make(chan struct{}),
+	}
+	go l.readDatagrams()
+	return l, nil
+}
+
+func (udpTransport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve server address: %w", err)
+	}
+	sealer, err := newDatagramSealer(tm.config.Token, udpLabelClient)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	return &udpLink{
+		UDPConn: conn,
+		sealer:  sealer,
+		opener:  newDatagramOpener(tm.config.Token, udpLabelServer),
+		debug:   tm.config.Debug,
+	}, nil
+}
+
+// datagramLink is implemented by links that keep datagram boundaries, which
+// carry UDP flows without a length prefix
+type datagramLink interface {
+	keepsDatagrams()
+}
+
+// udpLink is the client end of a udp link, sealing what it writes and
+// opening what it reads
+type udpLink struct {
+	*net.UDPConn
+	sealer *datagramSealer
+	opener *datagramOpener
+	debug  bool
+}
+
+func (c *udpLink) keepsDatagrams() {}
+
+func (c *udpLink) Write(b []byte) (int, error) {
+	if _, err := c.UDPConn.Write(c.sealer.seal(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the next datagram from the server, dropping those that fail
+// to open
+func (c *udpLink) Read(b []byte) (int, error) {
+	buffer := datagramBuffers.get()
+	defer datagramBuffers.put(buffer)
+
+	for {
+		n, err := c.UDPConn.Read(*buffer)
+		if err != nil {
+			return 0, err
+		}
+		payload, err := c.opener.open((*buffer)[:n])
+		if err != nil {
+			if c.debug {
+				log.Printf("Dropping UDP datagram from server: %v", err)
+			}
+			stats.Errors.Add(1)
+			continue
+		}
+		return copy(b, payload), nil
+	}
+}
+
+// udpListener accepts a link for every source address sending sealed
+// datagrams to its socket
+type udpListener struct {
+	tm     *TunnelManager
+	conn   *net.UDPConn
+	batch  *udpBatchConn
+	sealer *datagramSealer
+	opener *datagramOpener
+
+	mu       sync.Mutex
+	flows    map[string]*udpFlowLink
+	draining bool
+
+	links chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// readDatagrams hands each datagram that opens to the link of its source
+// address until the socket closes
+func (l *udpListener) readDatagrams() {
+	defer l.Close()
+
+	for {
+		sealed, peer, err := l.batch.readFrom()
+		if err != nil {
+			select {
+			case <-l.done:
+			default:
+				log.Printf("UDP read error: %v", err)
+			}
+			return
+		}
+
+		payload, err := l.opener.open(sealed)
+		if err != nil {
+			if l.tm.config.Debug {
+				log.Printf("Dropping UDP datagram from %s: %v", peer, err)
+			}
+			stats.Errors.Add(1)
+			continue
+		}
+
+		key := peer.String()
+		l.mu.Lock()
+		flow, exists := l.flows[key]
+		if !exists && l.draining {
+			l.mu.Unlock()
+			stats.Dropped.Add(1)
+			continue
+		}
+		if !exists {
+			flow = &udpFlowLink{
+				listener:  l,
+				key:       key,
+				peer:      peer,
+				datagrams: newDatagramQueue(),
+				closed:    make(chan struct{}),
+			}
+			l.flows[key] = flow
+		}
+		l.mu.Unlock()
+
+		if !exists {
+			select {
+			case l.links <- flow:
+			default:
+				// The accept loop is not keeping up, the peer can retry
+				l.remove(flow)
+				stats.Dropped.Add(1)
+				continue
+			}
+		}
+		flow.datagrams.push(payload)
+	}
+}
+
+func (l *udpListener) remove(flow *udpFlowLink) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.flows[flow.key] == flow {
+		delete(l.flows, flow.key)
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case link := <-l.links:
+		return link, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// drain stops the listener taking new flows, those it took keep the socket
+// until Close
+func (l *udpListener) drain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.draining = true
+}
+
+// Close closes the socket, which ends the links accepted on it
+func (l *udpListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.batch.Close()
+		l.conn.Close()
+	})
+	return nil
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// udpDatagram is an opened datagram waiting to be read from a link
+type udpDatagram struct {
+	buffer *[]byte
+	n      int
+}
+
+// datagramQueue holds the datagrams waiting to be read from a link whose
+// socket is read by someone else
+type datagramQueue chan udpDatagram
+
+func newDatagramQueue() datagramQueue {
+	return make(datagramQueue, udpAcceptBacklog)
+}
+
+// push queues a datagram, dropping it if the link's reader is behind
+func (q datagramQueue) push(payload []byte) {
+	buffer := datagramBuffers.get()
+	datagram := udpDatagram{buffer: buffer, n: copy(*buffer, payload)}
+	select {
+	case q <- datagram:
+	default:
+		datagramBuffers.put(buffer)
+		stats.Dropped.Add(1)
+	}
+}
+
+// pop reads the next datagram into b until either channel closes
+func (q datagramQueue) pop(b []byte, closed, stop <-chan struct{}) (int, error) {
+	select {
+	case datagram := <-q:
+		defer datagramBuffers.put(datagram.buffer)
+		return copy(b, (*datagram.buffer)[:datagram.n]), nil
+	case <-closed:
+		return 0, net.ErrClosed
+	case <-stop:
+		return 0, net.ErrClosed
+	}
+}
+
+// udpFlowLink is the server end of a udp link, one source address sending
+// to the listener's socket
+type udpFlowLink struct {
+	listener  *udpListener
+	key       string
+	peer      *net.UDPAddr
+	datagrams datagramQueue
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *udpFlowLink) keepsDatagrams() {}
+
+func (c *udpFlowLink) Read(b []byte) (int, error) {
+	return c.datagrams.pop(b, c.closed, c.listener.done)
+}
+
+func (c *udpFlowLink) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if _, err := c.listener.batch.WriteToUDP(c.listener.sealer.seal(b), c.peer); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends the flow, a later datagram from its address starts a new one
+func (c *udpFlowLink) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+	})
+	return nil
+}
+
+func (c *udpFlowLink) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *udpFlowLink) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// Deadlines are not supported, flows end by closing
+func (c *udpFlowLink) SetDeadline(t time.Time) error      { return nil }
+func (c *udpFlowLink) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpFlowLink) SetWriteDeadline(t time.Time) error { return nil }
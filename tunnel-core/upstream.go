@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// Upstream proxies
+//
+// -proxy makes clients dial servers through a proxy, for networks whose only
+// way out is one:
+//
+//	http://[user:password@]host:port    HTTP CONNECT
+//	https://[user:password@]host:port   HTTP CONNECT over TLS to the proxy
+//	socks5://[user:password@]host:port  SOCKS5, the server name resolved locally
+//	socks5h://[user:password@]host:port SOCKS5, the server name resolved by the proxy
+//
+// It applies to the links of every protocol but udp and the QUIC ones, whose
+// datagrams proxies do not carry. TLS to the server runs end to end through
+// the proxy.
+
+// validProxy reports whether -proxy names a proxy clients can dial through
+func validProxy(spec string) error {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("invalid proxy %q, use an http, https, socks5 or socks5h URL", spec)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid proxy %q, it names no host", spec)
+	}
+	return nil
+}
+
+// dialServer connects to a server address, through -proxy when it is set
+func (tm *TunnelManager) dialServer(ctx context.Context, network, addr string) (net.Conn, error) {
+	if tm.config.Proxy == "" {
+		return tm.dialer().DialContext(ctx, network, addr)
+	}
+
+	u, err := url.Parse(tm.config.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, tm.connectTimeout())
+	defer cancel()
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(u, tm.dialer())
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect through proxy %s: %w", u.Host, err)
+		}
+		return conn, nil
+	default:
+		return tm.dialConnect(ctx, u, addr)
+	}
+}
+
+// dialConnect opens a tunnel to addr through an HTTP proxy with CONNECT
+func (tm *TunnelManager) dialConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := tm.dialer().DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	// Unblock the exchange once the context ends
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	// The body of a CONNECT response is the tunnel, so it is left unread
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+
+	// Keep what the server sent along with the response
+	if reader.Buffered() > 0 {
+		return &replayConn{Conn: conn, r: reader}, nil
+	}
+	return conn, nil
+}
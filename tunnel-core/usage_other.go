@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// processCPUSeconds is not available on this platform
+func processCPUSeconds() float64 {
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUSeconds returns the user and system CPU time the process has used
+func processCPUSeconds() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	user := time.Duration(usage.Utime.Nano())
+	system := time.Duration(usage.Stime.Nano())
+	return (user + system).Seconds()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket transport
+//
+// Links are WebSocket connections upgraded on -path, /tunnel by default,
+// each message carrying a chunk of the link's bytes. The upgrade request
+// carries the token, so raw links skip the handshake and offer compression
+// in the X-Tunnel-Compression header instead. Requests are shaped and
+// answered as httplink.go describes. Clients dial through -proxy, or the
+// proxy the environment names when it is not set.
+
+// wsTransport carries links over WebSocket connections, with TLS for wss
+type wsTransport struct{}
+
+func init() {
+	registerTransport("ws", wsTransport{})
+	registerProtocol("ws", protocolSpec{transport: "ws"})
+	registerProtocol("wss", protocolSpec{transport: "ws", tls: true})
+	registerProtocol("wsmux", protocolSpec{transport: "ws", mux: true})
+	registerProtocol("wssmux", protocolSpec{transport: "ws", tls: true, mux: true})
+	registerProtocol("uwsmux", protocolSpec{transport: "ws", mux: true, udp: true})
+}
+
+func (wsTransport) authenticatesLinks() bool {
+	return true
+}
+
+func (wsTransport) Listen(tm *TunnelManager, addr string) (net.Listener, error) {
+	// listenLink applies TLS and PROXY header parsing like other links get
+	listener, err := tm.listenLink(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux, err := tm.newLinkMux()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	l := newHTTPListener(listener)
+
+	// Requests are authorized before they are upgraded
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux.HandleFunc(tm.linkPath(linkDefaultPath), func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !websocket.IsWebSocketUpgrade(r):
+			mux.refuse(w, r, http.StatusBadRequest)
+			return
+		case !tm.authorizedRequest(r):
+			mux.refuse(w, r, http.StatusForbidden)
+			return
+		}
+
+		// Raw links accept the compression they offer if it is ours
+		var responseHeader http.Header
+		compress := tm.compressionFlag()
+		if compress == 0 || tm.useMux() || r.Header.Get(compressionHeader) != tm.config.Compression {
+			compress = 0
+		} else {
+			responseHeader = http.Header{compressionHeader: {tm.config.Compression}}
+		}
+
+		conn, err := upgrader.Upgrade(w, r, responseHeader)
+		if err != nil {
+			log.Printf("WebSocket upgrade error: %v", err)
+			return
+		}
+
+		ws := newWSConn(conn)
+		tm.keepWebSocketAlive(ws)
+
+		link, err := compressLink(ws, compress)
+		if err != nil {
+			log.Printf("WebSocket link from %s dropped: %v", ws.RemoteAddr(), err)
+			stats.Errors.Add(1)
+			ws.Close()
+			return
+		}
+
+		l.push(link)
+	})
+
+	l.serve(&http.Server{Handler: mux})
+	return l, nil
+}
+
+func (wsTransport) Dial(tm *TunnelManager, server string) (net.Conn, error) {
+	var tlsConfig *tls.Config
+	scheme := "ws"
+	if tm.useTLS() {
+		var err error
+		if tlsConfig, err = tm.clientTLSConfig(server); err != nil {
+			return nil, err
+		}
+		scheme = "wss"
+	}
+
+	dialer := websocket.Dialer{
+		NetDialContext:   tm.dialServer,
+		HandshakeTimeout: tm.connectTimeout(),
+		TLSClientConfig:  tlsConfig,
+	}
+	if tm.config.Proxy == "" {
+		dialer.Proxy = http.ProxyFromEnvironment
+	}
+	header := tm.linkHeader()
+	if tm.config.HostHeader != "" {
+		header.Set("Host", tm.config.HostHeader)
+	}
+
+	// Raw links have no handshake to offer compression in
+	offer := tm.compressionFlag()
+	if tm.useMux() {
+		offer = 0
+	}
+	if offer != 0 {
+		header.Set(compressionHeader, tm.config.Compression)
+	}
+
+	ws, resp, err := dialer.DialContext(tm.ctx, tm.linkURL(scheme, server, tm.linkPath(linkDefaultPath)), header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %w", err)
+	}
+	conn := newWSConn(ws)
+	tm.keepWebSocketAlive(conn)
+
+	if offer == 0 || resp.Header.Get(compressionHeader) != tm.config.Compression {
+		return conn, nil
+	}
+	compressed, err := compressLink(conn, offer)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return compressed, nil
+}
+
+// wsConn adapts a WebSocket connection to net.Conn so links can treat it as
+// a byte stream
+type wsConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+
+	// Heartbeat state, see timeouts.go
+	lastPong      atomic.Int64
+	closeReceived atomic.Bool
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{ws: ws}
+	c.lastPong.Store(time.Now().UnixNano())
+	ws.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+	// A close frame only ends the other end's direction, see CloseWrite
+	ws.SetCloseHandler(func(int, string) error {
+		c.closeReceived.Store(true)
+		return nil
+	})
+	return c
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite sends a close frame, which the other end reads as EOF while it
+// can still send until it closes too
+func (c *wsConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	return c.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(handshakeTimeout))
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}